@@ -0,0 +1,78 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package main
+
+// A vSphere CSI (Container Storage Interface) plugin - main
+
+import (
+	"flag"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vmdk/vmdkops"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vmdkcsi"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/metrics"
+)
+
+const defaultEndpoint = "unix:///var/lib/kubelet/plugins/" + vmdkcsi.PluginName + "/csi.sock"
+
+// main for the vSphere CSI plugin
+func main() {
+	// Flags are parsed by config.InitConfig
+	endpointEnv := os.Getenv("CSI_ENDPOINT")
+	if endpointEnv == "" {
+		endpointEnv = defaultEndpoint
+	}
+	hostname, _ := os.Hostname()
+	endpoint := flag.String("endpoint", endpointEnv, "CSI endpoint, unix:///path/to/socket or tcp://host:port")
+	nodeID := flag.String("nodeid", hostname, "Node ID reported to the container orchestrator")
+	port := flag.Int("port", config.DefaultPort, "Default port to connect to ESX service")
+	useMockEsx := flag.Bool("mock_esx", false, "Mock the ESX service")
+
+	cfg, err := config.InitConfig(config.DefaultVMDKPluginConfigPath, config.DefaultCSIPluginLogPath,
+		config.VSphereDriver, config.VSphereDriver)
+	if err != nil {
+		log.Warning("Failed to initialize config variables for CSI plugin")
+		os.Exit(1)
+	}
+
+	ops := vmdkops.VmdkOps{Cmd: vmdkops.NewMockCmd()}
+	if !*useMockEsx {
+		transport, err := vmdkops.NewTransport(cfg.Transport, cfg.EsxAddress, *port)
+		if err != nil {
+			log.WithFields(log.Fields{"transport": cfg.Transport, "esx_address": cfg.EsxAddress,
+				"error": err}).Fatal("Failed to set up the transport to ESX ")
+		}
+		ops = vmdkops.VmdkOps{Cmd: vmdkops.NewEsxCmd(transport)}
+	}
+	ops.Timeouts = vmdkops.TimeoutsFromSeconds(cfg.CmdTimeoutsSec)
+
+	if cfg.MetricsAddr != "" {
+		if _, err := metrics.StartServer(cfg.MetricsAddr); err != nil {
+			log.WithFields(log.Fields{"address": cfg.MetricsAddr, "error": err}).Warning("Failed to start metrics server, continuing however.. ")
+		}
+	}
+
+	listener, err := vmdkcsi.Listen(*endpoint)
+	if err != nil {
+		log.WithFields(log.Fields{"endpoint": *endpoint, "error": err}).Fatal("Failed to listen on CSI endpoint ")
+	}
+	if err = vmdkcsi.NewDriver(ops, *useMockEsx, *nodeID).Serve(listener); err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("CSI server failed ")
+	}
+}
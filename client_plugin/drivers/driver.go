@@ -17,7 +17,7 @@ package drivers
 // VolumeDriver interface used by the refcountedVolume module to handle
 // recovery mounts/unmounts.
 type VolumeDriver interface {
-	MountVolume(string, string, string, bool, bool) (string, error)
+	MountVolume(string, string, string, bool, bool, string) (string, error)
 	UnmountVolume(string) error
 	GetVolume(string) (map[string]interface{}, error)
 	DetachVolume(string) error
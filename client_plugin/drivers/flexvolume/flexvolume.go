@@ -0,0 +1,313 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package flexvolume
+
+//
+// Kubernetes FlexVolume driver on top of the vsphere and photon volume drivers.
+//
+// Kubelet runs the driver once per operation, e.g. "attach <options> <node>",
+// and reads the result from stdout as JSON. Volumes are attached and mounted
+// under the mount root by the volume driver, the mount root directory of a
+// volume is the "device" reported to Kubernetes, and is bind mounted at the
+// paths kubelet asks for.
+//
+// Volumes are attached to the VM the driver runs on, so attach and detach are
+// only served for this node: kubelet has to run with controller attach/detach
+// disabled (--enable-controller-attach-detach=false).
+//
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/plugin_utils"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
+)
+
+// Status of a FlexVolume call
+const (
+	StatusSuccess      = "Success"
+	StatusFailure      = "Failure"
+	StatusNotSupported = "Not supported"
+)
+
+// Options passed by kubelet, along with the ones in the volume spec
+const (
+	fsTypeOpt     = "kubernetes.io/fsType"
+	readWriteOpt  = "kubernetes.io/readwrite"
+	volumeNameOpt = "volumeName"
+	datastoreOpt  = "datastore"
+)
+
+// argCounts are the arguments of each call
+var argCounts = map[string]int{
+	"init":          0,
+	"getvolumename": 1, // options
+	"attach":        2, // options, node
+	"isattached":    2, // options, node
+	"waitforattach": 2, // device, options
+	"detach":        2, // volume name, node
+	"mountdevice":   3, // mount path, device, options
+	"unmountdevice": 1, // mount path
+	"mount":         2, // mount path, options
+	"unmount":       1, // mount path
+}
+
+// Result is written to stdout as JSON, see the FlexVolume spec
+type Result struct {
+	Status       string        `json:"status"`
+	Message      string        `json:"message,omitempty"`
+	Device       string        `json:"device,omitempty"`
+	VolumeName   string        `json:"volumeName,omitempty"`
+	Attached     bool          `json:"attached,omitempty"`
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
+}
+
+// Capabilities reported by init
+type Capabilities struct {
+	Attach bool `json:"attach"`
+}
+
+// Driver serves FlexVolume calls with a volume driver
+type Driver struct {
+	driver    drivers.VolumeDriver
+	mountRoot string
+	nodeName  string
+}
+
+// NewDriver returns a Driver mounting volumes under mountRoot.
+// nodeName is the name of this node, usually the host name.
+func NewDriver(driver drivers.VolumeDriver, mountRoot string, nodeName string) *Driver {
+	return &Driver{driver: driver, mountRoot: mountRoot, nodeName: nodeName}
+}
+
+// Run serves the call in args, e.g. ["mount", "/path", "{...}"]
+func (d *Driver) Run(args []string) Result {
+	if len(args) == 0 {
+		return failure(fmt.Errorf("No command specified"))
+	}
+	ctx := requestid.Background()
+	requestid.Log(ctx).WithFields(log.Fields{"args": args}).Info("FlexVolume call ")
+
+	cmd, args := args[0], args[1:]
+	count, ok := argCounts[cmd]
+	if !ok {
+		return Result{Status: StatusNotSupported, Message: fmt.Sprintf("%s is not supported", cmd)}
+	}
+	if len(args) < count {
+		return failure(fmt.Errorf("%s expects %d arguments, got %d", cmd, count, len(args)))
+	}
+
+	var err error
+	result := Result{Status: StatusSuccess}
+	switch cmd {
+	case "init":
+		result.Capabilities = &Capabilities{Attach: true}
+	case "getvolumename":
+		result.VolumeName, err = d.volumeName(args[0])
+	case "attach":
+		result.Device, err = d.attach(ctx, args[0], args[1])
+	case "isattached":
+		result.Attached, err = d.isAttached(ctx, args[0], args[1])
+	case "waitforattach":
+		result.Device, err = d.waitForAttach(ctx, args[0])
+	case "detach":
+		err = d.detach(ctx, args[0], args[1])
+	case "mountdevice":
+		err = d.bindMount(ctx, args[1], args[0], args[2])
+	case "unmountdevice", "unmount":
+		err = unmount(ctx, args[0])
+	case "mount":
+		var device string
+		if device, err = d.attach(ctx, args[1], d.nodeName); err == nil {
+			err = d.bindMount(ctx, device, args[0], args[1])
+		}
+	}
+	if err != nil {
+		requestid.Log(ctx).WithFields(log.Fields{"cmd": cmd, "error": err}).Error("FlexVolume call failed ")
+		return failure(err)
+	}
+	return result
+}
+
+func failure(err error) Result {
+	return Result{Status: StatusFailure, Message: err.Error()}
+}
+
+// parseOptions returns the options in the JSON passed by kubelet
+func parseOptions(jsonOpts string) (map[string]string, error) {
+	opts := make(map[string]string)
+	if err := json.Unmarshal([]byte(jsonOpts), &opts); err != nil {
+		return nil, fmt.Errorf("Invalid options %s: %v", jsonOpts, err)
+	}
+	return opts, nil
+}
+
+// volumeName returns the name of the volume in the options, with its datastore if any
+func (d *Driver) volumeName(jsonOpts string) (string, error) {
+	opts, err := parseOptions(jsonOpts)
+	if err != nil {
+		return "", err
+	}
+	name := opts[volumeNameOpt]
+	if name == "" {
+		return "", fmt.Errorf("Option %s is missing", volumeNameOpt)
+	}
+	if ds := opts[datastoreOpt]; ds != "" && !plugin_utils.IsFullVolName(name) {
+		name = name + "@" + ds
+	}
+	return name, nil
+}
+
+// checkNode fails for other nodes, volumes are attached to the VM the driver runs on
+func (d *Driver) checkNode(node string) error {
+	short := func(name string) string { return strings.SplitN(name, ".", 2)[0] }
+	if !strings.EqualFold(short(node), short(d.nodeName)) {
+		return fmt.Errorf("Volumes can only be attached to this node (%s), not to %s: "+
+			"kubelet must run with --enable-controller-attach-detach=false", d.nodeName, node)
+	}
+	return nil
+}
+
+// attach attaches the volume and mounts it under the mount root, unless it is
+// mounted already. Returns the mount root directory of the volume.
+func (d *Driver) attach(ctx context.Context, jsonOpts string, node string) (string, error) {
+	if err := d.checkNode(node); err != nil {
+		return "", err
+	}
+	name, err := d.volumeName(jsonOpts)
+	if err != nil {
+		return "", err
+	}
+	device := filepath.Join(d.mountRoot, name)
+	if plugin_utils.AlreadyMounted(ctx, name, d.mountRoot) {
+		return device, nil
+	}
+
+	meta, err := d.driver.GetVolume(name)
+	if err != nil {
+		return "", err
+	}
+	opts, _ := parseOptions(jsonOpts)
+	fstype := opts[fsTypeOpt]
+	for _, key := range []string{"fstype", "Fs_Type"} { // vsphere, photon
+		if value, ok := meta[key].(string); ok && fstype == "" {
+			fstype = value
+		}
+	}
+	if fstype == "" {
+		fstype = fs.FstypeDefault
+	}
+	// Photon disks are attached by ID, and may be attached already
+	id, _ := meta["ID"].(string)
+	state, _ := meta["State"].(string)
+	skipAttach := state != "" && state != "DETACHED"
+	isReadOnly := meta["access"] == "read-only"
+	mountOptions, _ := meta[fs.MountOptionsOpt].(string)
+
+	if _, err = d.driver.MountVolume(name, fstype, id, isReadOnly, skipAttach, mountOptions); err != nil {
+		return "", err
+	}
+	requestid.Log(ctx).WithFields(log.Fields{"name": name, "device": device}).Info("Volume attached and mounted ")
+	return device, nil
+}
+
+// isAttached returns true if the volume is mounted under the mount root
+func (d *Driver) isAttached(ctx context.Context, jsonOpts string, node string) (bool, error) {
+	if err := d.checkNode(node); err != nil {
+		return false, err
+	}
+	name, err := d.volumeName(jsonOpts)
+	if err != nil {
+		return false, err
+	}
+	return plugin_utils.AlreadyMounted(ctx, name, d.mountRoot), nil
+}
+
+// waitForAttach checks the device is ready, attach only returns once it is mounted
+func (d *Driver) waitForAttach(ctx context.Context, device string) (string, error) {
+	device = filepath.Clean(device)
+	if filepath.Dir(device) != filepath.Clean(d.mountRoot) ||
+		!plugin_utils.AlreadyMounted(ctx, filepath.Base(device), d.mountRoot) {
+		return "", fmt.Errorf("Device %s is not attached", device)
+	}
+	return device, nil
+}
+
+// detach unmounts the volume from the mount root and detaches it
+func (d *Driver) detach(ctx context.Context, name string, node string) error {
+	if err := d.checkNode(node); err != nil {
+		return err
+	}
+	if plugin_utils.AlreadyMounted(ctx, name, d.mountRoot) {
+		return d.driver.UnmountVolume(name)
+	}
+	return d.driver.DetachVolume(name)
+}
+
+// bindMount mounts the device, the mount root directory of a volume, at path
+func (d *Driver) bindMount(ctx context.Context, device string, path string, jsonOpts string) error {
+	opts, err := parseOptions(jsonOpts)
+	if err != nil {
+		return err
+	}
+	if _, err = d.waitForAttach(ctx, device); err != nil {
+		return err
+	}
+	if mounted, err := isMounted(ctx, path); err != nil || mounted {
+		return err
+	}
+	if err = fs.Mkdir(ctx, path); err != nil {
+		return err
+	}
+	return fs.BindMount(device, path, opts[readWriteOpt] == "ro")
+}
+
+// unmount unmounts path, if anything is mounted there
+func unmount(ctx context.Context, path string) error {
+	mounted, err := isMounted(ctx, path)
+	if err != nil || !mounted {
+		return err
+	}
+	return fs.Unmount(ctx, path)
+}
+
+func isMounted(ctx context.Context, path string) (bool, error) {
+	path = filepath.Clean(path)
+	mounts, err := fs.GetMountInfo(ctx, filepath.Dir(path))
+	if err != nil {
+		return false, err
+	}
+	_, ok := mounts[filepath.Base(path)]
+	return ok, nil
+}
+
+// Print writes the result to stdout, as kubelet expects it
+func (r Result) Print() {
+	b, err := json.Marshal(r)
+	if err != nil {
+		b = []byte(fmt.Sprintf(`{"status":"%s","message":"Failed to marshal result"}`, StatusFailure))
+	}
+	os.Stdout.Write(append(b, '\n'))
+}
@@ -0,0 +1,122 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package flexvolume_test
+
+// Runs FlexVolume calls against a volume driver mounting tmpfs file systems.
+// Needs root to mount.
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/flexvolume"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+)
+
+const (
+	node = "node1"
+	opts = `{"volumeName":"vol1","datastore":"ds1","kubernetes.io/fsType":"ext4","kubernetes.io/readwrite":"rw"}`
+)
+
+// tmpfsDriver mounts a tmpfs for each volume, and records the calls
+type tmpfsDriver struct {
+	mountRoot string
+	calls     []string
+}
+
+func (d *tmpfsDriver) MountVolume(name string, fstype string, id string, isReadOnly bool, skipAttach bool, mountOptions string) (string, error) {
+	d.calls = append(d.calls, fmt.Sprintf("mount %s %s", name, fstype))
+	mountpoint := filepath.Join(d.mountRoot, name)
+	if err := fs.Mkdir(context.Background(), mountpoint); err != nil {
+		return "", err
+	}
+	return mountpoint, syscall.Mount("tmpfs", mountpoint, "tmpfs", 0, "")
+}
+
+func (d *tmpfsDriver) UnmountVolume(name string) error {
+	d.calls = append(d.calls, "unmount "+name)
+	return syscall.Unmount(filepath.Join(d.mountRoot, name), 0)
+}
+
+func (d *tmpfsDriver) GetVolume(name string) (map[string]interface{}, error) {
+	return map[string]interface{}{"fstype": "xfs"}, nil
+}
+
+func (d *tmpfsDriver) DetachVolume(name string) error {
+	d.calls = append(d.calls, "detach "+name)
+	return nil
+}
+
+func TestFlexVolumeCalls(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Needs root to mount file systems")
+	}
+	root, err := ioutil.TempDir("", "flexvolume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	mountRoot := filepath.Join(root, "mnt")
+	driver := &tmpfsDriver{mountRoot: mountRoot}
+	flex := flexvolume.NewDriver(driver, mountRoot, node+".example.com")
+
+	result := flex.Run([]string{"init"})
+	assert.Equal(t, flexvolume.StatusSuccess, result.Status)
+	assert.True(t, result.Capabilities.Attach)
+	assert.Equal(t, flexvolume.StatusNotSupported, flex.Run([]string{"expandvolume"}).Status)
+	assert.Equal(t, flexvolume.StatusFailure, flex.Run([]string{"attach", opts}).Status)
+	assert.Equal(t, "vol1@ds1", flex.Run([]string{"getvolumename", opts}).VolumeName)
+
+	// Volumes can only be attached to this node
+	result = flex.Run([]string{"attach", opts, "node2"})
+	assert.Equal(t, flexvolume.StatusFailure, result.Status)
+	assert.Contains(t, result.Message, "--enable-controller-attach-detach=false")
+
+	result = flex.Run([]string{"attach", opts, node})
+	if !assert.Equal(t, flexvolume.StatusSuccess, result.Status, result.Message) {
+		return
+	}
+	device := result.Device
+	assert.Equal(t, filepath.Join(mountRoot, "vol1@ds1"), device)
+	assert.True(t, flex.Run([]string{"isattached", opts, node}).Attached)
+	assert.Equal(t, device, flex.Run([]string{"waitforattach", device, opts}).Device)
+
+	deviceMount := filepath.Join(root, "globalmount")
+	podMount := filepath.Join(root, "pod1", "vol1")
+	assert.Equal(t, flexvolume.StatusSuccess, flex.Run([]string{"mountdevice", deviceMount, device, opts}).Status)
+	assert.Equal(t, flexvolume.StatusSuccess, flex.Run([]string{"mount", podMount, opts}).Status)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(podMount, "data"), []byte("data"), 0644))
+	data, err := ioutil.ReadFile(filepath.Join(deviceMount, "data"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "data", string(data))
+	}
+
+	// The volume is attached once, all calls are idempotent
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, flexvolume.StatusSuccess, flex.Run([]string{"unmount", podMount}).Status)
+		assert.Equal(t, flexvolume.StatusSuccess, flex.Run([]string{"unmountdevice", deviceMount}).Status)
+		assert.Equal(t, flexvolume.StatusSuccess, flex.Run([]string{"detach", "vol1@ds1", node}).Status)
+	}
+	assert.False(t, flex.Run([]string{"isattached", opts, node}).Attached)
+	assert.Equal(t, []string{"mount vol1@ds1 ext4", "unmount vol1@ds1", "detach vol1@ds1"}, driver.calls)
+}
@@ -29,6 +29,7 @@ package photon
 //"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
 //"golang.org/x/exp/inotify"
 import (
+	"context"
 	"flag"
 	"fmt"
 	"strconv"
@@ -42,6 +43,7 @@ import (
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/plugin_utils"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/refcount"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
 	"github.com/vmware/photon-controller-go-sdk/photon"
 )
 
@@ -80,6 +82,18 @@ func (d *VolumeDriver) verifyTarget() error {
 
 // NewVolumeDriver - creates Driver, creates client for given target
 func NewVolumeDriver(cfg config.Config, mountDir string) *VolumeDriver {
+	d := NewStatelessVolumeDriver(cfg, mountDir)
+	if d != nil {
+		d.RefCounts.SetStateFile(cfg.StateFile, d.MountIDtoName)
+		d.RefCounts.Init(d, mountDir, cfg.Driver)
+		d.RefCounts.StartReconciler(cfg.RefCountReconcileSec)
+	}
+	return d
+}
+
+// NewStatelessVolumeDriver - creates Driver without discovering refcounts from Docker,
+// for commands serving a single request such as the FlexVolume driver.
+func NewStatelessVolumeDriver(cfg config.Config, mountDir string) *VolumeDriver {
 	// Read command line flags
 	targetURL := flag.String("target", "", "Photon controller URL")
 	projectID := flag.String("project", "", "Project ID of the docker host")
@@ -117,7 +131,6 @@ func NewVolumeDriver(cfg config.Config, mountDir string) *VolumeDriver {
 	}
 	d.MountRoot = mountDir
 	d.RefCounts = refcount.NewRefCountsMap()
-	d.RefCounts.Init(d, mountDir, cfg.Driver)
 	d.MountIDtoName = make(map[string]string)
 
 	log.WithFields(log.Fields{
@@ -131,7 +144,7 @@ func NewVolumeDriver(cfg config.Config, mountDir string) *VolumeDriver {
 }
 
 // validateCreateOptions validates the volume create request.
-func validateCreateOptions(r *volume.Request) error {
+func validateCreateOptions(ctx context.Context, r *volume.Request) error {
 	if r.Options == nil {
 		r.Options = make(map[string]string)
 	}
@@ -152,19 +165,19 @@ func validateCreateOptions(r *volume.Request) error {
 	}
 
 	// Check whether the fstype filesystem is supported.
-	errFstype := fs.VerifyFSSupport(r.Options[fsTypeTag])
+	errFstype := fs.VerifyFSSupport(ctx, r.Options[fsTypeTag])
 	if errFstype != nil {
-		log.WithFields(log.Fields{"name": r.Name,
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name,
 			"fstype": r.Options[fsTypeTag]}).Error("Not supported ")
 		return errFstype
 	}
 	return nil
 }
 
-func (d *VolumeDriver) taskWait(id string) error {
+func (d *VolumeDriver) taskWait(ctx context.Context, id string) error {
 	_, err := d.client.Tasks.Wait(id)
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"error": err, "taskID": id},
 		).Error("Task error - ")
 		return err
@@ -172,7 +185,7 @@ func (d *VolumeDriver) taskWait(id string) error {
 	return nil
 }
 
-func getDiskSize(r volume.Request) (int, error) {
+func getDiskSize(ctx context.Context, r volume.Request) (int, error) {
 	// Convert given size to GB and default to min
 	// 1GB.
 	capacity, err := r.Options["size"]
@@ -187,7 +200,7 @@ func getDiskSize(r volume.Request) (int, error) {
 		if err != nil {
 			return 0, err
 		}
-		log.Debugf("Got bytes=%d", bytes)
+		requestid.Log(ctx).Debugf("Got bytes=%d", bytes)
 		if bytes < capacityKB || (bytes/capacityKB) < capacityGB {
 			return 0, fmt.Errorf("Invalid size %s specified for volume %s",
 				r.Options["size"], r.Name)
@@ -199,7 +212,7 @@ func getDiskSize(r volume.Request) (int, error) {
 		if err != nil {
 			return 0, err
 		}
-		log.Debugf("Got bytes=%d", bytes)
+		requestid.Log(ctx).Debugf("Got bytes=%d", bytes)
 		return bytes, nil
 	}
 	return 0, fmt.Errorf("Invalid size %s specified for volume %s, size is specified as <size>mb/gb",
@@ -220,15 +233,16 @@ func convertDiskTags2Map(tags []string, status map[string]interface{}) {
 
 // Get info about a single volume
 func (d *VolumeDriver) Get(r volume.Request) volume.Response {
+	ctx := requestid.Background()
 	mountpoint := d.GetMountPoint(r.Name)
-	status, err := d.GetVolume(r.Name)
+	status, err := d.getVolume(ctx, r.Name)
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": r.Name, "error": err.Error()},
 		).Error("Failed to get data for volume ")
 		return volume.Response{Err: err.Error()}
 	}
-	log.WithFields(log.Fields{"name": r.Name, "status": status}).Info("Volume meta-data ")
+	requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "status": status}).Info("Volume meta-data ")
 	return volume.Response{Volume: &volume.Volume{
 		Name:       r.Name,
 		Mountpoint: mountpoint,
@@ -250,18 +264,18 @@ func (d *VolumeDriver) List(r volume.Request) volume.Response {
 	return volume.Response{Volumes: responseVolumes}
 }
 
-func (d *VolumeDriver) attachVolume(name string, id string) error {
+func (d *VolumeDriver) attachVolume(ctx context.Context, name string, id string) error {
 	diskOp := photon.VmDiskOperation{DiskID: id}
 	attachTask, errAttach := d.client.VMs.AttachDisk(d.hostID, &diskOp)
 	if errAttach != nil {
-		log.WithFields(log.Fields{"name": name, "error": errAttach}).Error("Failed to attach volume ")
+		requestid.Log(ctx).WithFields(log.Fields{"name": name, "error": errAttach}).Error("Failed to attach volume ")
 		return errAttach
 	}
 
 	// Uses default timeout and retry count
-	errTask := d.taskWait(attachTask.ID)
+	errTask := d.taskWait(ctx, attachTask.ID)
 	if errTask != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": name, "error": errTask},
 		).Error("Failed to attach volume ")
 		return errTask
@@ -269,46 +283,51 @@ func (d *VolumeDriver) attachVolume(name string, id string) error {
 	return nil
 }
 
-func (d *VolumeDriver) detachVolume(name string, id string) error {
+func (d *VolumeDriver) detachVolume(ctx context.Context, name string, id string) error {
 	diskOp := photon.VmDiskOperation{DiskID: id}
 	detachTask, errDetach := d.client.VMs.DetachDisk(d.hostID, &diskOp)
 	if errDetach != nil {
-		log.WithFields(log.Fields{"name": name, "error": errDetach}).Error("Failed to detach volume ")
+		requestid.Log(ctx).WithFields(log.Fields{"name": name, "error": errDetach}).Error("Failed to detach volume ")
 		return errDetach
 	}
 
 	// Uses default timeout and retry count
-	errTask := d.taskWait(detachTask.ID)
+	errTask := d.taskWait(ctx, detachTask.ID)
 	if errTask != nil {
-		log.WithFields(log.Fields{"name": name, "error": errTask}).Error("Failed to detach volume ")
+		requestid.Log(ctx).WithFields(log.Fields{"name": name, "error": errTask}).Error("Failed to detach volume ")
 		return errTask
 	}
-	err := fs.DeleteDevicePathWithID(id)
+	err := fs.DeleteDevicePathWithID(ctx, id)
 	if err != nil {
-		log.WithFields(log.Fields{"name": name, "id": id, "err": err.Error()}).Error("Failed to delete device path for ")
+		requestid.Log(ctx).WithFields(log.Fields{"name": name, "id": id, "err": err.Error()}).Error("Failed to delete device path for ")
 	}
 
-	log.WithFields(log.Fields{"name": name, "id": id}).Info("Detached volume ")
+	requestid.Log(ctx).WithFields(log.Fields{"name": name, "id": id}).Info("Detached volume ")
 	return nil
 }
 
 // GetVolume - returns Photon specific data for a volume
 func (d *VolumeDriver) GetVolume(name string) (map[string]interface{}, error) {
+	return d.getVolume(requestid.Background(), name)
+}
+
+// getVolume - see GetVolume
+func (d *VolumeDriver) getVolume(ctx context.Context, name string) (map[string]interface{}, error) {
 	// Create status map
 	status := make(map[string]interface{})
 
 	opt := photon.DiskGetOptions{Name: name}
 	dlist, err := d.client.Projects.GetDisks(d.project, &opt)
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": name, "error": err.Error()},
 		).Error("Failed to get data for volume ")
 		return status, err
 	} else if len(dlist.Items) == 0 {
 		// No disk of that name was found, its not an error
 		// for Photon but return one to the caller.
-		log.WithFields(log.Fields{"name": name}).Error("Unknown volume - ")
-		return status, fmt.Errorf("Unknown volume - " + name)
+		requestid.Log(ctx).WithFields(log.Fields{"name": name}).Error("Unknown volume - ")
+		return status, fmt.Errorf("Unknown volume - %s", name)
 	}
 
 	if len(dlist.Items) > 0 {
@@ -324,35 +343,41 @@ func (d *VolumeDriver) GetVolume(name string) (map[string]interface{}, error) {
 		}
 		convertDiskTags2Map(pDisk.Tags, status)
 	}
+	d.AddLocalStatus(ctx, name, status)
 	return status, nil
 }
 
 // MountVolume - Request attach and them mounts the volume.
-// Returns mount point and  error (or nil)
-func (d *VolumeDriver) MountVolume(name string, fstype string, id string, isReadOnly bool, skipAttach bool) (string, error) {
+// Returns mount point and  error (or nil). Mount options are not supported.
+func (d *VolumeDriver) MountVolume(name string, fstype string, id string, isReadOnly bool, skipAttach bool, mountOptions string) (string, error) {
+	return d.mountVolume(requestid.Background(), name, fstype, id, isReadOnly, skipAttach)
+}
+
+// mountVolume - see MountVolume
+func (d *VolumeDriver) mountVolume(ctx context.Context, name string, fstype string, id string, isReadOnly bool, skipAttach bool) (string, error) {
 	mountpoint := d.GetMountPoint(name)
 
 	// First, make sure  that mountpoint exists.
-	err := fs.Mkdir(mountpoint)
+	err := fs.Mkdir(ctx, mountpoint)
 	if err != nil {
-		log.WithFields(log.Fields{"name": name, "dir": mountpoint}).Error("Failed to make directory for volume mount ")
+		requestid.Log(ctx).WithFields(log.Fields{"name": name, "dir": mountpoint}).Error("Failed to make directory for volume mount ")
 		return "", err
 	}
 	if !skipAttach {
-		log.WithFields(log.Fields{"name": name, "fstype": fstype}).Info("Attaching volume ")
-		err = d.attachVolume(name, id)
+		requestid.Log(ctx).WithFields(log.Fields{"name": name, "fstype": fstype}).Info("Attaching volume ")
+		err = d.attachVolume(ctx, name, id)
 		if err != nil {
 			return "", err
 		}
 	}
-	return mountpoint, fs.MountWithID(mountpoint, fstype, id, isReadOnly)
+	return mountpoint, fs.MountWithID(ctx, mountpoint, fstype, id, isReadOnly)
 }
 
 // private function that does the job of mounting volume in conjunction with refcounting
-func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
-	volumeInfo, err := plugin_utils.GetVolumeInfo(r.Name, "", d)
+func (d *VolumeDriver) processMount(ctx context.Context, r volume.MountRequest) volume.Response {
+	volumeInfo, err := plugin_utils.GetVolumeInfo(ctx, r.Name, "", d.withContext(ctx))
 	if err != nil {
-		log.Errorf("Unable to get volume info for volume %s. err:%v", r.Name, err)
+		requestid.Log(ctx).Errorf("Unable to get volume info for volume %s. err:%v", r.Name, err)
 		return volume.Response{Err: err.Error()}
 	}
 	r.Name = volumeInfo.VolumeName
@@ -361,24 +386,24 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 	// If the volume is already mounted , just increase the refcount.
 	// Note: for new keys, GO maps return zero value, so no need for if_exists.
 	refcnt := d.IncrRefCount(r.Name) // save map traversal
-	log.Debugf("volume name=%s refcnt=%d", r.Name, refcnt)
+	requestid.Log(ctx).Debugf("volume name=%s refcnt=%d", r.Name, refcnt)
 	if refcnt > 1 {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": r.Name, "refcount": refcnt},
 		).Info("Already mounted, skipping mount. ")
 		return volume.Response{Mountpoint: d.GetMountPoint(r.Name)}
 	}
 
-	if plugin_utils.AlreadyMounted(r.Name, d.MountRoot) {
-		log.WithFields(log.Fields{"name": r.Name}).Info("Already mounted, skipping mount. ")
+	if plugin_utils.AlreadyMounted(ctx, r.Name, d.MountRoot) {
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name}).Info("Already mounted, skipping mount. ")
 		return volume.Response{Mountpoint: d.GetMountPoint(r.Name)}
 	}
 
 	// get volume metadata if required
 	volumeMeta := volumeInfo.VolumeMeta
 	if volumeMeta == nil {
-		if volumeMeta, err = d.GetVolume(r.Name); err != nil {
-			d.DecrRefCount(r.Name)
+		if volumeMeta, err = d.getVolume(ctx, r.Name); err != nil {
+			d.DecrRefCount(ctx, r.Name)
 			return volume.Response{Err: err.Error()}
 		}
 	}
@@ -394,19 +419,19 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 		if strings.Compare(state.(string), "DETACHED") != 0 {
 			skipAttach = true
 		}
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": r.Name, "skipAttach": skipAttach},
 		).Info("Attached state ")
 	}
 
 	// Mount the volume and for now its always read-write.
-	mountpoint, err := d.MountVolume(r.Name, fstype.(string), volumeMeta["ID"].(string), false, skipAttach)
+	mountpoint, err := d.mountVolume(ctx, r.Name, fstype.(string), volumeMeta["ID"].(string), false, skipAttach)
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": r.Name, "error": err.Error()},
 		).Error("Failed to mount ")
 
-		d.DecrRefCount(r.Name)
+		d.DecrRefCount(ctx, r.Name)
 		return volume.Response{Err: err.Error()}
 	}
 
@@ -415,23 +440,28 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 
 // UnmountVolume - Unmounts the volume and then requests detach
 func (d *VolumeDriver) UnmountVolume(name string) error {
+	return d.unmountVolume(requestid.Background(), name)
+}
+
+// unmountVolume - see UnmountVolume
+func (d *VolumeDriver) unmountVolume(ctx context.Context, name string) error {
 	mountpoint := d.GetMountPoint(name)
-	status, err := d.GetVolume(name)
+	status, err := d.getVolume(ctx, name)
 	if err != nil {
 		return err
 	}
 	id := status["ID"].(string)
 
-	err = fs.Unmount(mountpoint)
+	err = fs.Unmount(ctx, mountpoint)
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"mountpoint": mountpoint, "error": err},
 		).Error("Failed to unmount volume. Now trying to detach... ")
 		// Do not return error. Continue with detach.
 	}
-	log.WithFields(log.Fields{"name": name, "id": id}).Info("Unmounted volume ")
+	requestid.Log(ctx).WithFields(log.Fields{"name": name, "id": id}).Info("Unmounted volume ")
 
-	err = d.detachVolume(name, id)
+	err = d.detachVolume(ctx, name, id)
 	if err != nil {
 		return err
 	}
@@ -441,16 +471,17 @@ func (d *VolumeDriver) UnmountVolume(name string) error {
 
 // Create - create a volume.
 func (d *VolumeDriver) Create(r volume.Request) volume.Response {
-	log.WithFields(log.Fields{"name": r.Name, "option": r.Options}).Info("Creating volume ")
+	ctx := requestid.Background()
+	requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "option": r.Options}).Info("Creating volume ")
 
-	err := validateCreateOptions(&r)
+	err := validateCreateOptions(ctx, &r)
 	if err != nil {
 		return volume.Response{Err: err.Error()}
 	}
 
-	size, errSize := getDiskSize(r)
+	size, errSize := getDiskSize(ctx, r)
 	if errSize != nil {
-		log.WithFields(log.Fields{"name": r.Name, "error": errSize}).Error("Create volume failed, invalid size ")
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "error": errSize}).Error("Create volume failed, invalid size ")
 		return volume.Response{Err: errSize.Error()}
 	}
 
@@ -468,79 +499,84 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 
 	createTask, errCreate := d.client.Projects.CreateDisk(d.project, &dSpec)
 	if errCreate != nil {
-		log.WithFields(log.Fields{"name": r.Name, "error": errCreate}).Error("Create volume failed ")
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "error": errCreate}).Error("Create volume failed ")
 		return volume.Response{Err: errCreate.Error()}
 	}
 
 	// Uses default timeout and retry count
-	errTask := d.taskWait(createTask.ID)
+	errTask := d.taskWait(ctx, createTask.ID)
 	if errTask != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": r.Name, "error": errTask},
 		).Error("Failed to create volume ")
 		return volume.Response{Err: errTask.Error()}
 	}
 
 	// Handle filesystem creation
-	log.WithFields(log.Fields{"name": r.Name, "fstype": r.Options[fsTypeTag]}).Info("Attaching volume and creating filesystem ")
+	requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "fstype": r.Options[fsTypeTag]}).Info("Attaching volume and creating filesystem ")
 
-	errAttach := d.attachVolume(r.Name, createTask.Entity.ID)
+	errAttach := d.attachVolume(ctx, r.Name, createTask.Entity.ID)
 	if errAttach != nil {
-		log.WithFields(log.Fields{"name": r.Name, "error": errAttach}).Error("Attach volume failed, removing the volume ")
-		resp := d.Remove(volume.Request{Name: r.Name})
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "error": errAttach}).Error("Attach volume failed, removing the volume ")
+		resp := d.remove(ctx, volume.Request{Name: r.Name})
 		if resp.Err != "" {
-			log.WithFields(log.Fields{"name": r.Name, "error": resp.Err}).Warning("Remove volume failed ")
+			requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "error": resp.Err}).Warning("Remove volume failed ")
 		}
 		return volume.Response{Err: errAttach.Error()}
 	}
 
-	device, errGetDevicePath := fs.GetDevicePathByID(createTask.Entity.ID)
+	device, errGetDevicePath := fs.GetDevicePathByID(ctx, createTask.Entity.ID)
 	if errGetDevicePath != nil {
-		log.WithFields(log.Fields{"name": r.Name, "error": errGetDevicePath}).Error("Could not find attached device, removing the volume ")
-		err = d.detachVolume(r.Name, createTask.Entity.ID)
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "error": errGetDevicePath}).Error("Could not find attached device, removing the volume ")
+		err = d.detachVolume(ctx, r.Name, createTask.Entity.ID)
 		if err != nil {
-			log.WithFields(log.Fields{"name": r.Name, "error": err}).Warning("Detach volume failed ")
+			requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "error": err}).Warning("Detach volume failed ")
 		}
-		resp := d.Remove(volume.Request{Name: r.Name})
+		resp := d.remove(ctx, volume.Request{Name: r.Name})
 		if resp.Err != "" {
-			log.WithFields(log.Fields{"name": r.Name, "error": resp.Err}).Warning("Remove volume failed ")
+			requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "error": resp.Err}).Warning("Remove volume failed ")
 		}
 		return volume.Response{Err: errGetDevicePath.Error()}
 	}
 
-	errMkfs := fs.MkfsByDevicePath(r.Options[fsTypeTag], r.Name, device)
+	errMkfs := fs.MkfsByDevicePath(ctx, r.Options[fsTypeTag], r.Name, device, "")
 	if errMkfs != nil {
-		log.WithFields(log.Fields{"name": r.Name, "error": errMkfs}).Error("Create filesystem failed, removing the volume ")
-		err = d.detachVolume(r.Name, createTask.Entity.ID)
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "error": errMkfs}).Error("Create filesystem failed, removing the volume ")
+		err = d.detachVolume(ctx, r.Name, createTask.Entity.ID)
 		if err != nil {
-			log.WithFields(log.Fields{"name": r.Name, "error": err}).Warning("Detach volume failed ")
+			requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "error": err}).Warning("Detach volume failed ")
 		}
-		resp := d.Remove(volume.Request{Name: r.Name})
+		resp := d.remove(ctx, volume.Request{Name: r.Name})
 		if resp.Err != "" {
-			log.WithFields(log.Fields{"name": r.Name, "error": resp.Err}).Warning("Remove volume failed ")
+			requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "error": resp.Err}).Warning("Remove volume failed ")
 		}
 		return volume.Response{Err: errMkfs.Error()}
 	}
 
-	err = d.detachVolume(r.Name, createTask.Entity.ID)
+	err = d.detachVolume(ctx, r.Name, createTask.Entity.ID)
 	if err != nil {
-		log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Detach volume failed ")
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "error": err}).Error("Detach volume failed ")
 		return volume.Response{Err: err.Error()}
 	}
 
-	log.WithFields(log.Fields{"name": r.Name, "fstype": r.Options[fsTypeTag]}).Info("Volume and filesystem created ")
+	requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "fstype": r.Options[fsTypeTag]}).Info("Volume and filesystem created ")
 	return volume.Response{Err: ""}
 }
 
 // Remove - removes individual volume. Docker would call it only if is not using it anymore
 func (d *VolumeDriver) Remove(r volume.Request) volume.Response {
-	log.WithFields(log.Fields{"name": r.Name}).Info("Removing volume ")
+	return d.remove(requestid.Background(), r)
+}
+
+// remove - see Remove
+func (d *VolumeDriver) remove(ctx context.Context, r volume.Request) volume.Response {
+	requestid.Log(ctx).WithFields(log.Fields{"name": r.Name}).Info("Removing volume ")
 
 	// Cannot remove volumes till plugin completely initializes (refcounting is complete)
 	// because we don't know if it is being used or not
 	if d.RefCounts.IsInitialized() != true {
 		msg := fmt.Sprintf(plugin_utils.PluginInitError+" Cannot remove volume=%s", r.Name)
-		log.Error(msg)
+		requestid.Log(ctx).Error(msg)
 		return volume.Response{Err: msg}
 	}
 
@@ -548,30 +584,30 @@ func (d *VolumeDriver) Remove(r volume.Request) volume.Response {
 	if d.GetRefCount(r.Name) != 0 {
 		msg := fmt.Sprintf("Remove failure - volume is still mounted. "+
 			" volume=%s, refcount=%d", r.Name, d.GetRefCount(r.Name))
-		log.Error(msg)
+		requestid.Log(ctx).Error(msg)
 		return volume.Response{Err: msg}
 	}
 
 	// Always get the disk meta-data from Photon, when ref count is zero
 	// there is no refcount map entry either and hence no ID.
-	status, err := d.GetVolume(r.Name)
+	status, err := d.getVolume(ctx, r.Name)
 	if err != nil {
 		return volume.Response{Err: err.Error()}
 	}
 
-	log.WithFields(log.Fields{"using volume ID": status["ID"].(string)}).Info("Removing volume ")
+	requestid.Log(ctx).WithFields(log.Fields{"using volume ID": status["ID"].(string)}).Info("Removing volume ")
 	rmTask, err := d.client.Disks.Delete(status["ID"].(string))
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": r.Name, "error": err},
 		).Error("Failed to remove volume ")
 		return volume.Response{Err: err.Error()}
 	}
 
 	// Uses default timeout and retry count
-	err = d.taskWait(rmTask.ID)
+	err = d.taskWait(ctx, rmTask.ID)
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": r.Name, "error": err},
 		).Error("Failed to remove volume ")
 		return volume.Response{Err: err.Error()}
@@ -595,27 +631,31 @@ func (d *VolumeDriver) Path(r volume.Request) volume.Response {
 
 // Mount - mount a volume
 func (d *VolumeDriver) Mount(r volume.MountRequest) volume.Response {
-	log.WithFields(log.Fields{"name": r.Name}).Info("Mounting volume ")
+	ctx := requestid.Background()
+	requestid.Log(ctx).WithFields(log.Fields{"name": r.Name}).Info("Mounting volume ")
 
 	// lock the state
 	d.RefCounts.StateMtx.Lock()
 	defer d.RefCounts.StateMtx.Unlock()
+	defer d.RefCounts.SaveState()
 
 	// checked by refcounting thread until refmap initialized
 	// useless after that
 	d.RefCounts.MarkDirty()
 
-	return d.processMount(r)
+	return d.processMount(ctx, r)
 }
 
 // Unmount request from Docker. If mount refcount is drop to 0,
 // Unmount and detach from VM
 func (d *VolumeDriver) Unmount(r volume.UnmountRequest) volume.Response {
-	log.WithFields(log.Fields{"name": r.Name}).Info("Unmounting Volume ")
+	ctx := requestid.Background()
+	requestid.Log(ctx).WithFields(log.Fields{"name": r.Name}).Info("Unmounting Volume ")
 
 	// lock the state
 	d.RefCounts.StateMtx.Lock()
 	defer d.RefCounts.StateMtx.Unlock()
+	defer d.RefCounts.SaveState()
 
 	if d.RefCounts.IsInitialized() != true {
 		// if refcounting hasn't been succesful,
@@ -629,9 +669,9 @@ func (d *VolumeDriver) Unmount(r volume.UnmountRequest) volume.Response {
 		r.Name = fullVolName
 		delete(d.MountIDtoName, r.ID) //cleanup the map
 	} else {
-		volumeInfo, err := plugin_utils.GetVolumeInfo(r.Name, "", d)
+		volumeInfo, err := plugin_utils.GetVolumeInfo(ctx, r.Name, "", d.withContext(ctx))
 		if err != nil {
-			log.Errorf("Unable to get volume info for volume %s. err:%v", r.Name, err)
+			requestid.Log(ctx).Errorf("Unable to get volume info for volume %s. err:%v", r.Name, err)
 			return volume.Response{Err: err.Error()}
 		}
 		r.Name = volumeInfo.VolumeName
@@ -639,26 +679,26 @@ func (d *VolumeDriver) Unmount(r volume.UnmountRequest) volume.Response {
 
 	// if refcount has been succcessful, Normal flow.
 	// if the volume is still used by other containers, just return OK
-	refcnt, err := d.DecrRefCount(r.Name)
+	refcnt, err := d.DecrRefCount(ctx, r.Name)
 	if err != nil {
 		// something went wrong - yell, but still try to unmount
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": r.Name, "refcount": refcnt},
 		).Error("Refcount error - still trying to unmount...")
 	}
 
-	log.Debugf("volume name=%s refcnt=%d", r.Name, refcnt)
+	requestid.Log(ctx).Debugf("volume name=%s refcnt=%d", r.Name, refcnt)
 	if refcnt >= 1 {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": r.Name, "refcount": refcnt},
 		).Info("Still in use, skipping unmount request. ")
 		return volume.Response{Err: ""}
 	}
 
 	// and if nobody needs it, unmount and detach
-	err = d.UnmountVolume(r.Name)
+	err = d.unmountVolume(ctx, r.Name)
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": r.Name, "error": err.Error()},
 		).Error("Failed to unmount ")
 		return volume.Response{Err: err.Error()}
@@ -671,3 +711,20 @@ func (d *VolumeDriver) Unmount(r volume.UnmountRequest) volume.Response {
 func (d *VolumeDriver) DetachVolume(name string) error {
 	return nil
 }
+
+// requestDriver passes the request ID in ctx on to the driver when called
+// back through the drivers.VolumeDriver interface
+type requestDriver struct {
+	*VolumeDriver
+	ctx context.Context
+}
+
+// withContext returns the driver as a drivers.VolumeDriver logging with the request ID in ctx
+func (d *VolumeDriver) withContext(ctx context.Context) *requestDriver {
+	return &requestDriver{VolumeDriver: d, ctx: ctx}
+}
+
+// GetVolume - see VolumeDriver.GetVolume
+func (r *requestDriver) GetVolume(name string) (map[string]interface{}, error) {
+	return r.getVolume(r.ctx, name)
+}
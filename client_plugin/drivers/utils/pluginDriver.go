@@ -19,12 +19,21 @@ package utils
 //
 
 import (
+	"context"
 	"os"
 	"path/filepath"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/admin"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/refcount"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
 )
 
+// LocalStatusKey is the volume status key of the local use of the volume
+const LocalStatusKey = "local"
+
 // PluginDriver - helper struct to hold common utilities for driver interface
 type PluginDriver struct {
 	RefCounts     *refcount.RefCountsMap
@@ -57,9 +66,98 @@ func (u *PluginDriver) IncrRefCount(vol string) uint {
 }
 
 // Decrement the reference count for the given volume
-func (u *PluginDriver) DecrRefCount(vol string) (uint, error) {
+func (u *PluginDriver) DecrRefCount(ctx context.Context, vol string) (uint, error) {
 	if u.RefCounts.IsInitialized() != true {
 		return 1, nil
 	}
-	return u.RefCounts.Decr(vol)
+	return u.RefCounts.Decr(ctx, vol)
+}
+
+// AddLocalStatus adds how the volume is used on this host to its status: the
+// local refcount and, if the volume is mounted here, the mount device and time
+// and the file system usage. Nothing is added if the volume is not used here.
+func (u *PluginDriver) AddLocalStatus(ctx context.Context, volName string, status map[string]interface{}) {
+	local := make(map[string]interface{})
+	if info, ok := u.RefCounts.Get(volName); ok {
+		local["refcount"] = info.Count
+		local["mounted since"] = info.Since.UTC().Format(time.RFC3339)
+	}
+
+	mounts, err := fs.GetMountInfo(ctx, u.MountRoot)
+	if err != nil {
+		requestid.Log(ctx).WithFields(log.Fields{"name": volName, "error": err}).Warning("Failed to get mounts ")
+	}
+	if dev, mounted := mounts[volName]; mounted {
+		local["device"] = dev
+		usage, err := fs.GetUsage(u.GetMountPoint(volName))
+		if err != nil {
+			requestid.Log(ctx).WithFields(log.Fields{"name": volName, "error": err}).Warning("Failed to get file system usage ")
+		} else {
+			local["bytes total"] = usage.BytesTotal
+			local["bytes used"] = usage.BytesUsed
+			local["bytes available"] = usage.BytesAvailable
+			local["inodes total"] = usage.InodesTotal
+			local["inodes used"] = usage.InodesUsed
+			local["inodes free"] = usage.InodesFree
+		}
+	}
+
+	if len(local) != 0 {
+		status[LocalStatusKey] = local
+	}
+}
+
+// The following operations serve the admin server.
+
+// State returns the refcounts, mount IDs and refcounting init status
+func (u *PluginDriver) State() admin.State {
+	// MountIDtoName is only changed in Mount/Unmount, under StateMtx
+	u.RefCounts.StateMtx.Lock()
+	mountIDs := make(map[string]string, len(u.MountIDtoName))
+	for id, name := range u.MountIDtoName {
+		mountIDs[id] = name
+	}
+	u.RefCounts.StateMtx.Unlock()
+
+	refCounts := make(map[string]admin.RefCount)
+	for name, info := range u.RefCounts.Dump() {
+		refCounts[name] = admin.RefCount{Count: info.Count, Mounted: info.Mounted, Dev: info.Dev}
+	}
+	return admin.State{
+		Initialized:   u.RefCounts.IsInitialized(),
+		RefCounts:     refCounts,
+		MountIDtoName: mountIDs,
+	}
+}
+
+// Shutdown saves refcounts and mount IDs before the plugin exits, and
+// detaches volumes no container uses if detachIdle is set
+func (u *PluginDriver) Shutdown(detachIdle bool) {
+	u.RefCounts.Shutdown(detachIdle)
+}
+
+// Resync discovers refcounts from Docker again
+func (u *PluginDriver) Resync() error {
+	return u.RefCounts.Resync()
+}
+
+// ForceUnmount unmounts and detaches a volume even if it is in use and forgets
+// about its mounts. Containers using the volume lose access to it.
+func (u *PluginDriver) ForceUnmount(name string) error {
+	u.RefCounts.StateMtx.Lock()
+	defer u.RefCounts.StateMtx.Unlock()
+	defer u.RefCounts.SaveState()
+	for id, volName := range u.MountIDtoName {
+		if volName == name {
+			delete(u.MountIDtoName, id)
+		}
+	}
+	return u.RefCounts.ForceUnmount(name)
+}
+
+// ForceDetach detaches a volume which is not in use
+func (u *PluginDriver) ForceDetach(name string) error {
+	u.RefCounts.StateMtx.Lock()
+	defer u.RefCounts.StateMtx.Unlock()
+	return u.RefCounts.ForceDetach(name)
 }
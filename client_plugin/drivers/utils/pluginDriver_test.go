@@ -0,0 +1,69 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package utils_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/utils"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/refcount"
+)
+
+func TestAddLocalStatus(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Needs root to mount file systems")
+	}
+	mountRoot, err := ioutil.TempDir("", "mnt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mountRoot)
+	d := &utils.PluginDriver{RefCounts: refcount.NewRefCountsMap(), MountRoot: mountRoot}
+
+	status := map[string]interface{}{}
+	d.AddLocalStatus(context.Background(), "vol1@ds1", status)
+	assert.Empty(t, status, "Volumes not used on this host have no local status")
+
+	mountpoint := filepath.Join(mountRoot, "vol1@ds1")
+	if err = os.Mkdir(mountpoint, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = syscall.Mount("tmpfs", mountpoint, "tmpfs", 0, "size=1m"); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unmount(mountpoint, 0)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(mountpoint, "data"), make([]byte, 8192), 0644))
+	d.RefCounts.Incr("vol1@ds1")
+
+	d.AddLocalStatus(context.Background(), "vol1@ds1", status)
+	local, ok := status[utils.LocalStatusKey].(map[string]interface{})
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Equal(t, uint(1), local["refcount"])
+	assert.Equal(t, "tmpfs", local["device"])
+	assert.NotEmpty(t, local["mounted since"])
+	assert.Equal(t, uint64(1024*1024), local["bytes total"])
+	assert.True(t, local["bytes used"].(uint64) >= 8192)
+	assert.True(t, local["inodes used"].(uint64) >= 1)
+}
@@ -0,0 +1,158 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Samba credentials of vFile volumes
+//
+// Each vFile volume gets its own random Samba username and password when it
+// is created. They are kept in the info key of the volume, sealed (AES-GCM)
+// with a cluster key given to all nodes in their config file, or in a file
+// such as a Docker secret. The key is never stored in the KV store, without
+// it credentials can be neither sealed nor opened.
+
+package credentials
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
+)
+
+const (
+	// clusterKeySize: AES-256
+	clusterKeySize = 32
+	// usernamePrefix: Samba usernames must start with a letter
+	usernamePrefix = "vf"
+	usernameBytes  = 4
+	passwordBytes  = 16
+)
+
+// Credentials are the Samba username and password of a vFile volume
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Generate returns new random credentials
+func Generate() (Credentials, error) {
+	user := make([]byte, usernameBytes)
+	password := make([]byte, passwordBytes)
+	if _, err := rand.Read(user); err != nil {
+		return Credentials{}, err
+	}
+	if _, err := rand.Read(password); err != nil {
+		return Credentials{}, err
+	}
+	return Credentials{
+		Username: usernamePrefix + hex.EncodeToString(user),
+		Password: hex.EncodeToString(password),
+	}, nil
+}
+
+// errNoClusterKey is returned when sealing or opening without a cluster key
+var errNoClusterKey = errors.New("No cluster key configured, set ClusterKey or ClusterKeyFile in the plugin config file")
+
+// LoadClusterKey returns the base64 cluster key of cfg, ClusterKey or the
+// content of ClusterKeyFile (DefaultClusterKeyFile if not set)
+func LoadClusterKey(cfg config.Config) ([]byte, error) {
+	encoded := cfg.ClusterKey
+	if encoded == "" {
+		path := cfg.ClusterKeyFile
+		if path == "" {
+			path = config.DefaultClusterKeyFile
+		}
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil, errNoClusterKey
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the cluster key. %v", err)
+		}
+		encoded = string(data)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != clusterKeySize {
+		return nil, fmt.Errorf("Invalid cluster key, expected %d bytes in base64", clusterKeySize)
+	}
+	return key, nil
+}
+
+// Sealer seals and opens credentials with the cluster key
+type Sealer struct {
+	key []byte
+}
+
+// NewSealer returns a Sealer using the cluster key. With a nil key, as when
+// none is configured, it fails to seal and open credentials.
+func NewSealer(key []byte) *Sealer {
+	return &Sealer{key: key}
+}
+
+func (s *Sealer) aead() (cipher.AEAD, error) {
+	if s.key == nil {
+		return nil, errNoClusterKey
+	}
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts the credentials with the cluster key
+func (s *Sealer) Seal(c Credentials) (string, error) {
+	aead, err := s.aead()
+	if err != nil {
+		return "", err
+	}
+	plain, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plain, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts credentials sealed by Seal
+func (s *Sealer) Open(sealed string) (Credentials, error) {
+	var c Credentials
+	aead, err := s.aead()
+	if err != nil {
+		return c, err
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return c, errors.New("Invalid sealed credentials")
+	}
+	nonce, data := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, data, nil)
+	if err != nil {
+		return c, fmt.Errorf("Failed to decrypt credentials. %v", err)
+	}
+	err = json.Unmarshal(plain, &c)
+	return c, err
+}
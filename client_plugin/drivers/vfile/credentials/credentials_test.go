@@ -0,0 +1,92 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
+)
+
+func TestSealAndOpen(t *testing.T) {
+	key := make([]byte, clusterKeySize)
+	creds, err := Generate()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Regexp(t, regexp.MustCompile("^vf[0-9a-f]{8}$"), creds.Username)
+	assert.Len(t, creds.Password, 2*passwordBytes)
+	other, _ := Generate()
+	assert.NotEqual(t, creds, other)
+
+	sealed, err := NewSealer(key).Seal(creds)
+	assert.Nil(t, err)
+	assert.NotContains(t, sealed, creds.Password)
+
+	// Another node shares the cluster key
+	opened, err := NewSealer(key).Open(sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, creds, opened)
+
+	// Another cluster does not
+	otherKey := make([]byte, clusterKeySize)
+	otherKey[0] = 1
+	_, err = NewSealer(otherKey).Open(sealed)
+	assert.NotNil(t, err)
+	_, err = NewSealer(key).Open("garbage")
+	assert.NotNil(t, err)
+
+	// Nothing is sealed or opened without a key
+	_, err = NewSealer(nil).Seal(creds)
+	assert.Equal(t, errNoClusterKey, err)
+	_, err = NewSealer(nil).Open(sealed)
+	assert.Equal(t, errNoClusterKey, err)
+}
+
+func TestLoadClusterKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := make([]byte, clusterKeySize)
+	key[0] = 1
+	encoded := base64.StdEncoding.EncodeToString(key)
+
+	// In the config file
+	loaded, err := LoadClusterKey(config.Config{ClusterKey: encoded})
+	assert.Nil(t, err)
+	assert.Equal(t, key, loaded)
+
+	// In a file, e.g. a Docker secret
+	path := filepath.Join(dir, "cluster-key")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(encoded+"\n"), 0600))
+	loaded, err = LoadClusterKey(config.Config{ClusterKeyFile: path})
+	assert.Nil(t, err)
+	assert.Equal(t, key, loaded)
+
+	_, err = LoadClusterKey(config.Config{ClusterKeyFile: filepath.Join(dir, "missing")})
+	assert.Equal(t, errNoClusterKey, err)
+	_, err = LoadClusterKey(config.Config{ClusterKey: base64.StdEncoding.EncodeToString(key[:16])})
+	assert.NotNil(t, err)
+	_, err = LoadClusterKey(config.Config{ClusterKey: "not base64"})
+	assert.NotNil(t, err)
+}
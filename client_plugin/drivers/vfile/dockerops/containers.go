@@ -0,0 +1,217 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File servers running as containers on the local docker engine, for hosts
+// without Swarm.
+//
+// The file server of a volume runs in a container named like its service would
+// be, labeled with the volume name and restarted by Docker unless stopped. Its
+// port is published on a port of the host picked by Docker, clients mount the
+// volume from the host. Containers cannot use Docker secrets, so the password
+// is bind mounted from a file only root can read, at the path of the secret.
+// Creating a container does not pull its image as services do, so missing
+// images are pulled first.
+
+package dockerops
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	dockerClient "github.com/docker/engine-api/client"
+	dockerTypes "github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/container"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/docker/engine-api/types/strslice"
+	"github.com/docker/engine-api/types/swarm"
+	"github.com/docker/go-connections/nat"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/credentials"
+)
+
+const (
+	// Label of file server containers, holds the name of the volume
+	fileServerLabel = "com.vmware.vfile.volume"
+	// Directory of the password files of file server containers, /var/run
+	// is shared by the plugin and the host
+	hostSecretsDir = "/var/run/vfile/secrets"
+)
+
+// hostEngine runs file servers as containers, other operations are those of dockerEngine
+type hostEngine struct {
+	*dockerEngine
+}
+
+// StartFileServer - Start the file server of a volume in a container, returns
+// the port of the host it is published on and the container name
+func (d *hostEngine) StartFileServer(volName string, server FileServer, creds credentials.Credentials) (int, string, bool) {
+	name := serviceNamePrefix + volName
+	secretName := secretNamePrefix + volName
+
+	// Replace a container left behind by a file server which failed to stop
+	d.removeFileServerContainer(volName)
+
+	binds := []string{internalVolumePrefix + volName + ":/mount"}
+	if server.UsesSecret() {
+		secretFile, err := writeSecretFile(secretName, creds.Password)
+		if err != nil {
+			log.Warningf("Failed to write password file of file server for volume %s. Reason: %v",
+				volName, err)
+			return 0, "", false
+		}
+		binds = append(binds, secretFile+":"+secretsDir+secretName+":ro")
+	}
+	var spec swarm.ContainerSpec
+	server.SetContainerSpec(&spec, creds, secretsDir+secretName)
+	if err := d.pullImage(spec.Image); err != nil {
+		log.Warningf("Failed to pull image %s of file server for volume %s. Reason: %v",
+			spec.Image, volName, err)
+		d.removeFileServerContainer(volName)
+		return 0, "", false
+	}
+
+	port := nat.Port(fmt.Sprintf("%d/tcp", server.Port()))
+	config := &container.Config{
+		Image:        spec.Image,
+		Entrypoint:   strslice.StrSlice(spec.Command),
+		Cmd:          strslice.StrSlice(spec.Args),
+		Env:          spec.Env,
+		ExposedPorts: nat.PortSet{port: struct{}{}},
+		Labels:       map[string]string{fileServerLabel: volName},
+	}
+	hostConfig := &container.HostConfig{
+		Binds: binds,
+		// An empty binding lets Docker pick a free port of the host
+		PortBindings:  nat.PortMap{port: []nat.PortBinding{{}}},
+		RestartPolicy: container.RestartPolicy{Name: "unless-stopped"},
+	}
+	resp, err := d.Dockerd.ContainerCreate(context.Background(), config, hostConfig, nil, name)
+	if err == nil {
+		err = d.Dockerd.ContainerStart(context.Background(), resp.ID, dockerTypes.ContainerStartOptions{})
+	}
+	if err != nil {
+		log.Warningf("Failed to start file server container for volume %s. Reason: %v",
+			volName, err)
+		d.removeFileServerContainer(volName)
+		return 0, "", false
+	}
+
+	// Wait till the container runs with its port published
+	ticker := time.NewTicker(checkTicker)
+	defer ticker.Stop()
+	timer := time.NewTimer(GetServiceStartTimeout())
+	defer timer.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			log.Infof("Checking status of file server container...")
+			if hostPort, isRunning := d.isFileServerContainerRunning(resp.ID, port); isRunning {
+				return hostPort, name, true
+			}
+		case <-timer.C:
+			log.Warningf("Timeout reached while waiting for file server container for volume %s",
+				volName)
+			d.removeFileServerContainer(volName)
+			return 0, "", false
+		}
+	}
+}
+
+// isFileServerContainerRunning - Checks if a file server container is running,
+// returns the port of the host its port is published on
+func (d *hostEngine) isFileServerContainerRunning(id string, port nat.Port) (int, bool) {
+	info, err := d.Dockerd.ContainerInspect(context.Background(), id)
+	if err != nil {
+		log.Warningf("Failed to inspect file server container %s. Reason: %v", id, err)
+		return 0, false
+	}
+	if info.State == nil || !info.State.Running || info.NetworkSettings == nil {
+		return 0, false
+	}
+	bindings := info.NetworkSettings.Ports[port]
+	if len(bindings) == 0 {
+		return 0, false
+	}
+	hostPort, err := strconv.Atoi(bindings[0].HostPort)
+	if err != nil {
+		return 0, false
+	}
+	return hostPort, true
+}
+
+// StopFileServer - Stop the file server container of a volume
+func (d *hostEngine) StopFileServer(volName string) (int, string, bool) {
+	_, err := d.Dockerd.ContainerInspect(context.Background(), serviceNamePrefix+volName)
+	if err != nil {
+		log.Warningf("Failed to find file server container for volume %s. Reason: %v",
+			volName, err)
+		return 0, "", false
+	}
+	if err = d.removeFileServerContainer(volName); err != nil {
+		log.Warningf("Failed to remove file server container for volume %s. Reason: %v",
+			volName, err)
+		return 0, "", false
+	}
+	return 0, "", true
+}
+
+// removeFileServerContainer - Remove the file server container of a volume and
+// its password file, if any
+func (d *hostEngine) removeFileServerContainer(volName string) error {
+	err := d.Dockerd.ContainerRemove(context.Background(), serviceNamePrefix+volName,
+		dockerTypes.ContainerRemoveOptions{Force: true})
+	if err != nil && dockerClient.IsErrContainerNotFound(err) {
+		err = nil
+	}
+	if rmErr := os.Remove(filepath.Join(hostSecretsDir, secretNamePrefix+volName)); rmErr != nil && !os.IsNotExist(rmErr) {
+		log.Warningf("Failed to remove password file of file server for volume %s. Reason: %v",
+			volName, rmErr)
+	}
+	return err
+}
+
+// ListVolumesFromServices - List vFile volumes according to the file server containers
+func (d *hostEngine) ListVolumesFromServices() ([]string, error) {
+	var volumes []string
+	filter := filters.NewArgs()
+	filter.Add("label", fileServerLabel)
+	containers, err := d.Dockerd.ContainerList(context.Background(),
+		dockerTypes.ContainerListOptions{All: true, Filter: filter})
+	if err != nil {
+		log.Errorf("Failed to get a list of file server containers. Error: %v", err)
+		return volumes, err
+	}
+
+	for _, c := range containers {
+		volumes = append(volumes, c.Labels[fileServerLabel])
+	}
+	return volumes, nil
+}
+
+// writeSecretFile - Write the password of a file server to a file only root can read
+func writeSecretFile(secretName string, password string) (string, error) {
+	if err := os.MkdirAll(hostSecretsDir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(hostSecretsDir, secretName)
+	if err := ioutil.WriteFile(path, []byte(password), 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
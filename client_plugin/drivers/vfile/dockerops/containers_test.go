@@ -0,0 +1,49 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerops
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/credentials"
+)
+
+func TestFileServerContainerImage(t *testing.T) {
+	nfs, _ := GetFileServer(ProtocolNFS)
+
+	// The image is pulled before the container is created
+	fake, d, cleanup := newFakeDockerd(t)
+	defer cleanup()
+	port, name, ok := (&hostEngine{d}).StartFileServer("vol1", nfs, credentials.Credentials{})
+	if assert.True(t, ok, "File server should start once its image is pulled") {
+		assert.Equal(t, 32768, port)
+		assert.Equal(t, serviceNamePrefix+"vol1", name)
+	}
+	assert.Equal(t, []string{nfsImageName}, fake.pulls)
+
+	// Images Docker has are not pulled again
+	_, _, ok = (&hostEngine{d}).StartFileServer("vol2", nfs, credentials.Credentials{})
+	assert.True(t, ok)
+	assert.Len(t, fake.pulls, 1)
+
+	// No container is left behind when the image cannot be pulled
+	fake, d, cleanup = newFakeDockerd(t)
+	defer cleanup()
+	fake.pullError = "manifest unknown"
+	_, _, ok = (&hostEngine{d}).StartFileServer("vol1", nfs, credentials.Credentials{})
+	assert.False(t, ok, "File server should fail without its image")
+	assert.Empty(t, fake.containers)
+}
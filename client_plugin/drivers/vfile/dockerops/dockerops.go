@@ -14,18 +14,22 @@
 
 // Docker host related operations
 //
-// DockerOps struct holds the docker client based on a certain API version
-// and docker socket. All the operations which require a docker client should
-// be executed through this structure, including docker volume create/remove,
-// docker service start/stop, and docker information retrieve.
+// DockerOps is the interface for all the operations which require a docker
+// client, including docker volume create/remove, docker service start/stop,
+// and docker information retrieve. It is implemented by dockerEngine, which
+// holds the docker client based on a certain API version and docker socket,
+// by hostEngine running file servers as containers rather than services, and
+// by MockDockerOps for tests.
 
 package dockerops
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
@@ -35,7 +39,10 @@ import (
 	dockerClient "github.com/docker/engine-api/client"
 	dockerTypes "github.com/docker/engine-api/types"
 	"github.com/docker/engine-api/types/filters"
+	"github.com/docker/engine-api/types/reference"
 	"github.com/docker/engine-api/types/swarm"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/credentials"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
 )
 
 const (
@@ -43,27 +50,26 @@ const (
 	dockerAPIVersion = "v1.24"
 	// dockerUSocket: Unix socket on which Docker engine is listening
 	dockerUSocket = "unix:///var/run/docker.sock"
-	// Postfix added to names of Samba services for volumes
+	// Postfix added to names of file services for volumes
 	serviceNamePrefix = "vFileServer"
 	// Path where the file server image resides in plugin
 	fileServerPath = "/usr/lib/vmware/samba.tar"
-	// Driver for the network which Samba services will use
+	// Driver for the network which file services will use
 	// for communicating to clients
 	networkDriver = "overlay"
 	// Name of the Samba server docker image
 	sambaImageName = "dperson/samba"
+	// Entry point of the Samba server docker image
+	sambaInit   = "/sbin/tini"
+	sambaScript = "/usr/bin/samba.sh"
 	// Name of the Samba share used to expose a volume
 	FileShareName = "share1"
-	// Default username for all accessing Samba server mounts
-	SambaUsername = "root"
-	// Default password for all accessing Samba server mounts
-	SambaPassword = "badpass"
 	// Port number inside Samba container on which
 	// Samba service listens
 	defaultSambaPort = 445
 	// Time between successive checks for general checking
 	checkTicker = time.Second
-	// default Timeout to mark Samba service launch as unsuccessful
+	// default Timeout to mark file service launch as unsuccessful
 	defaultSvcStartTimeoutSec = 45
 	// Prefix for internal volume names
 	internalVolumePrefix = "_vF_"
@@ -82,12 +88,64 @@ func GetServiceStartTimeout() time.Duration {
 }
 
 // DockerOps is the interface for docker host related operations
-type DockerOps struct {
-	Dockerd *dockerClient.Client
+type DockerOps interface {
+	// GetSwarmInfo - returns the node ID and node IP address in swarm cluster
+	// also returns if this node is a manager or not
+	GetSwarmInfo() (nodeID string, addr string, isManager bool, err error)
+
+	// GetSwarmManagers - return all the managers according to local docker info
+	GetSwarmManagers() ([]swarm.Peer, error)
+
+	// IsSwarmLeader - check if nodeID is a swarm leader or not
+	IsSwarmLeader(nodeID string) (bool, error)
+
+	// GetSwarmLeader - return the IP address of the swarm leader
+	GetSwarmLeader() (string, error)
+
+	// VolumeCreate - create volume from docker host with specific volume driver
+	VolumeCreate(volumeDriver string, volName string, options map[string]string) error
+
+	// VolumeRemove - remove volume from docker host
+	VolumeRemove(volName string) error
+
+	// VolumeInspect - inspect volume from docker host, if failed, return error
+	VolumeInspect(volName string) error
+
+	// StartFileServer - Start the file server of a volume, returns its port and service name
+	StartFileServer(volName string, server FileServer, creds credentials.Credentials) (int, string, bool)
+
+	// StopFileServer - Stop the file server of a volume
+	StopFileServer(volName string) (int, string, bool)
+
+	// ListVolumesFromServices - List vFile volumes according to current docker services
+	ListVolumesFromServices() ([]string, error)
+
+	// ListVolumesFromInternalVol - List vFile volumes according to current internal volumes
+	ListVolumesFromInternalVol() ([]string, error)
+
+	// DeleteInternalVolume - delete the internal volume of a vFile volume
+	DeleteInternalVolume(volName string)
+
+	// LoadFileServerImage - Load the file server images, the Samba image
+	// present in the plugin and the NFS image from its registry
+	LoadFileServerImage()
+
+	// ShareSecrets - Make files available on all the nodes of the swarm, or
+	// on managers only, in SharedSecretsDir. The files replace those shared
+	// before with the same name.
+	ShareSecrets(name string, files map[string][]byte, managersOnly bool) error
 }
 
-func NewDockerOps() *DockerOps {
-	var d *DockerOps
+// dockerEngine implements DockerOps with the docker client
+type dockerEngine struct {
+	Dockerd   *dockerClient.Client
+	apiClient *http.Client // for API requests the Docker client does not support
+}
+
+// NewDockerOps returns DockerOps using the local docker engine, running file
+// servers as placed by the configuration
+func NewDockerOps(placement string) DockerOps {
+	var d *dockerEngine
 
 	client, err := dockerClient.NewClient(dockerUSocket, dockerAPIVersion, nil, nil)
 	if err != nil {
@@ -97,16 +155,20 @@ func NewDockerOps() *DockerOps {
 		return nil
 	}
 
-	d = &DockerOps{
-		Dockerd: client,
+	d = &dockerEngine{
+		Dockerd:   client,
+		apiClient: newAPIClient(),
 	}
 
+	if placement == config.FileServersOnHost {
+		return &hostEngine{d}
+	}
 	return d
 }
 
 // GetSwarmInfo - returns the node ID and node IP address in swarm cluster
 // also returns if this node is a manager or not
-func (d *DockerOps) GetSwarmInfo() (nodeID string, addr string, isManager bool, err error) {
+func (d *dockerEngine) GetSwarmInfo() (nodeID string, addr string, isManager bool, err error) {
 	info, err := d.Dockerd.Info(context.Background())
 	if err != nil {
 		return
@@ -128,7 +190,7 @@ func (d *DockerOps) GetSwarmInfo() (nodeID string, addr string, isManager bool,
 }
 
 // GetSwarmManagers - return all the managers according to local docker info
-func (d *DockerOps) GetSwarmManagers() ([]swarm.Peer, error) {
+func (d *dockerEngine) GetSwarmManagers() ([]swarm.Peer, error) {
 	info, err := d.Dockerd.Info(context.Background())
 	if err != nil {
 		return nil, err
@@ -139,7 +201,7 @@ func (d *DockerOps) GetSwarmManagers() ([]swarm.Peer, error) {
 
 // IsSwarmLeader - check if nodeID is a swarm leader or not
 // this function can only be executed successfully on a swarm manager node
-func (d *DockerOps) IsSwarmLeader(nodeID string) (bool, error) {
+func (d *dockerEngine) IsSwarmLeader(nodeID string) (bool, error) {
 	node, _, err := d.Dockerd.NodeInspectWithRaw(context.Background(), nodeID)
 	if err != nil {
 		return false, err
@@ -150,7 +212,7 @@ func (d *DockerOps) IsSwarmLeader(nodeID string) (bool, error) {
 
 // GetSwarmLeader - return the IP address of the swarm leader
 // this function can only be executed successfully on a swarm manager node
-func (d *DockerOps) GetSwarmLeader() (string, error) {
+func (d *dockerEngine) GetSwarmLeader() (string, error) {
 	nodes, err := d.Dockerd.NodeList(context.Background(), dockerTypes.NodeListOptions{})
 	if err != nil {
 		return "", err
@@ -167,7 +229,7 @@ func (d *DockerOps) GetSwarmLeader() (string, error) {
 }
 
 // VolumeCreate - create volume from docker host with specific volume driver
-func (d *DockerOps) VolumeCreate(volumeDriver string, volName string, options map[string]string) error {
+func (d *dockerEngine) VolumeCreate(volumeDriver string, volName string, options map[string]string) error {
 	dockerVolOptions := dockerTypes.VolumeCreateRequest{
 		Driver:     volumeDriver,
 		Name:       volName,
@@ -180,52 +242,51 @@ func (d *DockerOps) VolumeCreate(volumeDriver string, volName string, options ma
 }
 
 // VolumeCreate - remove volume from docker host with specific volume driver
-func (d *DockerOps) VolumeRemove(volName string) error {
+func (d *dockerEngine) VolumeRemove(volName string) error {
 	return d.Dockerd.VolumeRemove(context.Background(), volName)
 }
 
 // VolumeInspect - inspect volume from docker host, if failed, return error
-func (d *DockerOps) VolumeInspect(volName string) error {
+func (d *dockerEngine) VolumeInspect(volName string) error {
 	_, err := d.Dockerd.VolumeInspect(context.Background(), volName)
 	return err
 }
 
-// StartSMBServer - Start SMB server
-// Input - Name of the volume for which SMB has to be started
+// StartFileServer - Start file server
+// Input - Name of the volume for which the file server has to be started,
+//         the file server of the volume protocol, and the credentials of the volume
 // Output
 //      int:     The overlay network port number on which the
-//               newly created SMB server listens. This port
+//               newly created file server listens. This port
 //               is opened on every host VM in the swarm.
-//      string:  Name of the SMB service started
+//      string:  Name of the file service started
 //      bool:    Indicated success/failure of the function. If
 //               false, ignore other output values.
-func (d *DockerOps) StartSMBServer(volName string) (int, string, bool) {
+func (d *dockerEngine) StartFileServer(volName string, server FileServer, creds credentials.Credentials) (int, string, bool) {
 	var service swarm.ServiceSpec
-	var options dockerTypes.ServiceCreateOptions
+	var err error
 
 	// Name of the service
 	service.Name = serviceNamePrefix + volName
-	// The Docker image to run in this service
-	service.TaskTemplate.ContainerSpec.Image = sambaImageName
-
-	/* Args which will be passed to the service. These options are
-	   * used by the Samba container, not Docker API.
-	   * -s: Share related info: Name of the share,
-	                             Path in the Samba container that will be shared,
-	                             Browsable (yes),
-	                             Read only (no),
-	                             Guest access allowed by default (no),
-	                             Which users can access (all),
-	                             Which users are admins? (root)
-	                             Writelist: If RO, who can write on the share (root)
-	   * -u: Username and Password
-	*/
-	containerArgs := []string{"-s",
-		FileShareName + ";/mount;yes;no;no;all;" +
-			SambaUsername + ";" + SambaUsername,
-		"-u",
-		SambaUsername + ";" + SambaPassword}
-	service.TaskTemplate.ContainerSpec.Args = containerArgs
+
+	// The password is passed to the service as a secret, replace
+	// a secret left behind by a service which failed to stop
+	var secretID string
+	secretName := secretNamePrefix + volName
+	if server.UsesSecret() {
+		if err = d.removeSecret(secretName); err != nil {
+			log.Warningf("Failed to remove old secret of file server for volume %s. Reason: %v",
+				volName, err)
+		}
+		secretID, err = d.createSecret(secretName, []byte(creds.Password))
+		if err != nil {
+			log.Warningf("Failed to create secret of file server for volume %s. Reason: %v",
+				volName, err)
+			return 0, "", false
+		}
+	}
+	// The Docker image and command to run in this service
+	server.SetContainerSpec(&service.TaskTemplate.ContainerSpec, creds, secretsDir+secretName)
 
 	// Mount a volume on service containers at mount point "/mount"
 	var mountInfo []swarm.Mount
@@ -243,14 +304,14 @@ func (d *DockerOps) StartSMBServer(volName string) (int, string, bool) {
 	service.Mode = swarm.ServiceMode{Replicated: &numContainers}
 
 	/* Ports that the service wants to expose
-	   * Protocol: Samba operates on TCP
+	   * Protocol: Samba and NFSv4 operate on TCP
 	   * TargetPort: The port within the container that we wish to expose.
 	                 Port on host VM will get self assigned.
 	*/
 	var exposedPorts []swarm.PortConfig
 	exposedPorts = append(exposedPorts, swarm.PortConfig{
 		Protocol:   swarm.PortConfigProtocolTCP,
-		TargetPort: defaultSambaPort,
+		TargetPort: server.Port(),
 	})
 
 	// service.EndpointSpec is an input for service create.
@@ -271,11 +332,22 @@ func (d *DockerOps) StartSMBServer(volName string) (int, string, bool) {
 	}
 
 	//Start the service
-	resp, err := d.Dockerd.ServiceCreate(context.Background(),
-		service, options)
+	var serviceID string
+	if server.UsesSecret() {
+		serviceID, err = d.createServiceWithSecrets(service,
+			[]secretReference{newSecretReference(secretID, secretName, secretName)})
+	} else {
+		var resp dockerTypes.ServiceCreateResponse
+		resp, err = d.Dockerd.ServiceCreate(context.Background(),
+			service, dockerTypes.ServiceCreateOptions{})
+		serviceID = resp.ID
+	}
 	if err != nil {
 		log.Warningf("Failed to create file server for volume %s. Reason: %v",
 			volName, err)
+		if server.UsesSecret() {
+			d.removeSecret(secretName)
+		}
 		return 0, "", false
 	}
 
@@ -288,7 +360,7 @@ func (d *DockerOps) StartSMBServer(volName string) (int, string, bool) {
 		select {
 		case <-ticker.C:
 			log.Infof("Checking status of file server container...")
-			port, isRunning := d.isFileServiceRunning(resp.ID, volName)
+			port, isRunning := d.isFileServiceRunning(serviceID, volName)
 			if isRunning {
 				return int(port), serviceNamePrefix + volName, isRunning
 			}
@@ -313,7 +385,7 @@ func (d *DockerOps) StartSMBServer(volName string) (int, string, bool) {
 //               listens.
 //      bool:    Indicates if the service container is actually
 //               running or not. If false, ignore the port number.
-func (d *DockerOps) isFileServiceRunning(servID string, volName string) (uint32, bool) {
+func (d *dockerEngine) isFileServiceRunning(servID string, volName string) (uint32, bool) {
 	var port uint32
 	// Grep the samba service running for this volume using service ID
 	serviceFilters := filters.NewArgs()
@@ -331,7 +403,7 @@ func (d *DockerOps) isFileServiceRunning(servID string, volName string) (uint32,
 
 	port = services[0].Endpoint.Ports[0].PublishedPort
 	if port == 0 {
-		log.Warning("Bad port number assigned to file service for volume %s", volName)
+		log.Warningf("Bad port number assigned to file service for volume %s", volName)
 		return port, false
 	}
 
@@ -364,7 +436,7 @@ func (d *DockerOps) isFileServiceRunning(servID string, volName string) (uint32,
 //               every host VM and on which the service container
 //               listens.
 //      error:   error returned when it can not can service ID and port number
-func (d *DockerOps) getServiceIDAndPort(volName string) (string, uint32, error) {
+func (d *dockerEngine) getServiceIDAndPort(volName string) (string, uint32, error) {
 	// Grep the samba service running using service name
 	serviceName := serviceNamePrefix + volName
 	serviceFilters := filters.NewArgs()
@@ -373,12 +445,12 @@ func (d *DockerOps) getServiceIDAndPort(volName string) (string, uint32, error)
 		dockerTypes.ServiceListOptions{Filter: serviceFilters})
 	if err != nil {
 		msg := fmt.Sprintf("Failed to find service %v. %v", volName, err)
-		log.Warningf(msg)
+		log.Warning(msg)
 		return "", 0, errors.New(msg)
 	}
 	if len(services) < 1 {
 		msg := fmt.Sprintf("No service returned with name %s.", volName)
-		log.Warningf(msg)
+		log.Warning(msg)
 		return "", 0, errors.New(noSambaServiceError)
 	}
 
@@ -393,7 +465,7 @@ func (d *DockerOps) getServiceIDAndPort(volName string) (string, uint32, error)
 }
 
 // ListVolumesFromServices - List vFile volumes according to current docker services
-func (d *DockerOps) ListVolumesFromServices() ([]string, error) {
+func (d *dockerEngine) ListVolumesFromServices() ([]string, error) {
 	var volumes []string
 	// Get all the samba service for vFile plugin
 	filter := filters.NewArgs()
@@ -414,7 +486,7 @@ func (d *DockerOps) ListVolumesFromServices() ([]string, error) {
 }
 
 // ListVolumesFromInternalVol - List vFile volumes according to current internal volumes
-func (d *DockerOps) ListVolumesFromInternalVol() ([]string, error) {
+func (d *dockerEngine) ListVolumesFromInternalVol() ([]string, error) {
 	var volumes []string
 	filter := filters.NewArgs()
 	filter.Add("name", internalVolumePrefix)
@@ -434,7 +506,7 @@ func (d *DockerOps) ListVolumesFromInternalVol() ([]string, error) {
 }
 
 // DeleteVolume - delete the internal volume
-func (d *DockerOps) DeleteInternalVolume(volName string) {
+func (d *dockerEngine) DeleteInternalVolume(volName string) {
 	internalVolname := internalVolumePrefix + volName
 	ticker := time.NewTicker(checkTicker)
 	defer ticker.Stop()
@@ -454,12 +526,12 @@ func (d *DockerOps) DeleteInternalVolume(volName string) {
 				err = d.VolumeInspect(internalVolname)
 				if err != nil {
 					msg += fmt.Sprintf(" Failed to inspect internal volume. Error: %v.", err)
-					log.Warningf(msg)
+					log.Warning(msg)
 					return
 				}
 				// volume exists, continue waiting and retry removing
-				msg += fmt.Sprintf(" Internal volume still in use. Wait and retry before timeout.")
-				log.Warningf(msg)
+				msg += " Internal volume still in use. Wait and retry before timeout."
+				log.Warning(msg)
 			}
 		case <-timer.C:
 			// The deletion of internal volume will be handled by garbage collector
@@ -470,19 +542,19 @@ func (d *DockerOps) DeleteInternalVolume(volName string) {
 	}
 }
 
-// StopSMBServer - Stop SMB server
-// The return values are just to maintain parity with StartSMBServer()
+// StopFileServer - Stop file server
+// The return values are just to maintain parity with StartFileServer()
 // as both these functions are passed to a nested function as args.
 // Input
-//      volName: Name of the volume for which the SMB service has to
+//      volName: Name of the volume for which the file service has to
 //               be stopped.
 // Output
-//      int:     Port number on which the SMB server is listening.
+//      int:     Port number on which the file server is listening.
 //               Set this to 0 as cleanup.
-//      string:  Name of the SMB service. Set to empty.
+//      string:  Name of the file service. Set to empty.
 //      bool:    The result of the operation. True if the service was
 //               successfully stopped.
-func (d *DockerOps) StopSMBServer(volName string) (int, string, bool) {
+func (d *dockerEngine) StopFileServer(volName string) (int, string, bool) {
 	serviceID, _, err := d.getServiceIDAndPort(volName)
 	if err != nil {
 		return 0, "", false
@@ -511,6 +583,10 @@ func (d *DockerOps) StopSMBServer(volName string) (int, string, bool) {
 			}
 			// service is removed successfully
 			if serviceID == "" {
+				if err = d.removeSecret(secretNamePrefix + volName); err != nil {
+					log.Warningf("Failed to remove secret of file server for volume %s. Reason: %v",
+						volName, err)
+				}
 				return 0, "", true
 			}
 		case <-timer.C:
@@ -522,8 +598,13 @@ func (d *DockerOps) StopSMBServer(volName string) (int, string, bool) {
 }
 
 // loadFileServerImage - Load the file server image present
-// in the plugin to Docker images
-func (d *DockerOps) LoadFileServerImage() {
+// in the plugin to Docker images, and pull the NFS server image
+// so that NFS volumes do not wait for it
+func (d *dockerEngine) LoadFileServerImage() {
+	if err := d.pullImage(nfsImageName); err != nil {
+		log.Warningf("Failed to pull NFS server image %s: %v", nfsImageName, err)
+	}
+
 	file, err := os.Open(fileServerPath)
 	if err != nil {
 		log.Errorf("Failed to open file server tarball")
@@ -545,3 +626,40 @@ func (d *DockerOps) LoadFileServerImage() {
 	}
 	return
 }
+
+// pullImage - Pull an image unless Docker has it already. Images without
+// tag are pulled as latest, rather than with all their tags.
+func (d *dockerEngine) pullImage(image string) error {
+	_, _, err := d.Dockerd.ImageInspectWithRaw(context.Background(), image, false)
+	if err == nil || !dockerClient.IsErrImageNotFound(err) {
+		return err
+	}
+	if _, tag, err := reference.Parse(image); err != nil {
+		return err
+	} else if tag == "" {
+		image += ":latest"
+	}
+	log.Infof("Pulling image %s", image)
+	body, err := d.Dockerd.ImagePull(context.Background(), image, dockerTypes.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	// The pull goes on while its progress is read, failures are
+	// reported in the progress rather than by the request
+	decoder := json.NewDecoder(body)
+	for {
+		var progress struct {
+			Error string `json:"error"`
+		}
+		if err = decoder.Decode(&progress); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if progress.Error != "" {
+			return errors.New(progress.Error)
+		}
+	}
+}
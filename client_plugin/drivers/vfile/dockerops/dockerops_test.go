@@ -0,0 +1,148 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerops
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	dockerClient "github.com/docker/engine-api/client"
+	dockerTypes "github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/container"
+	"github.com/docker/go-connections/nat"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDockerd serves the image and container requests of the Docker API from
+// a set of images. Containers run once started, with their ports published.
+type fakeDockerd struct {
+	mtx        sync.Mutex
+	images     map[string]bool
+	pulls      []string
+	pullError  string                       // reported in the progress of pulls, which then fail
+	containers map[string]*container.Config // by name, which is also the ID
+}
+
+func (f *fakeDockerd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/"+dockerAPIVersion)
+	switch {
+	case r.Method == "GET" && strings.HasPrefix(path, "/images/") && strings.HasSuffix(path, "/json"):
+		if !f.images[strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/json")] {
+			http.Error(w, `{"message": "No such image"}`, http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{}`)
+	case r.Method == "POST" && path == "/images/create":
+		image := r.URL.Query().Get("fromImage") + ":" + r.URL.Query().Get("tag")
+		f.pulls = append(f.pulls, image)
+		if f.pullError != "" {
+			json.NewEncoder(w).Encode(map[string]string{"error": f.pullError})
+			return
+		}
+		f.images[image] = true
+		json.NewEncoder(w).Encode(map[string]string{"status": "Downloaded newer image for " + image})
+	case r.Method == "POST" && path == "/containers/create":
+		var config container.Config
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			http.Error(w, `{"message": "Bad config"}`, http.StatusBadRequest)
+			return
+		}
+		// Docker does not pull images of new containers
+		if !f.images[config.Image] {
+			http.Error(w, `{"message": "No such image: `+config.Image+`"}`, http.StatusNotFound)
+			return
+		}
+		name := r.URL.Query().Get("name")
+		f.containers[name] = &config
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(dockerTypes.ContainerCreateResponse{ID: name})
+	case strings.HasPrefix(path, "/containers/"):
+		name := strings.Split(strings.TrimPrefix(path, "/containers/"), "/")[0]
+		config, ok := f.containers[name]
+		if !ok {
+			http.Error(w, `{"message": "No such container: `+name+`"}`, http.StatusNotFound)
+			return
+		}
+		switch {
+		case r.Method == "POST" && strings.HasSuffix(path, "/start"):
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "GET" && strings.HasSuffix(path, "/json"):
+			ports := nat.PortMap{}
+			for port := range config.ExposedPorts {
+				ports[port] = []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "32768"}}
+			}
+			info := dockerTypes.ContainerJSON{
+				ContainerJSONBase: &dockerTypes.ContainerJSONBase{ID: name,
+					State: &dockerTypes.ContainerState{Running: true}},
+				NetworkSettings: &dockerTypes.NetworkSettings{
+					NetworkSettingsBase: dockerTypes.NetworkSettingsBase{Ports: ports}},
+			}
+			json.NewEncoder(w).Encode(info)
+		case r.Method == "DELETE":
+			delete(f.containers, name)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newFakeDockerd returns a fakeDockerd with images, and a dockerEngine using it
+func newFakeDockerd(t *testing.T, images ...string) (*fakeDockerd, *dockerEngine, func()) {
+	fake := &fakeDockerd{images: make(map[string]bool), containers: make(map[string]*container.Config)}
+	for _, image := range images {
+		fake.images[image] = true
+	}
+	server := httptest.NewServer(fake)
+	client, err := dockerClient.NewClient("tcp://"+server.Listener.Addr().String(), dockerAPIVersion, nil, nil)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return fake, &dockerEngine{Dockerd: client}, server.Close
+}
+
+func TestPullImage(t *testing.T) {
+	fake, d, cleanup := newFakeDockerd(t, sambaImageName+":latest")
+	defer cleanup()
+
+	// Images Docker has already are not pulled
+	assert.Nil(t, d.pullImage(sambaImageName+":latest"))
+	assert.Empty(t, fake.pulls)
+
+	assert.Nil(t, d.pullImage(nfsImageName))
+	assert.Equal(t, []string{nfsImageName}, fake.pulls)
+	assert.True(t, fake.images[nfsImageName])
+
+	// Images without tag are pulled as latest, not with all their tags
+	assert.Nil(t, d.pullImage("vfile/untagged"))
+	assert.Equal(t, "vfile/untagged:latest", fake.pulls[len(fake.pulls)-1])
+
+	// Failures come with the progress of the pull
+	fake.pullError = "manifest unknown"
+	err := d.pullImage("vfile/missing:1.0")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "manifest unknown")
+	}
+}
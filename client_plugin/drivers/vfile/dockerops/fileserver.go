@@ -0,0 +1,127 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File servers of vFile volumes
+//
+// Each mounted vFile volume is shared by a Docker service running a file
+// server for one protocol, chosen when the volume is created:
+//   smb: Samba (dperson/samba), with the credentials of the volume
+//   nfs: NFSv4 (nfs-ganesha), without authentication. NFSv4 needs a single
+//        port, which the swarm routing mesh publishes on every node.
+
+package dockerops
+
+import (
+	"fmt"
+
+	"github.com/docker/engine-api/types/swarm"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/credentials"
+)
+
+const (
+	// ProtocolSMB shares volumes over SMB 3.0
+	ProtocolSMB = "smb"
+	// ProtocolNFS shares volumes over NFSv4
+	ProtocolNFS = "nfs"
+	// DefaultProtocol is the protocol of volumes created without one,
+	// and of volumes created before the protocol was recorded
+	DefaultProtocol = ProtocolSMB
+
+	// Name of the NFS server docker image, not shipped with the plugin but
+	// pulled. Pulling a name without tag would fetch all the tags.
+	nfsImageName = "janeczku/nfs-ganesha:latest"
+	// Port number inside NFS container on which NFS service listens
+	defaultNFSPort = 2049
+	// Path in the NFS container where the share is exported
+	nfsExportPath = "/mount"
+)
+
+// FileServer runs the file server of a protocol in service containers
+type FileServer interface {
+	// Protocol returns the name of the protocol, as given with -o protocol
+	Protocol() string
+	// SetContainerSpec sets the image, command and environment of containers
+	// serving the share from /mount. secretFile holds the password of the
+	// volume if the file server uses a secret.
+	SetContainerSpec(spec *swarm.ContainerSpec, creds credentials.Credentials, secretFile string)
+	// UsesSecret tells if the password of the volume is passed in a secret
+	UsesSecret() bool
+	// Port returns the port the file server listens on in its container
+	Port() uint32
+}
+
+// Protocols lists the supported protocols
+var Protocols = []string{ProtocolSMB, ProtocolNFS}
+
+// GetFileServer returns the file server of protocol, DefaultProtocol if empty
+func GetFileServer(protocol string) (FileServer, error) {
+	switch protocol {
+	case ProtocolSMB, "":
+		return sambaServer{}, nil
+	case ProtocolNFS:
+		return nfsServer{}, nil
+	}
+	return nil, fmt.Errorf("Invalid protocol %s. Valid protocols are: %v", protocol, Protocols)
+}
+
+// sambaServer shares volumes over SMB
+type sambaServer struct{}
+
+func (sambaServer) Protocol() string { return ProtocolSMB }
+
+func (sambaServer) UsesSecret() bool { return true }
+
+func (sambaServer) Port() uint32 { return defaultSambaPort }
+
+/* SetContainerSpec - The Samba server reads the password from the secret
+   file, rather than from its arguments which anyone allowed to inspect
+   services can see.
+   * -s: Share related info: Name of the share,
+                             Path in the Samba container that will be shared,
+                             Browsable (yes),
+                             Read only (no),
+                             Guest access allowed by default (no),
+                             Which users can access (all),
+                             Which users are admins? (the user)
+                             Writelist: If RO, who can write on the share (the user)
+   * -u: Username and Password
+*/
+func (sambaServer) SetContainerSpec(spec *swarm.ContainerSpec, creds credentials.Credentials, secretFile string) {
+	share := FileShareName + ";/mount;yes;no;no;all;" + creds.Username + ";" + creds.Username
+	script := fmt.Sprintf(`exec %s -s "%s" -u "%s;$(cat %s)"`,
+		sambaScript, share, creds.Username, secretFile)
+	spec.Image = sambaImageName
+	spec.Command = []string{sambaInit, "--", "sh", "-c", script}
+}
+
+// nfsServer shares volumes over NFSv4
+type nfsServer struct{}
+
+func (nfsServer) Protocol() string { return ProtocolNFS }
+
+func (nfsServer) UsesSecret() bool { return false }
+
+func (nfsServer) Port() uint32 { return defaultNFSPort }
+
+// SetContainerSpec - nfs-ganesha exports /mount as /FileShareName, NFSv4 only
+func (nfsServer) SetContainerSpec(spec *swarm.ContainerSpec, creds credentials.Credentials, secretFile string) {
+	spec.Image = nfsImageName
+	spec.Env = []string{
+		"EXPORT_PATH=" + nfsExportPath,
+		"PSEUDO_PATH=/" + FileShareName,
+		"PROTOCOLS=4",
+		"TRANSPORTS=TCP",
+		"GRACELESS=true",
+	}
+}
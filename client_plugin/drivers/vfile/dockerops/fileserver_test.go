@@ -0,0 +1,62 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerops
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/docker/engine-api/types/swarm"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/credentials"
+)
+
+func TestGetFileServer(t *testing.T) {
+	server, err := GetFileServer("")
+	if assert.Nil(t, err) {
+		assert.Equal(t, DefaultProtocol, server.Protocol())
+	}
+	for _, protocol := range Protocols {
+		server, err = GetFileServer(protocol)
+		if assert.Nil(t, err, protocol) {
+			assert.Equal(t, protocol, server.Protocol())
+		}
+	}
+	_, err = GetFileServer("afp")
+	assert.NotNil(t, err)
+}
+
+func TestContainerSpec(t *testing.T) {
+	creds := credentials.Credentials{Username: "vf0123abcd", Password: "0f1e2d3c4b5a69788796a5b4c3d2e1f0"}
+
+	// The Samba password only comes from the secret file
+	smb, _ := GetFileServer(ProtocolSMB)
+	var spec swarm.ContainerSpec
+	smb.SetContainerSpec(&spec, creds, secretsDir+"vFileSecretvol1")
+	assert.True(t, smb.UsesSecret())
+	assert.Equal(t, sambaImageName, spec.Image)
+	command := strings.Join(spec.Command, " ")
+	assert.Contains(t, command, creds.Username)
+	assert.Contains(t, command, secretsDir+"vFileSecretvol1")
+	assert.NotContains(t, command, creds.Password)
+
+	nfs, _ := GetFileServer(ProtocolNFS)
+	spec = swarm.ContainerSpec{}
+	nfs.SetContainerSpec(&spec, credentials.Credentials{}, "")
+	assert.False(t, nfs.UsesSecret())
+	assert.Equal(t, nfsImageName, spec.Image)
+	assert.Contains(t, spec.Env, "PSEUDO_PATH=/"+FileShareName)
+	assert.Equal(t, uint32(defaultNFSPort), nfs.Port())
+}
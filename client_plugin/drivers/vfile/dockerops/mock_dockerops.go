@@ -0,0 +1,260 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// An implementation of the DockerOps interface that mocks a swarm of one node.
+// This removes the requirement of running Docker at all when testing vFile.
+//
+// Internal volumes are only names with their options. File services start and
+// stop right away, each gets a port of its own on the routing mesh. Docker
+// rules the vFile driver relies on are enforced: a volume used by a service
+// cannot be removed, and two services cannot have the same name. Shared files
+// are recorded, and written to SharedDir if set, as on the node of the mock.
+
+package dockerops
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/engine-api/types/swarm"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/credentials"
+)
+
+const (
+	// MockNodeID is the swarm node ID of a new MockDockerOps
+	MockNodeID = "mock-node"
+	// MockNodeAddr is the swarm address of a new MockDockerOps
+	MockNodeAddr = "127.0.0.1"
+	// First port published by mock file services
+	mockFirstPort = 30000
+)
+
+// MockService is a file service started by MockDockerOps
+type MockService struct {
+	Name        string
+	Port        int
+	Protocol    string
+	Credentials credentials.Credentials
+}
+
+// MockShare is a set of files shared by MockDockerOps
+type MockShare struct {
+	Files        map[string][]byte
+	ManagersOnly bool
+}
+
+// MockDockerOps struct
+type MockDockerOps struct {
+	NodeID   string
+	NodeAddr string
+	Manager  bool // the node is a manager, and the swarm leader
+
+	// FailFileServers makes file services fail to start or stop
+	FailFileServers bool
+	// SharedDir stands for SharedSecretsDir, shared files are not
+	// written if empty
+	SharedDir string
+
+	mtx      sync.Mutex
+	volumes  map[string]map[string]string // options of internal volumes
+	services map[string]MockService       // file services, by volume name
+	shares   map[string]MockShare         // shared files, by name
+	nextPort int
+}
+
+// NewMockDockerOps returns a new instance of MockDockerOps, a swarm manager
+func NewMockDockerOps() *MockDockerOps {
+	return &MockDockerOps{
+		NodeID:   MockNodeID,
+		NodeAddr: MockNodeAddr,
+		Manager:  true,
+		volumes:  make(map[string]map[string]string),
+		services: make(map[string]MockService),
+		shares:   make(map[string]MockShare),
+		nextPort: mockFirstPort,
+	}
+}
+
+// Service returns the file service of a volume, if it is running
+func (d *MockDockerOps) Service(volName string) (MockService, bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	service, ok := d.services[volName]
+	return service, ok
+}
+
+// Share returns the files shared with a name, if any
+func (d *MockDockerOps) Share(name string) (MockShare, bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	share, ok := d.shares[name]
+	return share, ok
+}
+
+// VolumeOptions returns the options a volume was created with, if it exists
+func (d *MockDockerOps) VolumeOptions(volName string) (map[string]string, bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	options, ok := d.volumes[volName]
+	return options, ok
+}
+
+// GetSwarmInfo - see DockerOps
+func (d *MockDockerOps) GetSwarmInfo() (nodeID string, addr string, isManager bool, err error) {
+	return d.NodeID, d.NodeAddr, d.Manager, nil
+}
+
+// GetSwarmManagers - see DockerOps
+func (d *MockDockerOps) GetSwarmManagers() ([]swarm.Peer, error) {
+	return []swarm.Peer{{NodeID: d.NodeID, Addr: d.NodeAddr}}, nil
+}
+
+// IsSwarmLeader - see DockerOps
+func (d *MockDockerOps) IsSwarmLeader(nodeID string) (bool, error) {
+	if !d.Manager {
+		return false, errors.New("This node is not a swarm manager")
+	}
+	return nodeID == d.NodeID, nil
+}
+
+// GetSwarmLeader - see DockerOps
+func (d *MockDockerOps) GetSwarmLeader() (string, error) {
+	if !d.Manager {
+		return "", errors.New("This node is not a swarm manager")
+	}
+	return d.NodeAddr, nil
+}
+
+// VolumeCreate - see DockerOps
+func (d *MockDockerOps) VolumeCreate(volumeDriver string, volName string, options map[string]string) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	copied := make(map[string]string)
+	for k, v := range options {
+		copied[k] = v
+	}
+	d.volumes[volName] = copied
+	return nil
+}
+
+// VolumeRemove - see DockerOps
+func (d *MockDockerOps) VolumeRemove(volName string) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if _, ok := d.volumes[volName]; !ok {
+		return fmt.Errorf("no such volume: %s", volName)
+	}
+	if _, ok := d.services[strings.TrimPrefix(volName, internalVolumePrefix)]; ok {
+		return fmt.Errorf("volume is in use: %s", volName)
+	}
+	delete(d.volumes, volName)
+	return nil
+}
+
+// VolumeInspect - see DockerOps
+func (d *MockDockerOps) VolumeInspect(volName string) error {
+	if _, ok := d.VolumeOptions(volName); !ok {
+		return fmt.Errorf("no such volume: %s", volName)
+	}
+	return nil
+}
+
+// StartFileServer - see DockerOps
+func (d *MockDockerOps) StartFileServer(volName string, server FileServer, creds credentials.Credentials) (int, string, bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if _, ok := d.services[volName]; ok || d.FailFileServers {
+		return 0, "", false
+	}
+	service := MockService{
+		Name:        serviceNamePrefix + volName,
+		Port:        d.nextPort,
+		Protocol:    server.Protocol(),
+		Credentials: creds,
+	}
+	d.nextPort++
+	d.services[volName] = service
+	return service.Port, service.Name, true
+}
+
+// StopFileServer - see DockerOps
+func (d *MockDockerOps) StopFileServer(volName string) (int, string, bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if _, ok := d.services[volName]; !ok || d.FailFileServers {
+		return 0, "", false
+	}
+	delete(d.services, volName)
+	return 0, "", true
+}
+
+// ListVolumesFromServices - see DockerOps
+func (d *MockDockerOps) ListVolumesFromServices() ([]string, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	var volumes []string
+	for volName := range d.services {
+		volumes = append(volumes, volName)
+	}
+	sort.Strings(volumes)
+	return volumes, nil
+}
+
+// ListVolumesFromInternalVol - see DockerOps
+func (d *MockDockerOps) ListVolumesFromInternalVol() ([]string, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	var volumes []string
+	for name := range d.volumes {
+		if strings.HasPrefix(name, internalVolumePrefix) {
+			volumes = append(volumes, strings.TrimPrefix(name, internalVolumePrefix))
+		}
+	}
+	sort.Strings(volumes)
+	return volumes, nil
+}
+
+// DeleteInternalVolume - see DockerOps. Gives up at once if the volume is in use,
+// rather than waiting for the file service to stop.
+func (d *MockDockerOps) DeleteInternalVolume(volName string) {
+	d.VolumeRemove(internalVolumePrefix + volName)
+}
+
+// LoadFileServerImage - see DockerOps
+func (d *MockDockerOps) LoadFileServerImage() {}
+
+// ShareSecrets - see DockerOps
+func (d *MockDockerOps) ShareSecrets(name string, files map[string][]byte, managersOnly bool) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.shares[name] = MockShare{Files: files, ManagersOnly: managersOnly}
+	if d.SharedDir == "" || (managersOnly && !d.Manager) {
+		return nil
+	}
+	if err := os.MkdirAll(d.SharedDir, 0700); err != nil {
+		return err
+	}
+	for file, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(d.SharedDir, file), data, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Docker secrets holding the Samba passwords of vFile volumes, and the files
+// the plugin shares between the nodes of the swarm
+//
+// The Samba service of a volume reads the password from a secret, rather
+// than from its arguments which anyone allowed to inspect services can see.
+// The vendored Docker client predates secrets (API 1.25), so secrets and
+// services using them are created with requests of their own.
+//
+// Docker never gives the content of a secret back, only service containers
+// read it. Shared files are secrets of a global service, whose containers
+// copy them to SharedSecretsDir on their node, which the plugin shares with
+// the host.
+
+package dockerops
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/types/swarm"
+)
+
+const (
+	// secretsAPIVersion: docker engine 1.13 and above support secrets
+	secretsAPIVersion = "v1.25"
+	// dockerSocketPath: Unix socket on which Docker engine is listening
+	dockerSocketPath = "/var/run/docker.sock"
+	// Prefix of names of the secrets of volumes
+	secretNamePrefix = "vFileSecret"
+	// Where secrets are found in service containers
+	secretsDir = "/run/secrets/"
+	// SharedSecretsDir is where ShareSecrets copies files on the nodes
+	SharedSecretsDir = "/var/run/vfile/shared"
+	// Prefix of names of the services and secrets sharing files
+	sharingNamePrefix = "vFileShared"
+	// Where sharing services mount /var/run of their host
+	sharingHostRun = "/host/run"
+)
+
+// apiError is an error response from Docker
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("Error response from daemon (%d): %s", e.status, e.message)
+}
+
+// secretReference gives a service access to a secret, as a file
+type secretReference struct {
+	File struct {
+		Name string
+		UID  string
+		GID  string
+		Mode uint32
+	}
+	SecretID   string
+	SecretName string
+}
+
+// newAPIClient returns an HTTP client talking to Docker over its Unix socket
+func newAPIClient() *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", dockerSocketPath)
+		},
+	}}
+}
+
+// apiRequest sends a request to the Docker API, and decodes the JSON response in result
+func (d *dockerEngine) apiRequest(method string, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "http://docker/"+secretsAPIVersion+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := d.apiClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return &apiError{status: resp.StatusCode, message: string(bytes.TrimSpace(msg))}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// createSecret creates a secret holding data, returns its ID
+func (d *dockerEngine) createSecret(name string, data []byte) (string, error) {
+	spec := struct {
+		Name string
+		Data []byte // base64 encoded by json
+	}{name, data}
+	var resp struct{ ID string }
+	err := d.apiRequest("POST", "/secrets/create", spec, &resp)
+	return resp.ID, err
+}
+
+// removeSecret removes a secret, removing a missing secret is not an error
+func (d *dockerEngine) removeSecret(name string) error {
+	err := d.apiRequest("DELETE", "/secrets/"+name, nil, nil)
+	if apiErr, ok := err.(*apiError); ok && apiErr.status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// newSecretReference returns the reference to a secret read from file in secretsDir
+func newSecretReference(secretID string, secretName string, file string) secretReference {
+	ref := secretReference{SecretID: secretID, SecretName: secretName}
+	ref.File.Name = file
+	ref.File.UID = "0"
+	ref.File.GID = "0"
+	ref.File.Mode = 0400
+	return ref
+}
+
+// createServiceWithSecrets creates a service whose containers read the secrets
+// from secretsDir, returns the ID of the service
+func (d *dockerEngine) createServiceWithSecrets(service swarm.ServiceSpec, secrets []secretReference) (string, error) {
+	// Add the secrets to the spec as the API expects them
+	data, err := json.Marshal(service)
+	if err != nil {
+		return "", err
+	}
+	var spec map[string]interface{}
+	if err = json.Unmarshal(data, &spec); err != nil {
+		return "", err
+	}
+	taskTemplate, _ := spec["TaskTemplate"].(map[string]interface{})
+	containerSpec, _ := taskTemplate["ContainerSpec"].(map[string]interface{})
+	if containerSpec == nil {
+		return "", fmt.Errorf("No container spec in service %s", service.Name)
+	}
+	containerSpec["Secrets"] = secrets
+
+	var resp struct{ ID string }
+	err = d.apiRequest("POST", "/services/create", spec, &resp)
+	return resp.ID, err
+}
+
+// removeService removes a service, removing a missing service is not an error
+func (d *dockerEngine) removeService(name string) error {
+	err := d.apiRequest("DELETE", "/services/"+name, nil, nil)
+	if apiErr, ok := err.(*apiError); ok && apiErr.status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// listSecrets returns the names of the secrets whose name starts with prefix
+func (d *dockerEngine) listSecrets(prefix string) ([]string, error) {
+	filters, err := json.Marshal(map[string][]string{"name": {prefix}})
+	if err != nil {
+		return nil, err
+	}
+	var secrets []struct {
+		Spec struct{ Name string }
+	}
+	err = d.apiRequest("GET", "/secrets?filters="+url.QueryEscape(string(filters)), nil, &secrets)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, secret := range secrets {
+		// The name filter of Docker also matches in the middle of names
+		if strings.HasPrefix(secret.Spec.Name, prefix) {
+			names = append(names, secret.Spec.Name)
+		}
+	}
+	return names, nil
+}
+
+// ShareSecrets - see DockerOps. Each file is a secret of the global service
+// of the share, whose containers copy the files to SharedSecretsDir on their
+// node and keep running, so that nodes joining later or rebooted get them.
+func (d *dockerEngine) ShareSecrets(name string, files map[string][]byte, managersOnly bool) error {
+	serviceName := sharingNamePrefix + name
+	// Secrets cannot be changed, nor removed while a service uses them,
+	// each share gets secrets of its own
+	prefix := serviceName + "-"
+	generation := prefix + strconv.FormatInt(time.Now().UnixNano(), 10) + "-"
+	oldSecrets, err := d.listSecrets(prefix)
+	if err != nil {
+		return err
+	}
+
+	var fileNames []string
+	for file := range files {
+		fileNames = append(fileNames, file)
+	}
+	sort.Strings(fileNames)
+	var refs []secretReference
+	for _, file := range fileNames {
+		secretName := generation + file
+		secretID, err := d.createSecret(secretName, files[file])
+		if err != nil {
+			return err
+		}
+		refs = append(refs, newSecretReference(secretID, secretName, file))
+	}
+
+	var service swarm.ServiceSpec
+	service.Name = serviceName
+	service.Mode = swarm.ServiceMode{Global: &swarm.GlobalService{}}
+	if managersOnly {
+		service.TaskTemplate.Placement = &swarm.Placement{
+			Constraints: []string{"node.role == manager"},
+		}
+	}
+	// The file server image is loaded on every node, and has a shell.
+	// Files are renamed in place so that the plugin never reads half of one.
+	dir := sharingHostRun + strings.TrimPrefix(SharedSecretsDir, "/var/run")
+	script := fmt.Sprintf("umask 077 && mkdir -p %[1]s && "+
+		"for f in %[2]s*; do n=$(basename \"$f\"); cp \"$f\" %[1]s/.$n && mv %[1]s/.$n %[1]s/$n; done && "+
+		"exec tail -f /dev/null", dir, secretsDir)
+	service.TaskTemplate.ContainerSpec = swarm.ContainerSpec{
+		Image:   sambaImageName,
+		Command: []string{"sh", "-c", script},
+		Mounts: []swarm.Mount{{
+			Type:   swarm.MountTypeBind,
+			Source: "/var/run",
+			Target: sharingHostRun,
+		}},
+	}
+
+	if err = d.removeService(serviceName); err != nil {
+		return err
+	}
+	if _, err = d.createServiceWithSecrets(service, refs); err != nil {
+		return err
+	}
+
+	// The containers of the old service may still use its secrets, the
+	// next share removes those left
+	for _, secretName := range oldSecrets {
+		if err = d.removeSecret(secretName); err != nil {
+			log.Warningf("Failed to remove secret %s of the previous share. Reason: %v",
+				secretName, err)
+		}
+	}
+	return nil
+}
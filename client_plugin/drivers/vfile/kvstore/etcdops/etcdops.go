@@ -18,9 +18,12 @@ package etcdops
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"os"
 	"os/exec"
 	"strconv"
 	"strings"
@@ -28,8 +31,12 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	etcdClient "github.com/coreos/etcd/clientv3"
+	"github.com/docker/go-connections/tlsconfig"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/credentials"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/dockerops"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/kvstore"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/metrics"
 )
 
 /*
@@ -38,6 +45,7 @@ import (
    etcdClusterToken:           ID of the cluster to create/join
    etcdListenURL:              etcd listening interface
    etcdScheme:                 Protocol used for communication
+   etcdTLSScheme:              Protocol used for communication with TLS
    etcdClusterStateNew:        Used to indicate the formation of a new
                                cluster
    etcdClusterStateExisting:   Used to indicate that this node is joining
@@ -49,8 +57,8 @@ import (
    gcTicker:                   ticker for garbage collector to run a collection
    etcdClientCreateError:      Error indicating failure to create etcd client
    swarmUnhealthyErrorMsg:     Message indicating swarm cluster is unhealthy
-   etcdSingleRef:              if global refcount 0 -> 1, start SMB server
-   etcdNoRef:                  if global refcount 1 -> 0, shut down SMB server
+   etcdSingleRef:              if global refcount 0 -> 1, start file server
+   etcdNoRef:                  if global refcount 1 -> 0, shut down file server
 */
 const (
 	etcdClientPort           = ":2379"
@@ -58,6 +66,7 @@ const (
 	etcdClusterToken         = "vfile-etcd-cluster"
 	etcdListenURL            = "0.0.0.0"
 	etcdScheme               = "http://"
+	etcdTLSScheme            = "https://"
 	etcdClusterStateNew      = "new"
 	etcdClusterStateExisting = "existing"
 	etcdRequestTimeout       = 2 * time.Second
@@ -68,12 +77,36 @@ const (
 	swarmUnhealthyErrorMsg   = "Swarm cluster maybe unhealthy"
 	etcdSingleRef            = "1"
 	etcdNoRef                = "0"
+
+	// Results of volume state changes
+	stateChangeConflict = "conflict" // the volume was not in the expected state
 )
 
+var stateTransitions = metrics.NewCounterVec("vfile_state_transitions_total",
+	"Attempted vFile volume state changes.", "from", "to", "result")
+
+// recordStateTransition counts a compare and put of a volume state key
+func recordStateTransition(key string, oldVal string, newVal string, err error, succeeded bool) {
+	if !strings.HasPrefix(key, kvstore.VolPrefixState) {
+		return
+	}
+	result := metrics.Result(err)
+	if err == nil && !succeeded {
+		result = stateChangeConflict
+	}
+	stateTransitions.Inc(oldVal, newVal, result)
+}
+
 type EtcdKVS struct {
-	dockerOps *dockerops.DockerOps
+	dockerOps dockerops.DockerOps
 	nodeID    string
 	nodeAddr  string
+	states    *volumeStates
+	// Client configuration of an external etcd cluster, nil with the
+	// etcd cluster embedded in swarm managers
+	external *etcdClient.Config
+	// Certificates of the embedded etcd, nil without TLS
+	etcdTLS *embeddedTLS
 }
 
 // vFileVolConnectivityData - Contains metadata of vFile volumes
@@ -82,13 +115,22 @@ type vFileVolConnectivityData struct {
 	ServiceName string   `json:"serviceName,omitempty"`
 	Username    string   `json:"username,omitempty"`
 	Password    string   `json:"password,omitempty"`
+	Credentials string   `json:"credentials,omitempty"`
+	Protocol    string   `json:"protocol,omitempty"`
+	ServerAddr  string   `json:"serverAddr,omitempty"`
 	ClientList  []string `json:"clientList,omitempty"`
 }
 
-// NewKvStore function: start or join ETCD cluster depending on the role of the node
-func NewKvStore(dockerOps *dockerops.DockerOps) *EtcdKVS {
+// NewKvStore function: start or join ETCD cluster depending on the role of the node,
+// or connect to the external etcd cluster of the configuration. sealer opens the
+// credentials of volumes for their file servers.
+func NewKvStore(dockerOps dockerops.DockerOps, cfg config.Config, sealer *credentials.Sealer) *EtcdKVS {
 	var e *EtcdKVS
 
+	if len(cfg.EtcdEndpoints) != 0 {
+		return newExternalKvStore(dockerOps, cfg, sealer)
+	}
+
 	// get swarm info from docker client
 	nodeID, addr, isManager, err := dockerOps.GetSwarmInfo()
 	if err != nil {
@@ -103,8 +145,23 @@ func NewKvStore(dockerOps *dockerops.DockerOps) *EtcdKVS {
 		nodeID:    nodeID,
 		nodeAddr:  addr,
 	}
+	e.states = newVolumeStates(e, dockerOps, sealer, serverAddr(cfg, addr))
 
 	if !isManager {
+		if err = e.setupTLS(cfg, false, false); err != nil {
+			log.WithFields(
+				log.Fields{"nodeID": nodeID, "error": err},
+			).Error("Failed to set up TLS to ETCD ")
+			return nil
+		}
+		// Workers stop the file servers they run on hosts
+		if e.states.serverAddr != "" {
+			cli := e.createEtcdClient()
+			if cli == nil {
+				return nil
+			}
+			go e.etcdWatcher(cli)
+		}
 		log.WithFields(
 			log.Fields{"nodeID": nodeID},
 		).Info("Swarm node role: worker. Return from NewKvStore ")
@@ -122,6 +179,13 @@ func NewKvStore(dockerOps *dockerops.DockerOps) *EtcdKVS {
 		return nil
 	}
 
+	if err = e.setupTLS(cfg, true, isLeader); err != nil {
+		log.WithFields(
+			log.Fields{"nodeID": nodeID, "error": err},
+		).Error("Failed to set up TLS of ETCD ")
+		return nil
+	}
+
 	// if leader, proceed to start ETCD cluster
 	if isLeader {
 		log.WithFields(
@@ -161,26 +225,158 @@ func NewKvStore(dockerOps *dockerops.DockerOps) *EtcdKVS {
 	return e
 }
 
+// newExternalKvStore returns the KV store on the external etcd cluster of the
+// configuration, neither the embedded etcd nor Swarm are needed
+func newExternalKvStore(dockerOps dockerops.DockerOps, cfg config.Config, sealer *credentials.Sealer) *EtcdKVS {
+	clientCfg := &etcdClient.Config{
+		Endpoints:   cfg.EtcdEndpoints,
+		DialTimeout: etcdRequestTimeout,
+		Username:    cfg.EtcdUsername,
+		Password:    cfg.EtcdPassword,
+	}
+	if cfg.EtcdCACert != "" || cfg.EtcdClientCert != "" {
+		tlsCfg, err := tlsconfig.Client(tlsconfig.Options{
+			CAFile:   cfg.EtcdCACert,
+			CertFile: cfg.EtcdClientCert,
+			KeyFile:  cfg.EtcdClientKey,
+		})
+		if err != nil {
+			log.WithFields(
+				log.Fields{"error": err},
+			).Error("Failed to load TLS configuration of etcd client ")
+			return nil
+		}
+		clientCfg.TLS = tlsCfg
+	}
+	e := &EtcdKVS{
+		dockerOps: dockerOps,
+		external:  clientCfg,
+	}
+
+	// Check that etcd can be reached before handling volumes
+	cli := e.createEtcdClient()
+	if cli == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	_, err := cli.Get(ctx, kvstore.VolPrefixState, etcdClient.WithPrefix(), etcdClient.WithCountOnly())
+	cancel()
+	if err != nil {
+		log.WithFields(
+			log.Fields{"endpoints": cfg.EtcdEndpoints, "error": err},
+		).Error("Failed to reach external etcd cluster ")
+		cli.Close()
+		return nil
+	}
+
+	// File servers run as services are started and stopped by swarm managers
+	// as with the embedded etcd, those run on hosts by any host
+	isManager := true
+	if config.FileServerPlacement(cfg) == config.FileServersOnSwarm {
+		e.nodeID, e.nodeAddr, isManager, err = dockerOps.GetSwarmInfo()
+		if err != nil {
+			log.WithFields(
+				log.Fields{"error": err},
+			).Error("Failed to get swarm Info from docker client ")
+			cli.Close()
+			return nil
+		}
+	} else {
+		e.nodeID, _ = os.Hostname()
+		e.nodeAddr = cfg.AdvertiseAddr
+		if e.nodeAddr == "" {
+			e.nodeAddr, err = localAddr(cfg.EtcdEndpoints[0])
+			if err != nil {
+				log.WithFields(
+					log.Fields{"error": err},
+				).Error("Failed to find address of this host, set AdvertiseAddr ")
+				cli.Close()
+				return nil
+			}
+		}
+	}
+	e.states = newVolumeStates(e, dockerOps, sealer, serverAddr(cfg, e.nodeAddr))
+
+	log.WithFields(
+		log.Fields{"endpoints": cfg.EtcdEndpoints, "nodeID": e.nodeID, "addr": e.nodeAddr},
+	).Info("Using external etcd cluster ")
+	if !isManager {
+		cli.Close()
+		return e
+	}
+	// Every host gets the refcount changes, a file server is stopped by the
+	// host running it, and started by the host mounting its volume
+	go e.etcdWatcher(cli)
+	go e.serviceAndVolumeGC(cli)
+	return e
+}
+
+// localAddr returns the address of this host on the route to an etcd endpoint
+func localAddr(endpoint string) (string, error) {
+	host := endpoint
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+len("://"):]
+	}
+	conn, err := net.Dial("udp", host)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+// serverAddr returns the address clients mount volumes whose file servers run
+// on this host from, empty if file servers run as services
+func serverAddr(cfg config.Config, nodeAddr string) string {
+	if config.FileServerPlacement(cfg) != config.FileServersOnHost {
+		return ""
+	}
+	return nodeAddr
+}
+
 // startEtcdCluster function is called by swarm leader to start a ETCD cluster
 func (e *EtcdKVS) startEtcdCluster() error {
 	nodeID := e.nodeID
 	nodeAddr := e.nodeAddr
+	scheme := e.scheme()
 	lines := []string{
 		"--name", nodeID,
-		"--advertise-client-urls", etcdScheme + nodeAddr + etcdClientPort,
-		"--initial-advertise-peer-urls", etcdScheme + nodeAddr + etcdPeerPort,
-		"--listen-client-urls", etcdScheme + etcdListenURL + etcdClientPort,
-		"--listen-peer-urls", etcdScheme + etcdListenURL + etcdPeerPort,
+		"--advertise-client-urls", scheme + nodeAddr + etcdClientPort,
+		"--initial-advertise-peer-urls", scheme + nodeAddr + etcdPeerPort,
+		"--listen-client-urls", scheme + etcdListenURL + etcdClientPort,
+		"--listen-peer-urls", scheme + etcdListenURL + etcdPeerPort,
 		"--initial-cluster-token", etcdClusterToken,
-		"--initial-cluster", nodeID + "=" + etcdScheme + nodeAddr + etcdPeerPort,
+		"--initial-cluster", nodeID + "=" + scheme + nodeAddr + etcdPeerPort,
 		"--initial-cluster-state", etcdClusterStateNew,
 	}
+	if e.etcdTLS != nil {
+		lines = append(lines, e.etcdTLS.etcdFlags()...)
+	}
 
 	// start the routine to create an etcd cluster
 	go etcdService(lines)
 
 	// check if etcd cluster is successfully started, then start the watcher
-	return e.checkLocalEtcd()
+	if err := e.checkLocalEtcd(); err != nil {
+		return err
+	}
+	if e.etcdTLS == nil {
+		return nil
+	}
+
+	// with TLS, clients are authenticated by their certificate
+	etcd, err := addrToEtcdClient(nodeAddr, e.clientTLS())
+	if err != nil {
+		return err
+	}
+	defer etcd.Close()
+	if err = enableEtcdAuth(etcd); err != nil {
+		log.WithFields(
+			log.Fields{"nodeID": nodeID, "error": err},
+		).Error("Failed to enable ETCD authentication ")
+		return err
+	}
+	return nil
 }
 
 // joinEtcdCluster function is called by a non-leader swarm manager to join a ETCD cluster
@@ -188,7 +384,7 @@ func (e *EtcdKVS) joinEtcdCluster(leaderAddr string) error {
 	nodeAddr := e.nodeAddr
 	nodeID := e.nodeID
 
-	etcd, err := addrToEtcdClient(leaderAddr)
+	etcd, err := addrToEtcdClient(leaderAddr, e.clientTLS())
 	if err != nil {
 		log.WithFields(
 			log.Fields{"nodeAddr": nodeAddr,
@@ -211,7 +407,8 @@ func (e *EtcdKVS) joinEtcdCluster(leaderAddr string) error {
 		return err
 	}
 
-	peerAddr := etcdScheme + nodeAddr + etcdPeerPort
+	scheme := e.scheme()
+	peerAddr := scheme + nodeAddr + etcdPeerPort
 	existing := false
 	for _, member := range lresp.Members {
 		// loop all current etcd members to find if there is already a member with the same peerAddr
@@ -279,14 +476,17 @@ func (e *EtcdKVS) joinEtcdCluster(leaderAddr string) error {
 
 	lines := []string{
 		"--name", nodeID,
-		"--advertise-client-urls", etcdScheme + nodeAddr + etcdClientPort,
-		"--initial-advertise-peer-urls", etcdScheme + nodeAddr + etcdPeerPort,
-		"--listen-client-urls", etcdScheme + etcdListenURL + etcdClientPort,
-		"--listen-peer-urls", etcdScheme + etcdListenURL + etcdPeerPort,
+		"--advertise-client-urls", scheme + nodeAddr + etcdClientPort,
+		"--initial-advertise-peer-urls", scheme + nodeAddr + etcdPeerPort,
+		"--listen-client-urls", scheme + etcdListenURL + etcdClientPort,
+		"--listen-peer-urls", scheme + etcdListenURL + etcdPeerPort,
 		"--initial-cluster-token", etcdClusterToken,
-		"--initial-cluster", initCluster + nodeID + "=" + etcdScheme + nodeAddr + etcdPeerPort,
+		"--initial-cluster", initCluster + nodeID + "=" + scheme + nodeAddr + etcdPeerPort,
 		"--initial-cluster-state", etcdClusterStateExisting,
 	}
+	if e.etcdTLS != nil {
+		lines = append(lines, e.etcdTLS.etcdFlags()...)
+	}
 
 	// start the routine for joining an etcd cluster
 	go etcdService(lines)
@@ -317,7 +517,7 @@ func (e *EtcdKVS) checkLocalEtcd() error {
 		select {
 		case <-ticker.C:
 			log.Infof("Checking ETCD client is started")
-			cli, err := addrToEtcdClient(e.nodeAddr)
+			cli, err := addrToEtcdClient(e.nodeAddr, e.clientTLS())
 			if err != nil {
 				log.WithFields(
 					log.Fields{"nodeAddr": e.nodeAddr,
@@ -400,7 +600,7 @@ func (e *EtcdKVS) cleanOrphanServiceAndVolume(volumesToVerify []string, stopServ
 			state == string(kvstore.VolStateDeleting) {
 			if stopService {
 				log.Warningf("The service for vFile volume %s needs to be shutdown.", volName)
-				e.dockerOps.StopSMBServer(volName)
+				e.dockerOps.StopFileServer(volName)
 			}
 
 			log.Warningf("The internal volume of vFile volume %s needs to be removed.", volName)
@@ -409,141 +609,312 @@ func (e *EtcdKVS) cleanOrphanServiceAndVolume(volumesToVerify []string, stopServ
 	}
 }
 
+// volumeStates moves volumes through their states as their global refcount
+// changes, starting and stopping their file servers. It only uses the KvStore
+// interface, so it works the same with etcd and with other KV stores.
+type volumeStates struct {
+	kvStore   kvstore.KvStore
+	dockerOps dockerops.DockerOps
+	sealer    *credentials.Sealer
+	// Address of this host if file servers run on hosts, empty if they
+	// run as services
+	serverAddr string
+}
+
+func newVolumeStates(kvStore kvstore.KvStore, dockerOps dockerops.DockerOps, sealer *credentials.Sealer, serverAddr string) *volumeStates {
+	return &volumeStates{
+		kvStore:    kvStore,
+		dockerOps:  dockerOps,
+		sealer:     sealer,
+		serverAddr: serverAddr,
+	}
+}
+
+// RefcountHandler returns a handler of the global refcount changes of volumes
+// in kvStore, doing what the etcd watcher of swarm managers does. The handler
+// takes the key put, its previous value and its new value. sealer opens the
+// credentials of volumes. serverAddr is the address of the host if file servers
+// run on hosts, empty otherwise.
+func RefcountHandler(kvStore kvstore.KvStore, dockerOps dockerops.DockerOps, sealer *credentials.Sealer, serverAddr string) func(key string, prevVal string, val string) {
+	return newVolumeStates(kvStore, dockerOps, sealer, serverAddr).refcountChanged
+}
+
+// FileServerHost starts the file servers of volumes mounted on this host, when
+// file servers run on hosts
+type FileServerHost interface {
+	// MountRequested starts the file server of a volume on this host, if
+	// it is not mounted yet. The host which increased the global refcount
+	// of the volume calls it.
+	MountRequested(volName string)
+	// TakeOver starts the file server of a mounted volume on this host, if
+	// it still runs on staleAddr, a host which cannot be reached
+	TakeOver(volName string, staleAddr string)
+}
+
+// NewFileServerHost returns the FileServerHost of the host at serverAddr for
+// the volumes of kvStore, as the etcd KV store does. sealer opens the
+// credentials of volumes.
+func NewFileServerHost(kvStore kvstore.KvStore, dockerOps dockerops.DockerOps, sealer *credentials.Sealer, serverAddr string) FileServerHost {
+	return newVolumeStates(kvStore, dockerOps, sealer, serverAddr)
+}
+
+// FileServerHost returns the FileServerHost of this host, nil if file servers
+// run as services
+func (e *EtcdKVS) FileServerHost() FileServerHost {
+	if e.states.serverAddr == "" {
+		return nil
+	}
+	return e.states
+}
+
 // etcdEventHandler function handles the returned event from etcd watcher of global refcount changes
 func (e *EtcdKVS) etcdEventHandler(ev *etcdClient.Event) {
 	log.WithFields(
 		log.Fields{"type": ev.Type},
 	).Infof("Watcher on global refcount returns event ")
 
-	nested := func(key string, fromState kvstore.VolStatus,
-		toState kvstore.VolStatus, interimState kvstore.VolStatus,
-		fn func(string) (int, string, bool)) {
-
-		// watcher observes global refcount critical change
-		// transactional edit state first
-		volName := strings.TrimPrefix(key, kvstore.VolPrefixGRef)
-		succeeded := e.CompareAndPutStateOrBusywait(kvstore.VolPrefixState+volName,
-			string(fromState), string(interimState))
-		if !succeeded {
-			// this handler doesn't get the right to start/stop server
+	// What we want to monitor are PUT requests on global refcount
+	// Not delete, not get, not anything else
+	if ev.Type == etcdClient.EventTypePut && ev.PrevKv != nil {
+		e.states.refcountChanged(string(ev.Kv.Key), string(ev.PrevKv.Value), string(ev.Kv.Value))
+	}
+}
+
+// refcountChanged handles the change of a global refcount key from prevVal to val
+func (s *volumeStates) refcountChanged(key string, prevVal string, val string) {
+	if val == etcdSingleRef && prevVal == etcdNoRef {
+		// Refcount went 0 -> 1
+		// A file server running on a host is started by the host
+		// mounting the volume, see MountRequested
+		if s.serverAddr != "" {
+			return
+		}
+		s.transition(key, kvstore.VolStateReady,
+			kvstore.VolStateMounted, kvstore.VolStateMounting,
+			s.startFileServer)
+	} else if val == etcdNoRef && prevVal == etcdSingleRef {
+		// Refcount went 1 -> 0
+		// A file server running on a host is stopped by that host
+		if s.serverAddr != "" && !s.servesVolume(strings.TrimPrefix(key, kvstore.VolPrefixGRef)) {
 			return
 		}
+		s.transition(key, kvstore.VolStateMounted,
+			kvstore.VolStateReady, kvstore.VolStateUnmounting,
+			s.dockerOps.StopFileServer)
+	}
+}
 
-		port, servName, succeeded := fn(volName)
-		if succeeded {
-			// Either starting or stopping SMB
-			// server succeeded.
-			// Update volume metadata to reflect
-			// port number and file service name.
-			var entries []kvstore.KvPair
-			var writeEntries []kvstore.KvPair
-			var volRecord vFileVolConnectivityData
-
-			// Port, Server name, Client list, Samba
-			// username/password are in the same key.
-			// Must fetch this key to know the value
-			// of other fields before rewriting them.
-			keys := []string{
-				kvstore.VolPrefixInfo + volName,
-			}
-			entries, err := e.ReadMetaData(keys)
-			if err != nil {
-				// Failed to fetch existing metadata on the volume
-				// Set volume state to error as we cannot
-				// proceed
-				log.Warningf("Failed to read volume metadata before updating port information: %v",
-					err)
-				e.CompareAndPut(kvstore.VolPrefixState+volName,
-					string(interimState),
-					string(kvstore.VolStateError))
-				return
-			}
-			err = json.Unmarshal([]byte(entries[0].Value), &volRecord)
-			if err != nil {
-				// Failed to unmarshal record from JSON
-				// Set volume state to error as we cannot
-				// proceed
-				log.Warningf("Failed to unmarshal JSON for reading existing metadata: %v",
-					err)
-				e.CompareAndPut(kvstore.VolPrefixState+volName,
-					string(interimState),
-					string(kvstore.VolStateError))
-				return
-			}
-			// Rewrite the port number and service name
-			// then marshal the data structure to JSON again.
-			volRecord.Port = port
-			volRecord.ServiceName = servName
-			byteRecord, err := json.Marshal(volRecord)
-			if err != nil {
-				// Failed to marshal record as JSON
-				// Set volume state to error as we cannot
-				// proceed
-				log.Warningf("Failed to marshal JSON for writing metadata: %v",
-					err)
-				e.CompareAndPut(kvstore.VolPrefixState+volName,
-					string(interimState),
-					string(kvstore.VolStateError))
-				return
-			}
-			writeEntries = append(writeEntries, kvstore.KvPair{
-				Key:   kvstore.VolPrefixInfo + volName,
-				Value: string(byteRecord)})
+// transition moves the volume of a global refcount key from fromState to
+// toState through interimState, running fn in between
+func (s *volumeStates) transition(key string, fromState kvstore.VolStatus,
+	toState kvstore.VolStatus, interimState kvstore.VolStatus,
+	fn func(string) (int, string, bool)) {
+
+	// watcher observes global refcount critical change
+	// transactional edit state first
+	volName := strings.TrimPrefix(key, kvstore.VolPrefixGRef)
+	succeeded := s.kvStore.CompareAndPutStateOrBusywait(kvstore.VolPrefixState+volName,
+		string(fromState), string(interimState))
+	if !succeeded {
+		// this handler doesn't get the right to start/stop server
+		return
+	}
 
-			log.Infof("Updating port and file service name for %s", volName)
-			err = e.WriteMetaData(writeEntries)
-			if err != nil {
-				// Failed to write metadata.
-				// Set volume state to error as we cannot
-				// proceed
-				log.Warningf("Failed to write metadata for volume %s",
-					volName)
-				e.CompareAndPut(kvstore.VolPrefixState+volName,
-					string(interimState),
-					string(kvstore.VolStateError))
-				return
-			}
+	port, servName, succeeded := fn(volName)
+	if !succeeded {
+		// failed to start/stop server, set to state Error
+		s.kvStore.CompareAndPut(kvstore.VolPrefixState+volName,
+			string(interimState),
+			string(kvstore.VolStateError))
+		return
+	}
+	// Clients mount from the host running the file server, if any
+	serverAddr := ""
+	if toState == kvstore.VolStateMounted {
+		serverAddr = s.serverAddr
+	}
+	s.serverChanged(volName, port, servName, serverAddr, interimState, toState)
+}
 
-			// server start/stop succeed. Set desired state on volume.
-			stateUpdateResult := e.CompareAndPut(kvstore.VolPrefixState+volName,
-				string(interimState),
-				string(toState))
-			if stateUpdateResult == false {
-				// Could not set desired state on volume
-				// set to state Error
-				e.CompareAndPut(kvstore.VolPrefixState+volName,
-					string(interimState),
-					string(kvstore.VolStateError))
-			}
-		} else {
-			// failed to start/stop server, set to state Error
-			e.CompareAndPut(kvstore.VolPrefixState+volName,
-				string(interimState),
-				string(kvstore.VolStateError))
-		}
+// serverChanged records the port, file service name and host address of the
+// file server of a volume, then moves it from interimState to toState, or to
+// the Error state if it cannot
+func (s *volumeStates) serverChanged(volName string, port int, servName string,
+	serverAddr string, interimState kvstore.VolStatus, toState kvstore.VolStatus) {
+	// Port, Server name, Client list, Samba
+	// username/password are in the same key.
+	// Must fetch this key to know the value
+	// of other fields before rewriting them.
+	var volRecord vFileVolConnectivityData
+	entries, err := s.kvStore.ReadMetaData([]string{kvstore.VolPrefixInfo + volName})
+	if err != nil {
+		// Failed to fetch existing metadata on the volume
+		// Set volume state to error as we cannot
+		// proceed
+		log.Warningf("Failed to read volume metadata before updating port information: %v",
+			err)
+		s.kvStore.CompareAndPut(kvstore.VolPrefixState+volName,
+			string(interimState),
+			string(kvstore.VolStateError))
 		return
 	}
+	err = json.Unmarshal([]byte(entries[0].Value), &volRecord)
+	if err != nil {
+		// Failed to unmarshal record from JSON
+		// Set volume state to error as we cannot
+		// proceed
+		log.Warningf("Failed to unmarshal JSON for reading existing metadata: %v",
+			err)
+		s.kvStore.CompareAndPut(kvstore.VolPrefixState+volName,
+			string(interimState),
+			string(kvstore.VolStateError))
+		return
+	}
+	// Rewrite the port number and service name
+	// then marshal the data structure to JSON again.
+	volRecord.Port = port
+	volRecord.ServiceName = servName
+	volRecord.ServerAddr = serverAddr
+	byteRecord, err := json.Marshal(volRecord)
+	if err != nil {
+		// Failed to marshal record as JSON
+		// Set volume state to error as we cannot
+		// proceed
+		log.Warningf("Failed to marshal JSON for writing metadata: %v",
+			err)
+		s.kvStore.CompareAndPut(kvstore.VolPrefixState+volName,
+			string(interimState),
+			string(kvstore.VolStateError))
+		return
+	}
+	writeEntries := []kvstore.KvPair{{
+		Key:   kvstore.VolPrefixInfo + volName,
+		Value: string(byteRecord)}}
 
-	// What we want to monitor are PUT requests on global refcount
-	// Not delete, not get, not anything else
-	if ev.Type == etcdClient.EventTypePut {
-		if string(ev.Kv.Value) == etcdSingleRef &&
-			ev.PrevKv != nil &&
-			string(ev.PrevKv.Value) == etcdNoRef {
-			// Refcount went 0 -> 1
-			nested(string(ev.Kv.Key), kvstore.VolStateReady,
-				kvstore.VolStateMounted, kvstore.VolStateMounting,
-				e.dockerOps.StartSMBServer)
-		} else if string(ev.Kv.Value) == etcdNoRef &&
-			ev.PrevKv != nil &&
-			string(ev.PrevKv.Value) == etcdSingleRef {
-			// Refcount went 1 -> 0
-			nested(string(ev.Kv.Key), kvstore.VolStateMounted,
-				kvstore.VolStateReady, kvstore.VolStateUnmounting,
-				e.dockerOps.StopSMBServer)
+	log.Infof("Updating port and file service name for %s", volName)
+	err = s.kvStore.WriteMetaData(writeEntries)
+	if err != nil {
+		// Failed to write metadata.
+		// Set volume state to error as we cannot
+		// proceed
+		log.Warningf("Failed to write metadata for volume %s",
+			volName)
+		s.kvStore.CompareAndPut(kvstore.VolPrefixState+volName,
+			string(interimState),
+			string(kvstore.VolStateError))
+		return
+	}
+
+	// server start/stop succeed. Set desired state on volume.
+	stateUpdateResult := s.kvStore.CompareAndPut(kvstore.VolPrefixState+volName,
+		string(interimState),
+		string(toState))
+	if stateUpdateResult == false {
+		// Could not set desired state on volume
+		// set to state Error
+		s.kvStore.CompareAndPut(kvstore.VolPrefixState+volName,
+			string(interimState),
+			string(kvstore.VolStateError))
+	}
+}
+
+// MountRequested starts the file server of a volume on this host, if file
+// servers run on hosts and the volume is not mounted yet. The host which
+// increased the global refcount calls it, so file servers run on hosts using
+// their volume.
+func (s *volumeStates) MountRequested(volName string) {
+	if s.serverAddr == "" {
+		return
+	}
+	s.transition(kvstore.VolPrefixGRef+volName, kvstore.VolStateReady,
+		kvstore.VolStateMounted, kvstore.VolStateMounting,
+		s.startFileServer)
+}
+
+// TakeOver starts the file server of a mounted volume on this host, if the KV
+// store still has it on staleAddr, a host which cannot be reached. The
+// internal volume of the file server can only be attached to one VM, and ESX
+// detaches it when its VM powers off, so the server cannot run twice.
+func (s *volumeStates) TakeOver(volName string, staleAddr string) {
+	if s.serverAddr == "" {
+		return
+	}
+	stateKey := kvstore.VolPrefixState + volName
+	if !s.kvStore.CompareAndPut(stateKey, string(kvstore.VolStateMounted),
+		string(kvstore.VolStateMounting)) {
+		// Another host is starting or stopping the file server
+		return
+	}
+
+	var volRecord vFileVolConnectivityData
+	entries, err := s.kvStore.ReadMetaData([]string{kvstore.VolPrefixInfo + volName})
+	if err == nil {
+		err = json.Unmarshal([]byte(entries[0].Value), &volRecord)
+	}
+	if err != nil || volRecord.ServerAddr != staleAddr {
+		// Another host took the file server over already
+		s.kvStore.CompareAndPut(stateKey, string(kvstore.VolStateMounting),
+			string(kvstore.VolStateMounted))
+		return
+	}
+
+	log.Warningf("File server of volume %s on %s cannot be reached, starting it on this host",
+		volName, staleAddr)
+	port, servName, succeeded := s.startFileServer(volName)
+	if !succeeded {
+		// The server may still run on its host, leave it there
+		s.kvStore.CompareAndPut(stateKey, string(kvstore.VolStateMounting),
+			string(kvstore.VolStateMounted))
+		return
+	}
+	s.serverChanged(volName, port, servName, s.serverAddr,
+		kvstore.VolStateMounting, kvstore.VolStateMounted)
+}
+
+// servesVolume tells if the file server of a volume runs on this host
+func (s *volumeStates) servesVolume(volName string) bool {
+	var volRecord vFileVolConnectivityData
+	entries, err := s.kvStore.ReadMetaData([]string{kvstore.VolPrefixInfo + volName})
+	if err == nil {
+		err = json.Unmarshal([]byte(entries[0].Value), &volRecord)
+	}
+	if err != nil {
+		log.Warningf("Failed to read metadata of volume %s: %v", volName, err)
+		return false
+	}
+	return volRecord.ServerAddr == s.serverAddr
+}
+
+// startFileServer starts the file server of a volume, for its protocol and credentials
+func (s *volumeStates) startFileServer(volName string) (int, string, bool) {
+	var volRecord vFileVolConnectivityData
+	entries, err := s.kvStore.ReadMetaData([]string{kvstore.VolPrefixInfo + volName})
+	if err == nil {
+		err = json.Unmarshal([]byte(entries[0].Value), &volRecord)
+	}
+	if err != nil {
+		log.Warningf("Failed to read metadata of volume %s: %v", volName, err)
+		return 0, "", false
+	}
+	server, err := dockerops.GetFileServer(volRecord.Protocol)
+	if err != nil {
+		log.Warningf("Cannot start file server of volume %s: %v", volName, err)
+		return 0, "", false
+	}
+	if !server.UsesSecret() {
+		return s.dockerOps.StartFileServer(volName, server, credentials.Credentials{})
+	}
+
+	// Volumes created before credentials were sealed have them in clear
+	creds := credentials.Credentials{Username: volRecord.Username, Password: volRecord.Password}
+	if volRecord.Credentials != "" {
+		creds, err = s.sealer.Open(volRecord.Credentials)
+		if err != nil {
+			log.Warningf("Failed to open credentials of volume %s: %v", volName, err)
+			return 0, "", false
 		}
 	}
-	return
+	return s.dockerOps.StartFileServer(volName, server, creds)
 }
 
 // CompareAndPut function: compare the value of the kay with oldVal
@@ -572,9 +943,11 @@ func (e *EtcdKVS) CompareAndPut(key string, oldVal string, newVal string) bool {
 				"Value to replace": newVal,
 				"Error":            err},
 		).Errorf("Failed to compare and put ")
+		recordStateTransition(key, oldVal, newVal, err, false)
 		return false
 	}
 
+	recordStateTransition(key, oldVal, newVal, nil, txresp.Succeeded)
 	return txresp.Succeeded
 }
 
@@ -609,6 +982,9 @@ func (e *EtcdKVS) CompareAndPutOrFetch(key string,
 				"Value to replace": newVal,
 				"Error":            err},
 		).Errorf("Failed to compare and put ")
+		recordStateTransition(key, oldVal, newVal, err, false)
+	} else {
+		recordStateTransition(key, oldVal, newVal, nil, txresp.Succeeded)
 	}
 	return txresp, err
 }
@@ -654,8 +1030,20 @@ func (e *EtcdKVS) CompareAndPutStateOrBusywait(key string, oldVal string, newVal
 	}
 }
 
-// createEtcdClient function creates an ETCD client according to swarm manager info
+// createEtcdClient function creates an ETCD client according to swarm manager info,
+// or to the configuration of the external etcd cluster
 func (e *EtcdKVS) createEtcdClient() *etcdClient.Client {
+	if e.external != nil {
+		etcd, err := etcdClient.New(*e.external)
+		if err != nil {
+			log.WithFields(
+				log.Fields{"endpoints": e.external.Endpoints, "error": err},
+			).Error("Failed to create etcd client of external cluster ")
+			return nil
+		}
+		return etcd
+	}
+
 	managers, err := e.dockerOps.GetSwarmManagers()
 	if err != nil {
 		log.WithFields(
@@ -665,7 +1053,7 @@ func (e *EtcdKVS) createEtcdClient() *etcdClient.Client {
 	}
 
 	for _, manager := range managers {
-		etcd, err := addrToEtcdClient(manager.Addr)
+		etcd, err := addrToEtcdClient(manager.Addr, e.clientTLS())
 		if err == nil {
 			return etcd
 		}
@@ -681,7 +1069,8 @@ func (e *EtcdKVS) createEtcdClient() *etcdClient.Client {
 // addrToEtcdClient function create a new Etcd client according to the input docker address
 // it can be used by swarm worker to get a Etcd client on swarm manager
 // or it can be used by swarm manager to get a Etcd client on swarm leader
-func addrToEtcdClient(addr string) (*etcdClient.Client, error) {
+// tlsCfg is the TLS configuration of the client, nil without TLS
+func addrToEtcdClient(addr string, tlsCfg *tls.Config) (*etcdClient.Client, error) {
 	// input address are RemoteManagers from docker info or ManagerStatus.Addr from docker inspect
 	// in the format of [host]:[docker manager port]
 	s := strings.Split(addr, ":")
@@ -689,6 +1078,7 @@ func addrToEtcdClient(addr string) (*etcdClient.Client, error) {
 	cfg := etcdClient.Config{
 		Endpoints:   []string{endpoint},
 		DialTimeout: etcdRequestTimeout,
+		TLS:         tlsCfg,
 	}
 
 	etcd, err := etcdClient.New(cfg)
@@ -786,9 +1176,9 @@ func (e *EtcdKVS) WriteMetaData(entries []kvstore.KvPair) error {
 	if err != nil {
 		msg = fmt.Sprintf("Failed to write metadata: %v.", err)
 		if err == context.DeadlineExceeded {
-			msg += fmt.Sprintf(swarmUnhealthyErrorMsg)
+			msg += swarmUnhealthyErrorMsg
 		}
-		log.Warningf(msg)
+		log.Warning(msg)
 		return errors.New(msg)
 	}
 	return nil
@@ -821,9 +1211,9 @@ func (e *EtcdKVS) ReadMetaData(keys []string) ([]kvstore.KvPair, error) {
 	if err != nil {
 		msg := fmt.Sprintf("Transactional metadata read failed: %v.", err)
 		if err == context.DeadlineExceeded {
-			msg += fmt.Sprintf(swarmUnhealthyErrorMsg)
+			msg += swarmUnhealthyErrorMsg
 		}
-		log.Warningf(msg)
+		log.Warning(msg)
 		return entries, errors.New(msg)
 	}
 
@@ -848,8 +1238,8 @@ func (e *EtcdKVS) ReadMetaData(keys []string) ([]kvstore.KvPair, error) {
 	} else if missedCount > 0 {
 		// This should not happen
 		// There is a volume but we couldn't read all its keys
-		msg := fmt.Sprintf("Failed to get volume. Couldn't find all keys!")
-		log.Warningf(msg)
+		msg := "Failed to get volume. Couldn't find all keys!"
+		log.Warning(msg)
 		panic(msg)
 	}
 	return entries, nil
@@ -883,9 +1273,9 @@ func (e *EtcdKVS) DeleteMetaData(name string) error {
 	if err != nil {
 		msg = fmt.Sprintf("Failed to delete metadata for volume %s: %v", name, err)
 		if err == context.DeadlineExceeded {
-			msg += fmt.Sprintf(swarmUnhealthyErrorMsg)
+			msg += swarmUnhealthyErrorMsg
 		}
-		log.Warningf(msg)
+		log.Warning(msg)
 		return errors.New(msg)
 	}
 	return nil
@@ -984,6 +1374,43 @@ func (e *EtcdKVS) AtomicDecr(key string) error {
 	}
 }
 
+// PutIfAbsent - Create key with value if it does not exist, return the value of the key
+func (e *EtcdKVS) PutIfAbsent(key string, value string) (string, error) {
+	// Create a client to talk to etcd
+	client := e.createEtcdClient()
+	if client == nil {
+		return "", errors.New(etcdClientCreateError)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	txresp, err := client.Txn(ctx).If(
+		etcdClient.Compare(etcdClient.CreateRevision(key), "=", 0),
+	).Then(
+		etcdClient.OpPut(key, value),
+	).Else(
+		etcdClient.OpGet(key),
+	).Commit()
+	cancel()
+	if err != nil {
+		msg := fmt.Sprintf("Failed to put %s: %v.", key, err)
+		if err == context.DeadlineExceeded {
+			msg += swarmUnhealthyErrorMsg
+		}
+		log.Warning(msg)
+		return "", errors.New(msg)
+	}
+
+	if txresp.Succeeded {
+		return value, nil
+	}
+	resp := txresp.Responses[0].GetResponseRange()
+	if len(resp.Kvs) == 0 {
+		return "", fmt.Errorf("PutIfAbsent: no key found for %s", key)
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
 // BlockingWaitAndGet - Blocking wait until a key value becomes equal to a specific value
 // then read the value of another key
 func (e *EtcdKVS) BlockingWaitAndGet(key string, value string, newKey string) (string, error) {
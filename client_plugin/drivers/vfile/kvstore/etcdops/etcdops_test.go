@@ -0,0 +1,163 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdops
+
+import (
+	"encoding/json"
+	"testing"
+
+	etcdClient "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/credentials"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/dockerops"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/kvstore"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/kvstore/memkvs"
+)
+
+// refcountEvent returns the event of the etcd watcher for a global refcount change
+func refcountEvent(volName string, prevVal string, val string) *etcdClient.Event {
+	return &etcdClient.Event{
+		Type:   mvccpb.PUT,
+		Kv:     &mvccpb.KeyValue{Key: []byte(kvstore.VolPrefixGRef + volName), Value: []byte(val)},
+		PrevKv: &mvccpb.KeyValue{Key: []byte(kvstore.VolPrefixGRef + volName), Value: []byte(prevVal)},
+	}
+}
+
+func TestEtcdEventHandler(t *testing.T) {
+	kv := memkvs.NewKvStore()
+	ops := dockerops.NewMockDockerOps()
+	sealer := credentials.NewSealer(make([]byte, 32))
+	e := &EtcdKVS{dockerOps: ops, states: newVolumeStates(kv, ops, sealer, "")}
+
+	creds, _ := credentials.Generate()
+	sealed, err := e.states.sealer.Seal(creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := json.Marshal(vFileVolConnectivityData{Credentials: sealed})
+	kv.WriteMetaData([]kvstore.KvPair{
+		{Key: kvstore.VolPrefixState + "vol1", Value: string(kvstore.VolStateReady)},
+		{Key: kvstore.VolPrefixGRef + "vol1", Value: "1"},
+		{Key: kvstore.VolPrefixInfo + "vol1", Value: string(info)},
+	})
+	state := func() string {
+		entries, _ := kv.ReadMetaData([]string{kvstore.VolPrefixState + "vol1"})
+		return entries[0].Value
+	}
+
+	// First mount starts the file server with the credentials of the volume
+	e.etcdEventHandler(refcountEvent("vol1", "0", "1"))
+	assert.Equal(t, string(kvstore.VolStateMounted), state())
+	service, running := ops.Service("vol1")
+	if assert.True(t, running) {
+		assert.Equal(t, creds, service.Credentials)
+		assert.Equal(t, dockerops.ProtocolSMB, service.Protocol)
+	}
+	entries, _ := kv.ReadMetaData([]string{kvstore.VolPrefixInfo + "vol1"})
+	var volRecord vFileVolConnectivityData
+	assert.Nil(t, json.Unmarshal([]byte(entries[0].Value), &volRecord))
+	assert.Equal(t, service.Port, volRecord.Port)
+	assert.Equal(t, service.Name, volRecord.ServiceName)
+	assert.Equal(t, sealed, volRecord.Credentials, "Other fields are kept")
+
+	// More mounts change nothing
+	e.etcdEventHandler(refcountEvent("vol1", "1", "2"))
+	e.etcdEventHandler(refcountEvent("vol1", "2", "1"))
+	assert.Equal(t, string(kvstore.VolStateMounted), state())
+
+	// Last unmount stops it
+	e.etcdEventHandler(refcountEvent("vol1", "1", "0"))
+	assert.Equal(t, string(kvstore.VolStateReady), state())
+	_, running = ops.Service("vol1")
+	assert.False(t, running)
+
+	// Only puts of a refcount are handled
+	e.etcdEventHandler(&etcdClient.Event{Type: mvccpb.PUT,
+		Kv: &mvccpb.KeyValue{Key: []byte(kvstore.VolPrefixGRef + "vol1"), Value: []byte("1")}})
+	e.etcdEventHandler(&etcdClient.Event{Type: mvccpb.DELETE,
+		Kv:     &mvccpb.KeyValue{Key: []byte(kvstore.VolPrefixGRef + "vol1")},
+		PrevKv: &mvccpb.KeyValue{Key: []byte(kvstore.VolPrefixGRef + "vol1"), Value: []byte("0")}})
+	assert.Equal(t, string(kvstore.VolStateReady), state())
+
+	// The file server fails to start
+	ops.FailFileServers = true
+	e.etcdEventHandler(refcountEvent("vol1", "0", "1"))
+	assert.Equal(t, string(kvstore.VolStateError), state())
+}
+
+func TestFileServerHost(t *testing.T) {
+	kv := memkvs.NewKvStore()
+	ops := dockerops.NewMockDockerOps()
+	ops.NodeAddr = "10.0.0.2"
+	sealer := credentials.NewSealer(make([]byte, 32))
+	e := &EtcdKVS{dockerOps: ops, states: newVolumeStates(kv, ops, sealer, ops.NodeAddr)}
+	host := e.FileServerHost()
+
+	info, _ := json.Marshal(vFileVolConnectivityData{Protocol: dockerops.ProtocolNFS})
+	kv.WriteMetaData([]kvstore.KvPair{
+		{Key: kvstore.VolPrefixState + "vol1", Value: string(kvstore.VolStateReady)},
+		{Key: kvstore.VolPrefixGRef + "vol1", Value: "1"},
+		{Key: kvstore.VolPrefixInfo + "vol1", Value: string(info)},
+	})
+	volume := func() (string, vFileVolConnectivityData) {
+		var volRecord vFileVolConnectivityData
+		entries, _ := kv.ReadMetaData([]string{kvstore.VolPrefixState + "vol1", kvstore.VolPrefixInfo + "vol1"})
+		assert.Nil(t, json.Unmarshal([]byte(entries[1].Value), &volRecord))
+		return entries[0].Value, volRecord
+	}
+
+	// The refcount watcher leaves the start to the host mounting the volume
+	e.etcdEventHandler(refcountEvent("vol1", "0", "1"))
+	state, _ := volume()
+	assert.Equal(t, string(kvstore.VolStateReady), state)
+	host.MountRequested("vol1")
+	state, volRecord := volume()
+	assert.Equal(t, string(kvstore.VolStateMounted), state)
+	assert.Equal(t, ops.NodeAddr, volRecord.ServerAddr)
+	_, running := ops.Service("vol1")
+	assert.True(t, running)
+
+	// Mounted volumes are left as they are
+	host.MountRequested("vol1")
+	state, _ = volume()
+	assert.Equal(t, string(kvstore.VolStateMounted), state)
+
+	// Only a file server on another host is taken over
+	host.TakeOver("vol1", "10.0.0.1")
+	state, volRecord = volume()
+	assert.Equal(t, string(kvstore.VolStateMounted), state)
+	assert.Equal(t, ops.NodeAddr, volRecord.ServerAddr)
+
+	other := dockerops.NewMockDockerOps()
+	other.NodeAddr = "10.0.0.3"
+	otherHost := NewFileServerHost(kv, other, sealer, other.NodeAddr)
+	other.FailFileServers = true
+	otherHost.TakeOver("vol1", ops.NodeAddr)
+	state, volRecord = volume()
+	assert.Equal(t, string(kvstore.VolStateMounted), state, "Failed takeovers leave the server")
+	assert.Equal(t, ops.NodeAddr, volRecord.ServerAddr)
+	other.FailFileServers = false
+	otherHost.TakeOver("vol1", ops.NodeAddr)
+	state, volRecord = volume()
+	assert.Equal(t, string(kvstore.VolStateMounted), state)
+	assert.Equal(t, other.NodeAddr, volRecord.ServerAddr)
+	_, running = other.Service("vol1")
+	assert.True(t, running)
+
+	// File servers run as services have no FileServerHost
+	e.states.serverAddr = ""
+	assert.Nil(t, e.FileServerHost())
+}
@@ -0,0 +1,490 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// TLS and authentication of the embedded etcd cluster.
+//
+// The embedded etcd only serves TLS, to clients and to peers, and requires
+// client certificates. Swarm managers issue themselves their certificates from
+// the CA when the plugin starts: a server certificate for their address, also
+// used between peers, and a client certificate. The swarm leader generates the
+// CA if there is none yet.
+//
+// The leader shares the CA with the other nodes as Docker secrets: the CA
+// certificate and a client certificate for workers with all the nodes, the CA
+// key with managers only. Managers keep the CA they get in the configured
+// files, for when they become the leader. Workers never get the CA key, they
+// use the shared client certificate, or the one of the configuration.
+//
+// Once the cluster is started, the swarm leader enables etcd authentication.
+// Clients are authenticated by the common name of their certificate: root for
+// swarm managers, which manage the members of the cluster, vfile for other
+// nodes, which can only use the keys of vFile volumes.
+
+package etcdops
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	etcdClient "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/docker/go-connections/tlsconfig"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/dockerops"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
+)
+
+const (
+	// etcd users of swarm managers and of other nodes
+	etcdRootUser  = "root"
+	etcdVFileUser = "vfile"
+	// Prefix of all the keys of vFile volumes
+	etcdKeyPrefix = "SVOLS_"
+	// Validity of the generated CA and of the certificates issued by nodes
+	caValidity   = 10 * 365 * 24 * time.Hour
+	certValidity = 365 * 24 * time.Hour
+	// Names of the files shared by the swarm leader, with all the nodes and
+	// with managers only
+	sharedWithAll      = "Etcd"
+	sharedWithManagers = "EtcdCA"
+	// Files shared by the swarm leader
+	sharedCACert     = "etcd-ca.pem"
+	sharedCAKey      = "etcd-ca-key.pem"
+	sharedClientCert = "etcd-client.pem"
+	sharedClientKey  = "etcd-client-key.pem"
+)
+
+// certsDir is where nodes keep the certificates they issue themselves
+var certsDir = "/var/run/vfile/etcd"
+
+// sharedDir is where the files shared by the swarm leader are found
+var sharedDir = dockerops.SharedSecretsDir
+
+// sharedFilesTimeout bounds the wait for the files shared by the swarm leader
+var sharedFilesTimeout = etcdUpdateTimeout
+
+// embeddedTLS holds the certificates of this node for the embedded etcd
+type embeddedTLS struct {
+	caFile     string
+	serverCert string // server and peer certificate, managers only
+	serverKey  string
+	client     *tls.Config
+	// The CA, managers only
+	caKeyFile string
+	caCert    *x509.Certificate
+	caKey     crypto.Signer
+}
+
+// newEmbeddedTLS issues the certificates of a manager with address nodeAddr,
+// or finds those of a worker. The leader generates the CA if needed.
+func newEmbeddedTLS(cfg config.Config, nodeAddr string, isManager bool, isLeader bool) (*embeddedTLS, error) {
+	t := &embeddedTLS{caFile: cfg.EtcdCACert, caKeyFile: cfg.EtcdCAKey}
+	if t.caFile == "" {
+		t.caFile = config.DefaultEtcdCACert
+	}
+	if t.caKeyFile == "" {
+		t.caKeyFile = config.DefaultEtcdCAKey
+	}
+	certFile, keyFile := cfg.EtcdClientCert, cfg.EtcdClientKey
+	if isManager {
+		var err error
+		t.caCert, t.caKey, err = loadCA(t.caFile, t.caKeyFile, isLeader)
+		if err != nil {
+			return nil, err
+		}
+		ips := []net.IP{net.ParseIP(nodeAddr), net.IPv4(127, 0, 0, 1)}
+		usages := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		t.serverCert, t.serverKey, err = issueCert(t.caCert, t.caKey, "server", nodeAddr, ips, usages)
+		if err != nil {
+			return nil, err
+		}
+		certFile, keyFile, err = issueCert(t.caCert, t.caKey, "client", etcdRootUser, nil,
+			[]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Workers use the CA and client certificate shared by the leader,
+		// unless the configuration has theirs
+		if _, err := os.Stat(t.caFile); os.IsNotExist(err) {
+			t.caFile = filepath.Join(sharedDir, sharedCACert)
+		}
+		if certFile == "" {
+			certFile = filepath.Join(sharedDir, sharedClientCert)
+			keyFile = filepath.Join(sharedDir, sharedClientKey)
+		}
+		if err := waitForFiles(t.caFile, certFile, keyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := tlsconfig.Client(tlsconfig.Options{
+		CAFile:   t.caFile,
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.client = client
+	return t, nil
+}
+
+// etcdFlags returns the etcd flags of the server and peer TLS
+func (t *embeddedTLS) etcdFlags() []string {
+	return []string{
+		"--cert-file", t.serverCert,
+		"--key-file", t.serverKey,
+		"--client-cert-auth",
+		"--trusted-ca-file", t.caFile,
+		"--peer-cert-file", t.serverCert,
+		"--peer-key-file", t.serverKey,
+		"--peer-client-cert-auth",
+		"--peer-trusted-ca-file", t.caFile,
+	}
+}
+
+// share shares the CA certificate and a client certificate for workers with
+// all the nodes of the swarm, and the CA key with managers only
+func (t *embeddedTLS) share(dockerOps dockerops.DockerOps) error {
+	caCertPEM, err := ioutil.ReadFile(t.caFile)
+	if err != nil {
+		return err
+	}
+	caKeyPEM, err := ioutil.ReadFile(t.caKeyFile)
+	if err != nil {
+		return err
+	}
+	certPEM, keyPEM, err := newCert(t.caCert, t.caKey, etcdVFileUser, nil,
+		[]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth})
+	if err != nil {
+		return err
+	}
+	err = dockerOps.ShareSecrets(sharedWithAll, map[string][]byte{
+		sharedCACert:     caCertPEM,
+		sharedClientCert: certPEM,
+		sharedClientKey:  keyPEM,
+	}, false)
+	if err != nil {
+		return err
+	}
+	return dockerOps.ShareSecrets(sharedWithManagers, map[string][]byte{sharedCAKey: caKeyPEM}, true)
+}
+
+// waitForFiles waits until the files exist, as shared by the swarm leader
+func waitForFiles(files ...string) error {
+	ticker := time.NewTicker(checkSleepDuration)
+	defer ticker.Stop()
+	timer := time.NewTimer(sharedFilesTimeout)
+	defer timer.Stop()
+
+	for {
+		missing := ""
+		for _, file := range files {
+			if _, err := os.Stat(file); err != nil {
+				missing = file
+				break
+			}
+		}
+		if missing == "" {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-timer.C:
+			return fmt.Errorf("Timeout reached; %s is not shared by the swarm leader yet", missing)
+		}
+	}
+}
+
+// loadCA reads the CA certificate and key. If neither file exists, they are
+// copied from those shared by the leader. The leader generates them if it
+// shared none yet.
+func loadCA(certFile string, keyFile string, isLeader bool) (*x509.Certificate, crypto.Signer, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		sharedCert := filepath.Join(sharedDir, sharedCACert)
+		sharedKey := filepath.Join(sharedDir, sharedCAKey)
+		_, err := os.Stat(sharedKey)
+		if os.IsNotExist(err) && isLeader {
+			log.WithFields(
+				log.Fields{"cert": certFile, "key": keyFile},
+			).Warning("Generating CA of embedded etcd ")
+			return generateCA(certFile, keyFile)
+		}
+		if err = waitForFiles(sharedCert, sharedKey); err != nil {
+			return nil, nil, err
+		}
+		// Keep the CA for when this manager becomes the leader
+		if err = copyFile(sharedCert, certFile, 0644); err != nil {
+			return nil, nil, err
+		}
+		if err = copyFile(sharedKey, keyFile, 0600); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("No PEM certificate in %s", certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("No PEM key in %s", keyFile)
+	}
+	key, err := parseKey(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse key in %s: %v", keyFile, err)
+	}
+	return cert, key, nil
+}
+
+// parseKey parses a PKCS #8, EC or PKCS #1 private key
+func parseKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unknown key type")
+}
+
+// generateCA generates a self-signed CA and writes it to certFile and keyFile
+func generateCA(certFile string, keyFile string) (*x509.Certificate, crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := certTemplate("vFile etcd CA", caValidity)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM, keyPEM, err := encodeCert(der, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = writeCert(certFile, keyFile, certPEM, keyPEM); err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// issueCert issues a certificate signed by the CA in certsDir, returns the
+// files of the certificate and of its key
+func issueCert(caCert *x509.Certificate, caKey crypto.Signer, name string, commonName string,
+	ips []net.IP, usages []x509.ExtKeyUsage) (string, string, error) {
+	certPEM, keyPEM, err := newCert(caCert, caKey, commonName, ips, usages)
+	if err != nil {
+		return "", "", err
+	}
+	certFile := filepath.Join(certsDir, name+".pem")
+	keyFile := filepath.Join(certsDir, name+"-key.pem")
+	if err = writeCert(certFile, keyFile, certPEM, keyPEM); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// newCert returns a new certificate signed by the CA and its key, as PEM
+func newCert(caCert *x509.Certificate, caKey crypto.Signer, commonName string,
+	ips []net.IP, usages []x509.ExtKeyUsage) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := certTemplate(commonName, certValidity)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	template.ExtKeyUsage = usages
+	template.IPAddresses = ips
+	if len(ips) != 0 {
+		template.DNSNames = []string{"localhost"}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encodeCert(der, key)
+}
+
+// certTemplate returns the template of a certificate valid from now
+func certTemplate(commonName string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	// Allow for clocks of the nodes being a bit off
+	notBefore := time.Now().Add(-time.Hour)
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(validity),
+	}, nil
+}
+
+// encodeCert returns a certificate and its key as PEM
+func encodeCert(der []byte, key *ecdsa.PrivateKey) ([]byte, []byte, error) {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// writeCert writes a PEM certificate and its key, the key only readable by root
+func writeCert(certFile string, keyFile string, certPEM []byte, keyPEM []byte) error {
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, certPEM, 0644)
+}
+
+// copyFile copies a file to dst, created with mode
+func copyFile(src string, dst string, mode os.FileMode) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, mode)
+}
+
+// enableEtcdAuth creates the etcd users and roles of the nodes, and enables
+// authentication. Users and roles left by a previous run are kept.
+func enableEtcdAuth(cli *etcdClient.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdUpdateTimeout)
+	defer cancel()
+
+	// Users need a password, nodes authenticate with their certificate instead
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	password := hex.EncodeToString(buf)
+	ignoreExisting := func(err error) error {
+		if err == rpctypes.ErrUserAlreadyExist || err == rpctypes.ErrRoleAlreadyExist {
+			return nil
+		}
+		return err
+	}
+
+	for _, name := range []string{etcdRootUser, etcdVFileUser} {
+		if _, err := cli.RoleAdd(ctx, name); ignoreExisting(err) != nil {
+			return err
+		}
+		if _, err := cli.UserAdd(ctx, name, password); ignoreExisting(err) != nil {
+			return err
+		}
+		if _, err := cli.UserGrantRole(ctx, name, name); err != nil {
+			return err
+		}
+	}
+	_, err := cli.RoleGrantPermission(ctx, etcdVFileUser, etcdKeyPrefix,
+		etcdClient.GetPrefixRangeEnd(etcdKeyPrefix), etcdClient.PermissionType(etcdClient.PermReadWrite))
+	if err != nil {
+		return err
+	}
+	_, err = cli.AuthEnable(ctx)
+	return err
+}
+
+// setupTLS issues the certificates of this node for the embedded etcd, the
+// leader shares the CA with the other nodes
+func (e *EtcdKVS) setupTLS(cfg config.Config, isManager bool, isLeader bool) error {
+	t, err := newEmbeddedTLS(cfg, e.nodeAddr, isManager, isLeader)
+	if err != nil {
+		return err
+	}
+	if isLeader {
+		if err = t.share(e.dockerOps); err != nil {
+			return err
+		}
+	}
+	e.etcdTLS = t
+	return nil
+}
+
+// clientTLS returns the TLS configuration of etcd clients, nil without TLS
+func (e *EtcdKVS) clientTLS() *tls.Config {
+	if e.etcdTLS == nil {
+		return nil
+	}
+	return e.etcdTLS.client
+}
+
+// scheme returns the scheme of the URLs of the embedded etcd
+func (e *EtcdKVS) scheme() string {
+	if e.etcdTLS == nil {
+		return etcdScheme
+	}
+	return etcdTLSScheme
+}
@@ -0,0 +1,193 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdops
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/dockerops"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
+)
+
+// handshake connects client to a server with the certificate of leader,
+// returns the common name of the client certificate seen by the server
+func handshake(t *testing.T, leader *embeddedTLS, client *embeddedTLS) (string, error) {
+	cert, err := tls.LoadX509KeyPair(leader.serverCert, leader.serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	caPEM, _ := ioutil.ReadFile(leader.caFile)
+	pool.AppendCertsFromPEM(caPEM)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	commonName := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if tlsConn.Handshake() == nil {
+			commonName <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		}
+		close(commonName)
+	}()
+	conn, err := tls.Dial("tcp", listener.Addr().String(), client.client)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return <-commonName, nil
+}
+
+func TestEmbeddedTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcdtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(timeout time.Duration) { sharedFilesTimeout = timeout }(sharedFilesTimeout)
+	sharedFilesTimeout = 0
+	sharedDir = filepath.Join(dir, "shared")
+	cfg := config.Config{
+		EtcdCACert: filepath.Join(dir, "ca.pem"),
+		EtcdCAKey:  filepath.Join(dir, "ca-key.pem"),
+	}
+
+	// Only the leader generates the CA
+	certsDir = filepath.Join(dir, "manager")
+	_, err = newEmbeddedTLS(cfg, "127.0.0.1", true, false)
+	assert.NotNil(t, err)
+	ops := dockerops.NewMockDockerOps()
+	ops.SharedDir = sharedDir
+	e := &EtcdKVS{dockerOps: ops, nodeAddr: "127.0.0.1"}
+	if !assert.Nil(t, e.setupTLS(cfg, true, true)) {
+		return
+	}
+	leader := e.etcdTLS
+	info, err := os.Stat(cfg.EtcdCAKey)
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+	assert.Contains(t, leader.etcdFlags(), "--client-cert-auth")
+	assert.Contains(t, leader.etcdFlags(), cfg.EtcdCACert)
+
+	// The leader shares the CA key with managers only
+	share, ok := ops.Share(sharedWithAll)
+	if assert.True(t, ok) {
+		assert.False(t, share.ManagersOnly)
+		assert.Contains(t, share.Files, sharedCACert)
+		assert.Contains(t, share.Files, sharedClientCert)
+		assert.NotContains(t, share.Files, sharedCAKey)
+	}
+	share, ok = ops.Share(sharedWithManagers)
+	if assert.True(t, ok) {
+		assert.True(t, share.ManagersOnly)
+		assert.Equal(t, []string{sharedCAKey}, keys(share.Files))
+	}
+
+	// Managers are root, other nodes are vfile
+	commonName, err := handshake(t, leader, leader)
+	assert.Nil(t, err)
+	assert.Equal(t, etcdRootUser, commonName)
+	certsDir = filepath.Join(dir, "worker")
+	worker, err := newEmbeddedTLS(config.Config{EtcdCACert: filepath.Join(dir, "worker", "ca.pem")},
+		"10.0.0.2", false, false)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Empty(t, worker.serverCert)
+	assert.Nil(t, worker.caKey)
+	commonName, err = handshake(t, leader, worker)
+	assert.Nil(t, err)
+	assert.Equal(t, etcdVFileUser, commonName)
+
+	// Other managers keep the shared CA
+	managerCfg := config.Config{
+		EtcdCACert: filepath.Join(dir, "manager2", "ca.pem"),
+		EtcdCAKey:  filepath.Join(dir, "manager2", "ca-key.pem"),
+	}
+	certsDir = filepath.Join(dir, "manager2")
+	manager, err := newEmbeddedTLS(managerCfg, "10.0.0.4", true, false)
+	if assert.Nil(t, err) {
+		assert.Equal(t, leader.caCert.Raw, manager.caCert.Raw)
+		commonName, err = handshake(t, leader, manager)
+		assert.Nil(t, err)
+		assert.Equal(t, etcdRootUser, commonName)
+	}
+	info, err = os.Stat(managerCfg.EtcdCAKey)
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	// Nodes use the configured client certificate
+	configured := config.Config{
+		EtcdCACert:     cfg.EtcdCACert,
+		EtcdClientCert: filepath.Join(sharedDir, sharedClientCert),
+		EtcdClientKey:  filepath.Join(sharedDir, sharedClientKey),
+	}
+	certsDir = filepath.Join(dir, "other")
+	other, err := newEmbeddedTLS(configured, "10.0.0.3", false, false)
+	if assert.Nil(t, err) {
+		commonName, err = handshake(t, leader, other)
+		assert.Nil(t, err)
+		assert.Equal(t, etcdVFileUser, commonName)
+	}
+
+	// Nothing is shared yet
+	sharedDir = filepath.Join(dir, "unshared")
+	_, err = newEmbeddedTLS(config.Config{EtcdCACert: filepath.Join(dir, "none.pem")}, "10.0.0.3", false, false)
+	assert.NotNil(t, err)
+	_, err = newEmbeddedTLS(managerCfg, "10.0.0.4", true, false)
+	assert.Nil(t, err, "Managers keep the CA")
+
+	// Certificates of another CA are refused
+	other, err = newEmbeddedTLS(config.Config{
+		EtcdCACert: filepath.Join(dir, "other-ca.pem"),
+		EtcdCAKey:  filepath.Join(dir, "other-ca-key.pem"),
+	}, "127.0.0.1", true, true)
+	if assert.Nil(t, err) {
+		_, err = handshake(t, leader, other)
+		assert.NotNil(t, err)
+	}
+}
+
+// keys returns the sorted names of shared files
+func keys(files map[string][]byte) []string {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
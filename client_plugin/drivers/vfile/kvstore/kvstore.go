@@ -96,4 +96,7 @@ type KvStore interface {
 	// BlockingWaitAndGet - Blocking wait until a key value becomes equal to a specific value
 	// then read the value of another key
 	BlockingWaitAndGet(key string, value string, newKey string) (string, error)
+
+	// PutIfAbsent - Create key with value if it does not exist, return the value of the key
+	PutIfAbsent(key string, value string) (string, error)
 }
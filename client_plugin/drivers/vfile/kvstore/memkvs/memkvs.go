@@ -0,0 +1,308 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// In-memory implementation of the KvStore interface, for tests.
+//
+// Keys are kept in a map under one lock, so that each operation is atomic as
+// etcd transactions are. Compare and put, atomic increment and decrement and
+// the blocking waits follow the etcd implementation, except that waits wake up
+// on changes rather than polling. Watch stands for the etcd watcher: handlers
+// get the keys put under a prefix in order, one at a time, on their own goroutine.
+
+package memkvs
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/kvstore"
+)
+
+const (
+	// Same as the etcd timeouts for state changes and for volumes to get mounted
+	defaultUpdateTimeout = 10 * time.Second
+	defaultWaitTimeout   = 55 * time.Second
+)
+
+// WatchHandler gets a key put, with its previous value, empty if the key was created
+type WatchHandler func(key string, prevVal string, val string)
+
+// MemKVS keeps key-value pairs in memory
+type MemKVS struct {
+	// UpdateTimeout bounds the wait of CompareAndPutStateOrBusywait
+	UpdateTimeout time.Duration
+	// WaitTimeout bounds the wait of BlockingWaitAndGet
+	WaitTimeout time.Duration
+
+	mtx      sync.Mutex
+	kvs      map[string]string
+	changed  chan struct{} // closed and replaced on every change
+	watchers []*watcher
+}
+
+// watcher queues the changes for its handler
+type watcher struct {
+	prefix  string
+	handler WatchHandler
+	mtx     sync.Mutex
+	cond    *sync.Cond
+	events  [][3]string // key, previous value, value
+	closed  bool
+}
+
+// NewKvStore returns an empty in-memory KV store
+func NewKvStore() *MemKVS {
+	return &MemKVS{
+		UpdateTimeout: defaultUpdateTimeout,
+		WaitTimeout:   defaultWaitTimeout,
+		kvs:           make(map[string]string),
+		changed:       make(chan struct{}),
+	}
+}
+
+// Watch calls handler for each key put with the given prefix, until Close
+func (m *MemKVS) Watch(prefix string, handler WatchHandler) {
+	w := &watcher{prefix: prefix, handler: handler}
+	w.cond = sync.NewCond(&w.mtx)
+	m.mtx.Lock()
+	m.watchers = append(m.watchers, w)
+	m.mtx.Unlock()
+	go w.run()
+}
+
+// Close stops the watchers, changes still queued are dropped
+func (m *MemKVS) Close() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, w := range m.watchers {
+		w.mtx.Lock()
+		w.closed = true
+		w.cond.Signal()
+		w.mtx.Unlock()
+	}
+	m.watchers = nil
+}
+
+func (w *watcher) run() {
+	for {
+		w.mtx.Lock()
+		for len(w.events) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+		if w.closed {
+			w.mtx.Unlock()
+			return
+		}
+		ev := w.events[0]
+		w.events = w.events[1:]
+		w.mtx.Unlock()
+		w.handler(ev[0], ev[1], ev[2])
+	}
+}
+
+// put sets a key, queues the change for watchers and wakes up waiters.
+// Caller holds m.mtx, so that watchers get changes in order.
+func (m *MemKVS) put(key string, val string) {
+	prevVal := m.kvs[key]
+	m.kvs[key] = val
+	for _, w := range m.watchers {
+		if strings.HasPrefix(key, w.prefix) {
+			w.mtx.Lock()
+			w.events = append(w.events, [3]string{key, prevVal, val})
+			w.cond.Signal()
+			w.mtx.Unlock()
+		}
+	}
+	m.notify()
+}
+
+// notify wakes up waiters. Caller holds m.mtx.
+func (m *MemKVS) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// waitUntil calls cond under the lock until it returns true, at each change,
+// for up to timeout. Returns false on timeout.
+func (m *MemKVS) waitUntil(timeout time.Duration, cond func() bool) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		m.mtx.Lock()
+		if cond() {
+			m.mtx.Unlock()
+			return true
+		}
+		changed := m.changed
+		m.mtx.Unlock()
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// WriteMetaData - Update or Create metadata in KV store
+func (m *MemKVS) WriteMetaData(entries []kvstore.KvPair) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, elem := range entries {
+		m.put(elem.Key, elem.Value)
+	}
+	return nil
+}
+
+// ReadMetaData - Read metadata in KV store
+func (m *MemKVS) ReadMetaData(keys []string) ([]kvstore.KvPair, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var entries []kvstore.KvPair
+	for _, key := range keys {
+		if val, ok := m.kvs[key]; ok {
+			entries = append(entries, kvstore.KvPair{Key: key, Value: val})
+		}
+	}
+	if len(entries) == 0 {
+		return nil, errors.New(kvstore.VolumeDoesNotExistError)
+	}
+	if len(entries) < len(keys) {
+		// etcd panics here
+		return nil, errors.New("Failed to get volume. Couldn't find all keys!")
+	}
+	return entries, nil
+}
+
+// DeleteMetaData - Delete volume metadata in KV store
+func (m *MemKVS) DeleteMetaData(name string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.kvs, kvstore.VolPrefixState+name)
+	delete(m.kvs, kvstore.VolPrefixGRef+name)
+	delete(m.kvs, kvstore.VolPrefixInfo+name)
+	m.notify()
+	return nil
+}
+
+// CompareAndPut - Compare the value of key with oldVal, if equal, replace with newVal
+func (m *MemKVS) CompareAndPut(key string, oldVal string, newVal string) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if val, ok := m.kvs[key]; !ok || val != oldVal {
+		return false
+	}
+	m.put(key, newVal)
+	return true
+}
+
+// CompareAndPutStateOrBusywait - Compare the volume state with oldVal
+// if equal, replace with newVal and return true; or else, return false;
+// waits if volume is in a state from where it can reach the ready state
+func (m *MemKVS) CompareAndPutStateOrBusywait(key string, oldVal string, newVal string) bool {
+	succeeded := false
+	m.waitUntil(m.UpdateTimeout, func() bool {
+		val, ok := m.kvs[key]
+		if !ok {
+			return true
+		}
+		if val == oldVal {
+			m.put(key, newVal)
+			succeeded = true
+			return true
+		}
+		return val != string(kvstore.VolStateUnmounting) &&
+			val != string(kvstore.VolStateCreating)
+	})
+	return succeeded
+}
+
+// List - List all the different portion of keys with a given prefix,
+// in descending order as etcd does
+func (m *MemKVS) List(prefix string) ([]string, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var keys []string
+	for key := range m.kvs {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, strings.TrimPrefix(key, prefix))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	return keys, nil
+}
+
+// AtomicIncr - Increase a key value by one
+func (m *MemKVS) AtomicIncr(key string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	val, ok := m.kvs[key]
+	if !ok {
+		return fmt.Errorf("AtomicIncr: no key found for %s", key)
+	}
+	num, _ := strconv.Atoi(val)
+	m.put(key, strconv.Itoa(num+1))
+	return nil
+}
+
+// AtomicDecr - Decrease a key value by one
+func (m *MemKVS) AtomicDecr(key string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	val, ok := m.kvs[key]
+	if !ok {
+		return fmt.Errorf("AtomicDecr: no key found for %s", key)
+	}
+	num, _ := strconv.Atoi(val)
+	if num == 0 {
+		return fmt.Errorf("Cannot decrease a value equal to 0")
+	}
+	m.put(key, strconv.Itoa(num-1))
+	return nil
+}
+
+// BlockingWaitAndGet - Blocking wait until a key value becomes equal to a specific value
+// then read the value of another key
+func (m *MemKVS) BlockingWaitAndGet(key string, value string, newKey string) (string, error) {
+	var newVal string
+	var err error
+	if !m.waitUntil(m.WaitTimeout, func() bool {
+		if val, ok := m.kvs[key]; !ok || val != value {
+			return false
+		}
+		var ok bool
+		if newVal, ok = m.kvs[newKey]; !ok {
+			err = fmt.Errorf("BlockingWaitAndGet: no key found for %s", newKey)
+		}
+		return true
+	}) {
+		return "", fmt.Errorf("Timeout reached; BlockingWait is not complete")
+	}
+	return newVal, err
+}
+
+// PutIfAbsent - Create key with value if it does not exist, return the value of the key
+func (m *MemKVS) PutIfAbsent(key string, value string) (string, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if val, ok := m.kvs[key]; ok {
+		return val, nil
+	}
+	m.put(key, value)
+	return value, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memkvs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/kvstore"
+)
+
+func TestMetaData(t *testing.T) {
+	m := NewKvStore()
+	keys := []string{kvstore.VolPrefixState + "vol1", kvstore.VolPrefixGRef + "vol1", kvstore.VolPrefixInfo + "vol1"}
+	_, err := m.ReadMetaData(keys)
+	assert.EqualError(t, err, kvstore.VolumeDoesNotExistError)
+
+	assert.Nil(t, m.WriteMetaData([]kvstore.KvPair{
+		{Key: keys[0], Value: string(kvstore.VolStateReady)},
+		{Key: keys[1], Value: "0"},
+	}))
+	_, err = m.ReadMetaData(keys)
+	assert.NotNil(t, err, "Some keys are missing")
+	assert.Nil(t, m.WriteMetaData([]kvstore.KvPair{{Key: keys[2], Value: "{}"}}))
+	entries, err := m.ReadMetaData(keys)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []kvstore.KvPair{
+			{Key: keys[0], Value: string(kvstore.VolStateReady)},
+			{Key: keys[1], Value: "0"},
+			{Key: keys[2], Value: "{}"},
+		}, entries)
+	}
+
+	assert.Nil(t, m.WriteMetaData([]kvstore.KvPair{{Key: kvstore.VolPrefixState + "vol2", Value: "Ready"}}))
+	names, _ := m.List(kvstore.VolPrefixState)
+	assert.Equal(t, []string{"vol2", "vol1"}, names)
+
+	assert.Nil(t, m.DeleteMetaData("vol1"))
+	_, err = m.ReadMetaData(keys)
+	assert.EqualError(t, err, kvstore.VolumeDoesNotExistError)
+}
+
+func TestAtomicOps(t *testing.T) {
+	m := NewKvStore()
+	key := kvstore.VolPrefixGRef + "vol1"
+	assert.NotNil(t, m.AtomicIncr(key), "No such key")
+	assert.False(t, m.CompareAndPut(key, "", "1"), "No such key")
+
+	value, err := m.PutIfAbsent(key, "0")
+	assert.Nil(t, err)
+	assert.Equal(t, "0", value)
+	value, _ = m.PutIfAbsent(key, "5")
+	assert.Equal(t, "0", value, "Key already exists")
+
+	assert.NotNil(t, m.AtomicDecr(key), "Refcount cannot go below 0")
+	assert.Nil(t, m.AtomicIncr(key))
+	assert.Nil(t, m.AtomicIncr(key))
+	assert.Nil(t, m.AtomicDecr(key))
+	assert.False(t, m.CompareAndPut(key, "0", "3"))
+	assert.True(t, m.CompareAndPut(key, "1", "3"))
+}
+
+func TestWaits(t *testing.T) {
+	m := NewKvStore()
+	m.UpdateTimeout = 100 * time.Millisecond
+	m.WaitTimeout = 100 * time.Millisecond
+	state := kvstore.VolPrefixState + "vol1"
+	info := kvstore.VolPrefixInfo + "vol1"
+	m.WriteMetaData([]kvstore.KvPair{
+		{Key: state, Value: string(kvstore.VolStateCreating)},
+		{Key: info, Value: "{}"},
+	})
+
+	// Creating becomes Ready, the busy wait goes on
+	go m.CompareAndPut(state, string(kvstore.VolStateCreating), string(kvstore.VolStateReady))
+	assert.True(t, m.CompareAndPutStateOrBusywait(state, string(kvstore.VolStateReady), string(kvstore.VolStateMounting)))
+	// Mounting cannot become Ready by itself
+	assert.False(t, m.CompareAndPutStateOrBusywait(state, string(kvstore.VolStateReady), string(kvstore.VolStateDeleting)))
+
+	_, err := m.BlockingWaitAndGet(state, string(kvstore.VolStateMounted), info)
+	assert.NotNil(t, err, "Timeout")
+	go m.CompareAndPut(state, string(kvstore.VolStateMounting), string(kvstore.VolStateMounted))
+	value, err := m.BlockingWaitAndGet(state, string(kvstore.VolStateMounted), info)
+	assert.Nil(t, err)
+	assert.Equal(t, "{}", value)
+}
+
+func TestWatch(t *testing.T) {
+	m := NewKvStore()
+	defer m.Close()
+	events := make(chan [3]string, 10)
+	m.Watch(kvstore.VolPrefixGRef, func(key string, prevVal string, val string) {
+		events <- [3]string{key, prevVal, val}
+	})
+	key := kvstore.VolPrefixGRef + "vol1"
+	m.WriteMetaData([]kvstore.KvPair{
+		{Key: key, Value: "0"},
+		{Key: kvstore.VolPrefixState + "vol1", Value: string(kvstore.VolStateReady)},
+	})
+	m.AtomicIncr(key)
+	m.AtomicDecr(key)
+	for _, expected := range [][3]string{{key, "", "0"}, {key, "0", "1"}, {key, "1", "0"}} {
+		select {
+		case ev := <-events:
+			assert.Equal(t, expected, ev)
+		case <-time.After(time.Second):
+			t.Fatalf("No change of %s watched", key)
+		}
+	}
+	assert.Empty(t, events, "Keys out of the prefix are not watched")
+}
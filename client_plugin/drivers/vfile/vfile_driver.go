@@ -23,17 +23,23 @@ package vfile
 ///
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/utils"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/credentials"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/dockerops"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/kvstore"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/kvstore/etcdops"
@@ -41,35 +47,65 @@ import (
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/plugin_utils"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/refcount"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
 )
 
 /* Constants
    version:                 Version of the vFile plugin driver
    internalVolumePrefix:    Prefix for names of internal volumes
                             which serve as backend stores for vFile volumes
-   fsType:                  Type of file system that will be presented
-                            in the vFile volume
+   smbFsType:               Type of file system presented in vFile volumes shared over SMB
+   nfsFsType:               Type of file system presented in vFile volumes shared over NFS
+   protocolOpt:             Volume create option choosing the file sharing protocol
+   serverDialTimeout:       Timeout of the check that a file server can be reached
 */
 const (
 	version              = "vFile Volume Driver v0.2"
 	internalVolumePrefix = "_vF_"
-	fsType               = "cifs"
+	smbFsType            = "cifs"
+	nfsFsType            = "nfs4"
+	protocolOpt          = "protocol"
 	initError            = "vFile volume driver is not fully initialized yet."
+	serverDialTimeout    = 5 * time.Second
 )
 
+// credentialsDir is where Samba credentials files are written for mount.cifs
+var credentialsDir = "/var/run/vfile/credentials"
+
+// mountCommand runs mount with args, tests replace it
+var mountCommand = func(args []string) ([]byte, error) {
+	return exec.Command("mount", args...).CombinedOutput()
+}
+
+// serverReachable tells if the file server at addr accepts connections on
+// port, tests replace it
+var serverReachable = func(addr string, port int) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(addr, strconv.Itoa(port)), serverDialTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
 /* VolumeDriver - vFile plugin volume driver struct
    dockerOps:               Docker related methods and information
    internalVolumeDriver:    Name of the plugin used by vFile volume
                             plugin to create internal volumes
    kvStore:                 Key-value store related methods and information
+   sealer:                  Seals and opens Samba credentials of volumes
+   serverHost:              Starts file servers on this host, nil if
+                            file servers run as services
 */
 
 // VolumeDriver - Contains vars specific to this driver
 type VolumeDriver struct {
 	utils.PluginDriver
-	dockerOps            *dockerops.DockerOps
+	dockerOps            dockerops.DockerOps
 	internalVolumeDriver string
 	kvStore              kvstore.KvStore
+	sealer               *credentials.Sealer
+	serverHost           etcdops.FileServerHost
 	isInitialized        bool
 }
 
@@ -81,9 +117,13 @@ type VolumeDriver struct {
    port:            On which port is the Samba service listening?
    serviceName:     What is the name of the Samba service for this volume?
    username:
-   password:        Local Samba username and password
-	            Only default values for now, later can be used
-                    for multi tenancy.
+   password:        Samba username and password of volumes created
+                    before credentials were sealed
+   credentials:     Samba username and password of the volume, sealed
+                    with the cluster key
+   protocol:        File sharing protocol of the volume, smb if not set
+   serverAddr:      Address of the host running the file server, if file
+                    servers run on hosts rather than as services
    clientList:      List of all host VMs using this vFile volume
 */
 
@@ -95,6 +135,9 @@ type VolumeMetadata struct {
 	ServiceName    string            `json:"serviceName,omitempty"`
 	Username       string            `json:"username,omitempty"`
 	Password       string            `json:"password,omitempty"`
+	Credentials    string            `json:"credentials,omitempty"`
+	Protocol       string            `json:"protocol,omitempty"`
+	ServerAddr     string            `json:"serverAddr,omitempty"`
 	ClientList     []string          `json:"clientList,omitempty"`
 }
 
@@ -103,8 +146,9 @@ func NewVolumeDriver(cfg config.Config, mountDir string) *VolumeDriver {
 	var d VolumeDriver
 
 	d.RefCounts = refcount.NewRefCountsMap()
-	d.RefCounts.Init(&d, mountDir, cfg.Driver)
 	d.MountIDtoName = make(map[string]string)
+	d.RefCounts.SetStateFile(cfg.StateFile, d.MountIDtoName)
+	d.RefCounts.Init(&d, mountDir, cfg.Driver)
 	d.MountRoot = mountDir
 	d.isInitialized = false
 
@@ -119,7 +163,7 @@ func NewVolumeDriver(cfg config.Config, mountDir string) *VolumeDriver {
 	}
 
 	// Use go routine due to the timeout for plugin initialization
-	go d.backgroundInitTasks()
+	go d.backgroundInitTasks(cfg)
 
 	log.WithFields(log.Fields{
 		"version": version,
@@ -128,10 +172,11 @@ func NewVolumeDriver(cfg config.Config, mountDir string) *VolumeDriver {
 	return &d
 }
 
-// backgroundInitTasks: create new dockerOps, load server image, and start key-value store
-func (d *VolumeDriver) backgroundInitTasks() {
+// backgroundInitTasks: create new dockerOps, load server image, start key-value store
+// and then refcount reconciliation, which needs the key-value store to unmount volumes
+func (d *VolumeDriver) backgroundInitTasks(cfg config.Config) {
 	// create new docker operation client
-	d.dockerOps = dockerops.NewDockerOps()
+	d.dockerOps = dockerops.NewDockerOps(config.FileServerPlacement(cfg))
 	if d.dockerOps == nil {
 		log.Errorf("Failed to create new DockerOps")
 		return
@@ -141,13 +186,23 @@ func (d *VolumeDriver) backgroundInitTasks() {
 	go d.dockerOps.LoadFileServerImage()
 	log.Infof("Started loading file server image")
 
-	// initialize built-in etcd cluster
+	// The cluster key seals the Samba credentials of volumes, without it
+	// SMB volumes can be neither created nor mounted
+	key, err := credentials.LoadClusterKey(cfg)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Failed to load the cluster key, SMB volumes cannot be created or mounted ")
+	}
+	d.sealer = credentials.NewSealer(key)
+
+	// initialize built-in etcd cluster, or connect to the external one
 	for {
 		// keep retry start kvstore, since managers may have plugin started before leader
-		etcdKVS := etcdops.NewKvStore(d.dockerOps)
+		etcdKVS := etcdops.NewKvStore(d.dockerOps, cfg, d.sealer)
 		if etcdKVS != nil {
 			d.kvStore = etcdKVS
+			d.serverHost = etcdKVS.FileServerHost()
 			d.isInitialized = true
+			d.RefCounts.StartReconciler(cfg.RefCountReconcileSec)
 			return
 		}
 		log.Warningf("Failed to create new KV store. Retry")
@@ -156,14 +211,15 @@ func (d *VolumeDriver) backgroundInitTasks() {
 
 // Get info about a single volume
 func (d *VolumeDriver) Get(r volume.Request) volume.Response {
-	log.Infof("VolumeDriver Get: %s", r.Name)
+	ctx := requestid.Background()
+	requestid.Log(ctx).Infof("VolumeDriver Get: %s", r.Name)
 	if !d.isInitialized {
 		return volume.Response{Err: initError}
 	}
 
-	status, err := d.GetVolume(r.Name)
+	status, err := d.getVolume(ctx, r.Name)
 	if err != nil {
-		log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Failed to get volume meta-data ")
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "error": err}).Error("Failed to get volume meta-data ")
 		return volume.Response{Err: err.Error()}
 	}
 
@@ -174,13 +230,14 @@ func (d *VolumeDriver) Get(r volume.Request) volume.Response {
 
 // List volumes known to the driver
 func (d *VolumeDriver) List(r volume.Request) volume.Response {
+	ctx := requestid.Background()
 	if !d.isInitialized {
 		return volume.Response{Err: initError}
 	}
 
 	volumes, err := d.kvStore.List(kvstore.VolPrefixState)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to get volume list ")
+		requestid.Log(ctx).WithFields(log.Fields{"error": err}).Error("Failed to get volume list ")
 		return volume.Response{Err: err.Error()}
 	}
 
@@ -197,6 +254,11 @@ func (d *VolumeDriver) List(r volume.Request) volume.Response {
 
 // GetVolume - return volume meta-data.
 func (d *VolumeDriver) GetVolume(name string) (map[string]interface{}, error) {
+	return d.getVolume(requestid.Background(), name)
+}
+
+// getVolume - see GetVolume
+func (d *VolumeDriver) getVolume(ctx context.Context, name string) (map[string]interface{}, error) {
 	var statusMap map[string]interface{}
 	var volRecord VolumeMetadata
 	statusMap = make(map[string]interface{})
@@ -212,12 +274,12 @@ func (d *VolumeDriver) GetVolume(name string) (map[string]interface{}, error) {
 	entries, err := d.kvStore.ReadMetaData(keys)
 	if err != nil {
 		if err.Error() == kvstore.VolumeDoesNotExistError {
-			log.Infof("Volume not found: %s", name)
+			requestid.Log(ctx).Infof("Volume not found: %s", name)
 			return statusMap, err
 		}
 		msg := fmt.Sprintf("Failed to read metadata for volume %s from KV store. %v",
 			name, err)
-		log.Warningf(msg)
+		requestid.Log(ctx).Warning(msg)
 		return statusMap, errors.New(msg)
 	}
 
@@ -227,19 +289,28 @@ func (d *VolumeDriver) GetVolume(name string) (map[string]interface{}, error) {
 	err = json.Unmarshal([]byte(entries[2].Value), &volRecord)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to unmarshal data. %v", err)
-		log.Warningf(msg)
+		requestid.Log(ctx).Warning(msg)
 		return statusMap, errors.New(msg)
 	}
 	statusMap["File server Port"] = volRecord.Port
 	statusMap["Service name"] = volRecord.ServiceName
+	if volRecord.ServerAddr != "" {
+		statusMap["File server address"] = volRecord.ServerAddr
+	}
+	statusMap["Protocol"] = volRecord.Protocol
+	if volRecord.Protocol == "" {
+		statusMap["Protocol"] = dockerops.DefaultProtocol
+	}
 	statusMap["Clients"] = volRecord.ClientList
+	d.AddLocalStatus(ctx, name, statusMap)
 
 	return statusMap, nil
 }
 
 // Create - create a volume.
 func (d *VolumeDriver) Create(r volume.Request) volume.Response {
-	log.Infof("VolumeDriver Create: %s", r.Name)
+	ctx := requestid.Background()
+	requestid.Log(ctx).Infof("VolumeDriver Create: %s", r.Name)
 	if !d.isInitialized {
 		return volume.Response{Err: initError}
 	}
@@ -247,13 +318,37 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 	var msg string
 	var entries []kvstore.KvPair
 
+	// The file sharing protocol is for vFile, other options for the internal volume
+	server, err := dockerops.GetFileServer(r.Options[protocolOpt])
+	if err != nil {
+		msg = fmt.Sprintf("Cannot create volume. %v", err)
+		requestid.Log(ctx).Warning(msg)
+		return volume.Response{Err: msg}
+	}
+	delete(r.Options, protocolOpt)
+
+	// Generate the Samba credentials of the volume
+	var sealed string
+	if server.UsesSecret() {
+		var creds credentials.Credentials
+		creds, err = credentials.Generate()
+		if err == nil {
+			sealed, err = d.sealer.Seal(creds)
+		}
+		if err != nil {
+			msg = fmt.Sprintf("Cannot create volume. Failed to generate credentials. Reason: %v", err)
+			requestid.Log(ctx).Warning(msg)
+			return volume.Response{Err: msg}
+		}
+	}
+
 	// Initialize volume metadata in KV store
 	volRecord := VolumeMetadata{
 		Status:         kvstore.VolStateCreating,
 		GlobalRefcount: 0,
 		Port:           0,
-		Username:       dockerops.SambaUsername,
-		Password:       dockerops.SambaPassword,
+		Credentials:    sealed,
+		Protocol:       server.Protocol(),
 	}
 
 	// Append global refcount and status to kv pairs that will be written
@@ -263,72 +358,73 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 	byteRecord, err := json.Marshal(volRecord)
 	if err != nil {
 		msg = fmt.Sprintf("Cannot create volume. Failed to marshal metadata to json. Reason: %v", err)
-		log.Warningf(msg)
+		requestid.Log(ctx).Warning(msg)
 		return volume.Response{Err: msg}
 	}
 	entries = append(entries, kvstore.KvPair{Key: kvstore.VolPrefixInfo + r.Name, Value: string(byteRecord)})
 
-	log.Infof("Attempting to write initial metadata entry for %s", r.Name)
+	requestid.Log(ctx).Infof("Attempting to write initial metadata entry for %s", r.Name)
 	err = d.kvStore.WriteMetaData(entries)
 	if err != nil {
 		msg = fmt.Sprintf("Failed to create volume %s. Reason: %v",
 			r.Name, err)
-		log.Warningf(msg)
+		requestid.Log(ctx).Warning(msg)
 		return volume.Response{Err: msg}
 	}
 
 	// Create traditional volume as backend to vFile volume
-	log.Infof("Attempting to create internal volume for %s", r.Name)
+	requestid.Log(ctx).Infof("Attempting to create internal volume for %s", r.Name)
 	internalVolname := internalVolumePrefix + r.Name
 	err = d.dockerOps.VolumeCreate(d.internalVolumeDriver, internalVolname, r.Options)
 	if err != nil {
 		msg = fmt.Sprintf("Failed to create internal volume %s. Reason: %v", r.Name, err)
 		msg += fmt.Sprintf(". Check the status of the volumes belonging to driver \"%s\".", d.internalVolumeDriver)
-		log.Warningf(msg)
+		requestid.Log(ctx).Warning(msg)
 
 		// If failed, attempt to delete the metadata for this volume
 		err = d.kvStore.DeleteMetaData(r.Name)
 		if err != nil {
-			log.Warningf("Failed to remove metadata entry for volume: %s. Reason: %v", r.Name, err)
+			requestid.Log(ctx).Warningf("Failed to remove metadata entry for volume: %s. Reason: %v", r.Name, err)
 		}
 		return volume.Response{Err: msg}
 	}
 
 	// Update metadata to indicate successful volume creation
-	log.Infof("Attempting to update volume state to ready for volume: %s", r.Name)
+	requestid.Log(ctx).Infof("Attempting to update volume state to ready for volume: %s", r.Name)
 	entries = nil
 	entries = append(entries, kvstore.KvPair{Key: kvstore.VolPrefixState + r.Name, Value: string(kvstore.VolStateReady)})
 	err = d.kvStore.WriteMetaData(entries)
 	if err != nil {
 		outerMessage := fmt.Sprintf("Failed to set status of volume %s to ready. Reason: %v", r.Name, err)
-		log.Warningf(outerMessage)
+		requestid.Log(ctx).Warning(outerMessage)
 
 		// If failed, attempt to remove the backing trad volume
-		log.Infof("Attempting to delete internal volume")
+		requestid.Log(ctx).Infof("Attempting to delete internal volume")
 		err = d.dockerOps.VolumeRemove(internalVolname)
 		if err != nil {
 			msg = fmt.Sprintf(" Failed to remove internal volume. Reason %v.", err)
 			msg += fmt.Sprintf(" Please remove the volume manually. Volume: %s", internalVolname)
-			log.Warningf(msg)
+			requestid.Log(ctx).Warning(msg)
 			outerMessage = outerMessage + msg
 		}
 
 		// Attempt to delete the metadata for this volume
 		err = d.kvStore.DeleteMetaData(r.Name)
 		if err != nil {
-			log.Warningf("Failed to remove metadata entry for volume: %s. Reason: %v", r.Name, err)
+			requestid.Log(ctx).Warningf("Failed to remove metadata entry for volume: %s. Reason: %v", r.Name, err)
 		}
 
 		return volume.Response{Err: outerMessage}
 	}
 
-	log.Infof("Successfully created volume: %s", r.Name)
+	requestid.Log(ctx).Infof("Successfully created volume: %s", r.Name)
 	return volume.Response{Err: ""}
 }
 
 // Remove - removes individual volume. Docker would call it only if is not using it anymore
 func (d *VolumeDriver) Remove(r volume.Request) volume.Response {
-	log.WithFields(log.Fields{"name": r.Name}).Info("Removing volume ")
+	ctx := requestid.Background()
+	requestid.Log(ctx).WithFields(log.Fields{"name": r.Name}).Info("Removing volume ")
 	if !d.isInitialized {
 		return volume.Response{Err: initError}
 	}
@@ -341,7 +437,7 @@ func (d *VolumeDriver) Remove(r volume.Request) volume.Response {
 	if d.RefCounts.IsInitialized() != true {
 		msg = fmt.Sprintf(plugin_utils.PluginInitError+" Cannot remove volume %s",
 			r.Name)
-		log.Error(msg)
+		requestid.Log(ctx).Error(msg)
 		return volume.Response{Err: msg}
 	}
 
@@ -350,7 +446,7 @@ func (d *VolumeDriver) Remove(r volume.Request) volume.Response {
 	if d.GetRefCount(r.Name) != 0 {
 		msg = fmt.Sprintf("Remove failed: Containers on this host VM are still using volume %s.",
 			r.Name)
-		log.Error(msg)
+		requestid.Log(ctx).Error(msg)
 		return volume.Response{Err: msg}
 	}
 
@@ -371,22 +467,22 @@ func (d *VolumeDriver) Remove(r volume.Request) volume.Response {
 		entries, err := d.kvStore.ReadMetaData(keys)
 		if err != nil {
 			msg = fmt.Sprintf("Remove failed: cannot read metadata of volume %s", r.Name)
-			log.Errorf(msg)
+			requestid.Log(ctx).Error(msg)
 			return volume.Response{Err: msg}
 		}
 
 		state := entries[0].Value
 		switch state {
 		case string(kvstore.VolStateDeleting):
-			log.Warningf("Remove: volume in Deleting state after timeout. Continue deleting.")
+			requestid.Log(ctx).Warningf("Remove: volume in Deleting state after timeout. Continue deleting.")
 		case string(kvstore.VolStateError):
 		case string(kvstore.VolStateCreating):
 		case string(kvstore.VolStateUnmounting):
-			log.Warningf("Remove: volume in %s state after timeout. Continue deleting", state)
+			requestid.Log(ctx).Warningf("Remove: volume in %s state after timeout. Continue deleting", state)
 			if !d.kvStore.CompareAndPut(kvstore.VolPrefixState+r.Name,
 				state, string(kvstore.VolStateDeleting)) {
 				msg = fmt.Sprintf("Remove: Volume state changed unexpected. Please retry later")
-				log.Errorf(msg)
+				requestid.Log(ctx).Error(msg)
 				return volume.Response{Err: msg}
 
 			}
@@ -395,28 +491,28 @@ func (d *VolumeDriver) Remove(r volume.Request) volume.Response {
 			err = json.Unmarshal([]byte(entries[1].Value), &volRecord)
 			if err != nil {
 				msg = fmt.Sprintf("Remove failed: cannot unmarshal info data. %v", err)
-				log.Errorf(msg)
+				requestid.Log(ctx).Error(msg)
 				return volume.Response{Err: msg}
 			}
 
 			msg = fmt.Sprintf("Remove failed: volume state is Mounted.")
 			msg += fmt.Sprintf(" Host VMs using this volume: %s",
 				strings.Join(volRecord.ClientList, ","))
-			log.Errorf(msg)
+			requestid.Log(ctx).Error(msg)
 			return volume.Response{Err: msg}
 		default:
 			msg = fmt.Sprintf("Remove failed: cannot delete from current state %s.", state)
-			log.Errorf(msg)
+			requestid.Log(ctx).Error(msg)
 			return volume.Response{Err: msg}
 		}
 	}
 
 	// Delete internal volume
-	log.Infof("Attempting to delete internal volume for %s", r.Name)
+	requestid.Log(ctx).Infof("Attempting to delete internal volume for %s", r.Name)
 	d.dockerOps.DeleteInternalVolume(r.Name)
 
 	// Delete metadata associated with this volume
-	log.Infof("Attempting to delete volume metadata for %s", r.Name)
+	requestid.Log(ctx).Infof("Attempting to delete volume metadata for %s", r.Name)
 	err := d.kvStore.DeleteMetaData(r.Name)
 	if err != nil {
 		msg = fmt.Sprintf("Failed to delete volume metadata for %s. Reason: %v", r.Name, err)
@@ -440,7 +536,8 @@ func (d *VolumeDriver) Path(r volume.Request) volume.Response {
 // at this level during create/mount/umount/remove.
 //
 func (d *VolumeDriver) Mount(r volume.MountRequest) volume.Response {
-	log.WithFields(log.Fields{"name": r.Name}).Info("Mounting volume ")
+	ctx := requestid.Background()
+	requestid.Log(ctx).WithFields(log.Fields{"name": r.Name}).Info("Mounting volume ")
 	if !d.isInitialized {
 		return volume.Response{Err: initError}
 	}
@@ -448,44 +545,45 @@ func (d *VolumeDriver) Mount(r volume.MountRequest) volume.Response {
 	// lock the state
 	d.RefCounts.StateMtx.Lock()
 	defer d.RefCounts.StateMtx.Unlock()
+	defer d.RefCounts.SaveState()
 
 	// checked by refcounting thread until refmap initialized
 	// useless after that
 	d.RefCounts.MarkDirty()
 
-	return d.processMount(r)
+	return d.processMount(ctx, r)
 }
 
 // processMount -  process a mount request
-func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
+func (d *VolumeDriver) processMount(ctx context.Context, r volume.MountRequest) volume.Response {
 	d.MountIDtoName[r.ID] = r.Name
 
 	// If the volume is already mounted , just increase the refcount.
 	// Note: for new keys, GO maps return zero value, so no need for if_exists.
 	refcnt := d.IncrRefCount(r.Name) // save map traversal
-	log.Debugf("volume name=%s refcnt=%d", r.Name, refcnt)
+	requestid.Log(ctx).Debugf("volume name=%s refcnt=%d", r.Name, refcnt)
 	if refcnt > 1 {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": r.Name, "refcount": refcnt},
 		).Info("Already mounted, skipping mount. ")
 		return volume.Response{Mountpoint: d.GetMountPoint(r.Name)}
 	}
 
-	if plugin_utils.AlreadyMounted(r.Name, d.MountRoot) {
-		log.WithFields(log.Fields{"name": r.Name}).Info("Already mounted, skipping mount. ")
+	if plugin_utils.AlreadyMounted(ctx, r.Name, d.MountRoot) {
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name}).Info("Already mounted, skipping mount. ")
 		return volume.Response{Mountpoint: d.GetMountPoint(r.Name)}
 	}
 
-	mountpoint, err := d.MountVolume(r.Name, "", "", false, true)
+	mountpoint, err := d.mountVolume(ctx, r.Name)
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": r.Name,
 				"error": err},
 		).Error("Failed to mount ")
 
-		refcnt, _ := d.DecrRefCount(r.Name)
+		refcnt, _ := d.DecrRefCount(ctx, r.Name)
 		if refcnt == 0 {
-			log.Infof("Detaching %s - it is not used anymore", r.Name)
+			requestid.Log(ctx).Infof("Detaching %s - it is not used anymore", r.Name)
 			// TODO: umount here
 		}
 		return volume.Response{Err: err.Error()}
@@ -495,12 +593,17 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 }
 
 // MountVolume - Request attach and then mounts the volume.
-func (d *VolumeDriver) MountVolume(name string, fstype string, id string, isReadOnly bool, skipAttach bool) (string, error) {
+func (d *VolumeDriver) MountVolume(name string, fstype string, id string, isReadOnly bool, skipAttach bool, mountOptions string) (string, error) {
+	return d.mountVolume(requestid.Background(), name)
+}
+
+// mountVolume - see MountVolume
+func (d *VolumeDriver) mountVolume(ctx context.Context, name string) (string, error) {
 	mountpoint := d.GetMountPoint(name)
 	// First, make sure  that mountpoint exists.
-	err := fs.Mkdir(mountpoint)
+	err := fs.Mkdir(ctx, mountpoint)
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": name,
 				"dir": mountpoint},
 		).Error("Failed to make directory for volume mount ")
@@ -508,104 +611,149 @@ func (d *VolumeDriver) MountVolume(name string, fstype string, id string, isRead
 	}
 
 	// Increase GRef
-	log.Infof("Before AtomicIncr")
+	requestid.Log(ctx).Infof("Before AtomicIncr")
 	err = d.kvStore.AtomicIncr(kvstore.VolPrefixGRef + name)
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": name,
 				"error": err},
 		).Error("Failed to increase global refcount when processMount ")
 		return "", err
 	}
 
-	// Blocking wait until the state of volume becomes Mounted
-	// the change of global refcount will trigger one watcher on manager nodes
-	// watchers should start event handler to transit the state of volumes
-	info, err := d.kvStore.BlockingWaitAndGet(kvstore.VolPrefixState+name,
-		string(kvstore.VolStateMounted), kvstore.VolPrefixInfo+name)
+	// File servers run on hosts are started by the host mounting the volume
+	if d.serverHost != nil {
+		d.serverHost.MountRequested(name)
+	}
+
+	volRecord, err := d.waitMounted(ctx, name)
+	if err == nil {
+		err = d.mountVFileVolume(ctx, name, mountpoint, &volRecord)
+		if err != nil && d.serverHost != nil && volRecord.ServerAddr != "" &&
+			!serverReachable(volRecord.ServerAddr, volRecord.Port) {
+			// The host of the file server is gone, run it on this host
+			requestid.Log(ctx).WithFields(
+				log.Fields{"name": name,
+					"serverAddr": volRecord.ServerAddr},
+			).Warning("File server cannot be reached, taking it over ")
+			d.serverHost.TakeOver(name, volRecord.ServerAddr)
+			if volRecord, err = d.waitMounted(ctx, name); err == nil {
+				err = d.mountVFileVolume(ctx, name, mountpoint, &volRecord)
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("Failed to mount vFile volume. Error: %v.", err)
+		}
+	}
 	if err != nil {
-		msg := fmt.Sprintf("Failed to blocking wait for Mounted state. Error: %v.", err)
+		msg := err.Error()
+		// AtomicDecr decreases global refcount by one
+		// if global refcount reduces from 1 to 0, a watcher event is triggered on manager nodes
 		err = d.kvStore.AtomicDecr(kvstore.VolPrefixGRef + name)
 		if err != nil {
 			msg += fmt.Sprintf(" Also failed to decrease global refcount. Error: %v.", err)
 		}
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": name,
 				"error": msg}).Error("")
 		return "", errors.New(msg)
 	}
 
-	// Start mounting
-	log.Infof("Volume state mounted, prepare to mounting locally")
+	return mountpoint, nil
+}
+
+// waitMounted blocks until the state of a volume becomes Mounted, then
+// returns its metadata
+func (d *VolumeDriver) waitMounted(ctx context.Context, name string) (VolumeMetadata, error) {
 	var volRecord VolumeMetadata
+	// the change of global refcount will trigger one watcher on manager nodes
+	// watchers should start event handler to transit the state of volumes
+	info, err := d.kvStore.BlockingWaitAndGet(kvstore.VolPrefixState+name,
+		string(kvstore.VolStateMounted), kvstore.VolPrefixInfo+name)
+	if err != nil {
+		return volRecord, fmt.Errorf("Failed to blocking wait for Mounted state. Error: %v.", err)
+	}
+
+	requestid.Log(ctx).Infof("Volume state mounted, prepare to mounting locally")
 	// Unmarshal Info key
 	err = json.Unmarshal([]byte(info), &volRecord)
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": name,
 				"error": err},
 		).Error("Failed to unmarshal info data ")
-		return "", err
+		return volRecord, err
 	}
 
-	log.WithFields(
+	requestid.Log(ctx).WithFields(
 		log.Fields{"name": name,
 			"Port":        volRecord.Port,
 			"ServiceName": volRecord.ServiceName,
 		}).Info("Get info for mounting ")
-	err = d.mountVFileVolume(name, mountpoint, &volRecord)
-	if err != nil {
-		msg := fmt.Sprintf("Failed to mount vFile volume. Error: %v.", err)
-		// AtomicDecr decreases global refcount by one
-		// if global refcount reduces from 1 to 0, a watcher event is triggered on manager nodes
-		err = d.kvStore.AtomicDecr(kvstore.VolPrefixGRef + name)
+	return volRecord, nil
+}
+
+// mountVFileVolume - mount the vFile volume according to volume metadata
+func (d *VolumeDriver) mountVFileVolume(ctx context.Context, volName string, mountpoint string, volRecord *VolumeMetadata) error {
+	// File servers run on a host are reached at its address, services
+	// at any address of the swarm
+	addr := volRecord.ServerAddr
+	if addr == "" {
+		var err error
+		_, addr, _, err = d.dockerOps.GetSwarmInfo()
 		if err != nil {
-			msg += fmt.Sprintf(" Also failed to decrease global refcount. Error: %v.", err)
+			requestid.Log(ctx).WithFields(
+				log.Fields{"volume name": volName,
+					"error": err,
+				}).Error("Failed to get IP address from docker swarm ")
+			return err
 		}
-		log.WithFields(
-			log.Fields{"name": name,
-				"error": msg}).Error("")
-		return "", errors.New(msg)
 	}
 
-	return mountpoint, nil
-}
-
-// mountVFileVolume - mount the vFile volume according to volume metadata
-func (d *VolumeDriver) mountVFileVolume(volName string, mountpoint string, volRecord *VolumeMetadata) error {
 	// Build mount command as follows:
 	//   mount [-t $fstype] [-o $options] [$source] $target
-	mountArgs := []string{}
-	mountArgs = append(mountArgs, "-t", fsType)
-
-	options := []string{
-		"username=" + volRecord.Username,
-		"password=" + volRecord.Password,
-		"port=" + strconv.Itoa(volRecord.Port),
-		"vers=3.0",
-	}
-	mountArgs = append(mountArgs, "-o", strings.Join(options, ","))
+	var fsType, source string
+	var options []string
+	switch volRecord.Protocol {
+	case dockerops.ProtocolNFS:
+		fsType = nfsFsType
+		options = []string{
+			"port=" + strconv.Itoa(volRecord.Port),
+			"vers=4.0",
+		}
+		source = addr + ":/" + dockerops.FileShareName
+	case dockerops.ProtocolSMB, "":
+		// Credentials are given to mount.cifs in a file only root can read,
+		// on the command line any user could see them
+		credsFile, err := d.writeCredentialsFile(volRecord)
+		if err != nil {
+			requestid.Log(ctx).WithFields(
+				log.Fields{"volume name": volName,
+					"error": err,
+				}).Error("Failed to write credentials file ")
+			return err
+		}
+		defer os.Remove(credsFile)
 
-	_, addr, _, err := d.dockerOps.GetSwarmInfo()
-	if err != nil {
-		log.WithFields(
-			log.Fields{"volume name": volName,
-				"error": err,
-			}).Error("Failed to get IP address from docker swarm ")
-		return err
+		fsType = smbFsType
+		options = []string{
+			"credentials=" + credsFile,
+			"port=" + strconv.Itoa(volRecord.Port),
+			"vers=3.0",
+		}
+		source = "//" + addr + "/" + dockerops.FileShareName
+	default:
+		return fmt.Errorf("Unknown protocol %s of volume %s", volRecord.Protocol, volName)
 	}
-	source := "//" + addr + "/" + dockerops.FileShareName
-	mountArgs = append(mountArgs, source)
-	mountArgs = append(mountArgs, mountpoint)
+	mountArgs := []string{"-t", fsType, "-o", strings.Join(options, ","), source, mountpoint}
 
-	log.WithFields(
+	requestid.Log(ctx).WithFields(
 		log.Fields{"volume name": volName,
 			"arguments": mountArgs,
 		}).Info("Mounting volume with options ")
-	command := exec.Command("mount", mountArgs...)
-	output, err := command.CombinedOutput()
+	output, err := mountCommand(mountArgs)
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"volume name": volName,
 				"output": string(output),
 				"error":  err,
@@ -616,9 +764,40 @@ func (d *VolumeDriver) mountVFileVolume(volName string, mountpoint string, volRe
 	return nil
 }
 
+// writeCredentialsFile writes the Samba credentials of the volume to a new
+// file readable by root only, in the format of mount.cifs. Returns the file path.
+func (d *VolumeDriver) writeCredentialsFile(volRecord *VolumeMetadata) (string, error) {
+	// Volumes created before credentials were sealed have them in clear
+	creds := credentials.Credentials{Username: volRecord.Username, Password: volRecord.Password}
+	if volRecord.Credentials != "" {
+		var err error
+		if creds, err = d.sealer.Open(volRecord.Credentials); err != nil {
+			return "", err
+		}
+	}
+
+	if err := os.MkdirAll(credentialsDir, 0700); err != nil {
+		return "", err
+	}
+	file, err := ioutil.TempFile(credentialsDir, "cifs-")
+	if err != nil {
+		return "", err
+	}
+	_, err = fmt.Fprintf(file, "username=%s\npassword=%s\n", creds.Username, creds.Password)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
 // Unmount request from Docker. If mount refcount is drop to 0.
 func (d *VolumeDriver) Unmount(r volume.UnmountRequest) volume.Response {
-	log.WithFields(log.Fields{"name": r.Name}).Info("Unmounting Volume ")
+	ctx := requestid.Background()
+	requestid.Log(ctx).WithFields(log.Fields{"name": r.Name}).Info("Unmounting Volume ")
 	if !d.isInitialized {
 		return volume.Response{Err: initError}
 	}
@@ -626,6 +805,7 @@ func (d *VolumeDriver) Unmount(r volume.UnmountRequest) volume.Response {
 	// lock the state
 	d.RefCounts.StateMtx.Lock()
 	defer d.RefCounts.StateMtx.Unlock()
+	defer d.RefCounts.SaveState()
 
 	if d.RefCounts.IsInitialized() != true {
 		// if refcounting hasn't been succesful,
@@ -635,11 +815,11 @@ func (d *VolumeDriver) Unmount(r volume.UnmountRequest) volume.Response {
 		return volume.Response{Err: ""}
 	}
 
-	return d.processUnmount(r)
+	return d.processUnmount(ctx, r)
 }
 
 // processUnMount -  process a unmount request
-func (d *VolumeDriver) processUnmount(r volume.UnmountRequest) volume.Response {
+func (d *VolumeDriver) processUnmount(ctx context.Context, r volume.UnmountRequest) volume.Response {
 	if fullVolName, exist := d.MountIDtoName[r.ID]; exist {
 		r.Name = fullVolName
 		delete(d.MountIDtoName, r.ID) //cleanup the map
@@ -650,25 +830,25 @@ func (d *VolumeDriver) processUnmount(r volume.UnmountRequest) volume.Response {
 
 	// if refcount has been succcessful, Normal flow
 	// if the volume is still used by other containers, just return OK
-	refcnt, err := d.DecrRefCount(r.Name)
+	refcnt, err := d.DecrRefCount(ctx, r.Name)
 	if err != nil {
 		// something went wrong - yell, but still try to unmount
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": r.Name, "refcount": refcnt},
 		).Error("Refcount error - still trying to unmount...")
 	}
-	log.Debugf("volume name=%s refcnt=%d", r.Name, refcnt)
+	requestid.Log(ctx).Debugf("volume name=%s refcnt=%d", r.Name, refcnt)
 	if refcnt >= 1 {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": r.Name, "refcount": refcnt},
 		).Info("Still in use, skipping unmount request. ")
 		return volume.Response{Err: ""}
 	}
 
 	// and if nobody needs it, unmount and detach
-	err = d.UnmountVolume(r.Name)
+	err = d.unmountVolume(ctx, r.Name)
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": r.Name, "error": err.Error()},
 		).Error("Failed to unmount ")
 		return volume.Response{Err: err.Error()}
@@ -678,20 +858,25 @@ func (d *VolumeDriver) processUnmount(r volume.UnmountRequest) volume.Response {
 
 // UnmountVolume - Request detach and then unmount the volume.
 func (d *VolumeDriver) UnmountVolume(name string) error {
+	return d.unmountVolume(requestid.Background(), name)
+}
+
+// unmountVolume - see UnmountVolume
+func (d *VolumeDriver) unmountVolume(ctx context.Context, name string) error {
 	mountpoint := d.GetMountPoint(name)
-	err := fs.Unmount(mountpoint)
+	err := fs.Unmount(ctx, mountpoint)
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"mountpoint": mountpoint, "error": err},
 		).Error("Failed to unmount volume. Now trying to detach... ")
 		// Do not return error. Continue with detach.
 	}
 
 	// Decrease GRef
-	log.Infof("Before AtomicDecr")
+	requestid.Log(ctx).Infof("Before AtomicDecr")
 	err = d.kvStore.AtomicDecr(kvstore.VolPrefixGRef + name)
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": name,
 				"error": err},
 		).Error("Failed to derease global refcount when processUnmount ")
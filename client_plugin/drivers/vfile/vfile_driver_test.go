@@ -0,0 +1,325 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfile
+
+// Run the vFile volume state machine on the in-memory KV store and the mock
+// swarm: two hosts share a volume, with the refcount handler of the managers
+// starting and stopping its file server. Without Swarm, the host mounting a
+// volume first runs its file server, and stops it on the last unmount.
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/credentials"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/dockerops"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/kvstore"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/kvstore/etcdops"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile/kvstore/memkvs"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/refcount"
+)
+
+// testSealer stands for the cluster key shared by the nodes of the swarm
+var testSealer = credentials.NewSealer(make([]byte, 32))
+
+// mountRun is a mount command run by the driver
+type mountRun struct {
+	args        []string
+	credentials string // content of the credentials file, if any
+}
+
+// newTestSwarm returns a KV store and a swarm where managers handle refcount changes,
+// and records the mount commands run by the drivers
+func newTestSwarm(t *testing.T, root string) (*memkvs.MemKVS, *dockerops.MockDockerOps, *[]mountRun) {
+	kv := memkvs.NewKvStore()
+	ops := dockerops.NewMockDockerOps()
+	kv.Watch(kvstore.VolPrefixGRef, etcdops.RefcountHandler(kv, ops, testSealer, ""))
+	return kv, ops, recordMounts(t, root)
+}
+
+// recordMounts records the mount commands run by the drivers
+func recordMounts(t *testing.T, root string) *[]mountRun {
+	credentialsDir = filepath.Join(root, "credentials")
+	var mounts []mountRun
+	mountCommand = func(args []string) ([]byte, error) {
+		run := mountRun{args: args}
+		for _, opt := range strings.Split(args[3], ",") {
+			if strings.HasPrefix(opt, "credentials=") {
+				data, err := ioutil.ReadFile(strings.TrimPrefix(opt, "credentials="))
+				assert.Nil(t, err)
+				run.credentials = string(data)
+			}
+		}
+		mounts = append(mounts, run)
+		return nil, nil
+	}
+	return &mounts
+}
+
+// newTestDriver returns the driver of a host of the swarm
+func newTestDriver(t *testing.T, root string, host string, kv kvstore.KvStore, ops dockerops.DockerOps) *VolumeDriver {
+	d := &VolumeDriver{
+		dockerOps:            ops,
+		internalVolumeDriver: "vsphere",
+		kvStore:              kv,
+		sealer:               testSealer,
+		isInitialized:        true,
+	}
+	// Remove needs initialized refcounts, use an empty saved state rather than Docker.
+	// The state is only loaded in the boot it was saved in.
+	bootID, err := ioutil.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateFile := filepath.Join(root, host, "state.json")
+	if err = os.MkdirAll(filepath.Dir(stateFile), 0700); err != nil {
+		t.Fatal(err)
+	}
+	state := fmt.Sprintf(`{"BootID": %q}`, strings.TrimSpace(string(bootID)))
+	if err = ioutil.WriteFile(stateFile, []byte(state), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d.MountRoot = filepath.Join(root, host, "mnt")
+	d.MountIDtoName = make(map[string]string)
+	d.RefCounts = refcount.NewRefCountsMap()
+	d.RefCounts.SetStateFile(stateFile, d.MountIDtoName)
+	d.RefCounts.Init(d, d.MountRoot, "vfile")
+	return d
+}
+
+func TestSharedVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "vfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	kv, ops, mounts := newTestSwarm(t, root)
+	defer kv.Close()
+	host1 := newTestDriver(t, root, "host1", kv, ops)
+	host2 := newTestDriver(t, root, "host2", kv, ops)
+
+	assert.NotEmpty(t, host1.Create(volume.Request{Name: "vol1",
+		Options: map[string]string{"protocol": "afp"}}).Err)
+	if !assert.Empty(t, host1.Create(volume.Request{Name: "vol1",
+		Options: map[string]string{"size": "10gb"}}).Err) {
+		return
+	}
+	options, _ := ops.VolumeOptions(internalVolumePrefix + "vol1")
+	assert.Equal(t, map[string]string{"size": "10gb"}, options)
+	status, err := host2.GetVolume("vol1")
+	if assert.Nil(t, err) {
+		assert.Equal(t, string(kvstore.VolStateReady), status["Volume Status"])
+		assert.Equal(t, dockerops.ProtocolSMB, status["Protocol"])
+	}
+
+	// The first mount starts the file server, hosts mount it with the credentials of the volume
+	assert.Empty(t, host1.Mount(volume.MountRequest{Name: "vol1", ID: "c1"}).Err)
+	assert.Empty(t, host2.Mount(volume.MountRequest{Name: "vol1", ID: "c2"}).Err)
+	service, running := ops.Service("vol1")
+	if !assert.True(t, running) || !assert.Len(t, *mounts, 2) {
+		return
+	}
+	for i, run := range *mounts {
+		assert.Equal(t, "cifs", run.args[1])
+		assert.Contains(t, run.args[3], "port=30000")
+		assert.Equal(t, "//"+dockerops.MockNodeAddr+"/"+dockerops.FileShareName, run.args[4])
+		assert.Equal(t, "username="+service.Credentials.Username+"\npassword="+service.Credentials.Password+"\n",
+			run.credentials)
+		assert.Equal(t, []*VolumeDriver{host1, host2}[i].GetMountPoint("vol1"), run.args[5])
+	}
+	files, _ := ioutil.ReadDir(credentialsDir)
+	assert.Empty(t, files, "Credentials files are removed once mounted")
+	status, _ = host1.GetVolume("vol1")
+	assert.Equal(t, string(kvstore.VolStateMounted), status["Volume Status"])
+	assert.Equal(t, 2, status["Global Refcount"])
+
+	// The volume stays mounted until the last host unmounts it
+	assert.Empty(t, host1.Unmount(volume.UnmountRequest{Name: "vol1", ID: "c1"}).Err)
+	assert.Contains(t, host1.Remove(volume.Request{Name: "vol1"}).Err, "Mounted")
+	assert.Empty(t, host2.Unmount(volume.UnmountRequest{Name: "vol1", ID: "c2"}).Err)
+	_, err = kv.BlockingWaitAndGet(kvstore.VolPrefixState+"vol1", string(kvstore.VolStateReady),
+		kvstore.VolPrefixInfo+"vol1")
+	assert.Nil(t, err)
+	_, running = ops.Service("vol1")
+	assert.False(t, running)
+
+	assert.Empty(t, host1.Remove(volume.Request{Name: "vol1"}).Err)
+	_, err = host2.GetVolume("vol1")
+	assert.NotNil(t, err)
+	_, exists := ops.VolumeOptions(internalVolumePrefix + "vol1")
+	assert.False(t, exists)
+}
+
+func TestNFSVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "vfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	kv, ops, mounts := newTestSwarm(t, root)
+	defer kv.Close()
+	d := newTestDriver(t, root, "host1", kv, ops)
+
+	if !assert.Empty(t, d.Create(volume.Request{Name: "vol1",
+		Options: map[string]string{"protocol": "nfs"}}).Err) {
+		return
+	}
+	options, _ := ops.VolumeOptions(internalVolumePrefix + "vol1")
+	assert.Empty(t, options, "The protocol is not an option of the internal volume")
+	assert.Empty(t, d.Mount(volume.MountRequest{Name: "vol1", ID: "c1"}).Err)
+	service, _ := ops.Service("vol1")
+	assert.Equal(t, dockerops.ProtocolNFS, service.Protocol)
+	assert.Equal(t, credentials.Credentials{}, service.Credentials)
+	if assert.Len(t, *mounts, 1) {
+		run := (*mounts)[0]
+		assert.Equal(t, []string{"-t", "nfs4", "-o", "port=30000,vers=4.0",
+			dockerops.MockNodeAddr + ":/" + dockerops.FileShareName, d.GetMountPoint("vol1")}, run.args)
+	}
+
+	// The file server fails to stop, the volume cannot be removed
+	ops.FailFileServers = true
+	assert.Empty(t, d.Unmount(volume.UnmountRequest{Name: "vol1", ID: "c1"}).Err)
+	_, err = kv.BlockingWaitAndGet(kvstore.VolPrefixState+"vol1", string(kvstore.VolStateError),
+		kvstore.VolPrefixInfo+"vol1")
+	assert.Nil(t, err)
+	ops.FailFileServers = false
+	assert.Empty(t, d.Remove(volume.Request{Name: "vol1"}).Err, "Volumes in error can be removed")
+}
+
+// newTestHosts returns the drivers of hosts running file servers themselves,
+// and their mock Docker
+func newTestHosts(t *testing.T, root string, kv *memkvs.MemKVS) ([]*VolumeDriver, []*dockerops.MockDockerOps) {
+	var hosts []*VolumeDriver
+	var hostOps []*dockerops.MockDockerOps
+	for i, addr := range []string{"10.0.0.1", "10.0.0.2"} {
+		ops := dockerops.NewMockDockerOps()
+		ops.NodeAddr = addr
+		kv.Watch(kvstore.VolPrefixGRef, etcdops.RefcountHandler(kv, ops, testSealer, addr))
+		d := newTestDriver(t, root, "host"+strconv.Itoa(i+1), kv, ops)
+		d.serverHost = etcdops.NewFileServerHost(kv, ops, testSealer, addr)
+		hostOps = append(hostOps, ops)
+		hosts = append(hosts, d)
+	}
+	return hosts, hostOps
+}
+
+func TestHostFileServers(t *testing.T) {
+	root, err := ioutil.TempDir("", "vfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	mounts := recordMounts(t, root)
+	kv := memkvs.NewKvStore()
+	defer kv.Close()
+	hosts, hostOps := newTestHosts(t, root, kv)
+
+	if !assert.Empty(t, hosts[0].Create(volume.Request{Name: "vol1"}).Err) {
+		return
+	}
+	assert.Empty(t, hosts[1].Mount(volume.MountRequest{Name: "vol1", ID: "c1"}).Err)
+	assert.Empty(t, hosts[0].Mount(volume.MountRequest{Name: "vol1", ID: "c2"}).Err)
+
+	// The host mounting the volume first runs the file server, both mount
+	// it from that host
+	server := hostOps[1]
+	_, running := server.Service("vol1")
+	assert.True(t, running)
+	_, running = hostOps[0].Service("vol1")
+	assert.False(t, running, "File server runs on a single host")
+	if !assert.Len(t, *mounts, 2) {
+		return
+	}
+	for _, run := range *mounts {
+		assert.Equal(t, "//"+server.NodeAddr+"/"+dockerops.FileShareName, run.args[4])
+	}
+	status, _ := hosts[0].GetVolume("vol1")
+	assert.Equal(t, server.NodeAddr, status["File server address"])
+
+	// The host running the file server stops it
+	assert.Empty(t, hosts[1].Unmount(volume.UnmountRequest{Name: "vol1", ID: "c1"}).Err)
+	assert.Empty(t, hosts[0].Unmount(volume.UnmountRequest{Name: "vol1", ID: "c2"}).Err)
+	_, err = kv.BlockingWaitAndGet(kvstore.VolPrefixState+"vol1", string(kvstore.VolStateReady),
+		kvstore.VolPrefixInfo+"vol1")
+	assert.Nil(t, err)
+	_, running = server.Service("vol1")
+	assert.False(t, running)
+	status, _ = hosts[0].GetVolume("vol1")
+	assert.NotContains(t, status, "File server address")
+	assert.Empty(t, hosts[0].Remove(volume.Request{Name: "vol1"}).Err)
+}
+
+func TestFileServerTakeOver(t *testing.T) {
+	root, err := ioutil.TempDir("", "vfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	mounts := recordMounts(t, root)
+	kv := memkvs.NewKvStore()
+	defer kv.Close()
+	hosts, hostOps := newTestHosts(t, root, kv)
+
+	if !assert.Empty(t, hosts[0].Create(volume.Request{Name: "vol1"}).Err) {
+		return
+	}
+	assert.Empty(t, hosts[0].Mount(volume.MountRequest{Name: "vol1", ID: "c1"}).Err)
+
+	// The first host goes down with its file server
+	down := hostOps[0].NodeAddr
+	record := mountCommand
+	mountCommand = func(args []string) ([]byte, error) {
+		if strings.Contains(args[4], down) {
+			return nil, errors.New("Host is down")
+		}
+		return record(args)
+	}
+	reachable := serverReachable
+	defer func() { serverReachable = reachable }()
+	serverReachable = func(addr string, port int) bool {
+		return addr != down
+	}
+
+	// The next mount starts the file server again on its host
+	assert.Empty(t, hosts[1].Mount(volume.MountRequest{Name: "vol1", ID: "c2"}).Err)
+	_, running := hostOps[1].Service("vol1")
+	assert.True(t, running)
+	if assert.Len(t, *mounts, 2) {
+		assert.Equal(t, "//"+hostOps[1].NodeAddr+"/"+dockerops.FileShareName, (*mounts)[1].args[4])
+	}
+	status, _ := hosts[1].GetVolume("vol1")
+	assert.Equal(t, hostOps[1].NodeAddr, status["File server address"])
+	assert.Equal(t, string(kvstore.VolStateMounted), status["Volume Status"])
+
+	// The mount of the host which went down is still counted, the last
+	// unmount stops the file server
+	assert.Empty(t, hosts[1].Unmount(volume.UnmountRequest{Name: "vol1", ID: "c2"}).Err)
+	_, running = hostOps[1].Service("vol1")
+	assert.True(t, running)
+	assert.Empty(t, hosts[0].Unmount(volume.UnmountRequest{Name: "vol1", ID: "c1"}).Err)
+	_, err = kv.BlockingWaitAndGet(kvstore.VolPrefixState+"vol1", string(kvstore.VolStateReady),
+		kvstore.VolPrefixInfo+"vol1")
+	assert.Nil(t, err)
+	_, running = hostOps[1].Service("vol1")
+	assert.False(t, running)
+}
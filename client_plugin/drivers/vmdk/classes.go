@@ -0,0 +1,114 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Storage classes and host default create options, see config.Config.
+//
+// A volume created with -o class=<name> gets the create options of the class,
+// and all volumes get the host default create options, unless given
+// explicitly: explicit options win over the class, the class over host
+// defaults. The class is passed on to ESX along with the other options, to
+// be recorded in the volume metadata.
+//
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+)
+
+// cloneInheritedOpts are options clones get from their source volume,
+// classes and host defaults do not apply them to clones
+var cloneInheritedOpts = []string{"size", "fstype", fs.MkfsOptionsOpt, encryptOpt}
+
+// storageClasses holds the classes and host defaults of the configuration.
+// A nil storageClasses applies nothing.
+type storageClasses struct {
+	mtx      sync.RWMutex
+	classes  map[string]map[string]string
+	defaults map[string]string
+}
+
+func newStorageClasses(cfg config.Config) *storageClasses {
+	s := &storageClasses{}
+	s.set(cfg)
+	return s
+}
+
+// set replaces the classes and host defaults with those of cfg
+func (s *storageClasses) set(cfg config.Config) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.classes = cfg.Classes
+	s.defaults = cfg.DefaultCreateOptions
+}
+
+// apply adds the options of the requested class and the host defaults to opts
+func (s *storageClasses) apply(opts map[string]string) error {
+	if s == nil {
+		if _, ok := opts[config.ClassOpt]; ok {
+			return fmt.Errorf("No storage classes are defined")
+		}
+		return nil
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	name, ok := opts[config.ClassOpt]
+	if !ok {
+		name, ok = s.defaults[config.ClassOpt]
+	}
+	var class map[string]string
+	if ok {
+		if class, ok = s.classes[name]; !ok {
+			return fmt.Errorf("Unknown storage class %s, valid classes are %v", name, s.classNames())
+		}
+		opts[config.ClassOpt] = name
+	}
+
+	_, clone := opts["clone-from"]
+	for _, from := range []map[string]string{class, s.defaults} {
+		for k, v := range from {
+			if _, set := opts[k]; set || (clone && isCloneInherited(k)) {
+				continue
+			}
+			opts[k] = v
+		}
+	}
+	return nil
+}
+
+// classNames returns the sorted class names. Caller holds the lock.
+func (s *storageClasses) classNames() []string {
+	names := make([]string, 0, len(s.classes))
+	for name := range s.classes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func isCloneInherited(opt string) bool {
+	for _, o := range cloneInheritedOpts {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
+)
+
+func TestStorageClasses(t *testing.T) {
+	s := newStorageClasses(config.Config{
+		Classes: map[string]map[string]string{
+			"gold":   {"size": "10gb", "vsan-policy-name": "gold", "diskformat": "thin", "fstype": "xfs"},
+			"silver": {"size": "1gb"},
+		},
+		DefaultCreateOptions: map[string]string{"class": "silver", "access": "read-write", "size": "100mb"},
+	})
+
+	// Explicit options win over the class, the class over host defaults
+	opts := map[string]string{"class": "gold", "size": "20gb"}
+	assert.Nil(t, s.apply(opts))
+	assert.Equal(t, map[string]string{"class": "gold", "size": "20gb", "vsan-policy-name": "gold",
+		"diskformat": "thin", "fstype": "xfs", "access": "read-write"}, opts)
+
+	// Host default class
+	opts = map[string]string{}
+	assert.Nil(t, s.apply(opts))
+	assert.Equal(t, map[string]string{"class": "silver", "size": "1gb", "access": "read-write"}, opts)
+
+	// Clones keep the size and file system of their source
+	opts = map[string]string{"class": "gold", "clone-from": "src"}
+	assert.Nil(t, s.apply(opts))
+	assert.Equal(t, map[string]string{"class": "gold", "clone-from": "src", "vsan-policy-name": "gold",
+		"diskformat": "thin", "access": "read-write"}, opts)
+
+	assert.NotNil(t, s.apply(map[string]string{"class": "bronze"}))
+
+	// Reloaded without classes
+	s.set(config.Config{})
+	opts = map[string]string{"size": "1gb"}
+	assert.Nil(t, s.apply(opts))
+	assert.Equal(t, map[string]string{"size": "1gb"}, opts)
+	assert.NotNil(t, s.apply(map[string]string{"class": "gold"}))
+}
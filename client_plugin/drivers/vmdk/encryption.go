@@ -0,0 +1,251 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Volumes encrypted with LUKS ("-o encrypt=luks").
+//
+// The ESX service does not know about encryption: a volume is encrypted if its
+// disk holds a LUKS header, the file system is created and mounted on the
+// opened dm-crypt mapping. Keys are stored by the key provider, by full volume name.
+//
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/keyprovider"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/plugin_utils"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
+)
+
+const (
+	encryptOpt     = "encrypt"
+	luksEncryption = "luks"
+)
+
+// newKeyProvider returns the configured key provider, nil if none is configured
+func newKeyProvider(cfg config.Config) keyprovider.Provider {
+	location := cfg.KeyServerURL
+	if cfg.KeyProvider == keyprovider.FileProvider {
+		location = cfg.KeyDir
+		if location == "" {
+			location = config.DefaultKeyDir
+		}
+	}
+	keys, err := keyprovider.New(cfg.KeyProvider, location)
+	if err != nil {
+		log.WithFields(log.Fields{"provider": cfg.KeyProvider, "location": location,
+			"error": err}).Warning("Failed to set up the key provider, encrypted volumes are not available ")
+		return nil
+	}
+	return keys
+}
+
+// takeEncryptOption removes the encrypt option from the request, the ESX
+// service does not accept it. Returns true if the volume is to be encrypted.
+func (d *VolumeDriver) takeEncryptOption(r *volume.Request) (bool, error) {
+	value, ok := r.Options[encryptOpt]
+	if !ok {
+		return false, nil
+	}
+	delete(r.Options, encryptOpt)
+	if value != luksEncryption {
+		return false, fmt.Errorf("Invalid option for %s: %s. Valid options are: [%s]", encryptOpt, value, luksEncryption)
+	}
+	if _, clone := r.Options["clone-from"]; clone {
+		return false, fmt.Errorf("Cannot define %s for a clone, clones of encrypted volumes are encrypted", encryptOpt)
+	}
+	if d.keys == nil {
+		return false, fmt.Errorf("Cannot create encrypted volume %s, no KeyProvider configured", r.Name)
+	}
+	return true, nil
+}
+
+// keyName returns the full name of the volume, which its key is stored by
+func (d *VolumeDriver) keyName(ctx context.Context, name string) (string, error) {
+	if plugin_utils.IsFullVolName(name) {
+		return name, nil
+	}
+	volumeInfo, err := plugin_utils.GetVolumeInfo(ctx, name, "", d.withContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	return volumeInfo.VolumeName, nil
+}
+
+// mkfsEncrypted formats the device with LUKS, with a new key for the volume,
+// and creates the file system on the opened device.
+func (d *VolumeDriver) mkfsEncrypted(ctx context.Context, name string, fstype string, mkfsOptions string, device string) error {
+	keyName, err := d.keyName(ctx, name)
+	if err != nil {
+		return err
+	}
+	key, err := keyprovider.NewKey()
+	if err != nil {
+		return err
+	}
+	if err = d.keys.PutKey(keyName, key); err != nil {
+		return fmt.Errorf("Failed to store the key of volume %s: %v", keyName, err)
+	}
+
+	mapping := fs.LuksMappingName(name)
+	err = fs.LuksFormat(ctx, device, key)
+	if err == nil {
+		var mapped string
+		if mapped, err = fs.LuksOpen(device, mapping, key); err == nil {
+			err = fs.MkfsByDevicePath(ctx, fstype, name, mapped, mkfsOptions)
+			if errClose := fs.LuksClose(mapping); err == nil {
+				err = errClose
+			}
+		}
+	}
+	if err != nil {
+		if errKey := d.keys.DeleteKey(keyName); errKey != nil {
+			requestid.Log(ctx).WithFields(log.Fields{"name": keyName,
+				"error": errKey}).Warning("Failed to delete key ")
+		}
+		return err
+	}
+	requestid.Log(ctx).WithFields(log.Fields{"name": keyName}).Info("Volume encrypted ")
+	return nil
+}
+
+// encryptMockVolume encrypts a volume created by the mock ESX service
+func (d *VolumeDriver) encryptMockVolume(ctx context.Context, r volume.Request) volume.Response {
+	dev, err := d.ops.RawAttach(ctx, r.Name, nil)
+	if err == nil {
+		err = d.mkfsEncrypted(ctx, r.Name, r.Options["fstype"], r.Options[fs.MkfsOptionsOpt], string(dev[:]))
+	}
+	if err != nil {
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name,
+			"error": err}).Error("Failed to encrypt volume, removing the volume ")
+		d.detachAndRemove(ctx, r.Name)
+		return volume.Response{Err: err.Error()}
+	}
+	if err = d.detach(ctx, r.Name); err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	return volume.Response{Err: ""}
+}
+
+// openDevice returns the device to use for the volume: the device itself,
+// or the opened mapping if the volume is encrypted.
+func (d *VolumeDriver) openDevice(ctx context.Context, name string, device string) (string, error) {
+	encrypted, err := fs.IsLuks(device)
+	if err != nil {
+		// The device may not have shown up yet, let the caller fail on it
+		requestid.Log(ctx).WithFields(log.Fields{"name": name, "device": device,
+			"error": err}).Warning("Failed to read device header, continuing however.. ")
+		return device, nil
+	}
+	if !encrypted {
+		return device, nil
+	}
+	key, err := d.getKey(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	requestid.Log(ctx).WithFields(log.Fields{"name": name, "device": device}).Info("Opening encrypted volume ")
+	return fs.LuksOpen(device, fs.LuksMappingName(name), key)
+}
+
+// closeDevice closes the mapping of the volume, if it is encrypted and open
+func (d *VolumeDriver) closeDevice(ctx context.Context, name string) error {
+	err := fs.LuksClose(fs.LuksMappingName(name))
+	if err != nil {
+		requestid.Log(ctx).WithFields(log.Fields{"name": name, "error": err}).Error("Failed to close encrypted volume ")
+	}
+	return err
+}
+
+// resizeDevice makes the mounted device of the volume pick up the new size of
+// its disk. For encrypted volumes, the mapping is grown as well.
+func (d *VolumeDriver) resizeDevice(ctx context.Context, name string, device string) error {
+	disk := device
+	encrypted := strings.HasPrefix(device, fs.LuksMapperDir+"/")
+	if encrypted {
+		var err error
+		if disk, err = fs.LuksBackingDevice(device); err != nil {
+			return err
+		}
+	}
+	if err := fs.RescanDevice(ctx, disk); err != nil {
+		requestid.Log(ctx).WithFields(log.Fields{"name": name, "device": disk,
+			"error": err}).Warning("Failed to rescan device, continuing however.. ")
+	}
+	if !encrypted {
+		return nil
+	}
+	key, err := d.getKey(ctx, name)
+	if err != nil {
+		return err
+	}
+	return fs.LuksResize(fs.LuksMappingName(name), key)
+}
+
+// getKey returns the key of an encrypted volume
+func (d *VolumeDriver) getKey(ctx context.Context, name string) ([]byte, error) {
+	if d.keys == nil {
+		return nil, fmt.Errorf("Volume %s is encrypted, no KeyProvider configured", name)
+	}
+	keyName, err := d.keyName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	key, err := d.keys.GetKey(keyName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the key of encrypted volume %s: %v", keyName, err)
+	}
+	return key, nil
+}
+
+// copyKey gives a clone the key of its source volume, if the source is encrypted
+func (d *VolumeDriver) copyKey(ctx context.Context, srcName string, name string) error {
+	if d.keys == nil {
+		return nil
+	}
+	srcKeyName, err := d.keyName(ctx, srcName)
+	if err != nil {
+		return err
+	}
+	key, err := d.keys.GetKey(srcKeyName)
+	if err == keyprovider.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	keyName, err := d.keyName(ctx, name)
+	if err != nil {
+		return err
+	}
+	return d.keys.PutKey(keyName, key)
+}
+
+// deleteKey deletes the key of a removed volume, if any
+func (d *VolumeDriver) deleteKey(ctx context.Context, keyName string) {
+	if d.keys == nil || keyName == "" {
+		return
+	}
+	if err := d.keys.DeleteKey(keyName); err != nil {
+		requestid.Log(ctx).WithFields(log.Fields{"name": keyName, "error": err}).Warning("Failed to delete key ")
+	}
+}
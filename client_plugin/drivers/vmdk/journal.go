@@ -0,0 +1,215 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Intent journal of multi-step volume operations.
+//
+// Create (create, attach, wait, mkfs, detach), clone (clone, copy the key) and
+// Remove (remove, delete the key) take several steps, and a plugin crash in
+// between leaves a volume unformatted, attached, or without its key. Each step
+// an operation reaches is written to a file per volume in the journal directory,
+// and the file is removed once the operation returns, whether it succeeded or
+// failed (failures clean up after themselves). On plugin start, operations left
+// in the journal are completed if only cleanup is left, and undone otherwise.
+//
+// Create and clone record whether the volume existed before they started, and
+// recovery never removes a volume it did not create. A crash while the ESX
+// service creates the volume leaves it in an unknown state, such volumes are
+// reported and left alone.
+//
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
+)
+
+const (
+	opCreate = "create"
+	opClone  = "clone"
+	opRemove = "remove"
+
+	stepStarted   = "started"   // nothing done yet
+	stepCreated   = "created"   // volume created or cloned on ESX
+	stepAttached  = "attached"  // volume attached to create the file system
+	stepFormatted = "formatted" // file system created, volume still attached
+	stepRemoved   = "removed"   // volume removed on ESX
+
+	journalFileExt = ".json"
+)
+
+// intent is a multi-step operation in progress on a volume
+type intent struct {
+	Op      string
+	Name    string
+	Step    string
+	Source  string `json:",omitempty"` // source volume of a clone
+	KeyName string `json:",omitempty"` // key to delete, for encrypted volumes
+	Existed bool   `json:",omitempty"` // the volume existed before a create or clone
+	Time    time.Time
+}
+
+// journal keeps the intents of operations in progress, in dir.
+// A nil journal journals nothing.
+type journal struct {
+	dir string
+}
+
+// afterStep is called once a step is journaled, tests crash the driver here
+var afterStep = func(in *intent) {}
+
+// openJournal returns the journal in the configured directory, nil if it
+// cannot be used
+func openJournal(cfg config.Config) *journal {
+	dir := cfg.JournalDir
+	if dir == "" {
+		dir = config.DefaultJournalDir
+	}
+	if dir == "" {
+		return nil
+	}
+	j, err := newJournal(dir)
+	if err != nil {
+		log.WithFields(log.Fields{"dir": dir, "error": err}).Warning("Failed to open journal, operations interrupted by a crash are not recovered ")
+		return nil
+	}
+	return j
+}
+
+func newJournal(dir string) (*journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &journal{dir: dir}, nil
+}
+
+func (j *journal) path(name string) string {
+	return filepath.Join(j.dir, url.QueryEscape(name)+journalFileExt)
+}
+
+// begin journals the start of an operation
+func (j *journal) begin(in intent) *intent {
+	in.Time = time.Now()
+	j.step(&in, stepStarted)
+	return &in
+}
+
+// step journals that the operation reached step
+func (j *journal) step(in *intent, step string) {
+	in.Step = step
+	if j != nil {
+		data, err := json.Marshal(in)
+		if err == nil {
+			// Replace the intent atomically, a torn write would lose it
+			tmp := j.path(in.Name) + ".tmp"
+			if err = ioutil.WriteFile(tmp, data, 0600); err == nil {
+				err = os.Rename(tmp, j.path(in.Name))
+			}
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"name": in.Name, "op": in.Op, "step": step,
+				"error": err}).Warning("Failed to journal operation ")
+		}
+	}
+	afterStep(in)
+}
+
+// done removes a returned operation from the journal
+func (j *journal) done(in *intent) {
+	if j == nil {
+		return
+	}
+	if err := os.Remove(j.path(in.Name)); err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{"name": in.Name, "op": in.Op, "error": err}).Warning("Failed to remove journaled operation ")
+	}
+}
+
+// pending returns the operations left in the journal
+func (j *journal) pending() []intent {
+	if j == nil {
+		return nil
+	}
+	files, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		log.WithFields(log.Fields{"dir": j.dir, "error": err}).Warning("Failed to read journal ")
+		return nil
+	}
+	var intents []intent
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), journalFileExt) {
+			continue
+		}
+		path := filepath.Join(j.dir, file.Name())
+		var in intent
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &in)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"file": path, "error": err}).Warning("Dropping unreadable journaled operation ")
+			os.Remove(path)
+			continue
+		}
+		intents = append(intents, in)
+	}
+	return intents
+}
+
+// replayJournal completes or undoes the operations left in the journal by a crash
+func (d *VolumeDriver) replayJournal() {
+	ctx := requestid.Background()
+	for _, in := range d.journal.pending() {
+		f := log.Fields{"name": in.Name, "op": in.Op, "step": in.Step, "started": in.Time}
+		requestid.Log(ctx).WithFields(f).Warning("Recovering interrupted operation ")
+		switch {
+		case in.Op == opRemove:
+			// Docker asked for the volume to go, finish the job
+			if in.Step == stepStarted {
+				d.remove(ctx, in.Name)
+			}
+			d.deleteKey(ctx, in.KeyName)
+		case in.Step == stepStarted:
+			// Unless the volume existed already, ESX may have created it
+			if _, err := d.ops.Get(ctx, in.Name); err == nil && !in.Existed {
+				requestid.Log(ctx).WithFields(f).Warning("Volume may be incomplete, check it and remove it if needed ")
+			}
+		case in.Existed:
+			// Not created by this operation, it may hold data
+			d.detach(ctx, in.Name)
+			requestid.Log(ctx).WithFields(f).Warning("Volume existed before the operation, not removing it ")
+		case in.Op == opClone:
+			if err := d.copyKey(ctx, in.Source, in.Name); err != nil {
+				requestid.Log(ctx).WithFields(f).WithField("error", err).Warning("Failed to copy the key of the cloned volume, removing the clone ")
+				d.remove(ctx, in.Name)
+			}
+		case in.Step == stepFormatted:
+			d.detach(ctx, in.Name)
+		default:
+			// Created or attached, but without a file system
+			d.detachAndRemove(ctx, in.Name)
+			d.deleteKey(ctx, in.KeyName)
+		}
+		d.journal.done(&in)
+	}
+}
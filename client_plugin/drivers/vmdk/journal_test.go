@@ -0,0 +1,159 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+// Crash the driver at each journaled step of Create, clone and Remove, and
+// check the journal replay on restart. Needs root for the mock ESX service.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
+)
+
+// crash stands for the plugin process dying
+type crash struct{}
+
+// crashAt makes the driver crash once op reaches step. The journal is left
+// as it was at that point, deferred cleanup of the operation does not count.
+func crashAt(t *testing.T, j *journal, op string, step string) func() {
+	var saved []byte
+	var path string
+	afterStep = func(in *intent) {
+		if in.Op != op || in.Step != step {
+			return
+		}
+		data, err := ioutil.ReadFile(j.path(in.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved = data
+		path = j.path(in.Name)
+		panic(crash{})
+	}
+	return func() {
+		afterStep = func(in *intent) {}
+		if saved != nil {
+			assert.Nil(t, ioutil.WriteFile(path, saved, 0600))
+		}
+	}
+}
+
+// run runs the driver operation, returns true if it crashed
+func run(op func()) (crashed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(crash); !ok {
+				panic(r)
+			}
+			crashed = true
+		}
+	}()
+	op()
+	return false
+}
+
+func TestJournalReplay(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Mock ESX service needs root to set up loopback devices")
+	}
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	j := d.journal
+	ctx := requestid.Background()
+
+	exists := func(name string) bool {
+		_, err := d.ops.Get(ctx, name)
+		return err == nil
+	}
+	if !assert.Empty(t, d.Create(volume.Request{Name: "src", Options: map[string]string{"size": "10mb"}}).Err) {
+		return
+	}
+
+	tests := []struct {
+		op     string
+		step   string
+		run    func()
+		exists bool // after the replay
+	}{
+		// Crashed before the volume was created, nothing to do
+		{opCreate, stepStarted, func() { d.Create(volume.Request{Name: "vol1", Options: map[string]string{"size": "10mb"}}) }, false},
+		// Create of an existing volume, which is left alone
+		{opCreate, stepStarted, func() { d.Create(volume.Request{Name: "src", Options: map[string]string{"size": "10mb"}}) }, true},
+		// Created without a file system, undone
+		{opCreate, stepCreated, func() { d.Create(volume.Request{Name: "vol2", Options: map[string]string{"size": "10mb"}}) }, false},
+		{opClone, stepStarted, func() { d.Create(volume.Request{Name: "clone1", Options: map[string]string{"clone-from": "src"}}) }, false},
+		// Cloned, only the key is left to copy
+		{opClone, stepCreated, func() { d.Create(volume.Request{Name: "clone2", Options: map[string]string{"clone-from": "src"}}) }, true},
+		// Remove is completed
+		{opRemove, stepStarted, func() { d.Remove(volume.Request{Name: "clone2"}) }, false},
+	}
+	for _, test := range tests {
+		restore := crashAt(t, j, test.op, test.step)
+		assert.True(t, run(test.run), "%s should crash at %s", test.op, test.step)
+		restore()
+
+		pending := j.pending()
+		if assert.Len(t, pending, 1) {
+			assert.Equal(t, test.op, pending[0].Op)
+			assert.Equal(t, test.step, pending[0].Step)
+		}
+		d.replayJournal()
+		assert.Empty(t, j.pending(), "%s at %s", test.op, test.step)
+		assert.Equal(t, test.exists, exists(pending[0].Name), "%s at %s", test.op, test.step)
+	}
+
+	// The mock creates the file system along with the volume, so Create does not
+	// attach it: journal the steps it would crash at instead.
+	journaled := []struct {
+		step    string
+		existed bool
+		exists  bool // after the replay
+	}{
+		// Attached without a file system, undone
+		{stepAttached, false, false},
+		// Formatted, only the detach is left
+		{stepFormatted, false, true},
+		// Volumes which existed before are only detached
+		{stepCreated, true, true},
+		{stepAttached, true, true},
+	}
+	for i, test := range journaled {
+		name := fmt.Sprintf("journaled%d", i)
+		if !assert.Empty(t, d.Create(volume.Request{Name: name, Options: map[string]string{"size": "10mb"}}).Err) {
+			continue
+		}
+		if test.step != stepCreated {
+			_, err := d.ops.RawAttach(ctx, name, nil)
+			assert.Nil(t, err)
+		}
+		in := j.begin(intent{Op: opCreate, Name: name, Existed: test.existed})
+		j.step(in, test.step)
+
+		d.replayJournal()
+		assert.Empty(t, j.pending(), "%s at %s", name, test.step)
+		meta, err := d.ops.Get(ctx, name)
+		if assert.Equal(t, test.exists, err == nil, "%s at %s", name, test.step) && err == nil {
+			assert.Equal(t, "detached", meta["status"], "%s at %s", name, test.step)
+			assert.Empty(t, d.Remove(volume.Request{Name: name}).Err)
+		}
+	}
+	assert.Empty(t, d.Remove(volume.Request{Name: "src"}).Err)
+}
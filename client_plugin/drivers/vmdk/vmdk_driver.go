@@ -25,9 +25,11 @@ package vmdk
 //
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"sync"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
@@ -35,8 +37,10 @@ import (
 	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vmdk/vmdkops"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/keyprovider"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/plugin_utils"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/refcount"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
 )
 
 const version = "vSphere Volume Driver v0.5"
@@ -46,10 +50,27 @@ type VolumeDriver struct {
 	utils.PluginDriver
 	useMockEsx bool
 	ops        vmdkops.VmdkOps
+	cache      *volumeCache
+	keys       keyprovider.Provider
+	journal    *journal
+	classes    *storageClasses
 }
 
 // NewVolumeDriver creates Driver which to real ESX (useMockEsx=False) or a mock
 func NewVolumeDriver(cfg config.Config, mountDir string) *VolumeDriver {
+	d := NewStatelessVolumeDriver(cfg, mountDir)
+	d.journal = openJournal(cfg)
+	d.replayJournal()
+	d.RefCounts.SetStateFile(cfg.StateFile, d.MountIDtoName)
+	d.RefCounts.Init(d, mountDir, cfg.Driver)
+	d.RefCounts.StartReconciler(cfg.RefCountReconcileSec)
+	return d
+}
+
+// NewStatelessVolumeDriver creates Driver without discovering refcounts from Docker,
+// for commands serving a single request such as the FlexVolume driver. Volumes
+// mounted under mountDir are left alone, no recovery unmount is attempted.
+func NewStatelessVolumeDriver(cfg config.Config, mountDir string) *VolumeDriver {
 	var d *VolumeDriver
 
 	// Read command line flags
@@ -57,44 +78,83 @@ func NewVolumeDriver(cfg config.Config, mountDir string) *VolumeDriver {
 	useMockEsx := flag.Bool("mock_esx", false, "Mock the ESX service")
 	flag.Parse()
 
-	vmdkops.EsxPort = *port
-
 	if *useMockEsx {
 		d = &VolumeDriver{
 			useMockEsx: true,
 			ops:        vmdkops.VmdkOps{Cmd: vmdkops.NewMockCmd()},
 		}
 	} else {
+		transport, err := vmdkops.NewTransport(cfg.Transport, cfg.EsxAddress, *port)
+		if err != nil {
+			log.WithFields(log.Fields{"transport": cfg.Transport, "esx_address": cfg.EsxAddress,
+				"error": err}).Fatal("Failed to set up the transport to ESX ")
+		}
 		d = &VolumeDriver{
 			useMockEsx: false,
-			ops: vmdkops.VmdkOps{
-				Cmd: vmdkops.EsxVmdkCmd{
-					Mtx: &sync.Mutex{},
-				},
-			},
+			ops:        vmdkops.VmdkOps{Cmd: vmdkops.NewEsxCmd(transport)},
 		}
 	}
+	d.ops.Timeouts = vmdkops.TimeoutsFromSeconds(cfg.CmdTimeoutsSec)
+	d.cache = newVolumeCache(cacheTTL(cfg.VolumeCacheTTLSec))
+	d.keys = newKeyProvider(cfg)
+	d.classes = newStorageClasses(cfg)
 
 	d.MountRoot = mountDir
 	d.RefCounts = refcount.NewRefCountsMap()
-	d.RefCounts.Init(d, mountDir, cfg.Driver)
 	d.MountIDtoName = make(map[string]string)
 
 	log.WithFields(log.Fields{
-		"version":  version,
-		"port":     vmdkops.EsxPort,
-		"mock_esx": *useMockEsx,
+		"version":   version,
+		"port":      *port,
+		"mock_esx":  *useMockEsx,
+		"transport": cfg.Transport,
+		"cache_ttl": d.cache.ttl,
+		"keys":      cfg.KeyProvider,
+		"classes":   len(cfg.Classes),
 	}).Info("Docker VMDK plugin started ")
 
 	return d
 }
 
+// cacheTTL returns the volume cache TTL, 0 disables the cache
+func cacheTTL(ttlSec int) time.Duration {
+	if ttlSec == 0 {
+		ttlSec = config.DefaultVolumeCacheTTLSec
+	}
+	if ttlSec < 0 {
+		return 0
+	}
+	return time.Duration(ttlSec) * time.Second
+}
+
+// Reload applies the volume cache TTL, ESX command timeouts and storage classes of cfg
+func (d *VolumeDriver) Reload(cfg config.Config) {
+	d.cache.setTTL(cacheTTL(cfg.VolumeCacheTTLSec))
+	d.ops.UpdateTimeouts(vmdkops.TimeoutsFromSeconds(cfg.CmdTimeoutsSec))
+	d.classes.set(cfg)
+	log.WithFields(log.Fields{"cache_ttl": cacheTTL(cfg.VolumeCacheTTLSec),
+		"timeouts": cfg.CmdTimeoutsSec, "classes": len(cfg.Classes)}).Info("Driver settings reloaded ")
+}
+
+// CacheStats returns the counters of the volume metadata cache
+func (d *VolumeDriver) CacheStats() CacheStats {
+	return d.cache.getStats()
+}
+
+// FlushCache drops all cached volume metadata
+func (d *VolumeDriver) FlushCache() {
+	d.cache.flush()
+}
+
 // Get info about a single volume
 func (d *VolumeDriver) Get(r volume.Request) volume.Response {
-	status, err := d.GetVolume(r.Name)
+	ctx := requestid.Background()
+	status, err := d.getVolume(ctx, r.Name)
 	if err != nil {
 		return volume.Response{Err: err.Error()}
 	}
+	// Snapshots, if any, come with the (cached) volume status
+	status = d.withLocalStatus(ctx, r.Name, status)
 	mountpoint := d.GetMountPoint(r.Name)
 	return volume.Response{Volume: &volume.Volume{Name: r.Name,
 		Mountpoint: mountpoint,
@@ -103,9 +163,12 @@ func (d *VolumeDriver) Get(r volume.Request) volume.Response {
 
 // List volumes known to the driver
 func (d *VolumeDriver) List(r volume.Request) volume.Response {
-	volumes, err := d.ops.List()
+	ctx := requestid.Background()
+	volumes, err := d.cache.list(func() ([]vmdkops.VolumeData, error) {
+		return d.ops.List(ctx)
+	})
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to get volume list ")
+		requestid.Log(ctx).WithFields(log.Fields{"error": err}).Error("Failed to get volume list ")
 		return volume.Response{Err: err.Error()}
 	}
 	responseVolumes := make([]*volume.Volume, 0, len(volumes))
@@ -124,16 +187,42 @@ func (d *VolumeDriver) List(r volume.Request) volume.Response {
 
 // GetVolume - return volume meta-data.
 func (d *VolumeDriver) GetVolume(name string) (map[string]interface{}, error) {
+	ctx := requestid.Background()
+	status, err := d.getVolume(ctx, name)
+	if err != nil {
+		return status, err
+	}
+	return d.withLocalStatus(ctx, name, status), nil
+}
+
+// withLocalStatus returns a copy of the (possibly cached) volume meta-data,
+// with how the volume is used on this host. Volumes are mounted by full name.
+func (d *VolumeDriver) withLocalStatus(ctx context.Context, name string, status map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(status)+1)
+	for k, v := range status {
+		result[k] = v
+	}
+	if datastore, ok := status["datastore"].(string); ok && !plugin_utils.IsFullVolName(name) {
+		name = name + "@" + datastore
+	}
+	d.AddLocalStatus(ctx, name, result)
+	return result
+}
+
+// getVolume - return volume meta-data, logging with the request ID in ctx.
+func (d *VolumeDriver) getVolume(ctx context.Context, name string) (map[string]interface{}, error) {
 	// Get for empty volume name is issued by docker when it is coming up. Issue #1833
 	// Just return the error in such case.
 	if name == "" {
 		return nil, fmt.Errorf(" No volume with name as empty string exists")
 	}
 
-	mdata, err := d.ops.Get(name)
+	mdata, err := d.cache.get(name, func() (map[string]interface{}, error) {
+		return d.ops.Get(ctx, name)
+	})
 
 	if err != nil {
-		log.WithFields(log.Fields{"name": name, "error": err}).Error("Failed to get volume meta-data ")
+		requestid.Log(ctx).WithFields(log.Fields{"name": name, "error": err}).Error("Failed to get volume meta-data ")
 	}
 	return mdata, err
 }
@@ -141,42 +230,52 @@ func (d *VolumeDriver) GetVolume(name string) (map[string]interface{}, error) {
 // MountVolume - Request attach and then mounts the volume.
 // Actual mount - send attach to ESX and do the in-guest magic
 // Returns mount point and  error (or nil)
-func (d *VolumeDriver) MountVolume(name string, fstype string, id string, isReadOnly bool, skipAttach bool) (string, error) {
+func (d *VolumeDriver) MountVolume(name string, fstype string, id string, isReadOnly bool, skipAttach bool, mountOptions string) (string, error) {
+	return d.mountVolume(requestid.Background(), name, fstype, isReadOnly, mountOptions)
+}
+
+// mountVolume - see MountVolume
+func (d *VolumeDriver) mountVolume(ctx context.Context, name string, fstype string, isReadOnly bool, mountOptions string) (string, error) {
 	mountpoint := d.GetMountPoint(name)
+	defer d.cache.invalidate(name)
 
 	// First, make sure  that mountpoint exists.
-	err := fs.Mkdir(mountpoint)
+	err := fs.Mkdir(ctx, mountpoint)
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": name,
 				"dir": mountpoint},
 		).Error("Failed to make directory for volume mount ")
 		return mountpoint, err
 	}
 
-	waitCtx, errWait := fs.DevAttachWaitPrep()
+	waitCtx, errWait := fs.DevAttachWaitPrep(ctx)
 	if errWait != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": name,
 				"error": errWait},
 		).Warning("Failed to initialize wait context, continuing however.. ")
 	}
 
 	if d.useMockEsx {
-		dev, err := d.ops.RawAttach(name, nil)
+		dev, err := d.ops.RawAttach(ctx, name, nil)
 		if err != nil {
-			log.WithFields(
+			requestid.Log(ctx).WithFields(
 				log.Fields{"name": name,
 					"error": err},
 			).Error("Failed to attach volume ")
 			return mountpoint, err
 		}
-		return mountpoint, fs.MountByDevicePath(mountpoint, fstype, string(dev[:]), false)
+		device, err := d.openDevice(ctx, name, string(dev[:]))
+		if err != nil {
+			return mountpoint, err
+		}
+		return mountpoint, fs.MountByDevicePath(ctx, mountpoint, fstype, device, false, mountOptions)
 	}
 
-	volDev, err := d.ops.Attach(name, nil)
+	volDev, err := d.ops.Attach(ctx, name, nil)
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": name,
 				"error": err},
 		).Error("Attach volume failed ")
@@ -185,34 +284,41 @@ func (d *VolumeDriver) MountVolume(name string, fstype string, id string, isRead
 
 	if errWait != nil {
 		fs.DevAttachWaitFallback()
-		return mountpoint, fs.Mount(mountpoint, fstype, volDev, false)
+		return mountpoint, d.mountAttached(ctx, name, mountpoint, fstype, volDev, false, mountOptions)
 	}
 
-	fs.DevAttachWait(waitCtx, volDev)
+	fs.DevAttachWait(ctx, waitCtx, volDev)
 
 	// May have timed out waiting for the attach to complete,
 	// attempt the mount anyway.
-	return mountpoint, fs.Mount(mountpoint, fstype, volDev, isReadOnly)
+	return mountpoint, d.mountAttached(ctx, name, mountpoint, fstype, volDev, isReadOnly, mountOptions)
 }
 
 // UnmountVolume - Unmounts the volume and then requests detach
 func (d *VolumeDriver) UnmountVolume(name string) error {
+	return d.unmountVolume(requestid.Background(), name)
+}
+
+// unmountVolume - see UnmountVolume
+func (d *VolumeDriver) unmountVolume(ctx context.Context, name string) error {
 	mountpoint := d.GetMountPoint(name)
-	err := fs.Unmount(mountpoint)
+	defer d.cache.invalidate(name)
+	err := fs.Unmount(ctx, mountpoint)
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"mountpoint": mountpoint, "error": err},
 		).Error("Failed to unmount volume. Now trying to detach... ")
 		// Do not return error. Continue with detach.
 	}
-	return d.ops.Detach(name, nil)
+	d.closeDevice(ctx, name)
+	return d.ops.Detach(ctx, name, nil)
 }
 
 // private function that does the job of mounting volume in conjunction with refcounting
-func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
-	volumeInfo, err := plugin_utils.GetVolumeInfo(r.Name, "", d)
+func (d *VolumeDriver) processMount(ctx context.Context, r volume.MountRequest) volume.Response {
+	volumeInfo, err := plugin_utils.GetVolumeInfo(ctx, r.Name, "", d.withContext(ctx))
 	if err != nil {
-		log.Errorf("Unable to get volume info for volume %s. err:%v", r.Name, err)
+		requestid.Log(ctx).Errorf("Unable to get volume info for volume %s. err:%v", r.Name, err)
 		return volume.Response{Err: err.Error()}
 	}
 	r.Name = volumeInfo.VolumeName
@@ -221,24 +327,24 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 	// If the volume is already mounted , just increase the refcount.
 	// Note: for new keys, GO maps return zero value, so no need for if_exists.
 	refcnt := d.IncrRefCount(r.Name) // save map traversal
-	log.Debugf("volume name=%s refcnt=%d", r.Name, refcnt)
+	requestid.Log(ctx).Debugf("volume name=%s refcnt=%d", r.Name, refcnt)
 	if refcnt > 1 {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": r.Name, "refcount": refcnt},
 		).Info("Already mounted, skipping mount. ")
 		return volume.Response{Mountpoint: d.GetMountPoint(r.Name)}
 	}
 
-	if plugin_utils.AlreadyMounted(r.Name, d.MountRoot) {
-		log.WithFields(log.Fields{"name": r.Name}).Info("Already mounted, skipping mount. ")
+	if plugin_utils.AlreadyMounted(ctx, r.Name, d.MountRoot) {
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name}).Info("Already mounted, skipping mount. ")
 		return volume.Response{Mountpoint: d.GetMountPoint(r.Name)}
 	}
 
 	// get volume metadata if required
 	volumeMeta := volumeInfo.VolumeMeta
 	if volumeMeta == nil {
-		if volumeMeta, err = d.GetVolume(r.Name); err != nil {
-			d.DecrRefCount(r.Name)
+		if volumeMeta, err = d.getVolume(ctx, r.Name); err != nil {
+			d.DecrRefCount(ctx, r.Name)
 			return volume.Response{Err: err.Error()}
 		}
 	}
@@ -246,14 +352,14 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 	fstype := fs.FstypeDefault
 	isReadOnly := false
 	if err != nil {
-		d.DecrRefCount(r.Name)
+		d.DecrRefCount(ctx, r.Name)
 		return volume.Response{Err: err.Error()}
 	}
 	// Check access type.
 	value, exists := volumeMeta["access"].(string)
 	if !exists {
 		msg := fmt.Sprintf("Invalid access type for %s, assuming read-write access.", r.Name)
-		log.WithFields(log.Fields{"name": r.Name, "error": msg}).Error("")
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "error": msg}).Error("")
 		isReadOnly = false
 	} else if value == "read-only" {
 		isReadOnly = true
@@ -264,22 +370,25 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 	if !exists {
 		msg := fmt.Sprintf("Invalid filesystem type for %s, assuming type as %s.",
 			r.Name, fstype)
-		log.WithFields(log.Fields{"name": r.Name, "error": msg}).Error("")
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "error": msg}).Error("")
 		// Fail back to a default version that we can try with.
 		value = fs.FstypeDefault
 	}
 	fstype = value
 
-	mountpoint, err := d.MountVolume(r.Name, fstype, "", isReadOnly, false)
+	// Mount options are optional, checked when the volume was created
+	mountOptions, _ := volumeMeta[fs.MountOptionsOpt].(string)
+
+	mountpoint, err := d.mountVolume(ctx, r.Name, fstype, isReadOnly, mountOptions)
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": r.Name, "error": err.Error()},
 		).Error("Failed to mount ")
 
-		refcnt, _ := d.DecrRefCount(r.Name)
+		refcnt, _ := d.DecrRefCount(ctx, r.Name)
 		if refcnt == 0 {
-			log.Infof("Detaching %s - it is not used anymore", r.Name)
-			d.ops.Detach(r.Name, nil) // try to detach before failing the request for volume
+			requestid.Log(ctx).Infof("Detaching %s - it is not used anymore", r.Name)
+			d.detach(ctx, r.Name) // try to detach before failing the request for volume
 		}
 		return volume.Response{Err: err.Error()}
 	}
@@ -289,63 +398,195 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 
 // prepareCreateOptions sets default options for the given request, allocates
 // request options if needed
-func (d *VolumeDriver) prepareCreateOptions(r *volume.Request) error {
+func (d *VolumeDriver) prepareCreateOptions(ctx context.Context, r *volume.Request) error {
 	if r.Options == nil {
 		r.Options = make(map[string]string)
 	}
 
+	// Options of the storage class and host defaults, unless given explicitly
+	if err := d.classes.apply(r.Options); err != nil {
+		return err
+	}
+
 	// Use default fstype if both fstype and clone-from are not specified.
 	_, fstypeRes := r.Options["fstype"]
 	_, cloneFromRes := r.Options["clone-from"]
 	if !fstypeRes && !cloneFromRes {
-		log.WithFields(log.Fields{"req": r}).Debugf("Setting fstype to %s ", fs.FstypeDefault)
+		requestid.Log(ctx).WithFields(log.Fields{"req": r}).Debugf("Setting fstype to %s ", fs.FstypeDefault)
 		r.Options["fstype"] = fs.FstypeDefault
 	}
 
 	// Check whether the fstype filesystem is supported.
 	if _, fstypeRes = r.Options["fstype"]; fstypeRes {
-		err := fs.VerifyFSSupport(r.Options["fstype"])
+		err := fs.VerifyFSSupport(ctx, r.Options["fstype"])
 		if err != nil {
-			log.WithFields(log.Fields{"name": r.Name, "fstype": r.Options["fstype"],
+			requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "fstype": r.Options["fstype"],
 				"error": err}).Error("Not supported ")
 			return err
 		}
 	}
-	return nil
+	return d.validateFsOptions(ctx, r)
+}
+
+// validateFsOptions checks mount and mkfs options against the file system type.
+// Clones have the file system of their source volume, and cannot be given mkfs options.
+func (d *VolumeDriver) validateFsOptions(ctx context.Context, r *volume.Request) error {
+	mountOptions, mountRes := r.Options[fs.MountOptionsOpt]
+	mkfsOptions, mkfsRes := r.Options[fs.MkfsOptionsOpt]
+	if !mountRes && !mkfsRes {
+		return nil
+	}
+
+	fstype := r.Options["fstype"]
+	if srcName, cloneFromRes := r.Options["clone-from"]; cloneFromRes {
+		if mkfsRes {
+			return fmt.Errorf("Cannot define %s for a clone", fs.MkfsOptionsOpt)
+		}
+		srcMeta, err := d.getVolume(ctx, srcName)
+		if err != nil {
+			return err
+		}
+		if fstype, _ = srcMeta["fstype"].(string); fstype == "" {
+			fstype = fs.FstypeDefault
+		}
+	}
+
+	err := fs.ValidateMountOptions(fstype, mountOptions)
+	if err == nil {
+		err = fs.ValidateMkfsOptions(fstype, mkfsOptions)
+	}
+	if err != nil {
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "fstype": fstype,
+			"error": err}).Error("Not supported ")
+	}
+	return err
 }
 
 // cloneFrom clones an existing volume.
-func (d *VolumeDriver) cloneFrom(r volume.Request) volume.Response {
-	errClone := d.ops.Create(r.Name, r.Options)
+func (d *VolumeDriver) cloneFrom(ctx context.Context, r volume.Request) volume.Response {
+	// Recovery only removes the volume if this request created it
+	_, errGet := d.ops.Get(ctx, r.Name)
+	in := d.journal.begin(intent{Op: opClone, Name: r.Name, Source: r.Options["clone-from"], Existed: errGet == nil})
+	defer d.journal.done(in)
+
+	errClone := d.ops.Create(ctx, r.Name, r.Options)
 	if errClone != nil {
-		log.WithFields(log.Fields{"name": r.Name, "error": errClone}).Error("Clone volume failed ")
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "error": errClone}).Error("Clone volume failed ")
 		return volume.Response{Err: errClone.Error()}
 	}
+	d.journal.step(in, stepCreated)
+
+	// Clones of encrypted volumes are encrypted with the same key
+	errKey := d.copyKey(ctx, r.Options["clone-from"], r.Name)
+	if errKey != nil {
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name,
+			"error": errKey}).Error("Failed to copy the key of the cloned volume, removing the clone ")
+		d.remove(ctx, r.Name)
+		return volume.Response{Err: errKey.Error()}
+	}
 	return volume.Response{Err: ""}
 }
 
+// snapshotOf takes a snapshot of an existing volume, named after r.Name without the
+// datastore, and makes it available as a read-only clone named r.Name. The source
+// volume can be reverted to the snapshot, which is deleted along with the clone.
+// The clone is made from the snapshot's disk, not the live disk of the source.
+func (d *VolumeDriver) snapshotOf(ctx context.Context, r volume.Request, srcName string) volume.Response {
+	if len(r.Options) != 1 {
+		msg := fmt.Sprintf("Cannot define other options with snapshot-of, snapshot=%s", r.Name)
+		requestid.Log(ctx).Error(msg)
+		return volume.Response{Err: msg}
+	}
+	snapName := snapshotName(r.Name)
+	errSnapshot := d.ops.Snapshot(ctx, srcName, snapName)
+	d.cache.invalidate(srcName)
+	if errSnapshot != nil {
+		requestid.Log(ctx).WithFields(log.Fields{"name": srcName, "snapshot": snapName,
+			"error": errSnapshot}).Error("Snapshot volume failed ")
+		return volume.Response{Err: errSnapshot.Error()}
+	}
+
+	resp := d.cloneFrom(ctx, volume.Request{Name: r.Name,
+		Options: map[string]string{"clone-from": srcName, "clone-snapshot": snapName, "access": "read-only"}})
+	if resp.Err != "" {
+		requestid.Log(ctx).WithFields(log.Fields{"name": srcName, "snapshot": snapName,
+			"error": resp.Err}).Error("Failed to create the snapshot volume, deleting the snapshot ")
+		d.deleteSnapshot(ctx, srcName, snapName)
+		return resp
+	}
+	requestid.Log(ctx).WithFields(log.Fields{"name": srcName, "snapshot": snapName}).Info("Volume snapshot created ")
+	return volume.Response{Err: ""}
+}
+
+// snapshotName returns the name of the snapshot backing the snapshot volume name
+func snapshotName(name string) string {
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// snapshotSource returns the volume which snapshot volume name was taken of,
+// or "" if name is not a snapshot volume.
+func (d *VolumeDriver) snapshotSource(ctx context.Context, name string) string {
+	meta, err := d.getVolume(ctx, name)
+	if err != nil {
+		return ""
+	}
+	// ESX reports "None" for volumes which are not clones
+	srcName, _ := meta["clone-from"].(string)
+	if srcName == "" || srcName == "None" {
+		return ""
+	}
+	srcMeta, err := d.getVolume(ctx, srcName)
+	if err != nil {
+		return ""
+	}
+	snapshots, _ := srcMeta["snapshots"].([]interface{})
+	for _, snap := range snapshots {
+		if info, ok := snap.(map[string]interface{}); ok && info["Name"] == snapshotName(name) {
+			return srcName
+		}
+	}
+	return ""
+}
+
+// deleteSnapshot deletes a snapshot of a volume, or prints a warning log on failure.
+func (d *VolumeDriver) deleteSnapshot(ctx context.Context, name string, snapName string) error {
+	defer d.cache.invalidate(name)
+	errDelete := d.ops.DeleteSnapshot(ctx, name, snapName)
+	if errDelete != nil {
+		requestid.Log(ctx).WithFields(log.Fields{"name": name, "snapshot": snapName,
+			"error": errDelete}).Warning("Delete snapshot failed ")
+	}
+	return errDelete
+}
+
 // detach detaches a volume, or prints a warning log on failure.
-func (d *VolumeDriver) detach(name string) error {
-	errDetach := d.ops.Detach(name, nil)
+func (d *VolumeDriver) detach(ctx context.Context, name string) error {
+	defer d.cache.invalidate(name)
+	d.closeDevice(ctx, name)
+	errDetach := d.ops.Detach(ctx, name, nil)
 	if errDetach != nil {
-		log.WithFields(log.Fields{"name": name, "error": errDetach}).Warning("Detach volume failed ")
+		requestid.Log(ctx).WithFields(log.Fields{"name": name, "error": errDetach}).Warning("Detach volume failed ")
 	}
 	return errDetach
 }
 
 // remove removes a volume, or prints a warning log on failure.
-func (d *VolumeDriver) remove(name string) error {
-	errRemove := d.ops.Remove(name, nil)
+func (d *VolumeDriver) remove(ctx context.Context, name string) error {
+	defer d.cache.invalidate(name)
+	errRemove := d.ops.Remove(ctx, name, nil)
 	if errRemove != nil {
-		log.WithFields(log.Fields{"name": name, "error": errRemove}).Warning("Remove volume failed ")
+		requestid.Log(ctx).WithFields(log.Fields{"name": name, "error": errRemove}).Warning("Remove volume failed ")
 	}
 	return errRemove
 }
 
 // detachAndRemove detaches a volume and then removes it, ignoring any errors.
-func (d *VolumeDriver) detachAndRemove(name string) {
-	d.detach(name)
-	d.remove(name)
+func (d *VolumeDriver) detachAndRemove(ctx context.Context, name string) {
+	d.detach(ctx, name)
+	d.remove(ctx, name)
 }
 
 // No need to actually manifest the volume on the filesystem yet
@@ -354,83 +595,119 @@ func (d *VolumeDriver) detachAndRemove(name string) {
 
 // Create creates a volume.
 func (d *VolumeDriver) Create(r volume.Request) volume.Response {
-	err := d.prepareCreateOptions(&r)
+	ctx := requestid.Background()
+	defer d.cache.invalidate(r.Name)
+
+	// If taking a snapshot of an existent volume, snapshot and return
+	if srcName, result := r.Options["snapshot-of"]; result {
+		return d.snapshotOf(ctx, r, srcName)
+	}
+
+	err := d.prepareCreateOptions(ctx, &r)
 	if err != nil {
-		log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Failed to prepare options ")
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "error": err}).Error("Failed to prepare options ")
+		return volume.Response{Err: err.Error()}
+	}
+
+	encrypt, err := d.takeEncryptOption(&r)
+	if err != nil {
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "error": err}).Error("Invalid encryption option ")
 		return volume.Response{Err: err.Error()}
 	}
 
 	// If cloning a existent volume, create and return
 	if _, result := r.Options["clone-from"]; result {
-		return d.cloneFrom(r)
+		return d.cloneFrom(ctx, r)
 	}
 
-	errCreate := d.ops.Create(r.Name, r.Options)
+	// Recovery only removes the volume if this request created it
+	_, errGet := d.ops.Get(ctx, r.Name)
+	in := d.journal.begin(intent{Op: opCreate, Name: r.Name, Existed: errGet == nil})
+	defer d.journal.done(in)
+
+	errCreate := d.ops.Create(ctx, r.Name, r.Options)
 	if errCreate != nil {
-		log.WithFields(log.Fields{"name": r.Name, "error": errCreate}).Error("Create volume failed ")
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "error": errCreate}).Error("Create volume failed ")
 		return volume.Response{Err: errCreate.Error()}
 	}
+	if encrypt {
+		// Recovery deletes the key along with the volume
+		in.KeyName, _ = d.keyName(ctx, r.Name)
+	}
+	d.journal.step(in, stepCreated)
+
+	// The mock creates the file system along with the volume,
+	// encrypted volumes get a new one on the LUKS device
+	if d.useMockEsx {
+		if encrypt {
+			return d.encryptMockVolume(ctx, r)
+		}
+		return volume.Response{Err: ""}
+	}
 
 	// Handle filesystem creation
-	log.WithFields(log.Fields{"name": r.Name,
+	requestid.Log(ctx).WithFields(log.Fields{"name": r.Name,
 		"fstype": r.Options["fstype"]}).Info("Attaching volume and creating filesystem ")
 
-	waitCtx, errWait := fs.DevAttachWaitPrep()
+	waitCtx, errWait := fs.DevAttachWaitPrep(ctx)
 	if errWait != nil {
-		log.WithFields(log.Fields{"name": r.Name,
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name,
 			"error": errWait}).Warning("Failed to initialize wait context, continuing however.. ")
 	}
 
-	volDev, errAttach := d.ops.Attach(r.Name, nil)
+	volDev, errAttach := d.ops.Attach(ctx, r.Name, nil)
 	if errAttach != nil {
-		log.WithFields(log.Fields{"name": r.Name,
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name,
 			"error": errAttach}).Error("Attach volume failed, removing the volume ")
-		d.remove(r.Name)
+		d.remove(ctx, r.Name)
 		return volume.Response{Err: errAttach.Error()}
 	}
+	d.journal.step(in, stepAttached)
 
 	if errWait != nil {
 		fs.DevAttachWaitFallback()
 	} else {
 		// Wait for the attach to complete, may timeout
 		// in which case we continue creating the file system.
-		errAttachWait := fs.DevAttachWait(waitCtx, volDev)
+		errAttachWait := fs.DevAttachWait(ctx, waitCtx, volDev)
 		if errAttachWait != nil {
-			log.WithFields(log.Fields{"name": r.Name,
+			requestid.Log(ctx).WithFields(log.Fields{"name": r.Name,
 				"error": errAttachWait}).Error("Could not find attached device, removing the volume ")
-			d.detachAndRemove(r.Name)
+			d.detachAndRemove(ctx, r.Name)
 			return volume.Response{Err: errAttachWait.Error()}
 		}
 	}
 
-	errMkfs := fs.Mkfs(r.Options["fstype"], r.Name, volDev)
+	errMkfs := d.mkfsAttached(ctx, r.Name, r.Options["fstype"], r.Options[fs.MkfsOptionsOpt], volDev, encrypt)
 	if errMkfs != nil {
-		log.WithFields(log.Fields{"name": r.Name,
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name,
 			"error": errMkfs}).Error("Create filesystem failed, removing the volume ")
-		d.detachAndRemove(r.Name)
+		d.detachAndRemove(ctx, r.Name)
 		return volume.Response{Err: errMkfs.Error()}
 	}
+	d.journal.step(in, stepFormatted)
 
-	errDetach := d.ops.Detach(r.Name, nil)
+	errDetach := d.ops.Detach(ctx, r.Name, nil)
 	if errDetach != nil {
-		log.WithFields(log.Fields{"name": r.Name, "error": errDetach}).Error("Detach volume failed ")
+		requestid.Log(ctx).WithFields(log.Fields{"name": r.Name, "error": errDetach}).Error("Detach volume failed ")
 		return volume.Response{Err: errDetach.Error()}
 	}
 
-	log.WithFields(log.Fields{"name": r.Name,
+	requestid.Log(ctx).WithFields(log.Fields{"name": r.Name,
 		"fstype": r.Options["fstype"]}).Info("Volume and filesystem created ")
 	return volume.Response{Err: ""}
 }
 
 // Remove - removes individual volume. Docker would call it only if is not using it anymore
 func (d *VolumeDriver) Remove(r volume.Request) volume.Response {
-	log.WithFields(log.Fields{"name": r.Name}).Info("Removing volume ")
+	ctx := requestid.Background()
+	requestid.Log(ctx).WithFields(log.Fields{"name": r.Name}).Info("Removing volume ")
 
 	// Cannot remove volumes till plugin completely initializes (refcounting is complete)
 	// because we don't know if it is being used or not
 	if d.RefCounts.IsInitialized() != true {
 		msg := fmt.Sprintf(plugin_utils.PluginInitError+" Cannot remove volume=%s", r.Name)
-		log.Error(msg)
+		requestid.Log(ctx).Error(msg)
 		return volume.Response{Err: msg}
 	}
 
@@ -438,18 +715,36 @@ func (d *VolumeDriver) Remove(r volume.Request) volume.Response {
 	if d.GetRefCount(r.Name) != 0 {
 		msg := fmt.Sprintf("Remove failure - volume is still mounted. "+
 			" volume=%s, refcount=%d", r.Name, d.GetRefCount(r.Name))
-		log.Error(msg)
+		requestid.Log(ctx).Error(msg)
 		return volume.Response{Err: msg}
 	}
 
-	err := d.ops.Remove(r.Name, r.Options)
+	// Keys of encrypted volumes are stored by full name
+	var keyName string
+	if d.keys != nil {
+		keyName, _ = d.keyName(ctx, r.Name)
+	}
+
+	// Snapshot volumes take their snapshot with them
+	srcName := d.snapshotSource(ctx, r.Name)
+
+	in := d.journal.begin(intent{Op: opRemove, Name: r.Name, KeyName: keyName})
+	defer d.journal.done(in)
+
+	err := d.ops.Remove(ctx, r.Name, r.Options)
+	d.cache.invalidate(r.Name)
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": r.Name,
 				"error": err},
 		).Error("Failed to remove volume ")
 		return volume.Response{Err: err.Error()}
 	}
+	d.journal.step(in, stepRemoved)
+	d.deleteKey(ctx, keyName)
+	if srcName != "" {
+		d.deleteSnapshot(ctx, srcName, snapshotName(r.Name))
+	}
 
 	return volume.Response{Err: ""}
 }
@@ -468,27 +763,31 @@ func (d *VolumeDriver) Path(r volume.Request) volume.Response {
 // at this level during create/mount/umount/remove.
 //
 func (d *VolumeDriver) Mount(r volume.MountRequest) volume.Response {
-	log.WithFields(log.Fields{"name": r.Name}).Info("Mounting volume ")
+	ctx := requestid.Background()
+	requestid.Log(ctx).WithFields(log.Fields{"name": r.Name}).Info("Mounting volume ")
 
 	// lock the state
 	d.RefCounts.StateMtx.Lock()
 	defer d.RefCounts.StateMtx.Unlock()
+	defer d.RefCounts.SaveState()
 
 	// checked by refcounting thread until refmap initialized
 	// useless after that
 	d.RefCounts.MarkDirty()
 
-	return d.processMount(r)
+	return d.processMount(ctx, r)
 }
 
 // Unmount request from Docker. If mount refcount is drop to 0.
 // Unmount and detach from VM
 func (d *VolumeDriver) Unmount(r volume.UnmountRequest) volume.Response {
-	log.WithFields(log.Fields{"name": r.Name}).Info("Unmounting Volume ")
+	ctx := requestid.Background()
+	requestid.Log(ctx).WithFields(log.Fields{"name": r.Name}).Info("Unmounting Volume ")
 
 	// lock the state
 	d.RefCounts.StateMtx.Lock()
 	defer d.RefCounts.StateMtx.Unlock()
+	defer d.RefCounts.SaveState()
 
 	if d.RefCounts.IsInitialized() != true {
 		// if refcounting hasn't been succesful,
@@ -502,9 +801,9 @@ func (d *VolumeDriver) Unmount(r volume.UnmountRequest) volume.Response {
 		r.Name = fullVolName
 		delete(d.MountIDtoName, r.ID) //cleanup the map
 	} else {
-		volumeInfo, err := plugin_utils.GetVolumeInfo(r.Name, "", d)
+		volumeInfo, err := plugin_utils.GetVolumeInfo(ctx, r.Name, "", d.withContext(ctx))
 		if err != nil {
-			log.Errorf("Unable to get volume info for volume %s. err:%v", r.Name, err)
+			requestid.Log(ctx).Errorf("Unable to get volume info for volume %s. err:%v", r.Name, err)
 			return volume.Response{Err: err.Error()}
 		}
 		r.Name = volumeInfo.VolumeName
@@ -512,25 +811,25 @@ func (d *VolumeDriver) Unmount(r volume.UnmountRequest) volume.Response {
 
 	// if refcount has been succcessful, Normal flow
 	// if the volume is still used by other containers, just return OK
-	refcnt, err := d.DecrRefCount(r.Name)
+	refcnt, err := d.DecrRefCount(ctx, r.Name)
 	if err != nil {
 		// something went wrong - yell, but still try to unmount
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": r.Name, "refcount": refcnt},
 		).Error("Refcount error - still trying to unmount...")
 	}
-	log.Debugf("volume name=%s refcnt=%d", r.Name, refcnt)
+	requestid.Log(ctx).Debugf("volume name=%s refcnt=%d", r.Name, refcnt)
 	if refcnt >= 1 {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": r.Name, "refcount": refcnt},
 		).Info("Still in use, skipping unmount request. ")
 		return volume.Response{Err: ""}
 	}
 
 	// and if nobody needs it, unmount and detach
-	err = d.UnmountVolume(r.Name)
+	err = d.unmountVolume(ctx, r.Name)
 	if err != nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"name": r.Name, "error": err.Error()},
 		).Error("Failed to unmount ")
 		return volume.Response{Err: err.Error()}
@@ -545,5 +844,126 @@ func (d *VolumeDriver) Capabilities(r volume.Request) volume.Response {
 
 // DetachVolume - detach a volume from the VM
 func (d *VolumeDriver) DetachVolume(name string) error {
-	return d.ops.Detach(name, nil)
+	ctx := requestid.Background()
+	defer d.cache.invalidate(name)
+	d.closeDevice(ctx, name)
+	return d.ops.Detach(ctx, name, nil)
+}
+
+// RevertSnapshot - restore the content of a volume from one of its snapshots.
+// The volume must be detached.
+func (d *VolumeDriver) RevertSnapshot(name string, snapName string) error {
+	ctx := requestid.Background()
+	defer d.cache.invalidate(name)
+	err := d.ops.RevertSnapshot(ctx, name, snapName)
+	if err != nil {
+		requestid.Log(ctx).WithFields(log.Fields{"name": name, "snapshot": snapName,
+			"error": err}).Error("Revert volume failed ")
+		return err
+	}
+	requestid.Log(ctx).WithFields(log.Fields{"name": name, "snapshot": snapName}).Info("Volume reverted to snapshot ")
+	return nil
+}
+
+// DeleteSnapshot - delete a snapshot of a volume. The snapshot volume created
+// along with it, if any, is kept.
+func (d *VolumeDriver) DeleteSnapshot(name string, snapName string) error {
+	return d.deleteSnapshot(requestid.Background(), name, snapName)
+}
+
+// ExtendVolume - grow the volume to size (e.g. "20gb") and grow the filesystem on it.
+// The filesystem is grown online if the volume is mounted on this host, otherwise
+// the volume is attached for the time it takes to grow the filesystem offline.
+func (d *VolumeDriver) ExtendVolume(name string, size string) error {
+	ctx := requestid.Background()
+	volumeInfo, err := plugin_utils.GetVolumeInfo(ctx, name, "", d.withContext(ctx))
+	if err != nil {
+		return err
+	}
+	name = volumeInfo.VolumeName
+	volumeMeta := volumeInfo.VolumeMeta
+	if volumeMeta == nil {
+		if volumeMeta, err = d.getVolume(ctx, name); err != nil {
+			return err
+		}
+	}
+	fstype, exists := volumeMeta["fstype"].(string)
+	if !exists {
+		fstype = fs.FstypeDefault
+	}
+
+	err = d.ops.Extend(ctx, name, size)
+	d.cache.invalidate(name)
+	if err != nil {
+		requestid.Log(ctx).WithFields(log.Fields{"name": name, "size": size, "error": err}).Error("Extend volume failed ")
+		return err
+	}
+	requestid.Log(ctx).WithFields(log.Fields{"name": name, "size": size}).Info("Volume extended, growing filesystem ")
+
+	mounts, err := fs.GetMountInfo(ctx, d.MountRoot)
+	if err != nil {
+		return err
+	}
+	if device, mounted := mounts[name]; mounted {
+		if err = d.resizeDevice(ctx, name, device); err != nil {
+			return err
+		}
+		return fs.GrowFsByDevicePath(ctx, fstype, device, d.GetMountPoint(name))
+	}
+	return d.growFsOffline(ctx, name, fstype)
+}
+
+// growFsOffline attaches the volume, grows the filesystem and detaches the volume
+func (d *VolumeDriver) growFsOffline(ctx context.Context, name string, fstype string) error {
+	if d.useMockEsx {
+		dev, err := d.ops.RawAttach(ctx, name, nil)
+		if err != nil {
+			return err
+		}
+		device, err := d.openDevice(ctx, name, string(dev[:]))
+		if err == nil {
+			err = fs.GrowFsByDevicePath(ctx, fstype, device, "")
+		}
+		if errDetach := d.detach(ctx, name); err == nil {
+			err = errDetach
+		}
+		return err
+	}
+
+	waitCtx, errWait := fs.DevAttachWaitPrep(ctx)
+	if errWait != nil {
+		requestid.Log(ctx).WithFields(log.Fields{"name": name,
+			"error": errWait}).Warning("Failed to initialize wait context, continuing however.. ")
+	}
+	volDev, err := d.ops.Attach(ctx, name, nil)
+	if err != nil {
+		return err
+	}
+	if errWait != nil {
+		fs.DevAttachWaitFallback()
+	} else {
+		fs.DevAttachWait(ctx, waitCtx, volDev)
+	}
+	err = d.growFsAttached(ctx, name, fstype, volDev)
+	if errDetach := d.detach(ctx, name); err == nil {
+		err = errDetach
+	}
+	return err
+}
+
+// requestDriver passes the request ID in ctx on to the driver when called
+// back through the drivers.VolumeDriver interface
+type requestDriver struct {
+	*VolumeDriver
+	ctx context.Context
+}
+
+// withContext returns the driver as a drivers.VolumeDriver logging with the request ID in ctx
+func (d *VolumeDriver) withContext(ctx context.Context) *requestDriver {
+	return &requestDriver{VolumeDriver: d, ctx: ctx}
+}
+
+// GetVolume - see VolumeDriver.GetVolume
+func (r *requestDriver) GetVolume(name string) (map[string]interface{}, error) {
+	return r.getVolume(r.ctx, name)
 }
@@ -18,7 +18,51 @@ package vmdk
 // Supporting functions for the VMware vSphere Docker Volume plugin on Linux.
 //
 
+import (
+	"context"
+
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+)
+
 // normalizeVolumeName returns the volume name as-is.
 func normalizeVolumeName(name string) string {
 	return name
 }
+
+// mkfsAttached creates the file system on the attached volume, encrypted if asked to.
+func (d *VolumeDriver) mkfsAttached(ctx context.Context, name string, fstype string, mkfsOptions string,
+	volDev *fs.VolumeDevSpec, encrypt bool) error {
+	if !encrypt {
+		return fs.Mkfs(ctx, fstype, name, volDev, mkfsOptions)
+	}
+	device, err := fs.DevicePath(ctx, volDev)
+	if err != nil {
+		return err
+	}
+	return d.mkfsEncrypted(ctx, name, fstype, mkfsOptions, device)
+}
+
+// mountAttached mounts the attached volume, opening it first if it is encrypted.
+func (d *VolumeDriver) mountAttached(ctx context.Context, name string, mountpoint string, fstype string,
+	volDev *fs.VolumeDevSpec, isReadOnly bool, mountOptions string) error {
+	device, err := fs.DevicePath(ctx, volDev)
+	if err != nil {
+		return err
+	}
+	if device, err = d.openDevice(ctx, name, device); err != nil {
+		return err
+	}
+	return fs.MountByDevicePath(ctx, mountpoint, fstype, device, isReadOnly, mountOptions)
+}
+
+// growFsAttached grows the file system of the attached, unmounted volume.
+func (d *VolumeDriver) growFsAttached(ctx context.Context, name string, fstype string, volDev *fs.VolumeDevSpec) error {
+	device, err := fs.DevicePath(ctx, volDev)
+	if err != nil {
+		return err
+	}
+	if device, err = d.openDevice(ctx, name, device); err != nil {
+		return err
+	}
+	return fs.GrowFsByDevicePath(ctx, fstype, device, "")
+}
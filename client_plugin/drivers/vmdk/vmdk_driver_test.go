@@ -0,0 +1,118 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+// Driver tests with the mock ESX service. Need root to set up loopback devices.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vmdk/vmdkops"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/refcount"
+)
+
+// newTestDriver returns a driver using the mock ESX service in a temporary
+// directory, and a function removing it
+func newTestDriver(t *testing.T) (*VolumeDriver, func()) {
+	if os.Geteuid() != 0 {
+		t.Skip("Mock ESX service needs root to set up loopback devices")
+	}
+	root, err := ioutil.TempDir("", "vmdk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := newJournal(filepath.Join(root, "journal"))
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	cmd := vmdkops.NewMockCmd()
+	cmd.Root = filepath.Join(root, "volumes")
+	d := &VolumeDriver{useMockEsx: true, ops: vmdkops.VmdkOps{Cmd: cmd}, cache: newVolumeCache(0), journal: j}
+	// Remove needs initialized refcounts, use an empty saved state rather than Docker.
+	// The state is only loaded in the boot it was saved in.
+	bootID, err := ioutil.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	stateFile := filepath.Join(root, "state.json")
+	state := fmt.Sprintf(`{"BootID": %q}`, strings.TrimSpace(string(bootID)))
+	if err = ioutil.WriteFile(stateFile, []byte(state), 0600); err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	d.MountRoot = filepath.Join(root, "mnt")
+	d.MountIDtoName = make(map[string]string)
+	d.RefCounts = refcount.NewRefCountsMap()
+	d.RefCounts.SetStateFile(stateFile, d.MountIDtoName)
+	d.RefCounts.Init(d, d.MountRoot, "vsphere")
+	return d, func() { os.RemoveAll(root) }
+}
+
+// snapshotNames returns the names of the snapshots in the status of a volume
+func snapshotNames(t *testing.T, d *VolumeDriver, name string) []string {
+	resp := d.Get(volume.Request{Name: name})
+	if !assert.Empty(t, resp.Err) {
+		return nil
+	}
+	var names []string
+	snapshots, _ := resp.Volume.Status["snapshots"].([]interface{})
+	for _, snap := range snapshots {
+		names = append(names, snap.(map[string]interface{})["Name"].(string))
+	}
+	return names
+}
+
+func TestSnapshotVolumes(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	if !assert.Empty(t, d.Create(volume.Request{Name: "src", Options: map[string]string{"size": "10mb"}}).Err) {
+		return
+	}
+	assert.NotEmpty(t, d.Create(volume.Request{Name: "snap1",
+		Options: map[string]string{"snapshot-of": "src", "size": "1gb"}}).Err, "Other options should be rejected")
+
+	// The snapshot is listed with the source, and is a read-only volume of its own
+	assert.Empty(t, d.Create(volume.Request{Name: "snap1", Options: map[string]string{"snapshot-of": "src"}}).Err)
+	assert.Equal(t, []string{"snap1"}, snapshotNames(t, d, "src"))
+	resp := d.Get(volume.Request{Name: "snap1"})
+	if assert.Empty(t, resp.Err) {
+		assert.Equal(t, "read-only", resp.Volume.Status["access"])
+		assert.Equal(t, "src", resp.Volume.Status["clone-from"])
+		assert.Equal(t, "snap1", resp.Volume.Status["clone-snapshot"], "Should be cloned from the snapshot")
+	}
+
+	assert.Nil(t, d.RevertSnapshot("src", "snap1"))
+	assert.NotNil(t, d.RevertSnapshot("src", "nosuchsnap"))
+
+	// Removing the snapshot volume deletes the snapshot
+	assert.Empty(t, d.Remove(volume.Request{Name: "snap1"}).Err)
+	assert.Empty(t, snapshotNames(t, d, "src"))
+
+	assert.Empty(t, d.Create(volume.Request{Name: "snap2", Options: map[string]string{"snapshot-of": "src"}}).Err)
+	assert.Nil(t, d.DeleteSnapshot("src", "snap2"))
+	assert.Empty(t, snapshotNames(t, d, "src"))
+	assert.Empty(t, d.Remove(volume.Request{Name: "snap2"}).Err)
+	assert.Empty(t, d.Remove(volume.Request{Name: "src"}).Err)
+}
@@ -18,7 +18,13 @@ package vmdk
 // Supporting functions for the VMware vSphere Docker Volume plugin on Windows.
 //
 
-import "strings"
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+)
 
 // normalizeVolumeName returns the volume name in its lower-case form.
 // Paths on Windows are case-insensitive, so Docker explicitly converts volume
@@ -28,3 +34,24 @@ import "strings"
 func normalizeVolumeName(name string) string {
 	return strings.ToLower(name)
 }
+
+// mkfsAttached creates the file system on the attached volume.
+// Encrypted volumes are not supported on Windows.
+func (d *VolumeDriver) mkfsAttached(ctx context.Context, name string, fstype string, mkfsOptions string,
+	volDev *fs.VolumeDevSpec, encrypt bool) error {
+	if encrypt {
+		return errors.New("Encrypted volumes are not supported on Windows")
+	}
+	return fs.Mkfs(ctx, fstype, name, volDev, mkfsOptions)
+}
+
+// mountAttached mounts the attached volume.
+func (d *VolumeDriver) mountAttached(ctx context.Context, name string, mountpoint string, fstype string,
+	volDev *fs.VolumeDevSpec, isReadOnly bool, mountOptions string) error {
+	return fs.Mount(ctx, mountpoint, fstype, volDev, isReadOnly, mountOptions)
+}
+
+// growFsAttached grows the file system of the attached, unmounted volume.
+func (d *VolumeDriver) growFsAttached(ctx context.Context, name string, fstype string, volDev *fs.VolumeDevSpec) error {
+	return fs.GrowFs(ctx, fstype, volDev)
+}
@@ -18,6 +18,7 @@ package vmdkops_test
 // Does not communicate over VMCI
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vmdk/vmdkops"
 	testparams "github.com/vmware/docker-volume-vsphere/tests/utils/inputparams"
@@ -25,25 +26,26 @@ import (
 )
 
 func TestCommands(t *testing.T) {
+	ctx := context.Background()
 	ops := vmdkops.VmdkOps{Cmd: vmdkops.NewMockCmd()}
 	name := testparams.GetVolumeName()
 	t.Logf("\nCreating Test Volume with name = [%s]...\n", name)
 	opts := map[string]string{"size": "2gb"}
-	if assert.Nil(t, ops.Create(name, opts)) {
+	if assert.Nil(t, ops.Create(ctx, name, opts)) {
 
 		opts = map[string]string{}
-		_, err := ops.RawAttach(name, opts)
+		_, err := ops.RawAttach(ctx, name, opts)
 		assert.Nil(t, err)
-		assert.Nil(t, ops.Detach(name, opts))
-		assert.Nil(t, ops.Remove(name, opts))
+		assert.Nil(t, ops.Detach(ctx, name, opts))
+		assert.Nil(t, ops.Remove(ctx, name, opts))
 	}
-	if assert.Nil(t, ops.Create("otherVolume",
+	if assert.Nil(t, ops.Create(ctx, "otherVolume",
 		map[string]string{"size": "1gb", "fstype": "ext3"})) {
-		assert.Nil(t, ops.Remove("otherVolume", opts))
+		assert.Nil(t, ops.Remove(ctx, "otherVolume", opts))
 	}
 
-	if assert.Nil(t, ops.Create("anotherVolume",
+	if assert.Nil(t, ops.Create(ctx, "anotherVolume",
 		map[string]string{"size": "1gb", "fstype": "ext2"})) {
-		assert.Nil(t, ops.Remove("anotherVolume", opts))
+		assert.Nil(t, ops.Remove(ctx, "anotherVolume", opts))
 	}
 }
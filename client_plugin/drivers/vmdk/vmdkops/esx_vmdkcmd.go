@@ -15,132 +15,128 @@
 // +build linux windows
 
 // The default (ESX) implementation of the VmdkCmdRunner interface.
-// This implementation sends synchronous commands to and receives responses from ESX.
+// This implementation sends commands to and receives responses from ESX
+// over a Transport, retrying with exponential backoff until the context is done.
+// Requests are pipelined: up to MaxInFlight requests are sent concurrently,
+// serialized per volume only (read-only list/get are not serialized at all).
 
 package vmdkops
 
 import (
-	"encoding/json"
-	"errors"
+	"context"
 	"fmt"
-	"os"
-	"sync"
-	"syscall"
 	"time"
-	"unsafe"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
 )
 
-/*
-#cgo CFLAGS: -I ../../../../esx_service/vmci
-#cgo windows LDFLAGS: -L${SRCDIR} -lvmci_client
-#include "vmci_client.h"
-#include "vmci_client_proxy.c"
-*/
-import "C"
+const (
+	maxRetryCount  = 5
+	initialBackoff = 500 * time.Millisecond
+	maxBackoff     = 8 * time.Second
+
+	// DefaultMaxInFlight is the default number of concurrent requests to ESX
+	DefaultMaxInFlight = 8
+)
 
-// EsxVmdkCmd struct - empty , we use it only to implement VmdkCmdRunner interface
+// EsxVmdkCmd struct - runs commands over a Transport
 type EsxVmdkCmd struct {
-	Mtx *sync.Mutex // For serialization of Run comand/response
+	Transport Transport
+	pool      chan struct{} // Bounds the number of requests in flight
+	locks     *volumeLocks  // Serializes requests per volume
 }
 
-const (
-	commBackendName string = "vsocket"
-	maxRetryCount          = 5
-	// Server side understand protocol version. If you are changing client/server protocol we use
-	// over VMCI, PLEASE DO NOT FORGET TO CHANGE IT FOR SERVER in file <vmdk_ops.py> !
-	clientProtocolVersion = "2"
-)
-
-// A request to be passed to ESX service
-type requestToVmci struct {
-	Ops     string     `json:"cmd"`
-	Details VolumeInfo `json:"details"`
-	Version string     `json:"version,omitempty"`
+// NewEsxCmd returns a new instance of EsxVmdkCmd using the transport,
+// with at most DefaultMaxInFlight requests in flight.
+func NewEsxCmd(transport Transport) *EsxVmdkCmd {
+	return NewEsxCmdWithPool(transport, DefaultMaxInFlight)
 }
 
-// VolumeInfo we get about the volume from upstairs
-type VolumeInfo struct {
-	Name    string            `json:"Name"`
-	Options map[string]string `json:"Opts,omitempty"`
+// NewEsxCmdWithPool returns a new instance of EsxVmdkCmd using the transport,
+// with at most maxInFlight requests in flight.
+func NewEsxCmdWithPool(transport Transport, maxInFlight int) *EsxVmdkCmd {
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+	return &EsxVmdkCmd{
+		Transport: transport,
+		pool:      make(chan struct{}, maxInFlight),
+		locks:     newVolumeLocks(),
+	}
 }
 
-type vmciError struct {
-	Error string `json:",omitempty"`
+// backoff returns the time to wait before the given retry (starting at 0)
+func backoff(retry int) time.Duration {
+	delay := initialBackoff << uint(retry)
+	if delay > maxBackoff || delay <= 0 {
+		delay = maxBackoff
+	}
+	return delay
 }
 
-// EsxPort used to connect to ESX, passed in as command line param
-var EsxPort int
+// nonIdempotentCmds must not be sent again once they may have reached ESX,
+// e.g. a repeated revert would discard changes made after the first one.
+// The other commands check the volume state on ESX and are safe to repeat.
+var nonIdempotentCmds = map[string]bool{
+	"snapshot":       true,
+	"deletesnapshot": true,
+	"revertsnapshot": true,
+}
 
-// Run command Guest VM requests on ESX via vmdkops_serv.py listening on vSocket
+// Run command Guest VM requests on ESX via vmdkops_serv.py
 // *
 // * For each request:
-// *   - Establishes a vSocket connection
+// *   - Establishes a connection over the transport
 // *   - Sends json string up to ESX
 // *   - waits for reply and returns resulting JSON or an error
-func (vmdkCmd EsxVmdkCmd) Run(cmd string, name string, opts map[string]string) ([]byte, error) {
-	vmdkCmd.Mtx.Lock()
-	defer vmdkCmd.Mtx.Unlock()
-	protocolVersion := os.Getenv("VDVS_TEST_PROTOCOL_VERSION")
-	log.Debugf("Run get request: version=%s", protocolVersion)
-	if protocolVersion == "" {
-		protocolVersion = clientProtocolVersion
-	}
-	jsonStr, err := json.Marshal(&requestToVmci{
-		Ops:     cmd,
-		Details: VolumeInfo{Name: name, Options: opts},
-		Version: protocolVersion})
+// * Connection failures are retried with exponential backoff, unless the
+// * command is not idempotent and may have reached ESX. Nothing is retried
+// * once ctx is done. A hung request is abandoned at that point, but keeps
+// * the volume lock and its slot in the pool until it completes.
+func (vmdkCmd *EsxVmdkCmd) Run(ctx context.Context, cmd string, name string, opts map[string]string) ([]byte, error) {
+	jsonStr, err := marshalRequest(cmd, name, opts)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to marshal json: %v", err)
+		return nil, err
 	}
+	requestid.Log(ctx).Debugf("Run get request: %s", jsonStr)
 
-	cmdS := C.CString(string(jsonStr))
-	defer C.free(unsafe.Pointer(cmdS))
-
-	beS := C.CString(commBackendName)
-	defer C.free(unsafe.Pointer(beS))
-
-	// Get the response data in json
-	ans := (*C.be_answer)(C.calloc(1, C.sizeof_struct_be_answer))
-	defer C.free(unsafe.Pointer(ans))
-
-	var ret C.be_sock_status
-	for i := 0; i <= maxRetryCount; i++ {
-		ret, err = C.Vmci_GetReply(C.int(EsxPort), cmdS, beS, ans)
-		if ret == 0 {
-			// Received no error, exit loop.
-			// C.Vmci_GetReply indicates success/faulure by <ret> value.
-			// Cgo  interface adds <err> based on errno. We do not explicitly
-			// reset errno in our code. Still, we do not want a stale errno
-			// to confuse this code into thinking there was an error even when ret==0,
-			// so explicitly declare success on <ret> value only, and
-			break
-		}
-
-		var msg string
+	// Take the volume lock before a slot in the pool, so requests waiting
+	// for a busy volume don't hold up requests for other volumes.
+	unlock := func() {}
+	if name != "" && !readOnlyCmds[cmd] {
+		unlock, err = vmdkCmd.locks.lock(ctx, name)
 		if err != nil {
-			var errno syscall.Errno
-			errno = err.(syscall.Errno)
-			msg = fmt.Sprintf("Run '%s' failed: %v (errno=%d) - %s", cmd, err, int(errno), C.GoString(&ans.errBuf[0]))
-			if i < maxRetryCount {
-				log.Warnf(msg + " Retrying...")
-				time.Sleep(time.Second * 1)
-				continue
-			}
-			if errno == syscall.ECONNRESET || errno == syscall.ETIMEDOUT {
-				msg += " Cannot communicate with ESX, please refer to the FAQ https://github.com/vmware/docker-volume-vsphere/wiki#faq"
-			}
-		} else {
-			msg = fmt.Sprintf("Internal issue: ret != 0 but errno is not set. Cancelling operation - %s ", C.GoString(&ans.errBuf[0]))
+			return nil, fmt.Errorf("Run '%s' failed: %v while waiting for other requests on volume %s",
+				cmd, err, name)
 		}
+	}
 
-		log.Warnf(msg)
-		return nil, errors.New(msg)
+	select {
+	case vmdkCmd.pool <- struct{}{}:
+	case <-ctx.Done():
+		unlock()
+		return nil, fmt.Errorf("Run '%s' failed: %v while waiting for other requests to %s",
+			cmd, ctx.Err(), vmdkCmd.Transport)
+	}
+	release := func() {
+		<-vmdkCmd.pool
+		unlock()
 	}
 
-	response := []byte(C.GoString(ans.buf))
-	C.Vmci_FreeBuf(ans)
+	response, err := vmdkCmd.send(ctx, cmd, jsonStr)
+	if abandoned, ok := err.(abandonedError); ok {
+		requestid.Log(ctx).Warningf("Request '%s' abandoned, volume %s stays locked until it completes ", cmd, name)
+		go func() {
+			<-abandoned.done
+			release()
+		}()
+	} else {
+		release()
+	}
+	if err != nil {
+		return nil, err
+	}
 
 	err = unmarshalError(response)
 	if err != nil && len(err.Error()) != 0 {
@@ -150,17 +146,34 @@ func (vmdkCmd EsxVmdkCmd) Run(cmd string, name string, opts map[string]string) (
 	return response, nil
 }
 
-func unmarshalError(str []byte) error {
-	// Unmarshalling null always succeeds
-	if string(str) == "null" {
-		return nil
-	}
-	errStruct := vmciError{}
-	err := json.Unmarshal(str, &errStruct)
-	if err != nil {
-		// We didn't unmarshal an error, so there is no error ;)
-		return nil
+// send sends the request over the transport, retrying it while it is safe to.
+// An abandoned request is still reported as abandonedError.
+func (vmdkCmd *EsxVmdkCmd) send(ctx context.Context, cmd string, jsonStr []byte) ([]byte, error) {
+	for i := 0; ; i++ {
+		response, err := vmdkCmd.Transport.Send(ctx, jsonStr)
+		if err == nil {
+			return response, nil
+		}
+		msg := fmt.Sprintf("Run '%s' failed: %v", cmd, err)
+		retryable, ok := err.(retryableError)
+		if !ok || i >= maxRetryCount {
+			requestid.Log(ctx).Warning(msg)
+			if abandoned, ok := err.(abandonedError); ok {
+				return nil, abandonedError{fmt.Errorf("%s", msg), abandoned.done}
+			}
+			return nil, fmt.Errorf("%s", msg)
+		}
+		if retryable.sent && nonIdempotentCmds[cmd] {
+			requestid.Log(ctx).Warning(msg)
+			return nil, fmt.Errorf("%s, not retrying as the request may have reached ESX", msg)
+		}
+
+		delay := backoff(i)
+		requestid.Log(ctx).WithFields(log.Fields{"transport": vmdkCmd.Transport, "delay": delay}).Warning(msg + " Retrying... ")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%s, not retrying: %v", msg, ctx.Err())
+		}
 	}
-	// Return the unmarshaled error string as an `error`
-	return errors.New(errStruct.Error)
 }
@@ -0,0 +1,214 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux windows
+
+package vmdkops_test
+
+// Test timeouts, retries and concurrency of EsxVmdkCmd using socket transports.
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vmdk/vmdkops"
+)
+
+func TestCmdTimeout(t *testing.T) {
+	// A service which accepts connections but never replies
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ops := vmdkops.VmdkOps{
+		Cmd:      vmdkops.NewSockCmd("tcp", listener.Addr().String()),
+		Timeouts: map[string]time.Duration{"get": 200 * time.Millisecond},
+	}
+	start := time.Now()
+	_, err = ops.Get(context.Background(), "vol1")
+	assert.NotNil(t, err, "Get from a hung service should fail")
+	assert.True(t, time.Since(start) < 5*time.Second, "Get should give up on its deadline")
+
+	// Cancelling the caller's context stops the command too
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start = time.Now()
+	_, err = ops.List(ctx)
+	if assert.NotNil(t, err, "List from a hung service should fail") {
+		assert.Contains(t, err.Error(), context.Canceled.Error())
+	}
+	assert.True(t, time.Since(start) < 5*time.Second, "List should give up once cancelled")
+
+	// A configured default applies to commands with a default timeout of their own
+	ops.Timeouts = map[string]time.Duration{"default": 200 * time.Millisecond}
+	start = time.Now()
+	_, err = ops.Attach(context.Background(), "vol1", nil)
+	assert.NotNil(t, err, "Attach to a hung service should fail")
+	assert.True(t, time.Since(start) < 5*time.Second, "Attach should give up on the configured default")
+}
+
+func TestCmdRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mock-esx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sockAddr := filepath.Join(dir, "vmdk-opsd.sock")
+
+	// The service comes up while the first connection attempts fail
+	started := make(chan *vmdkops.MockEsxService, 1)
+	time.AfterFunc(700*time.Millisecond, func() {
+		started <- startMockEsx(t, "unix", sockAddr)
+	})
+	defer func() { (<-started).Close() }()
+
+	ops := vmdkops.VmdkOps{Cmd: vmdkops.NewSockCmd("unix", sockAddr)}
+	volumes, err := ops.List(context.Background())
+	assert.Nil(t, err, "List should succeed once the service is up")
+	assert.Empty(t, volumes)
+
+	// Nothing is retried once the deadline is reached
+	missing := vmdkops.VmdkOps{
+		Cmd:      vmdkops.NewSockCmd("unix", filepath.Join(dir, "missing.sock")),
+		Timeouts: map[string]time.Duration{"list": time.Second},
+	}
+	start := time.Now()
+	_, err = missing.List(context.Background())
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "not retrying")
+	}
+	assert.True(t, time.Since(start) < 3*time.Second, "List should stop retrying on its deadline")
+}
+
+func TestCmdConcurrency(t *testing.T) {
+	service, err := vmdkops.NewMockEsxService("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Attach of vol1 hangs until released, other requests get through
+	release := make(chan struct{})
+	attaching := make(chan struct{}, 1)
+	service.OnRequest = func(cmd string, name string) {
+		if cmd == "attach" && name == "vol1" {
+			attaching <- struct{}{}
+			<-release
+		}
+	}
+	go service.Serve()
+	defer service.Close()
+
+	ctx := context.Background()
+	ops := vmdkops.VmdkOps{Cmd: service.NewCmd()}
+	for _, name := range []string{"vol1", "vol2"} {
+		if err := ops.Create(ctx, name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	attached := make(chan error, 1)
+	go func() {
+		_, err := ops.Attach(ctx, "vol1", nil)
+		attached <- err
+	}()
+	<-attaching
+
+	// Unrelated volumes and read-only commands are not blocked by the attach
+	quick, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	volumes, err := ops.List(quick)
+	assert.Nil(t, err, "List should not wait for the attach of vol1")
+	assert.Len(t, volumes, 2)
+	_, err = ops.Get(quick, "vol1")
+	assert.Nil(t, err, "Get should not wait for the attach of vol1")
+	_, err = ops.Attach(quick, "vol2", nil)
+	assert.Nil(t, err, "Attach of vol2 should not wait for the attach of vol1")
+
+	// Requests on the same volume are serialized
+	short, cancelShort := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancelShort()
+	err = ops.Detach(short, "vol1@"+vmdkops.MockDefaultDatastore, nil)
+	if assert.NotNil(t, err, "Detach of vol1 should wait for its attach") {
+		assert.Contains(t, err.Error(), "waiting for other requests on volume")
+	}
+
+	close(release)
+	assert.Nil(t, <-attached)
+	assert.Nil(t, ops.Detach(ctx, "vol1", nil))
+	assert.Nil(t, ops.Detach(ctx, "vol2", nil))
+}
+
+func TestCmdAbandoned(t *testing.T) {
+	service, err := vmdkops.NewMockEsxService("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Attach of vol1 hangs on the service until released
+	release := make(chan struct{})
+	attaching := make(chan struct{}, 1)
+	service.OnRequest = func(cmd string, name string) {
+		if cmd == "attach" && name == "vol1" {
+			attaching <- struct{}{}
+			<-release
+		}
+	}
+	go service.Serve()
+	defer service.Close()
+
+	ctx := context.Background()
+	ops := vmdkops.VmdkOps{
+		Cmd:      vmdkops.NewEsxCmdWithPool(vmdkops.NewSockTransport(service.Network(), service.Addr()), 1),
+		Timeouts: map[string]time.Duration{"attach": 200 * time.Millisecond},
+	}
+	if err := ops.Create(ctx, "vol1", nil); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ops.Attach(ctx, "vol1", nil)
+	assert.NotNil(t, err, "Attach should give up on its deadline")
+	<-attaching
+
+	// The abandoned attach still runs on the service, so it keeps the volume
+	// lock and the only slot in the pool until it completes
+	short, cancelShort := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancelShort()
+	err = ops.Detach(short, "vol1", nil)
+	if assert.NotNil(t, err, "Detach of vol1 should wait for the abandoned attach") {
+		assert.Contains(t, err.Error(), "waiting for other requests on volume")
+	}
+	short, cancelShort = context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancelShort()
+	_, err = ops.List(short)
+	if assert.NotNil(t, err, "List should wait for a slot held by the abandoned attach") {
+		assert.Contains(t, err.Error(), "waiting for other requests to")
+	}
+
+	close(release)
+	assert.Nil(t, ops.Detach(ctx, "vol1", nil), "Detach should run once the abandoned attach completed")
+}
@@ -0,0 +1,173 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux windows
+
+// MockEsxService is an in-process stand-in for vmdk-opsd (esx_service/vmdk_ops.py).
+// It listens on a TCP or Unix socket, accepts the same framed JSON requests as
+// the ESX service and replies the same way, so VmdkOps and the vsphere driver
+// can be tested end to end with a SockTransport on a plain Linux box.
+
+package vmdkops
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// MockEsxService struct - a fake vmdk-opsd serving a single (mock) VM
+type MockEsxService struct {
+	VMName string // VM name reported as "created by VM" / "attached to VM"
+	// OnRequest, when set, is called before executing each request,
+	// e.g. to make some commands slow in tests. Requests run concurrently.
+	OnRequest func(cmd string, name string)
+	listener  net.Listener
+	store     *mockVolumeStore
+	wg        sync.WaitGroup
+}
+
+// NewMockEsxService starts listening on network ("tcp" or "unix") and address.
+// Use "127.0.0.1:0" to get a free TCP port; Addr() returns the actual address.
+func NewMockEsxService(network string, address string) (*MockEsxService, error) {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &MockEsxService{
+		VMName:   MockDefaultVMName,
+		listener: listener,
+		store:    newMockVolumeStore(),
+	}, nil
+}
+
+// Network returns the network the service listens on
+func (s *MockEsxService) Network() string {
+	return s.listener.Addr().Network()
+}
+
+// Addr returns the address the service listens on
+func (s *MockEsxService) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// NewCmd returns a VmdkCmdRunner connected to this service
+func (s *MockEsxService) NewCmd() *EsxVmdkCmd {
+	return NewSockCmd(s.Network(), s.Addr())
+}
+
+// Serve accepts connections until Close is called. Each connection carries
+// a single request and reply, same as vmci_client.c.
+func (s *MockEsxService) Serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			log.WithFields(log.Fields{"address": s.Addr(), "error": err}).Debug("Mock ESX service stopped accepting ")
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+// Close stops the listener and waits for requests in flight
+func (s *MockEsxService) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *MockEsxService) handleConn(conn net.Conn) {
+	defer conn.Close()
+	request, err := readMessage(conn)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Warning("Mock ESX service failed to read request ")
+		return
+	}
+
+	reply, err := json.Marshal(s.executeRequest(request))
+	if err != nil {
+		reply, _ = json.Marshal(vmciError{Error: fmt.Sprintf("Failed to marshal reply: %v", err)})
+	}
+	log.Debugf("Mock ESX service request: %s reply: %s", request, reply)
+
+	if err = writeMessage(conn, reply); err != nil {
+		log.WithFields(log.Fields{"error": err}).Warning("Mock ESX service failed to send reply ")
+	}
+}
+
+// executeRequest mirrors execRequestThread() and executeRequest() in vmdk_ops.py.
+// The returned value is marshaled as the reply; a nil reply becomes "null".
+func (s *MockEsxService) executeRequest(request []byte) interface{} {
+	var req requestToVmci
+	if err := json.Unmarshal(request, &req); err != nil {
+		return vmciError{Error: fmt.Sprintf("Failed to parse json '%s'.", request)}
+	}
+	// Requests without a version are accepted for backward compatibility
+	if req.Version != "" && req.Version != clientProtocolVersion {
+		return vmciError{Error: fmt.Sprintf("There is a mismatch between vDVS client (Docker plugin) "+
+			"protocol version (%s) and server (ESXi) protocol version (%s) which indicates different "+
+			"versions of the product are installed on Guest and ESXi sides, please make sure vDVS "+
+			"plugin and driver are from the same release version.",
+			req.Version, clientProtocolVersion)}
+	}
+
+	name := req.Details.Name
+	opts := req.Details.Options
+	if s.OnRequest != nil {
+		s.OnRequest(req.Ops, name)
+	}
+	if opts == nil {
+		opts = map[string]string{}
+	}
+
+	var reply interface{}
+	var err error
+	switch req.Ops {
+	case "create":
+		_, err = s.store.create(name, opts, s.VMName)
+	case "remove":
+		err = s.store.remove(name)
+	case "attach":
+		reply, err = s.store.attach(name, s.VMName)
+	case "detach":
+		err = s.store.detach(name, s.VMName)
+	case "list":
+		reply = s.store.list()
+	case "get":
+		reply, err = s.store.get(name)
+	case "extend":
+		_, err = s.store.extend(name, opts[mockOptSize])
+	case "snapshot":
+		err = s.store.snapshot(name, opts[SnapshotOpt])
+	case "listsnapshots":
+		reply, err = s.store.listSnapshots(name)
+	case "deletesnapshot":
+		err = s.store.deleteSnapshot(name, opts[SnapshotOpt])
+	case "revertsnapshot":
+		err = s.store.revertSnapshot(name, opts[SnapshotOpt])
+	default:
+		err = fmt.Errorf("Unknown command:%s", req.Ops)
+	}
+	if err != nil {
+		return vmciError{Error: err.Error()}
+	}
+	return reply
+}
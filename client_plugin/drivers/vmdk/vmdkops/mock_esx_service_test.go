@@ -0,0 +1,198 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux windows
+
+package vmdkops_test
+
+// Test commands against the in-process mock ESX service.
+// Requests go through the real JSON protocol and framing over a socket.
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vmdk/vmdkops"
+)
+
+func startMockEsx(t *testing.T, network string, address string) *vmdkops.MockEsxService {
+	service, err := vmdkops.NewMockEsxService(network, address)
+	if err != nil {
+		t.Fatalf("Failed to start mock ESX service: %v", err)
+	}
+	go service.Serve()
+	return service
+}
+
+func TestMockEsxServiceTCP(t *testing.T) {
+	service := startMockEsx(t, "tcp", "127.0.0.1:0")
+	defer service.Close()
+	testVolumeLifecycle(t, vmdkops.VmdkOps{Cmd: service.NewCmd()})
+}
+
+func TestMockEsxServiceUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mock-esx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	service := startMockEsx(t, "unix", filepath.Join(dir, "vmdk-opsd.sock"))
+	defer service.Close()
+	testVolumeLifecycle(t, vmdkops.VmdkOps{Cmd: service.NewCmd()})
+}
+
+func testVolumeLifecycle(t *testing.T, ops vmdkops.VmdkOps) {
+	ctx := context.Background()
+	assert.Nil(t, ops.Create(ctx, "vol1", map[string]string{"size": "2gb", "fstype": "xfs",
+		"mount-options": "noatime"}))
+	// creating an existing volume is not an error
+	assert.Nil(t, ops.Create(ctx, "vol1", map[string]string{}))
+
+	status, err := ops.Get(ctx, "vol1")
+	if assert.Nil(t, err) {
+		assert.Equal(t, vmdkops.MockDefaultDatastore, status["datastore"])
+		assert.Equal(t, "xfs", status["fstype"])
+		assert.Equal(t, "noatime", status["mount-options"])
+		assert.Equal(t, "read-write", status["access"])
+		assert.Equal(t, "independent_persistent", status["attach-as"])
+		assert.Equal(t, "detached", status["status"])
+		assert.Equal(t, "2GB", status["capacity"].(map[string]interface{})["size"])
+	}
+
+	volDev, err := ops.Attach(ctx, "vol1", nil)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "0", volDev.Unit)
+		assert.NotEmpty(t, volDev.ControllerPciSlotNumber)
+	}
+	status, err = ops.Get(ctx, "vol1@" + vmdkops.MockDefaultDatastore)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "attached", status["status"])
+		assert.Equal(t, vmdkops.MockDefaultVMName, status["attached to VM"])
+	}
+	assert.NotNil(t, ops.Remove(ctx, "vol1", nil), "Remove of an attached volume should fail")
+
+	assert.Nil(t, ops.Create(ctx, "clone1", map[string]string{"clone-from": "vol1", "access": "read-only"}))
+	status, err = ops.Get(ctx, "clone1")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "xfs", status["fstype"])
+		assert.Equal(t, "read-only", status["access"])
+		assert.Equal(t, "vol1", status["clone-from"])
+	}
+
+	volumes, err := ops.List(ctx)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []vmdkops.VolumeData{
+			{Name: "clone1@" + vmdkops.MockDefaultDatastore, Attributes: map[string]string{}},
+			{Name: "vol1@" + vmdkops.MockDefaultDatastore, Attributes: map[string]string{}},
+		}, volumes)
+	}
+
+	assert.Nil(t, ops.Extend(ctx, "vol1", "3gb"))
+	assert.NotNil(t, ops.Extend(ctx, "vol1", "1gb"), "Shrinking a volume should fail")
+	assert.NotNil(t, ops.Extend(ctx, "vol1", "big"))
+	status, err = ops.Get(ctx, "vol1")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "3GB", status["capacity"].(map[string]interface{})["size"])
+	}
+
+	assert.NotNil(t, ops.Snapshot(ctx, "vol1", "snap1"), "Snapshot of an attached volume should fail")
+	assert.Nil(t, ops.Detach(ctx, "vol1", nil))
+	assert.Nil(t, ops.Snapshot(ctx, "vol1", "snap1"))
+	snapshots, err := ops.ListSnapshots(ctx, "vol1")
+	if assert.Nil(t, err) && assert.Len(t, snapshots, 1) {
+		assert.Equal(t, "snap1", snapshots[0].Name)
+	}
+	// a clone of the snapshot does not see later changes to the volume
+	assert.Nil(t, ops.Extend(ctx, "vol1", "4gb"))
+	assert.NotNil(t, ops.Create(ctx, "clone2", map[string]string{"clone-snapshot": "snap1"}),
+		"clone-snapshot without clone-from should fail")
+	assert.NotNil(t, ops.Create(ctx, "clone2", map[string]string{"clone-from": "vol1", "clone-snapshot": "nosuchsnap"}))
+	assert.Nil(t, ops.Create(ctx, "clone2", map[string]string{"clone-from": "vol1", "clone-snapshot": "snap1"}))
+	status, err = ops.Get(ctx, "clone2")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "vol1", status["clone-from"])
+		assert.Equal(t, "snap1", status["clone-snapshot"])
+		assert.Equal(t, "3GB", status["capacity"].(map[string]interface{})["size"])
+	}
+	assert.Nil(t, ops.Remove(ctx, "clone2", nil))
+	// snapshots come with the volume info as well
+	status, err = ops.Get(ctx, "vol1")
+	if assert.Nil(t, err) && assert.Len(t, status["snapshots"], 1) {
+		assert.Equal(t, "snap1", status["snapshots"].([]interface{})[0].(map[string]interface{})["Name"])
+	}
+	_, err = ops.Attach(ctx, "vol1", nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, ops.RevertSnapshot(ctx, "vol1", "snap1"), "Revert of an attached volume should fail")
+
+	assert.Nil(t, ops.Detach(ctx, "vol1", nil))
+	assert.Nil(t, ops.RevertSnapshot(ctx, "vol1", "snap1"))
+	assert.Nil(t, ops.DeleteSnapshot(ctx, "vol1", "snap1"))
+	assert.NotNil(t, ops.DeleteSnapshot(ctx, "vol1", "snap1"))
+	// detaching a detached volume is not an error
+	assert.Nil(t, ops.Detach(ctx, "vol1", nil))
+	assert.Nil(t, ops.Remove(ctx, "vol1", nil))
+	assert.Nil(t, ops.Remove(ctx, "clone1", nil))
+
+	_, err = ops.Get(ctx, "vol1")
+	assert.NotNil(t, err)
+	volumes, err = ops.List(ctx)
+	if assert.Nil(t, err) {
+		assert.Empty(t, volumes)
+	}
+}
+
+func TestMockEsxServiceErrors(t *testing.T) {
+	ctx := context.Background()
+	service := startMockEsx(t, "tcp", "127.0.0.1:0")
+	defer service.Close()
+	ops := vmdkops.VmdkOps{Cmd: service.NewCmd()}
+
+	badOpts := []map[string]string{
+		{"size": "10"},
+		{"size": "1xb"},
+		{"diskformat": "sparse"},
+		{"attach-as": "whatever"},
+		{"access": "write-only"},
+		{"no-such-option": "1"},
+	}
+	for _, opts := range badOpts {
+		assert.NotNil(t, ops.Create(ctx, "badvol", opts), "Create with %v should fail", opts)
+	}
+	assert.NotNil(t, ops.Create(ctx, "snap-000001", nil))
+	assert.NotNil(t, ops.Create(ctx, "bad/name", nil))
+
+	err := ops.Create(ctx, "clone", map[string]string{"clone-from": "missing"})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "Could not find volume for cloning")
+	}
+	assert.Nil(t, ops.Create(ctx, "src", nil))
+	assert.NotNil(t, ops.Create(ctx, "clone", map[string]string{"clone-from": "src", "size": "1gb"}))
+	assert.NotNil(t, ops.Create(ctx, "clone", map[string]string{"clone-from": "src", "fstype": "ext4"}))
+	assert.NotNil(t, ops.Create(ctx, "clone", map[string]string{"clone-from": "src", "mkfs-options": "-m 0"}))
+
+	_, err = ops.Attach(ctx, "missing", nil)
+	assert.NotNil(t, err)
+	assert.NotNil(t, ops.Remove(ctx, "missing", nil))
+
+	os.Setenv("VDVS_TEST_PROTOCOL_VERSION", "1")
+	err = ops.Create(ctx, "vol", nil)
+	os.Unsetenv("VDVS_TEST_PROTOCOL_VERSION")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "protocol version")
+	}
+}
@@ -13,153 +13,334 @@
 // limitations under the License.
 
 // An implementation of the VmdkCmdRunner interface that mocks ESX. This removes the requirement forunning ESX at all when testing the plugin.
+//
+// Volumes are backed by sparse files exposed as loopback devices. Volume metadata
+// (creation options, capacity/used, attached-to VM) is kept in a JSON file next to
+// the backing files, so it survives plugin restarts, and the same rules as in
+// the ESX service are enforced on it (no double attach, no remove while attached, etc.)
+// Snapshots are copies (reflinks where the file system supports it) of the backing files.
 
 package vmdkops
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
 )
 
 // MockVmdkCmd struct
-type MockVmdkCmd struct{}
+type MockVmdkCmd struct {
+	Root   string // backing files and volume metadata are kept here
+	VMName string // VM the mock pretends to run on, reported as "attached to VM"
+}
 
 const (
-	backingRoot     = "/tmp/docker-volumes" // Files for loopback device backing stored here
-	fileSizeInBytes = 100 * 1024 * 1024     // file size for loopback block device
+	backingRoot      = "/tmp/docker-volumes" // Files for loopback device backing stored here
+	mockMetadataFile = "volumes.json"        // volume metadata, stored in Root
+	mockSnapshotDir  = "snapshots"           // snapshot backing files, stored in Root
+	bytesInMb        = 1024 * 1024
 )
 
+// mockCmdMtx serializes mock commands, backing files and loop devices are shared
+var mockCmdMtx sync.Mutex
+
 // NewMockCmd returns a new instance of MockVmdkCmd.
 func NewMockCmd() MockVmdkCmd {
-	return MockVmdkCmd{}
+	return MockVmdkCmd{Root: backingRoot, VMName: MockDefaultVMName}
+}
+
+func (mockCmd MockVmdkCmd) getBackingFileName(vol *mockVolume) string {
+	return filepath.Join(mockCmd.Root, vol.fullName())
+}
+
+func (mockCmd MockVmdkCmd) getSnapshotDir(vol *mockVolume) string {
+	return filepath.Join(mockCmd.Root, mockSnapshotDir, vol.fullName())
 }
 
-func getBackingFileName(nameBase string) string {
-	// make unique name - avoid clashes shall we find any garbage in the directory
-	name := fmt.Sprintf("%s/%d/%s", backingRoot, os.Getpid(), nameBase)
-	log.WithFields(log.Fields{"name": name}).Debug("Created tmp file for loopback")
-	return name
+func (mockCmd MockVmdkCmd) getSnapshotFileName(vol *mockVolume, snapName string) string {
+	return filepath.Join(mockCmd.getSnapshotDir(vol), snapName)
 }
 
 // Run returns JSON responses to each command or an error
-func (mockCmd MockVmdkCmd) Run(cmd string, name string, opts map[string]string) ([]byte, error) {
-	// We store no in memory state, so just try to recreate backingRoot every time
-	rootName := fmt.Sprintf("%s/%d", backingRoot, os.Getpid())
-	err := fs.Mkdir(rootName)
+func (mockCmd MockVmdkCmd) Run(ctx context.Context, cmd string, name string, opts map[string]string) ([]byte, error) {
+	mockCmdMtx.Lock()
+	defer mockCmdMtx.Unlock()
+
+	err := fs.Mkdir(ctx, mockCmd.Root)
+	if err != nil {
+		return nil, err
+	}
+	store, err := openMockVolumeStore(filepath.Join(mockCmd.Root, mockMetadataFile))
 	if err != nil {
 		return nil, err
 	}
-	log.WithFields(log.Fields{"cmd": cmd}).Debug("Running Mock Cmd")
+	requestid.Log(ctx).WithFields(log.Fields{"cmd": cmd, "name": name}).Debug("Running Mock Cmd")
 	switch cmd {
 	case "create":
-		err := createBlockDevice(name, opts)
-		return nil, err
+		return nil, mockCmd.create(ctx, store, name, opts)
 	case "list":
-		return list()
+		return json.Marshal(store.list())
 	case "get":
-		return nil, get(name)
+		return mockCmd.get(store, name)
 	case "attach":
-		return getBlockDeviceForName(name)
+		return mockCmd.attach(store, name)
 	case "detach":
-		return nil, nil
+		return nil, store.detach(name, mockCmd.VMName)
 	case "remove":
-		err := remove(name)
-		return nil, err
+		return nil, mockCmd.remove(store, name)
+	case "extend":
+		return nil, mockCmd.extend(store, name, opts[mockOptSize])
+	case "snapshot":
+		return nil, mockCmd.snapshot(ctx, store, name, opts[SnapshotOpt])
+	case "listsnapshots":
+		snapshots, err := store.listSnapshots(name)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(snapshots)
+	case "deletesnapshot":
+		return nil, mockCmd.deleteSnapshot(store, name, opts[SnapshotOpt])
+	case "revertsnapshot":
+		return nil, mockCmd.revertSnapshot(store, name, opts[SnapshotOpt])
 	}
-	return []byte("null"), nil
+	return nil, fmt.Errorf("Unknown command:%s", cmd)
 }
 
-func list() ([]byte, error) {
-	rootName := fmt.Sprintf("%s/%d", backingRoot, os.Getpid())
-	files, err := ioutil.ReadDir(rootName)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to read %s", backingRoot)
+// create records the volume and creates its backing file and file system,
+// or copies the backing file of the source volume for a clone.
+func (mockCmd MockVmdkCmd) create(ctx context.Context, store *mockVolumeStore, name string, opts map[string]string) error {
+	vol, err := store.create(name, opts, mockCmd.VMName)
+	if err != nil || vol == nil {
+		return err
 	}
-	volumes := make([]VolumeData, 0, len(files))
-	for _, file := range files {
-		volumes = append(volumes, VolumeData{Name: file.Name()})
+	backing := mockCmd.getBackingFileName(vol)
+
+	if src, ok := opts[mockOptCloneFrom]; ok {
+		srcVol, _ := store.lookupCopy(src)
+		if srcVol == nil {
+			err = fmt.Errorf("Could not find volume for cloning %s", src)
+		} else {
+			err = copyBackingFile(mockCmd.getBackingFileName(srcVol), backing)
+		}
+	} else {
+		err = mockCmd.createBlockDevice(ctx, vol, backing)
 	}
-	return json.Marshal(volumes)
+	if err != nil {
+		os.Remove(backing)
+		store.remove(vol.fullName())
+		return err
+	}
+	return nil
 }
 
-// validates that the volume exists, returns error or nil (for OK)
-func get(name string) error {
-	filePath := getBackingFileName(name)
-	if _, err := os.Lstat(filePath); os.IsNotExist(err) {
-		return fmt.Errorf("Unknown volume %s", name)
-	} else if err != nil {
+func (mockCmd MockVmdkCmd) createBlockDevice(ctx context.Context, vol *mockVolume, backing string) error {
+	err := createBackingFile(backing, vol.CapacityMb*bytesInMb)
+	if err != nil {
 		return err
 	}
-	return nil
+	device, err := getLoopbackDevice(backing)
+	if err != nil {
+		return err
+	}
+	fstype := vol.Opts[mockOptFsType]
+	errFstype := fs.VerifyFSSupport(ctx, fstype)
+	if errFstype != nil {
+		detachLoopbackDevice(device)
+		return fmt.Errorf("Not found mkfs for %s", fstype)
+	}
+	err = fs.MkfsByDevicePath(ctx, fstype, vol.Name, device, vol.Opts[mockOptMkfsOpts])
+	if err != nil {
+		detachLoopbackDevice(device)
+	}
+	return err
 }
 
-func remove(name string) error {
-	backing := getBackingFileName(name)
-	out, err := exec.Command("blkid", []string{"-L", name}...).CombinedOutput()
+// get refreshes the space used by the volume and returns its metadata
+func (mockCmd MockVmdkCmd) get(store *mockVolumeStore, name string) ([]byte, error) {
+	if vol, _ := store.lookupCopy(name); vol != nil {
+		var stat syscall.Stat_t
+		if err := syscall.Stat(mockCmd.getBackingFileName(vol), &stat); err == nil {
+			used := uint64(stat.Blocks) * 512
+			store.setUsed(name, (used+bytesInMb-1)/bytesInMb)
+		}
+	}
+	info, err := store.get(name)
 	if err != nil {
-		return fmt.Errorf("Failed to find device for backing file %s via blkid", backing)
+		return nil, err
+	}
+	return json.Marshal(info)
+}
+
+// attach marks the volume attached to this VM and returns the loopback device
+// path (not a VolumeDevSpec) as the response.
+func (mockCmd MockVmdkCmd) attach(store *mockVolumeStore, name string) ([]byte, error) {
+	if _, err := store.attach(name, mockCmd.VMName); err != nil {
+		return nil, err
 	}
-	device := strings.TrimRight(string(out), " \n")
-	fmt.Printf("Detaching loopback device %s\n", device)
-	out, err = exec.Command("losetup", "-d", device).CombinedOutput()
+	vol, _ := store.lookupCopy(name)
+	device, err := getLoopbackDevice(mockCmd.getBackingFileName(vol))
 	if err != nil {
-		return fmt.Errorf("Failed to detach loopback device node %s with error: %s. Output = %s",
-			device, err, out)
+		store.detach(name, mockCmd.VMName)
+		return nil, err
 	}
-	err = os.Remove(backing)
+	return []byte(device), nil
+}
+
+func (mockCmd MockVmdkCmd) remove(store *mockVolumeStore, name string) error {
+	vol, err := store.lookupCopy(name)
 	if err != nil {
+		return err
+	}
+	if err = store.remove(name); err != nil {
+		return err
+	}
+	backing := mockCmd.getBackingFileName(vol)
+	if device := findLoopbackDevice(backing); device != "" {
+		if err = detachLoopbackDevice(device); err != nil {
+			return err
+		}
+	}
+	err = os.Remove(backing)
+	if err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("Failed to remove backing file %s: %s", backing, err)
 	}
-	return os.Remove(device)
+	// snapshots go away with the volume
+	return os.RemoveAll(mockCmd.getSnapshotDir(vol))
+}
+
+// extend grows the backing file and makes the loopback device, if any, pick up the new size
+func (mockCmd MockVmdkCmd) extend(store *mockVolumeStore, name string, size string) error {
+	newMb, err := store.extend(name, size)
+	if err != nil {
+		return err
+	}
+	vol, _ := store.lookupCopy(name)
+	backing := mockCmd.getBackingFileName(vol)
+	if err = os.Truncate(backing, int64(newMb*bytesInMb)); err != nil {
+		return fmt.Errorf("Failed to extend backing file %s: %s", backing, err)
+	}
+	return refreshLoopbackDevice(backing)
+}
+
+func (mockCmd MockVmdkCmd) snapshot(ctx context.Context, store *mockVolumeStore, name string, snapName string) error {
+	if err := store.snapshot(name, snapName); err != nil {
+		return err
+	}
+	vol, _ := store.lookupCopy(name)
+	snapFile := mockCmd.getSnapshotFileName(vol, snapName)
+	err := fs.Mkdir(ctx, mockCmd.getSnapshotDir(vol))
+	if err == nil {
+		err = copyBackingFile(mockCmd.getBackingFileName(vol), snapFile)
+	}
+	if err != nil {
+		store.deleteSnapshot(name, snapName)
+		return err
+	}
+	return nil
 }
 
-func createBlockDevice(label string, opts map[string]string) error {
-	backing := getBackingFileName(label)
-	err := createBackingFile(backing)
+func (mockCmd MockVmdkCmd) deleteSnapshot(store *mockVolumeStore, name string, snapName string) error {
+	vol, err := store.lookupCopy(name)
 	if err != nil {
 		return err
 	}
+	if err = store.deleteSnapshot(name, snapName); err != nil {
+		return err
+	}
+	err = os.Remove(mockCmd.getSnapshotFileName(vol, snapName))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to remove snapshot file: %s", err)
+	}
+	return nil
+}
+
+// revertSnapshot copies the snapshot over the backing file. The copy is done
+// in place, so a loopback device set up for the volume keeps working.
+func (mockCmd MockVmdkCmd) revertSnapshot(store *mockVolumeStore, name string, snapName string) error {
+	if err := store.revertSnapshot(name, snapName); err != nil {
+		return err
+	}
+	vol, _ := store.lookupCopy(name)
+	backing := mockCmd.getBackingFileName(vol)
+	if err := copyBackingFile(mockCmd.getSnapshotFileName(vol, snapName), backing); err != nil {
+		return err
+	}
+	// the volume may have been extended after the snapshot was taken
+	return refreshLoopbackDevice(backing)
+}
+
+// getLoopbackDevice returns the loopback device for the backing file,
+// setting one up if there is none (e.g. after a reboot).
+func getLoopbackDevice(backing string) (string, error) {
+	if device := findLoopbackDevice(backing); device != "" {
+		return device, nil
+	}
 	loopbackCount := getMaxLoopbackCount() + 1
 	device := fmt.Sprintf("/dev/loop%d", loopbackCount)
-	err = createDeviceNode(device, loopbackCount)
+	err := createDeviceNode(device, loopbackCount)
 	if err != nil {
-		return err
+		return "", err
 	}
 	// Ignore output. This is to prevent spurious failures from old devices
 	// that were removed, but not detached.
 	exec.Command("losetup", "-d", device).CombinedOutput()
 	err = setupLoopbackDevice(backing, device)
 	if err != nil {
-		return err
+		os.Remove(device)
+		return "", err
 	}
-	// Use default fstype if not specified
-	if _, result := opts["fstype"]; result == false {
-		opts["fstype"] = fs.FstypeDefault
+	return device, nil
+}
+
+// findLoopbackDevice returns the loopback device using the backing file, or ""
+func findLoopbackDevice(backing string) string {
+	out, err := exec.Command("losetup", "-j", backing).CombinedOutput()
+	if err != nil {
+		return ""
 	}
-	errFstype := fs.VerifyFSSupport(opts["fstype"])
-	if errFstype != nil {
-		return fmt.Errorf("Not found mkfs for %s", opts["fstype"])
+	// Output looks like "/dev/loop1001: [2049]:1234 (/tmp/docker-volumes/vol@datastore1)"
+	line := strings.SplitN(string(out), "\n", 2)[0]
+	if i := strings.Index(line, ":"); i > 0 {
+		return line[:i]
 	}
-	return fs.MkfsByDevicePath(opts["fstype"], label, device)
+	return ""
 }
 
-func getBlockDeviceForName(name string) ([]byte, error) {
-	backing := getBackingFileName(name)
-	out, err := exec.Command("blkid", []string{"-L", name}...).CombinedOutput()
+// refreshLoopbackDevice makes the loopback device using the backing file, if any,
+// re-read the size of the file
+func refreshLoopbackDevice(backing string) error {
+	device := findLoopbackDevice(backing)
+	if device == "" {
+		return nil
+	}
+	out, err := exec.Command("losetup", "-c", device).CombinedOutput()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to find device for backing file %s via blkid", backing)
+		return fmt.Errorf("Failed to refresh capacity of loopback device %s: %s. Output = %s",
+			device, err, out)
 	}
-	device := strings.TrimRight(string(out), " \n")
-	return []byte(device), nil
+	return nil
+}
+
+func detachLoopbackDevice(device string) error {
+	log.WithFields(log.Fields{"device": device}).Debug("Detaching loopback device ")
+	out, err := exec.Command("losetup", "-d", device).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to detach loopback device node %s with error: %s. Output = %s",
+			device, err, out)
+	}
+	return os.Remove(device)
 }
 
 func getMaxLoopbackCount() int {
@@ -180,19 +361,30 @@ func getMaxLoopbackCount() int {
 	return count
 }
 
-func createBackingFile(backing string) error {
+// createBackingFile creates a sparse file, space is allocated as it is written
+func createBackingFile(backing string, size uint64) error {
 	flags := syscall.O_RDWR | syscall.O_CREAT | syscall.O_EXCL
 	file, err := os.OpenFile(backing, flags, 0755)
 	if err != nil {
 		return fmt.Errorf("Failed to create backing file %s: %s", backing, err)
 	}
-	err = syscall.Fallocate(int(file.Fd()), 0, 0, fileSizeInBytes)
+	defer file.Close()
+	err = file.Truncate(int64(size))
 	if err != nil {
 		return fmt.Errorf("Failed to allocate %s: %s", backing, err)
 	}
 	return nil
 }
 
+func copyBackingFile(src string, dst string) error {
+	out, err := exec.Command("cp", "--reflink=auto", "--sparse=always", src, dst).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to copy backing file %s to %s: %s. Output = %s",
+			src, dst, err, out)
+	}
+	return nil
+}
+
 func createDeviceNode(device string, loopbackCount int) error {
 	count := fmt.Sprintf("%d", loopbackCount)
 	out, err := exec.Command("mknod", device, "b", "7", count).CombinedOutput()
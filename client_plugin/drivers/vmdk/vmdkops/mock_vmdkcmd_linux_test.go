@@ -0,0 +1,152 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdkops_test
+
+// Test the state kept by the mocked ESX server.
+// Needs root to set up loopback devices.
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vmdk/vmdkops"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+)
+
+func TestMockCmdState(t *testing.T) {
+	ctx := context.Background()
+	if os.Geteuid() != 0 {
+		t.Skip("Mock commands need root to set up loopback devices")
+	}
+	root, err := ioutil.TempDir("", "mock-vmdkcmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	vm1 := vmdkops.NewMockCmd()
+	vm1.Root = root
+	vm1.VMName = "vm1"
+	vm2 := vm1
+	vm2.VMName = "vm2"
+	ops1 := vmdkops.VmdkOps{Cmd: vm1}
+	ops2 := vmdkops.VmdkOps{Cmd: vm2}
+
+	err = ops1.Create(ctx, "clone", map[string]string{"clone-from": "missing"})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "Could not find volume for cloning")
+	}
+
+	if !assert.Nil(t, ops1.Create(ctx, "vol", map[string]string{"size": "20mb", "access": "read-only"})) {
+		return
+	}
+	status, err := ops1.Get(ctx, "vol")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "read-only", status["access"])
+		assert.Equal(t, "vm1", status["created by VM"])
+		assert.Equal(t, "20MB", status["capacity"].(map[string]interface{})["size"])
+		assert.NotEqual(t, "0MB", status["capacity"].(map[string]interface{})["allocated"])
+	}
+
+	dev, err := ops1.RawAttach(ctx, "vol", nil)
+	if assert.Nil(t, err) {
+		assert.Contains(t, string(dev), "/dev/loop")
+	}
+
+	// extend the attached volume, the device and the filesystem should grow
+	assert.NotNil(t, ops1.Extend(ctx, "vol", "10mb"), "Shrinking a volume should fail")
+	if assert.Nil(t, ops1.Extend(ctx, "vol", "40mb")) {
+		out, err := exec.Command("blockdev", "--getsize64", string(dev)).Output()
+		if assert.Nil(t, err) {
+			assert.Equal(t, "41943040", strings.TrimSpace(string(out)))
+		}
+		assert.Nil(t, fs.GrowFsByDevicePath(context.Background(), "ext4", string(dev), ""))
+		status, err = ops1.Get(ctx, "vol")
+		if assert.Nil(t, err) {
+			assert.Equal(t, "40MB", status["capacity"].(map[string]interface{})["size"])
+		}
+	}
+	_, err = ops2.RawAttach(ctx, "vol", nil)
+	assert.NotNil(t, err, "Attach to a second VM should fail")
+	assert.NotNil(t, ops2.Detach(ctx, "vol", nil), "Detach from the wrong VM should fail")
+	assert.NotNil(t, ops1.Remove(ctx, "vol", nil), "Remove of an attached volume should fail")
+
+	// attach state is visible to every user of the metadata and kept on disk
+	status, err = ops2.Get(ctx, "vol")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "attached", status["status"])
+		assert.Equal(t, "vm1", status["attached to VM"])
+	}
+	data, err := ioutil.ReadFile(filepath.Join(root, "volumes.json"))
+	if assert.Nil(t, err) {
+		var volumes map[string]map[string]interface{}
+		assert.Nil(t, json.Unmarshal(data, &volumes))
+		assert.Equal(t, "vm1", volumes["vol@"+vmdkops.MockDefaultDatastore]["AttachedTo"])
+	}
+
+	assert.Nil(t, ops1.Detach(ctx, "vol", nil))
+	assert.Nil(t, ops1.Create(ctx, "clone", map[string]string{"clone-from": "vol"}))
+	status, err = ops1.Get(ctx, "clone")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "read-only", status["access"])
+		assert.Equal(t, "vol", status["clone-from"])
+	}
+
+	// snapshot, change the volume, then revert to the snapshot
+	assert.Nil(t, ops1.Snapshot(ctx, "vol", "snap1"))
+	assert.NotNil(t, ops1.Snapshot(ctx, "vol", "snap1"), "Duplicate snapshot should fail")
+	snapshots, err := ops1.ListSnapshots(ctx, "vol")
+	if assert.Nil(t, err) && assert.Len(t, snapshots, 1) {
+		assert.Equal(t, "snap1", snapshots[0].Name)
+		assert.Equal(t, "40MB", snapshots[0].Size)
+	}
+	snapFile := filepath.Join(root, "snapshots", "vol@"+vmdkops.MockDefaultDatastore, "snap1")
+	backing := filepath.Join(root, "vol@"+vmdkops.MockDefaultDatastore)
+	assert.Nil(t, ioutil.WriteFile(backing, []byte("changed"), 0644))
+	_, err = ops1.RawAttach(ctx, "vol", nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, ops1.RevertSnapshot(ctx, "vol", "snap1"), "Revert of an attached volume should fail")
+	assert.Nil(t, ops1.Detach(ctx, "vol", nil))
+	assert.Nil(t, ops1.RevertSnapshot(ctx, "vol", "snap1"))
+	snapData, _ := ioutil.ReadFile(snapFile)
+	volData, _ := ioutil.ReadFile(backing)
+	assert.Equal(t, snapData, volData)
+	assert.NotNil(t, ops1.RevertSnapshot(ctx, "vol", "nosuchsnap"))
+	assert.Nil(t, ops1.DeleteSnapshot(ctx, "vol", "snap1"))
+	_, err = os.Stat(snapFile)
+	assert.True(t, os.IsNotExist(err))
+	assert.NotNil(t, ops1.DeleteSnapshot(ctx, "vol", "snap1"))
+	_, err = ops1.RawAttach(ctx, "vol", nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, ops1.Snapshot(ctx, "vol", "snap2"), "Snapshot of an attached volume should fail")
+	assert.Nil(t, ops1.Detach(ctx, "vol", nil))
+	assert.Nil(t, ops1.Snapshot(ctx, "vol", "snap2"))
+
+	volumes, err := ops2.List(ctx)
+	if assert.Nil(t, err) {
+		assert.Len(t, volumes, 2)
+	}
+	assert.Nil(t, ops2.Remove(ctx, "vol", nil))
+	assert.Nil(t, ops2.Remove(ctx, "clone", nil))
+	_, err = os.Stat(filepath.Join(root, "snapshots", "vol@"+vmdkops.MockDefaultDatastore))
+	assert.True(t, os.IsNotExist(err), "Snapshots should be removed with the volume")
+}
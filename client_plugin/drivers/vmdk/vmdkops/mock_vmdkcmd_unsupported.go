@@ -16,7 +16,10 @@
 
 package vmdkops
 
-import "errors"
+import (
+	"context"
+	"errors"
+)
 
 // UnsupportedMockCmd struct.
 type UnsupportedMockCmd struct{}
@@ -27,6 +30,6 @@ func NewMockCmd() UnsupportedMockCmd {
 }
 
 // Run returns an error.
-func (u UnsupportedMockCmd) Run(cmd string, name string, opts map[string]string) ([]byte, error) {
+func (u UnsupportedMockCmd) Run(ctx context.Context, cmd string, name string, opts map[string]string) ([]byte, error) {
 	return nil, errors.New("VmdkCmdRunner mocking is not supported on this platform")
 }
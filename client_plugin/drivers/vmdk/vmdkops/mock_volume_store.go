@@ -0,0 +1,678 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux windows
+
+// Volume table used by the mock ESX service and MockVmdkCmd.
+// It validates options and keeps per-volume metadata the same way vmdk_ops.py
+// and volume_kv.py do, so errors returned to clients match the real service.
+// The table can be kept in memory only or in a JSON file which survives restarts.
+
+package vmdkops
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+)
+
+const (
+	// Volume option names, see volume_kv.py
+	mockOptSize       = "size"
+	mockOptPolicy     = "vsan-policy-name"
+	mockOptDiskFormat = "diskformat"
+	mockOptAttachAs   = "attach-as"
+	mockOptAccess     = "access"
+	mockOptFsType     = "fstype"
+	mockOptCloneFrom  = "clone-from"
+	mockOptMountOpts  = "mount-options"
+	mockOptMkfsOpts   = "mkfs-options"
+	mockOptClass      = "class"
+	mockOptCloneSnap  = "clone-snapshot"
+
+	// Defaults used by vmdk_ops.py
+	mockDefaultSize       = "100mb"
+	mockDefaultDiskFormat = "thin"
+	mockDefaultAttachAs   = "independent_persistent"
+	mockDefaultAccess     = "read-write"
+	mockDefaultFsType     = "ext4"
+	mockDefaultCloneFrom  = "None"
+
+	// MockDefaultDatastore is used for volume names without "@datastore"
+	MockDefaultDatastore = "datastore1"
+	// MockDefaultVMName is the VM name the mock service reports for its clients
+	MockDefaultVMName = "mock-vm"
+
+	mockStatusAttached = "attached"
+	mockStatusDetached = "detached"
+
+	// PCI slot of the PVSCSI controller reported on attach
+	mockControllerPciSlot = "160"
+	// Units available on a PVSCSI controller, unit 7 is reserved for the controller
+	mockMaxUnits      = 16
+	mockReservedUnit  = 7
+	mockMaxVolNameLen = 100
+)
+
+var (
+	mockValidOpts = []string{mockOptSize, mockOptPolicy, mockOptDiskFormat,
+		mockOptAttachAs, mockOptAccess, mockOptFsType, mockOptCloneFrom, mockOptMountOpts, mockOptMkfsOpts, mockOptClass,
+		mockOptCloneSnap}
+	mockValidDiskFormats = []string{"zeroedthick", "thin", "eagerzeroedthick"}
+	mockValidAttachAs    = []string{"independent_persistent", "persistent"}
+	mockValidAccess      = []string{"read-write", "read-only"}
+
+	mockSizeRe    = regexp.MustCompile(`^(?i)([0-9]+)(mb|gb|tb)$`)
+	mockSnapRe    = regexp.MustCompile(`-[0-9]{6}$`)
+	mockFsTypeRe  = regexp.MustCompile(`^[a-z0-9]+$`)
+	mockSizeUnits = map[string]uint64{"mb": 1, "gb": 1024, "tb": 1024 * 1024}
+)
+
+// mockVolume is the metadata kept for a single volume
+type mockVolume struct {
+	Name       string            // short name, without "@datastore"
+	Datastore  string            // datastore the volume lives on
+	Status     string            // mockStatusAttached or mockStatusDetached
+	Opts       map[string]string // creation options, with defaults filled in
+	CapacityMb uint64            // requested size
+	UsedMb     uint64            // space allocated by the backing store
+	Created    string            // creation time, formatted like time.asctime()
+	CreatedBy  string            // VM which created the volume
+	AttachedTo string            // VM the volume is attached to, if any
+	Unit       string            // SCSI unit number while attached
+	Snapshots  []mockSnapshot    `json:",omitempty"`
+}
+
+// mockSnapshot is a point-in-time copy of a volume
+type mockSnapshot struct {
+	Name       string
+	Created    string
+	CapacityMb uint64 // capacity of the volume when the snapshot was taken
+}
+
+// fullName returns "volume@datastore"
+func (v *mockVolume) fullName() string {
+	return v.Name + "@" + v.Datastore
+}
+
+// mockVolumeStore is a table of volumes indexed by "volume@datastore"
+type mockVolumeStore struct {
+	mtx     sync.Mutex
+	path    string // metadata file, empty if volumes are kept in memory only
+	volumes map[string]*mockVolume
+}
+
+var (
+	// stores opened from a metadata file, shared by all users of the same file
+	openStores    = make(map[string]*mockVolumeStore)
+	openStoresMtx sync.Mutex
+)
+
+func newMockVolumeStore() *mockVolumeStore {
+	return &mockVolumeStore{volumes: make(map[string]*mockVolume)}
+}
+
+// openMockVolumeStore returns the store kept in the metadata file at path,
+// loading it if this is the first user of the file in this process.
+func openMockVolumeStore(path string) (*mockVolumeStore, error) {
+	openStoresMtx.Lock()
+	defer openStoresMtx.Unlock()
+	if s, ok := openStores[path]; ok {
+		return s, nil
+	}
+
+	s := newMockVolumeStore()
+	s.path = path
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if err = json.Unmarshal(data, &s.volumes); err != nil {
+			return nil, fmt.Errorf("Failed to parse volume metadata %s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Failed to read volume metadata %s: %v", path, err)
+	}
+	openStores[path] = s
+	return s, nil
+}
+
+// save writes the table to the metadata file. Caller holds the lock.
+func (s *mockVolumeStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.volumes, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write a temp file and rename it so a crash never leaves a partial file
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return fmt.Errorf("Failed to save volume metadata: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to save volume metadata %s: %v", s.path, err)
+	}
+	return nil
+}
+
+// parseVolName splits "volume[@datastore]" the way vmdk_ops.py does it
+func parseVolName(fullName string) (string, string, error) {
+	vol, ds := fullName, MockDefaultDatastore
+	if i := strings.LastIndex(fullName, "@"); i >= 0 {
+		vol, ds = fullName[:i], fullName[i+1:]
+		if ds == "" {
+			return "", "", fmt.Errorf("Volume name %s has an empty datastore", fullName)
+		}
+	}
+	if vol == "" || len(vol) > mockMaxVolNameLen || strings.ContainsAny(vol, `/\`) ||
+		mockSnapRe.MatchString(vol) {
+		return "", "", fmt.Errorf("Volume name %s is invalid", fullName)
+	}
+	return vol, ds, nil
+}
+
+// validateSnapName checks the snapshot name is usable as a file name
+func validateSnapName(snapName string) error {
+	if snapName == "" || len(snapName) > mockMaxVolNameLen || strings.ContainsAny(snapName, `/\@`) ||
+		mockSnapRe.MatchString(snapName) {
+		return fmt.Errorf("Snapshot name '%s' is invalid", snapName)
+	}
+	return nil
+}
+
+// sizeToMb converts "10gb" style sizes to MB
+func sizeToMb(size string) (uint64, bool) {
+	m := mockSizeRe.FindStringSubmatch(size)
+	if m == nil {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(m[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n * mockSizeUnits[strings.ToLower(m[2])], true
+}
+
+// mbToString formats MB the way vmdk_ops.py reports capacity
+func mbToString(mb uint64) string {
+	switch {
+	case mb >= 1024*1024 && mb%(1024*1024) == 0:
+		return fmt.Sprintf("%dTB", mb/(1024*1024))
+	case mb >= 1024 && mb%1024 == 0:
+		return fmt.Sprintf("%dGB", mb/1024)
+	}
+	return fmt.Sprintf("%dMB", mb)
+}
+
+func contains(list []string, val string) bool {
+	for _, v := range list {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
+// validateOpts mirrors validate_opts() in vmdk_ops.py
+func validateOpts(opts map[string]string) error {
+	var invalid []string
+	for k := range opts {
+		if !contains(mockValidOpts, k) {
+			invalid = append(invalid, k)
+		}
+	}
+	if len(invalid) != 0 {
+		sort.Strings(invalid)
+		return fmt.Errorf("Invalid options: %v \nValid options and defaults: %v",
+			invalid, mockValidOpts)
+	}
+	if size, ok := opts[mockOptSize]; ok {
+		if _, ok := sizeToMb(size); !ok {
+			return fmt.Errorf("Invalid option for size: %s. Size must be a number followed by mb/gb/tb", size)
+		}
+	}
+	if val, ok := opts[mockOptDiskFormat]; ok && !contains(mockValidDiskFormats, val) {
+		return fmt.Errorf("Invalid option for diskformat: %s. Valid options are: %v", val, mockValidDiskFormats)
+	}
+	if val, ok := opts[mockOptAttachAs]; ok && !contains(mockValidAttachAs, val) {
+		return fmt.Errorf("Invalid option for attach-as: %s. Valid options are: %v", val, mockValidAttachAs)
+	}
+	if val, ok := opts[mockOptAccess]; ok && !contains(mockValidAccess, val) {
+		return fmt.Errorf("Invalid option for access: %s. Valid options are: %v", val, mockValidAccess)
+	}
+	if val, ok := opts[mockOptFsType]; ok && !mockFsTypeRe.MatchString(val) {
+		return fmt.Errorf("Invalid option for fstype: %s", val)
+	}
+	if _, ok := opts[mockOptCloneSnap]; ok {
+		if _, ok := opts[mockOptCloneFrom]; !ok {
+			return fmt.Errorf("Cannot define clone-snapshot without clone-from")
+		}
+	}
+	return nil
+}
+
+// lookup returns the volume for name, nil if it does not exist. Caller holds the lock.
+func (s *mockVolumeStore) lookup(name string) (*mockVolume, error) {
+	vol, ds, err := parseVolName(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.volumes[vol+"@"+ds], nil
+}
+
+// lookupCopy returns a copy of the volume metadata, nil if it does not exist
+func (s *mockVolumeStore) lookupCopy(name string) (*mockVolume, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	v, err := s.lookup(name)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	copyVol := *v
+	return &copyVol, nil
+}
+
+// create adds a new volume and returns it. Creating an existing volume is not
+// an error, nil is returned for it.
+func (s *mockVolumeStore) create(name string, opts map[string]string, vmName string) (*mockVolume, error) {
+	vol, ds, err := parseVolName(name)
+	if err != nil {
+		return nil, err
+	}
+	if err = validateOpts(opts); err != nil {
+		return nil, err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, exists := s.volumes[vol+"@"+ds]; exists {
+		return nil, nil
+	}
+
+	newVol := &mockVolume{
+		Name:      vol,
+		Datastore: ds,
+		Status:    mockStatusDetached,
+		Created:   time.Now().Format(time.ANSIC),
+		CreatedBy: vmName,
+		Opts: map[string]string{
+			mockOptSize:       mockDefaultSize,
+			mockOptDiskFormat: mockDefaultDiskFormat,
+			mockOptAttachAs:   mockDefaultAttachAs,
+			mockOptAccess:     mockDefaultAccess,
+			mockOptFsType:     mockDefaultFsType,
+			mockOptCloneFrom:  mockDefaultCloneFrom,
+		},
+	}
+
+	if src, ok := opts[mockOptCloneFrom]; ok {
+		if _, ok := opts[mockOptSize]; ok {
+			return nil, fmt.Errorf("Cannot define the size for a clone")
+		}
+		if _, ok := opts[mockOptFsType]; ok {
+			return nil, fmt.Errorf("Cannot define the filesystem type for a clone")
+		}
+		if _, ok := opts[mockOptMkfsOpts]; ok {
+			return nil, fmt.Errorf("Cannot define mkfs options for a clone")
+		}
+		srcVol, err := s.lookup(src)
+		if err != nil {
+			return nil, err
+		}
+		if srcVol == nil {
+			return nil, fmt.Errorf("Could not find volume for cloning %s", src)
+		}
+		newVol.CapacityMb = srcVol.CapacityMb
+		if snapName, ok := opts[mockOptCloneSnap]; ok {
+			i := srcVol.findSnapshot(snapName)
+			if i < 0 {
+				return nil, fmt.Errorf("Snapshot %s of volume %s not found", snapName, srcVol.Name)
+			}
+			newVol.CapacityMb = srcVol.Snapshots[i].CapacityMb
+		}
+		for k, v := range srcVol.Opts {
+			if k != mockOptCloneSnap {
+				newVol.Opts[k] = v
+			}
+		}
+		newVol.Opts[mockOptCloneFrom] = srcVol.Name
+	}
+	for k, v := range opts {
+		if k != mockOptCloneFrom {
+			newVol.Opts[k] = v
+		}
+	}
+	if newVol.CapacityMb == 0 {
+		newVol.CapacityMb, _ = sizeToMb(newVol.Opts[mockOptSize])
+	}
+
+	s.volumes[newVol.fullName()] = newVol
+	if err = s.save(); err != nil {
+		delete(s.volumes, newVol.fullName())
+		return nil, err
+	}
+	copyVol := *newVol
+	return &copyVol, nil
+}
+
+// remove deletes a detached volume
+func (s *mockVolumeStore) remove(name string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	v, err := s.lookup(name)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return fmt.Errorf("Volume %s not found", name)
+	}
+	if v.Status == mockStatusAttached {
+		return fmt.Errorf("Failed to remove volume %s, in use by VM = %s.", v.Name, v.AttachedTo)
+	}
+	delete(s.volumes, v.fullName())
+	return s.save()
+}
+
+// freeUnit returns the lowest SCSI unit not used by volumes attached to vmName
+func (s *mockVolumeStore) freeUnit(vmName string) (string, error) {
+	used := make(map[string]bool)
+	for _, v := range s.volumes {
+		if v.Status == mockStatusAttached && v.AttachedTo == vmName {
+			used[v.Unit] = true
+		}
+	}
+	for unit := 0; unit < mockMaxUnits; unit++ {
+		u := strconv.Itoa(unit)
+		if unit != mockReservedUnit && !used[u] {
+			return u, nil
+		}
+	}
+	return "", fmt.Errorf("Failed to place new disk - out of disk slots")
+}
+
+// attach marks the volume attached to vmName. Attaching a volume already
+// attached to the same VM returns the same unit.
+func (s *mockVolumeStore) attach(name string, vmName string) (*fs.VolumeDevSpec, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	v, err := s.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, fmt.Errorf("Volume %s not found", name)
+	}
+	if v.Status == mockStatusAttached {
+		if v.AttachedTo != vmName {
+			return nil, fmt.Errorf("Failed to attach volume %s to VM %s, already attached to VM %s",
+				v.Name, vmName, v.AttachedTo)
+		}
+	} else {
+		if v.Unit, err = s.freeUnit(vmName); err != nil {
+			return nil, err
+		}
+		v.Status = mockStatusAttached
+		v.AttachedTo = vmName
+		if err = s.save(); err != nil {
+			return nil, err
+		}
+	}
+	return &fs.VolumeDevSpec{Unit: v.Unit, ControllerPciSlotNumber: mockControllerPciSlot}, nil
+}
+
+// detach marks the volume detached. Detaching a detached volume is not an error.
+func (s *mockVolumeStore) detach(name string, vmName string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	v, err := s.lookup(name)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return fmt.Errorf("Volume %s not found", name)
+	}
+	if v.Status != mockStatusAttached {
+		return nil
+	}
+	if v.AttachedTo != vmName {
+		return fmt.Errorf("Failed to detach volume %s from VM %s, attached to VM %s",
+			v.Name, vmName, v.AttachedTo)
+	}
+	v.Status = mockStatusDetached
+	v.AttachedTo = ""
+	v.Unit = ""
+	return s.save()
+}
+
+// setUsed records the space allocated for the volume
+func (s *mockVolumeStore) setUsed(name string, usedMb uint64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	v, err := s.lookup(name)
+	if err != nil || v == nil || v.UsedMb == usedMb {
+		return err
+	}
+	v.UsedMb = usedMb
+	return s.save()
+}
+
+// list returns all volumes sorted by name
+func (s *mockVolumeStore) list() []VolumeData {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	result := make([]VolumeData, 0, len(s.volumes))
+	for fullName := range s.volumes {
+		result = append(result, VolumeData{Name: fullName, Attributes: map[string]string{}})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// get returns volume info with the same keys vmdk_ops.py returns
+func (s *mockVolumeStore) get(name string) (map[string]interface{}, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	vol, ds, err := parseVolName(name)
+	if err != nil {
+		return nil, err
+	}
+	v := s.volumes[vol+"@"+ds]
+	if v == nil {
+		return nil, fmt.Errorf("Volume %s not found (file: [%s] dockvols/%s.vmdk)", vol, ds, vol)
+	}
+	info := map[string]interface{}{
+		"created by VM":    v.CreatedBy,
+		"created":          v.Created,
+		"status":           v.Status,
+		"capacity":         map[string]string{"size": mbToString(v.CapacityMb), "allocated": mbToString(v.UsedMb)},
+		"datastore":        v.Datastore,
+		"vsan-policy-name": "",
+	}
+	for _, k := range []string{mockOptFsType, mockOptDiskFormat, mockOptAttachAs,
+		mockOptAccess, mockOptCloneFrom} {
+		info[k] = v.Opts[k]
+	}
+	for _, k := range []string{mockOptPolicy, mockOptMountOpts, mockOptMkfsOpts, mockOptClass, mockOptCloneSnap} {
+		if val, ok := v.Opts[k]; ok {
+			info[k] = val
+		}
+	}
+	if v.Status == mockStatusAttached {
+		info["attached to VM"] = v.AttachedTo
+		info["attachedVMDevice"] = map[string]string{
+			"Unit":                    v.Unit,
+			"ControllerPciSlotNumber": mockControllerPciSlot,
+		}
+	}
+	if len(v.Snapshots) != 0 {
+		info["snapshots"] = v.snapshotData()
+	}
+	return info, nil
+}
+
+// findSnapshot returns the index of the snapshot in v.Snapshots or -1
+func (v *mockVolume) findSnapshot(snapName string) int {
+	for i, snap := range v.Snapshots {
+		if snap.Name == snapName {
+			return i
+		}
+	}
+	return -1
+}
+
+// lookupExisting returns the volume for name or a "not found" error. Caller holds the lock.
+func (s *mockVolumeStore) lookupExisting(name string) (*mockVolume, error) {
+	v, err := s.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, fmt.Errorf("Volume %s not found", name)
+	}
+	return v, nil
+}
+
+// snapshot records a new snapshot of the volume, which must be detached
+func (s *mockVolumeStore) snapshot(name string, snapName string) error {
+	if err := validateSnapName(snapName); err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	v, err := s.lookupExisting(name)
+	if err != nil {
+		return err
+	}
+	if v.findSnapshot(snapName) >= 0 {
+		return fmt.Errorf("Snapshot %s of volume %s already exists", snapName, v.Name)
+	}
+	if v.Status == mockStatusAttached {
+		return fmt.Errorf("Failed to snapshot volume %s, in use by VM = %s.", v.Name, v.AttachedTo)
+	}
+	v.Snapshots = append(v.Snapshots, mockSnapshot{
+		Name:       snapName,
+		Created:    time.Now().Format(time.ANSIC),
+		CapacityMb: v.CapacityMb,
+	})
+	if err = s.save(); err != nil {
+		v.Snapshots = v.Snapshots[:len(v.Snapshots)-1]
+		return err
+	}
+	return nil
+}
+
+// listSnapshots returns the snapshots of the volume, oldest first
+func (s *mockVolumeStore) listSnapshots(name string) ([]SnapshotData, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	v, err := s.lookupExisting(name)
+	if err != nil {
+		return nil, err
+	}
+	return v.snapshotData(), nil
+}
+
+// snapshotData returns the snapshots of the volume as reported by the ESX service
+func (v *mockVolume) snapshotData() []SnapshotData {
+	result := make([]SnapshotData, 0, len(v.Snapshots))
+	for _, snap := range v.Snapshots {
+		result = append(result, SnapshotData{
+			Name:    snap.Name,
+			Created: snap.Created,
+			Size:    mbToString(snap.CapacityMb),
+		})
+	}
+	return result
+}
+
+// deleteSnapshot forgets a snapshot of the volume
+func (s *mockVolumeStore) deleteSnapshot(name string, snapName string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	v, err := s.lookupExisting(name)
+	if err != nil {
+		return err
+	}
+	i := v.findSnapshot(snapName)
+	if i < 0 {
+		return fmt.Errorf("Snapshot %s of volume %s not found", snapName, v.Name)
+	}
+	v.Snapshots = append(v.Snapshots[:i], v.Snapshots[i+1:]...)
+	return s.save()
+}
+
+// revertSnapshot checks the volume can be reverted to the snapshot and
+// restores the capacity recorded in it. The volume must be detached.
+func (s *mockVolumeStore) revertSnapshot(name string, snapName string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	v, err := s.lookupExisting(name)
+	if err != nil {
+		return err
+	}
+	i := v.findSnapshot(snapName)
+	if i < 0 {
+		return fmt.Errorf("Snapshot %s of volume %s not found", snapName, v.Name)
+	}
+	if v.Status == mockStatusAttached {
+		return fmt.Errorf("Failed to revert volume %s, in use by VM = %s.", v.Name, v.AttachedTo)
+	}
+	v.CapacityMb = v.Snapshots[i].CapacityMb
+	return s.save()
+}
+
+// extend grows the volume to size. Attached volumes can be extended,
+// shrinking is not supported.
+func (s *mockVolumeStore) extend(name string, size string) (uint64, error) {
+	newMb, ok := sizeToMb(size)
+	if !ok {
+		return 0, fmt.Errorf("Invalid option for size: %s. Size must be a number followed by mb/gb/tb", size)
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	v, err := s.lookupExisting(name)
+	if err != nil {
+		return 0, err
+	}
+	if newMb < v.CapacityMb {
+		return 0, fmt.Errorf("Cannot shrink volume %s from %s to %s", v.Name,
+			mbToString(v.CapacityMb), mbToString(newMb))
+	}
+	oldMb, oldSize := v.CapacityMb, v.Opts[mockOptSize]
+	v.CapacityMb = newMb
+	v.Opts[mockOptSize] = size
+	if err = s.save(); err != nil {
+		v.CapacityMb, v.Opts[mockOptSize] = oldMb, oldSize
+		return 0, err
+	}
+	return newMb, nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux windows
+
+// A Transport which talks to a vmdk-opsd compatible service (e.g. MockEsxService)
+// over a TCP or Unix socket instead of vSocket.
+// The request/response format and framing are the same as on vSocket.
+
+package vmdkops
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// sockDialTimeout is the time to wait for the connection to the service
+const sockDialTimeout = 5 * time.Second
+
+// SockTransport struct - sends requests over a TCP or Unix socket
+type SockTransport struct {
+	Network string // "tcp" or "unix"
+	Address string // host:port for "tcp", socket path for "unix"
+}
+
+// NewSockTransport returns a new instance of SockTransport.
+func NewSockTransport(network string, address string) SockTransport {
+	return SockTransport{Network: network, Address: address}
+}
+
+// NewSockCmd returns a VmdkCmdRunner sending commands over a TCP or Unix socket.
+func NewSockCmd(network string, address string) *EsxVmdkCmd {
+	return NewEsxCmd(NewSockTransport(network, address))
+}
+
+func (t SockTransport) String() string {
+	return fmt.Sprintf("%s://%s", t.Network, t.Address)
+}
+
+// Send sends a single request over a new connection and waits for the reply
+// until ctx is done. The connection is then kept open in the background until
+// the service replies, since closing it does not stop the request on the service.
+func (t SockTransport) Send(ctx context.Context, request []byte) ([]byte, error) {
+	dialer := net.Dialer{Timeout: sockDialTimeout}
+	conn, err := dialer.DialContext(ctx, t.Network, t.Address)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, retryableError{fmt.Errorf("cannot connect to %s: %v", t, err), false}
+	}
+	return sendAsync(ctx, func() ([]byte, error) {
+		defer conn.Close()
+		if err := writeMessage(conn, request); err != nil {
+			return nil, err
+		}
+		return readMessage(conn)
+	})
+}
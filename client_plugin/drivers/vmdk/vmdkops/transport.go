@@ -0,0 +1,107 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux windows
+
+// Transports carry a single request to the ESX service and bring back the reply.
+// EsxVmdkCmd runs commands over any of them and takes care of retries.
+
+package vmdkops
+
+import (
+	"context"
+	"fmt"
+)
+
+const (
+	// TransportVsocket talks to vmdk-opsd on ESX over vSocket (the default)
+	TransportVsocket = "vsocket"
+	// TransportTCP talks to a vmdk-opsd compatible service at host:port
+	TransportTCP = "tcp"
+	// TransportUnix talks to a vmdk-opsd compatible service on a Unix socket
+	TransportUnix = "unix"
+)
+
+// Transport sends a request to the ESX service and returns the reply.
+// Send must return when ctx is done, even if the request is still in flight.
+// Such a request is reported with an abandonedError, so that the caller can
+// wait for it to complete before touching the same volume again.
+type Transport interface {
+	Send(ctx context.Context, request []byte) ([]byte, error)
+	String() string
+}
+
+// retryableError marks failures where the request can be sent again, e.g.
+// when the connection could not be established. sent is set when the request
+// may have reached the service before the failure, so only idempotent
+// commands should be retried.
+type retryableError struct {
+	err  error
+	sent bool
+}
+
+func (e retryableError) Error() string {
+	return e.err.Error()
+}
+
+// abandonedError is returned when ctx is done before the reply arrived.
+// The request may still be executing on ESX; done is closed once the
+// transport is finished with it.
+type abandonedError struct {
+	err  error
+	done <-chan struct{}
+}
+
+func (e abandonedError) Error() string {
+	return e.err.Error()
+}
+
+type sendResult struct {
+	reply []byte
+	err   error
+}
+
+// sendAsync runs send in the background and waits for its reply until ctx
+// is done. A request still in flight at that point is abandoned, not cancelled.
+func sendAsync(ctx context.Context, send func() ([]byte, error)) ([]byte, error) {
+	result := make(chan sendResult, 1)
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		reply, err := send()
+		result <- sendResult{reply, err}
+	}()
+	select {
+	case r := <-result:
+		return r.reply, r.err
+	case <-ctx.Done():
+		return nil, abandonedError{ctx.Err(), finished}
+	}
+}
+
+// NewTransport returns the transport by name. address is host:port for "tcp"
+// and a socket path for "unix", port is the vSocket port for "vsocket".
+func NewTransport(name string, address string, port int) (Transport, error) {
+	switch name {
+	case "", TransportVsocket:
+		return NewVsocketTransport(port), nil
+	case TransportTCP, TransportUnix:
+		if address == "" {
+			return nil, fmt.Errorf("No ESX service address configured for transport %s", name)
+		}
+		return NewSockTransport(name, address), nil
+	}
+	return nil, fmt.Errorf("Unknown transport %s, expected one of %s, %s, %s",
+		name, TransportVsocket, TransportTCP, TransportUnix)
+}
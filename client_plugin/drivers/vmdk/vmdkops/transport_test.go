@@ -0,0 +1,73 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux windows
+
+package vmdkops
+
+// Test how EsxVmdkCmd retries failures reported by a Transport.
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingTransport fails every request with err and counts the attempts
+type failingTransport struct {
+	err   error
+	sends int
+}
+
+func (t *failingTransport) Send(ctx context.Context, request []byte) ([]byte, error) {
+	t.sends++
+	return nil, t.err
+}
+
+func (t *failingTransport) String() string {
+	return "failing"
+}
+
+func TestRetrySentRequests(t *testing.T) {
+	ctx := context.Background()
+	sent := retryableError{errors.New("connection reset"), true}
+
+	// A request which may have reached ESX is not repeated for snapshot commands
+	for _, cmd := range []string{"snapshot", "deletesnapshot", "revertsnapshot"} {
+		transport := &failingTransport{err: sent}
+		_, err := NewEsxCmd(transport).Run(ctx, cmd, "vol1", map[string]string{"snapshot-name": "snap1"})
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "may have reached ESX")
+		}
+		assert.Equal(t, 1, transport.sends, "%s should not be retried", cmd)
+	}
+
+	// ... but a snapshot which could not be sent at all is retried
+	transport := &failingTransport{err: retryableError{errors.New("connection refused"), false}}
+	short, cancel := context.WithTimeout(ctx, 2*initialBackoff)
+	defer cancel()
+	_, err := NewEsxCmd(transport).Run(short, "snapshot", "vol1", map[string]string{"snapshot-name": "snap1"})
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, transport.sends, "snapshot should be retried until the deadline")
+
+	// ... and so are idempotent commands
+	transport = &failingTransport{err: sent}
+	short, cancel = context.WithTimeout(ctx, 2*initialBackoff)
+	defer cancel()
+	_, err = NewEsxCmd(transport).Run(short, "attach", "vol1", nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, transport.sends, "attach should be retried until the deadline")
+}
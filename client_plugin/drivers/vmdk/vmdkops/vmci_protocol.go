@@ -0,0 +1,127 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux windows
+
+// Client/server protocol spoken with vmdk-opsd (see esx_service/vmdk_ops.py).
+//
+// A request is a JSON document {"cmd": ..., "details": {"Name": ..., "Opts": ...}, "version": ...}
+// and a reply is either a command specific JSON document, "null" or {"Error": "..."}.
+// On the wire each message is framed the same way vmci_client.c does it:
+// a uint32 MAGIC, a uint32 length (including the trailing '\0') and the message.
+
+package vmdkops
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	// Server side understand protocol version. If you are changing client/server protocol we use
+	// over VMCI, PLEASE DO NOT FORGET TO CHANGE IT FOR SERVER in file <vmdk_ops.py> !
+	clientProtocolVersion = "2"
+
+	// vmciMagic is the frame marker, see esx_service/vmci/connection_types.h
+	vmciMagic uint32 = 0xbadbeef
+	// maxMessageLen caps the size of a single frame we are willing to read
+	maxMessageLen uint32 = 1024 * 1024
+)
+
+// A request to be passed to ESX service
+type requestToVmci struct {
+	Ops     string     `json:"cmd"`
+	Details VolumeInfo `json:"details"`
+	Version string     `json:"version,omitempty"`
+}
+
+// VolumeInfo we get about the volume from upstairs
+type VolumeInfo struct {
+	Name    string            `json:"Name"`
+	Options map[string]string `json:"Opts,omitempty"`
+}
+
+type vmciError struct {
+	Error string `json:",omitempty"`
+}
+
+// marshalRequest builds the JSON request for cmd. The protocol version can be
+// overridden with VDVS_TEST_PROTOCOL_VERSION to test version mismatch handling.
+func marshalRequest(cmd string, name string, opts map[string]string) ([]byte, error) {
+	protocolVersion := os.Getenv("VDVS_TEST_PROTOCOL_VERSION")
+	if protocolVersion == "" {
+		protocolVersion = clientProtocolVersion
+	}
+	jsonStr, err := json.Marshal(&requestToVmci{
+		Ops:     cmd,
+		Details: VolumeInfo{Name: name, Options: opts},
+		Version: protocolVersion})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal json: %v", err)
+	}
+	return jsonStr, nil
+}
+
+// writeMessage sends msg framed as MAGIC, length and '\0' terminated data.
+func writeMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 8, 8+len(msg)+1)
+	binary.LittleEndian.PutUint32(buf[0:4], vmciMagic)
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(msg)+1))
+	buf = append(buf, msg...)
+	buf = append(buf, 0)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readMessage receives a single framed message and returns it without the trailing '\0'.
+func readMessage(r io.Reader) ([]byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("Failed to receive message header: %v", err)
+	}
+	if magic := binary.LittleEndian.Uint32(hdr[0:4]); magic != vmciMagic {
+		return nil, fmt.Errorf("Wrong magic: got 0x%x expected 0x%x", magic, vmciMagic)
+	}
+	mlen := binary.LittleEndian.Uint32(hdr[4:8])
+	if mlen > maxMessageLen {
+		return nil, fmt.Errorf("Message too long: %d bytes (max %d)", mlen, maxMessageLen)
+	}
+	msg := make([]byte, mlen)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("Failed to receive message data: %v", err)
+	}
+	if mlen > 0 && msg[mlen-1] == 0 {
+		msg = msg[:mlen-1]
+	}
+	return msg, nil
+}
+
+func unmarshalError(str []byte) error {
+	// Unmarshalling null always succeeds
+	if string(str) == "null" {
+		return nil
+	}
+	errStruct := vmciError{}
+	err := json.Unmarshal(str, &errStruct)
+	if err != nil {
+		// We didn't unmarshal an error, so there is no error ;)
+		return nil
+	}
+	// Return the unmarshaled error string as an `error`
+	return errors.New(errStruct.Error)
+}
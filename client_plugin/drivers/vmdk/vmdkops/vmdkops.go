@@ -17,9 +17,15 @@
 package vmdkops
 
 import (
+	"context"
 	"encoding/json"
+	"sync"
+	"time"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/metrics"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
 )
 
 //
@@ -32,12 +38,94 @@ import (
 
 // VmdkCmdRunner interface for sending Vmdk Commands to an ESX server.
 type VmdkCmdRunner interface {
-	Run(cmd string, name string, opts map[string]string) ([]byte, error)
+	// Run must return once ctx is done.
+	Run(ctx context.Context, cmd string, name string, opts map[string]string) ([]byte, error)
 }
 
 // VmdkOps struct
 type VmdkOps struct {
 	Cmd VmdkCmdRunner // see *_vmdkcmd.go for implementations.
+	// Timeouts overrides DefaultTimeouts per command, its "default" applies to
+	// all commands not listed in it. Zero disables the timeout for a command.
+	Timeouts map[string]time.Duration
+}
+
+// DefaultTimeoutKey is the Timeouts key for commands without their own timeout
+const DefaultTimeoutKey = "default"
+
+// DefaultTimeouts is how long each command may take, including retries.
+// Creating and copying disks on ESX can be slow, queries should be quick.
+var DefaultTimeouts = map[string]time.Duration{
+	"create":          5 * time.Minute,
+	"extend":          5 * time.Minute,
+	"snapshot":        5 * time.Minute,
+	"revertsnapshot":  5 * time.Minute,
+	"attach":          2 * time.Minute,
+	"detach":          2 * time.Minute,
+	"remove":          time.Minute,
+	DefaultTimeoutKey: time.Minute,
+}
+
+var (
+	esxCommands = metrics.NewCounterVec("esx_commands_total",
+		"Commands sent to the ESX service.", "cmd", "result")
+	esxCommandDuration = metrics.NewHistogramVec("esx_command_duration_seconds",
+		"Duration of commands sent to the ESX service, including retries.", nil, "cmd")
+)
+
+// TimeoutsFromSeconds converts command timeouts in seconds, as configured, to Timeouts
+func TimeoutsFromSeconds(timeoutsSec map[string]int) map[string]time.Duration {
+	timeouts := make(map[string]time.Duration)
+	for cmd, sec := range timeoutsSec {
+		timeouts[cmd] = time.Duration(sec) * time.Second
+	}
+	return timeouts
+}
+
+// timeoutsMtx serializes reading Timeouts with UpdateTimeouts
+var timeoutsMtx sync.RWMutex
+
+// UpdateTimeouts replaces the content of v.Timeouts, which is shared by all
+// copies of v, while commands may be running. v.Timeouts must not be nil.
+func (v VmdkOps) UpdateTimeouts(timeouts map[string]time.Duration) {
+	timeoutsMtx.Lock()
+	defer timeoutsMtx.Unlock()
+	for cmd := range v.Timeouts {
+		delete(v.Timeouts, cmd)
+	}
+	for cmd, t := range timeouts {
+		v.Timeouts[cmd] = t
+	}
+}
+
+// timeout returns the timeout for the command
+func (v VmdkOps) timeout(cmd string) time.Duration {
+	timeoutsMtx.RLock()
+	defer timeoutsMtx.RUnlock()
+	if t, ok := v.Timeouts[cmd]; ok {
+		return t
+	}
+	if t, ok := v.Timeouts[DefaultTimeoutKey]; ok {
+		return t
+	}
+	if t, ok := DefaultTimeouts[cmd]; ok {
+		return t
+	}
+	return DefaultTimeouts[DefaultTimeoutKey]
+}
+
+// run sends the command with the command's timeout applied to ctx
+func (v VmdkOps) run(ctx context.Context, cmd string, name string, opts map[string]string) ([]byte, error) {
+	if t := v.timeout(cmd); t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t)
+		defer cancel()
+	}
+	start := time.Now()
+	reply, err := v.Cmd.Run(ctx, cmd, name, opts)
+	esxCommands.Inc(cmd, metrics.Result(err))
+	esxCommandDuration.ObserveSince(start, cmd)
+	return reply, err
 }
 
 // VolumeData we return to the caller
@@ -47,33 +135,33 @@ type VolumeData struct {
 }
 
 // Create a volume
-func (v VmdkOps) Create(name string, opts map[string]string) error {
-	log.Debugf("vmdkOp.Create name=%s", name)
-	_, err := v.Cmd.Run("create", name, opts)
+func (v VmdkOps) Create(ctx context.Context, name string, opts map[string]string) error {
+	requestid.Log(ctx).Debugf("vmdkOp.Create name=%s", name)
+	_, err := v.run(ctx, "create", name, opts)
 	return err
 }
 
 // Remove a volume
-func (v VmdkOps) Remove(name string, opts map[string]string) error {
-	log.Debugf("vmdkOps.Remove name=%s", name)
-	_, err := v.Cmd.Run("remove", name, opts)
+func (v VmdkOps) Remove(ctx context.Context, name string, opts map[string]string) error {
+	requestid.Log(ctx).Debugf("vmdkOps.Remove name=%s", name)
+	_, err := v.run(ctx, "remove", name, opts)
 	return err
 }
 
 // RawAttach attaches a volume and returns `[]byte` representing the raw response string.
-func (v VmdkOps) RawAttach(name string, opts map[string]string) ([]byte, error) {
-	log.Debugf("vmdkOps.Attach name=%s", name)
-	str, err := v.Cmd.Run("attach", name, opts)
+func (v VmdkOps) RawAttach(ctx context.Context, name string, opts map[string]string) ([]byte, error) {
+	requestid.Log(ctx).Debugf("vmdkOps.Attach name=%s", name)
+	str, err := v.run(ctx, "attach", name, opts)
 	if err != nil {
-		log.WithFields(log.Fields{"name": name, "opts": opts, "error": err}).Error("RawAttach failed ")
+		requestid.Log(ctx).WithFields(log.Fields{"name": name, "opts": opts, "error": err}).Error("RawAttach failed ")
 		return nil, err
 	}
 	return str, nil
 }
 
 // Attach attaches a volume and returns the disk's VolumeDevSpec.
-func (v VmdkOps) Attach(name string, opts map[string]string) (*fs.VolumeDevSpec, error) {
-	str, err := v.RawAttach(name, opts)
+func (v VmdkOps) Attach(ctx context.Context, name string, opts map[string]string) (*fs.VolumeDevSpec, error) {
+	str, err := v.RawAttach(ctx, name, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -81,12 +169,12 @@ func (v VmdkOps) Attach(name string, opts map[string]string) (*fs.VolumeDevSpec,
 	var volDev fs.VolumeDevSpec
 	err = json.Unmarshal(str, &volDev)
 	if err != nil {
-		log.WithFields(log.Fields{"name": name, "opts": opts, "bytes": str,
+		requestid.Log(ctx).WithFields(log.Fields{"name": name, "opts": opts, "bytes": str,
 			"error": err}).Error("Failed to unmarshal, detaching volume ")
 		// RawAttach may have the volume attached to this client, so detach.
-		errDetach := v.Detach(name, nil)
+		errDetach := v.Detach(ctx, name, nil)
 		if errDetach != nil {
-			log.WithFields(log.Fields{"name": name,
+			requestid.Log(ctx).WithFields(log.Fields{"name": name,
 				"error": errDetach}).Warning("Detach volume failed ")
 		}
 		return nil, err
@@ -95,16 +183,16 @@ func (v VmdkOps) Attach(name string, opts map[string]string) (*fs.VolumeDevSpec,
 }
 
 // Detach a volume
-func (v VmdkOps) Detach(name string, opts map[string]string) error {
-	log.Debugf("vmdkOps.Detach name=%s", name)
-	_, err := v.Cmd.Run("detach", name, opts)
+func (v VmdkOps) Detach(ctx context.Context, name string, opts map[string]string) error {
+	requestid.Log(ctx).Debugf("vmdkOps.Detach name=%s", name)
+	_, err := v.run(ctx, "detach", name, opts)
 	return err
 }
 
 // List all volumes
-func (v VmdkOps) List() ([]VolumeData, error) {
-	log.Debugf("vmdkOps.List")
-	str, err := v.Cmd.Run("list", "", make(map[string]string))
+func (v VmdkOps) List(ctx context.Context) ([]VolumeData, error) {
+	requestid.Log(ctx).Debugf("vmdkOps.List")
+	str, err := v.run(ctx, "list", "", make(map[string]string))
 	if err != nil {
 		return nil, err
 	}
@@ -118,9 +206,9 @@ func (v VmdkOps) List() ([]VolumeData, error) {
 }
 
 // Get for volume
-func (v VmdkOps) Get(name string) (map[string]interface{}, error) {
-	log.Debugf("vmdkOps.Get name=%s", name)
-	str, err := v.Cmd.Run("get", name, make(map[string]string))
+func (v VmdkOps) Get(ctx context.Context, name string) (map[string]interface{}, error) {
+	requestid.Log(ctx).Debugf("vmdkOps.Get name=%s", name)
+	str, err := v.run(ctx, "get", name, make(map[string]string))
 	if err != nil {
 		return nil, err
 	}
@@ -130,7 +218,61 @@ func (v VmdkOps) Get(name string) (map[string]interface{}, error) {
 
 	err = json.Unmarshal(str, &statusMap)
 	if err != nil {
-		log.Warn("vmdkOps.Get failed decoding volume status for name=%s", name)
+		requestid.Log(ctx).Warnf("vmdkOps.Get failed decoding volume status for name=%s", name)
 	}
 	return statusMap, nil
 }
+
+// SnapshotOpt is the option carrying the snapshot name in snapshot commands
+const SnapshotOpt = "snapshot-name"
+
+// SnapshotData we return to the caller
+type SnapshotData struct {
+	Name    string
+	Created string
+	Size    string
+}
+
+// Snapshot takes a point-in-time copy of a volume
+func (v VmdkOps) Snapshot(ctx context.Context, name string, snapName string) error {
+	requestid.Log(ctx).Debugf("vmdkOps.Snapshot name=%s snapshot=%s", name, snapName)
+	_, err := v.run(ctx, "snapshot", name, map[string]string{SnapshotOpt: snapName})
+	return err
+}
+
+// ListSnapshots lists the snapshots of a volume
+func (v VmdkOps) ListSnapshots(ctx context.Context, name string) ([]SnapshotData, error) {
+	requestid.Log(ctx).Debugf("vmdkOps.ListSnapshots name=%s", name)
+	str, err := v.run(ctx, "listsnapshots", name, make(map[string]string))
+	if err != nil {
+		return nil, err
+	}
+
+	var result []SnapshotData
+	err = json.Unmarshal(str, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DeleteSnapshot removes a snapshot of a volume
+func (v VmdkOps) DeleteSnapshot(ctx context.Context, name string, snapName string) error {
+	requestid.Log(ctx).Debugf("vmdkOps.DeleteSnapshot name=%s snapshot=%s", name, snapName)
+	_, err := v.run(ctx, "deletesnapshot", name, map[string]string{SnapshotOpt: snapName})
+	return err
+}
+
+// RevertSnapshot restores the content of a (detached) volume from a snapshot
+func (v VmdkOps) RevertSnapshot(ctx context.Context, name string, snapName string) error {
+	requestid.Log(ctx).Debugf("vmdkOps.RevertSnapshot name=%s snapshot=%s", name, snapName)
+	_, err := v.run(ctx, "revertsnapshot", name, map[string]string{SnapshotOpt: snapName})
+	return err
+}
+
+// Extend grows a volume to the given size, e.g. "20gb". The volume may be attached.
+func (v VmdkOps) Extend(ctx context.Context, name string, size string) error {
+	requestid.Log(ctx).Debugf("vmdkOps.Extend name=%s size=%s", name, size)
+	_, err := v.run(ctx, "extend", name, map[string]string{"size": size})
+	return err
+}
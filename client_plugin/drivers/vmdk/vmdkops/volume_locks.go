@@ -0,0 +1,93 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux windows
+
+// Per-volume locks for the commands sent to ESX. Commands changing a volume
+// are serialized per volume, commands on other volumes are not blocked.
+
+package vmdkops
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// readOnlyCmds don't change volumes and can run in parallel with any command
+var readOnlyCmds = map[string]bool{
+	"list":          true,
+	"get":           true,
+	"listsnapshots": true,
+}
+
+// volumeLock is held by one command at a time, refs counts the commands
+// holding or waiting for it so that it can be dropped once unused.
+type volumeLock struct {
+	sem  chan struct{}
+	refs int
+}
+
+// volumeLocks is the lock table, by volume name
+type volumeLocks struct {
+	mtx   sync.Mutex
+	locks map[string]*volumeLock
+}
+
+func newVolumeLocks() *volumeLocks {
+	return &volumeLocks{locks: make(map[string]*volumeLock)}
+}
+
+// lockName returns the name to lock the volume by. "vol" and "vol@datastore"
+// may be the same volume, so the datastore is left out. Same named volumes
+// on different datastores are serialized too, which is harmless.
+func lockName(name string) string {
+	return strings.SplitN(name, "@", 2)[0]
+}
+
+// lock waits for the volume lock until ctx is done.
+// On success the returned function releases the lock.
+func (l *volumeLocks) lock(ctx context.Context, name string) (func(), error) {
+	name = lockName(name)
+
+	l.mtx.Lock()
+	vl, ok := l.locks[name]
+	if !ok {
+		vl = &volumeLock{sem: make(chan struct{}, 1)}
+		l.locks[name] = vl
+	}
+	vl.refs++
+	l.mtx.Unlock()
+
+	select {
+	case vl.sem <- struct{}{}:
+		return func() {
+			<-vl.sem
+			l.release(name, vl)
+		}, nil
+	case <-ctx.Done():
+		l.release(name, vl)
+		return nil, ctx.Err()
+	}
+}
+
+// release drops a reference to the lock and removes it from the table once unused
+func (l *volumeLocks) release(name string, vl *volumeLock) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	vl.refs--
+	if vl.refs == 0 {
+		delete(l.locks, name)
+	}
+}
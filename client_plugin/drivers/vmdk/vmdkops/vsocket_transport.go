@@ -0,0 +1,105 @@
+// Copyright 2016-2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux windows
+
+// The default (ESX) Transport. Requests are sent to vmdkops_serv.py
+// listening on vSocket through the vmci_client C library.
+
+package vmdkops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+/*
+#cgo CFLAGS: -I ../../../../esx_service/vmci
+#cgo windows LDFLAGS: -L${SRCDIR} -lvmci_client
+#include "vmci_client.h"
+#include "vmci_client_proxy.c"
+*/
+import "C"
+
+const commBackendName string = "vsocket"
+
+// VsocketTransport struct - sends requests to ESX over vSocket
+type VsocketTransport struct {
+	Port int // ESX service port
+}
+
+// NewVsocketTransport returns a new instance of VsocketTransport.
+func NewVsocketTransport(port int) VsocketTransport {
+	return VsocketTransport{Port: port}
+}
+
+func (t VsocketTransport) String() string {
+	return fmt.Sprintf("%s:%d", commBackendName, t.Port)
+}
+
+// Send sends the request to ESX and waits for the reply until ctx is done.
+// Vmci_GetReply is blocking and cannot be interrupted, so when ctx is done
+// first it is left to complete in the background and its reply is dropped.
+func (t VsocketTransport) Send(ctx context.Context, request []byte) ([]byte, error) {
+	return sendAsync(ctx, func() ([]byte, error) { return t.send(request) })
+}
+
+// notSent reports errno values Vmci_GetReply only fails with before the
+// request was handed to the ESX service.
+func notSent(errno syscall.Errno) bool {
+	switch errno {
+	case syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.ENETUNREACH, syscall.ENXIO:
+		return true
+	}
+	return false
+}
+
+// send establishes a vSocket connection, sends the request and returns the reply
+func (t VsocketTransport) send(request []byte) ([]byte, error) {
+	cmdS := C.CString(string(request))
+	defer C.free(unsafe.Pointer(cmdS))
+
+	beS := C.CString(commBackendName)
+	defer C.free(unsafe.Pointer(beS))
+
+	// Get the response data in json
+	ans := (*C.be_answer)(C.calloc(1, C.sizeof_struct_be_answer))
+	defer C.free(unsafe.Pointer(ans))
+
+	ret, err := C.Vmci_GetReply(C.int(t.Port), cmdS, beS, ans)
+	if ret != 0 {
+		// C.Vmci_GetReply indicates success/faulure by <ret> value.
+		// Cgo  interface adds <err> based on errno. We do not explicitly
+		// reset errno in our code. Still, we do not want a stale errno
+		// to confuse this code into thinking there was an error even when ret==0,
+		// so explicitly declare success on <ret> value only.
+		if err == nil {
+			return nil, fmt.Errorf("Internal issue: ret != 0 but errno is not set. Cancelling operation - %s ",
+				C.GoString(&ans.errBuf[0]))
+		}
+		errno := err.(syscall.Errno)
+		msg := fmt.Sprintf("%v (errno=%d) - %s", err, int(errno), C.GoString(&ans.errBuf[0]))
+		if errno == syscall.ECONNRESET || errno == syscall.ETIMEDOUT {
+			msg += " Cannot communicate with ESX, please refer to the FAQ https://github.com/vmware/docker-volume-vsphere/wiki#faq"
+		}
+		return nil, retryableError{errors.New(msg), !notSent(errno)}
+	}
+
+	response := []byte(C.GoString(ans.buf))
+	C.Vmci_FreeBuf(ans)
+	return response, nil
+}
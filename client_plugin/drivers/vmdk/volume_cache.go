@@ -0,0 +1,170 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Cache of volume metadata returned by the ESX service.
+//
+// List and Get results are kept for a TTL, so that Docker tooling
+// (docker ps, docker inspect, docker volume ls) doesn't make a round trip
+// to ESX for every volume. Entries of a volume are dropped when the volume
+// is changed through this plugin (create, remove, mount, unmount...).
+// Changes made from other VMs become visible once the TTL expires.
+//
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vmdk/vmdkops"
+)
+
+// CacheStats counts volume cache lookups
+type CacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Invalidations uint64
+}
+
+type cachedVolume struct {
+	meta    map[string]interface{}
+	expires time.Time
+}
+
+// volumeCache caches List and Get results. A zero TTL disables the cache.
+type volumeCache struct {
+	mtx         sync.Mutex
+	ttl         time.Duration
+	volumes     []vmdkops.VolumeData
+	listExpires time.Time
+	metadata    map[string]cachedVolume // by volume name as passed to Get
+	generation  uint64                  // bumped on invalidation
+	stats       CacheStats
+}
+
+func newVolumeCache(ttl time.Duration) *volumeCache {
+	return &volumeCache{ttl: ttl, metadata: make(map[string]cachedVolume)}
+}
+
+// baseName returns the volume name without the datastore
+func baseName(name string) string {
+	return strings.SplitN(name, "@", 2)[0]
+}
+
+// copyMeta returns a shallow copy of volume metadata, callers may add keys to it
+func copyMeta(meta map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(meta))
+	for k, v := range meta {
+		result[k] = v
+	}
+	return result
+}
+
+// list returns the cached volume list or calls fetch to get it
+func (c *volumeCache) list(fetch func() ([]vmdkops.VolumeData, error)) ([]vmdkops.VolumeData, error) {
+	c.mtx.Lock()
+	if c.volumes != nil && time.Now().Before(c.listExpires) {
+		c.stats.Hits++
+		volumes := append([]vmdkops.VolumeData(nil), c.volumes...)
+		c.mtx.Unlock()
+		return volumes, nil
+	}
+	c.stats.Misses++
+	generation := c.generation
+	c.mtx.Unlock()
+
+	volumes, err := fetch()
+	if err != nil {
+		return volumes, err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	// Don't keep results that may predate an invalidation
+	if generation == c.generation && c.ttl > 0 {
+		c.volumes = append([]vmdkops.VolumeData(nil), volumes...)
+		c.listExpires = time.Now().Add(c.ttl)
+	}
+	return volumes, nil
+}
+
+// get returns the cached metadata of a volume or calls fetch to get it
+func (c *volumeCache) get(name string, fetch func() (map[string]interface{}, error)) (map[string]interface{}, error) {
+	c.mtx.Lock()
+	if entry, ok := c.metadata[name]; ok && time.Now().Before(entry.expires) {
+		c.stats.Hits++
+		c.mtx.Unlock()
+		return copyMeta(entry.meta), nil
+	}
+	c.stats.Misses++
+	generation := c.generation
+	c.mtx.Unlock()
+
+	meta, err := fetch()
+	if err != nil {
+		return meta, err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if generation == c.generation && c.ttl > 0 {
+		c.metadata[name] = cachedVolume{meta: copyMeta(meta), expires: time.Now().Add(c.ttl)}
+	}
+	return meta, nil
+}
+
+// invalidate drops the cached metadata of the volume (under any of its names)
+// and the volume list
+func (c *volumeCache) invalidate(name string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.generation++
+	c.stats.Invalidations++
+	c.volumes = nil
+	base := baseName(name)
+	for key := range c.metadata {
+		if baseName(key) == base {
+			delete(c.metadata, key)
+		}
+	}
+}
+
+// flush drops all cached data
+func (c *volumeCache) flush() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.generation++
+	c.stats.Invalidations++
+	c.volumes = nil
+	c.metadata = make(map[string]cachedVolume)
+}
+
+// setTTL changes the TTL, dropping data cached with the previous one
+func (c *volumeCache) setTTL(ttl time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.ttl = ttl
+	c.generation++
+	c.volumes = nil
+	c.metadata = make(map[string]cachedVolume)
+}
+
+// getStats returns the cache counters
+func (c *volumeCache) getStats() CacheStats {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.stats
+}
@@ -0,0 +1,100 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vmdk/vmdkops"
+)
+
+func TestVolumeCache(t *testing.T) {
+	cache := newVolumeCache(time.Minute)
+	gets := 0
+	fetchGet := func() (map[string]interface{}, error) {
+		gets++
+		return map[string]interface{}{"datastore": "datastore1"}, nil
+	}
+	lists := 0
+	fetchList := func() ([]vmdkops.VolumeData, error) {
+		lists++
+		return []vmdkops.VolumeData{{Name: "vol1@datastore1"}}, nil
+	}
+
+	meta, err := cache.get("vol1", fetchGet)
+	assert.Nil(t, err)
+	meta["snapshots"] = "added by the caller"
+	meta, err = cache.get("vol1", fetchGet)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"datastore": "datastore1"}, meta)
+	assert.Equal(t, 1, gets)
+
+	_, err = cache.list(fetchList)
+	assert.Nil(t, err)
+	_, err = cache.list(fetchList)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, lists)
+
+	// Invalidating a volume by its full name drops the entry by short name too
+	cache.invalidate("vol1@datastore1")
+	cache.get("vol1", fetchGet)
+	cache.list(fetchList)
+	assert.Equal(t, 2, gets)
+	assert.Equal(t, 2, lists)
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 4, Invalidations: 1}, cache.getStats())
+
+	// Errors are not cached
+	failures := 0
+	fail := func() (map[string]interface{}, error) {
+		failures++
+		return nil, errors.New("Volume vol2 not found")
+	}
+	_, err = cache.get("vol2", fail)
+	assert.NotNil(t, err)
+	_, err = cache.get("vol2", fail)
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, failures)
+
+	// Results fetched across an invalidation are not kept
+	cache.get("vol3", func() (map[string]interface{}, error) {
+		cache.invalidate("vol3")
+		return map[string]interface{}{}, nil
+	})
+	cache.get("vol3", fetchGet)
+	assert.Equal(t, 3, gets)
+}
+
+func TestVolumeCacheExpiry(t *testing.T) {
+	cache := newVolumeCache(10 * time.Millisecond)
+	gets := 0
+	fetch := func() (map[string]interface{}, error) {
+		gets++
+		return map[string]interface{}{}, nil
+	}
+	cache.get("vol1", fetch)
+	cache.get("vol1", fetch)
+	time.Sleep(20 * time.Millisecond)
+	cache.get("vol1", fetch)
+	assert.Equal(t, 2, gets)
+
+	// A zero TTL disables caching
+	disabled := newVolumeCache(0)
+	disabled.get("vol1", fetch)
+	disabled.get("vol1", fetch)
+	assert.Equal(t, 4, gets)
+}
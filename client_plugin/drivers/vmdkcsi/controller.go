@@ -0,0 +1,285 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package vmdkcsi
+
+// CSI Controller service - creates, removes, attaches and detaches volumes.
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CreateVolume creates a volume along with its file system. Storage class
+// parameters are passed to the ESX service as volume options (e.g. vsan-policy-name,
+// diskformat), except for "datastore" which selects the datastore.
+func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume name missing in request")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume capabilities missing in request")
+	}
+	if err := checkCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return nil, err
+	}
+	requiredBytes := req.GetCapacityRange().GetRequiredBytes()
+	limitBytes := req.GetCapacityRange().GetLimitBytes()
+	if limitBytes != 0 && limitBytes < requiredBytes {
+		return nil, status.Error(codes.OutOfRange, "Capacity limit is below the required capacity")
+	}
+	sizeMb := (requiredBytes + bytesInMb - 1) / bytesInMb
+	if sizeMb == 0 {
+		sizeMb = defaultSizeMb
+	}
+	if limitBytes != 0 && sizeMb*bytesInMb > limitBytes {
+		return nil, status.Errorf(codes.OutOfRange, "Capacity limit %d is not a whole number of MB", limitBytes)
+	}
+
+	name := req.GetName()
+	opts := map[string]string{"size": fmt.Sprintf("%dmb", sizeMb)}
+	for key, value := range req.GetParameters() {
+		if key == datastoreParam {
+			name = name + "@" + value
+		} else {
+			opts[key] = value
+		}
+	}
+	if fstype := fsType(req.GetVolumeCapabilities()...); fstype != "" {
+		opts["fstype"] = fstype
+	}
+	if opts["fstype"] == "" {
+		opts["fstype"] = fs.FstypeDefault
+	}
+	if err := fs.VerifyFSSupport(ctx, opts["fstype"]); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// CreateVolume is retried by the container orchestrator, so the volume
+	// may exist already.
+	if meta, err := d.ops.Get(ctx, name); err == nil {
+		vol := newVolume(name, meta)
+		if vol.CapacityBytes < requiredBytes || (limitBytes != 0 && vol.CapacityBytes > limitBytes) {
+			return nil, status.Errorf(codes.AlreadyExists, "Volume %s exists with a capacity of %d bytes",
+				vol.Id, vol.CapacityBytes)
+		}
+		return &csi.CreateVolumeResponse{Volume: vol}, nil
+	}
+
+	if err := d.ops.Create(ctx, name, opts); err != nil {
+		requestid.Log(ctx).WithFields(log.Fields{"name": name, "error": err}).Error("Create volume failed ")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	// The mock creates the file system along with the volume
+	if !d.useMockEsx {
+		if err := d.makeFs(ctx, name, opts["fstype"]); err != nil {
+			if errRemove := d.ops.Remove(ctx, name, nil); errRemove != nil {
+				requestid.Log(ctx).WithFields(log.Fields{"name": name,
+					"error": errRemove}).Warning("Remove volume failed ")
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	meta, err := d.ops.Get(ctx, name)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	vol := newVolume(name, meta)
+	requestid.Log(ctx).WithFields(log.Fields{"id": vol.Id, "fstype": opts["fstype"]}).Info("Volume and filesystem created ")
+	return &csi.CreateVolumeResponse{Volume: vol}, nil
+}
+
+// makeFs attaches the volume to this VM, creates the file system and detaches the volume
+func (d *Driver) makeFs(ctx context.Context, name string, fstype string) error {
+	waitCtx, errWait := fs.DevAttachWaitPrep(ctx)
+	if errWait != nil {
+		requestid.Log(ctx).WithFields(log.Fields{"name": name,
+			"error": errWait}).Warning("Failed to initialize wait context, continuing however.. ")
+	}
+	volDev, err := d.ops.Attach(ctx, name, nil)
+	if err != nil {
+		return err
+	}
+	if errWait != nil {
+		fs.DevAttachWaitFallback()
+	} else if err = fs.DevAttachWait(ctx, waitCtx, volDev); err != nil {
+		d.ops.Detach(ctx, name, nil)
+		return err
+	}
+	err = fs.Mkfs(ctx, fstype, name, volDev, "")
+	if errDetach := d.ops.Detach(ctx, name, nil); err == nil {
+		err = errDetach
+	}
+	return err
+}
+
+// DeleteVolume removes a volume, which must not be attached
+func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	err := d.ops.Remove(ctx, req.GetVolumeId(), nil)
+	if err != nil && !isNotFound(err) {
+		requestid.Log(ctx).WithFields(log.Fields{"id": req.GetVolumeId(), "error": err}).Error("Failed to remove volume ")
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// ControllerPublishVolume attaches a volume to this node. The device
+// is returned in the publish info, for NodeStageVolume.
+func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if req.GetNodeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Node ID missing in request")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	if req.GetNodeId() != d.nodeID {
+		return nil, status.Errorf(codes.NotFound,
+			"Node %s not found, volumes can only be attached to this node (%s)", req.GetNodeId(), d.nodeID)
+	}
+	if _, err := d.ops.Get(ctx, req.GetVolumeId()); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err := checkCapabilities([]*csi.VolumeCapability{req.GetVolumeCapability()}); err != nil {
+		return nil, err
+	}
+
+	info := make(map[string]string)
+	if d.useMockEsx {
+		dev, err := d.ops.RawAttach(ctx, req.GetVolumeId(), nil)
+		if err != nil {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		info[deviceInfoKey] = string(dev)
+	} else {
+		volDev, err := d.ops.Attach(ctx, req.GetVolumeId(), nil)
+		if err != nil {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		info[unitInfoKey] = volDev.Unit
+		info[pciSlotInfoKey] = volDev.ControllerPciSlotNumber
+	}
+	requestid.Log(ctx).WithFields(log.Fields{"id": req.GetVolumeId(), "info": info}).Info("Volume attached ")
+	return &csi.ControllerPublishVolumeResponse{PublishInfo: info}, nil
+}
+
+// ControllerUnpublishVolume detaches a volume from this node
+func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if req.GetNodeId() != "" && req.GetNodeId() != d.nodeID {
+		return nil, status.Errorf(codes.NotFound,
+			"Node %s not found, volumes can only be detached from this node (%s)", req.GetNodeId(), d.nodeID)
+	}
+	err := d.ops.Detach(ctx, req.GetVolumeId(), nil)
+	if err != nil && !isNotFound(err) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+// ValidateVolumeCapabilities checks the volume can be used as requested
+func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume capabilities missing in request")
+	}
+	meta, err := d.ops.Get(ctx, req.GetVolumeId())
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err = checkCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Supported: false, Message: err.Error()}, nil
+	}
+	fstype := fsType(req.GetVolumeCapabilities()...)
+	if volFstype, _ := meta["fstype"].(string); fstype != "" && volFstype != "" && fstype != volFstype {
+		return &csi.ValidateVolumeCapabilitiesResponse{Supported: false,
+			Message: fmt.Sprintf("Volume has a %s file system", volFstype)}, nil
+	}
+	return &csi.ValidateVolumeCapabilitiesResponse{Supported: true}, nil
+}
+
+// ListVolumes lists volumes, the starting token is the index of the first volume
+func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	volumes, err := d.ops.List(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+
+	start := 0
+	if req.GetStartingToken() != "" {
+		start, err = strconv.Atoi(req.GetStartingToken())
+		if err != nil || start < 0 || start > len(volumes) {
+			return nil, status.Errorf(codes.Aborted, "Invalid starting token %s", req.GetStartingToken())
+		}
+	}
+	end := len(volumes)
+	if req.GetMaxEntries() > 0 && start+int(req.GetMaxEntries()) < end {
+		end = start + int(req.GetMaxEntries())
+	}
+
+	resp := &csi.ListVolumesResponse{}
+	for _, vol := range volumes[start:end] {
+		resp.Entries = append(resp.Entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{Id: vol.Name, Attributes: vol.Attributes},
+		})
+	}
+	if end < len(volumes) {
+		resp.NextToken = strconv.Itoa(end)
+	}
+	return resp, nil
+}
+
+// GetCapacity is not supported, datastore capacity is managed on ESX
+func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "GetCapacity is not supported")
+}
+
+// ControllerGetCapabilities - see csi.ControllerServer
+func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	resp := &csi.ControllerGetCapabilitiesResponse{}
+	for _, c := range []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+	} {
+		resp.Capabilities = append(resp.Capabilities, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{Type: c},
+			},
+		})
+	}
+	return resp, nil
+}
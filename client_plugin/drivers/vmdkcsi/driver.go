@@ -0,0 +1,193 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package vmdkcsi
+
+//
+// vSphere CSI (Container Storage Interface) plugin.
+//
+// Serves the CSI Identity, Controller and Node services for VMDK volumes,
+// using the same ESX service as the Docker volume plugin (see ./esx_service).
+//
+// Volumes are attached to the VM the plugin runs on, so ControllerPublishVolume
+// is only served for this node: the controller service has to run on every
+// node, along with the node service. Volume IDs are full volume names
+// (volume@datastore).
+//
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vmdk/vmdkops"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/refcount"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// PluginName is the name of the CSI plugin, as used in storage classes
+	PluginName = "csi-vsphere.vmware.com"
+
+	version = "vSphere CSI Driver v0.1"
+
+	bytesInMb       = 1024 * 1024
+	defaultSizeMb   = 100 // same default as the ESX service
+	datastoreParam  = "datastore"
+	deviceInfoKey   = "device" // publish info of the mock: the loopback device
+	unitInfoKey     = "unit"   // publish info from ESX: see fs.VolumeDevSpec
+	pciSlotInfoKey  = "controllerPciSlotNumber"
+	notFoundMessage = "not found"
+)
+
+// Driver serves the CSI services
+type Driver struct {
+	ops        vmdkops.VmdkOps
+	useMockEsx bool
+	nodeID     string
+
+	// Node service state: publishes of each staged volume are refcounted,
+	// so a volume cannot be unstaged while it is still published.
+	mtx       sync.Mutex
+	refCounts *refcount.RefCountsMap
+	published map[string]string // target path -> volume ID
+}
+
+// NewDriver returns a Driver sending commands to ESX with ops. nodeID is the
+// node ID reported to the container orchestrator, usually the host name.
+func NewDriver(ops vmdkops.VmdkOps, useMockEsx bool, nodeID string) *Driver {
+	log.WithFields(log.Fields{
+		"version":  version,
+		"node_id":  nodeID,
+		"mock_esx": useMockEsx,
+	}).Info("vSphere CSI driver started ")
+
+	return &Driver{
+		ops:        ops,
+		useMockEsx: useMockEsx,
+		nodeID:     nodeID,
+		refCounts:  refcount.NewRefCountsMap(),
+		published:  make(map[string]string),
+	}
+}
+
+// GetPluginInfo - see csi.IdentityServer
+func (d *Driver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{Name: PluginName, VendorVersion: version}, nil
+}
+
+// GetPluginCapabilities - see csi.IdentityServer
+func (d *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	return &csi.GetPluginCapabilitiesResponse{
+		Capabilities: []*csi.PluginCapability{{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+				},
+			},
+		}},
+	}, nil
+}
+
+// Probe - see csi.IdentityServer
+func (d *Driver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	return &csi.ProbeResponse{}, nil
+}
+
+// checkCapabilities returns an error for capabilities the driver cannot provide:
+// volumes are file systems, mounted on a single node.
+func checkCapabilities(caps []*csi.VolumeCapability) error {
+	for _, c := range caps {
+		if c.GetMount() == nil {
+			return status.Error(codes.InvalidArgument, "Only mount volumes are supported, not block volumes")
+		}
+		switch c.GetAccessMode().GetMode() {
+		case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:
+		default:
+			return status.Errorf(codes.InvalidArgument, "Access mode %s is not supported",
+				c.GetAccessMode().GetMode())
+		}
+	}
+	return nil
+}
+
+// fsType returns the file system requested in the capabilities, if any
+func fsType(caps ...*csi.VolumeCapability) string {
+	for _, c := range caps {
+		if fstype := c.GetMount().GetFsType(); fstype != "" {
+			return fstype
+		}
+	}
+	return ""
+}
+
+// isReadOnly returns true if the volume must be mounted read-only
+func isReadOnly(c *csi.VolumeCapability) bool {
+	return c.GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY
+}
+
+// isNotFound returns true if the ESX service failed the command as the volume does not exist
+func isNotFound(err error) bool {
+	return strings.Contains(err.Error(), notFoundMessage)
+}
+
+// sizeToBytes parses sizes reported by the ESX service, e.g. "100MB" or "1.5GB"
+func sizeToBytes(size string) int64 {
+	units := map[string]float64{"KB": 1024, "MB": bytesInMb, "GB": 1024 * bytesInMb, "TB": 1024 * 1024 * bytesInMb}
+	size = strings.ToUpper(strings.TrimSpace(size))
+	for suffix, multiplier := range units {
+		if strings.HasSuffix(size, suffix) {
+			value, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(size, suffix)), 64)
+			if err != nil {
+				return 0
+			}
+			return int64(value * multiplier)
+		}
+	}
+	return 0
+}
+
+// volumeID returns the full name of the volume from its metadata
+func volumeID(name string, meta map[string]interface{}) string {
+	if strings.Contains(name, "@") {
+		return name
+	}
+	if ds, ok := meta["datastore"].(string); ok && ds != "" {
+		return name + "@" + ds
+	}
+	return name
+}
+
+// newVolume builds the CSI volume from the volume metadata
+func newVolume(name string, meta map[string]interface{}) *csi.Volume {
+	vol := &csi.Volume{Id: volumeID(name, meta), Attributes: make(map[string]string)}
+	if capacity, ok := meta["capacity"].(map[string]interface{}); ok {
+		if size, ok := capacity["size"].(string); ok {
+			vol.CapacityBytes = sizeToBytes(size)
+		}
+	}
+	for _, key := range []string{"datastore", "fstype", "diskformat", "attach-as", "access", "vsan-policy-name"} {
+		if value, ok := meta[key].(string); ok && value != "" {
+			vol.Attributes[key] = value
+		}
+	}
+	return vol
+}
@@ -0,0 +1,175 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package vmdkcsi_test
+
+// Runs a volume through its CSI lifecycle, over gRPC, with the mocked ESX service.
+// Needs root to set up loopback devices and mount volumes.
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vmdk/vmdkops"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vmdkcsi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const testNode = "node1"
+
+func mountCapability(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func TestVolumeLifecycle(t *testing.T) {
+	ctx := context.Background()
+	if os.Geteuid() != 0 {
+		t.Skip("The mocked ESX service needs root to set up loopback devices")
+	}
+	root, err := ioutil.TempDir("", "vmdkcsi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	ops := vmdkops.VmdkOps{Cmd: vmdkops.MockVmdkCmd{Root: root, VMName: vmdkops.MockDefaultVMName}}
+	endpoint := "unix://" + filepath.Join(root, "csi.sock")
+	listener, err := vmdkcsi.Listen(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go vmdkcsi.NewDriver(ops, true, testNode).Serve(listener)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure(),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	identity := csi.NewIdentityClient(conn)
+	controller := csi.NewControllerClient(conn)
+	node := csi.NewNodeClient(conn)
+
+	info, err := identity.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	if assert.Nil(t, err) {
+		assert.Equal(t, vmdkcsi.PluginName, info.Name)
+	}
+
+	// Block volumes and multi-node access are refused
+	writer := mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+	_, err = controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "csivol",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)},
+	})
+	assert.Equal(t, codes.InvalidArgument, grpc.Code(err))
+
+	createReq := &csi.CreateVolumeRequest{
+		Name:               "csivol",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 20 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{writer},
+	}
+	created, err := controller.CreateVolume(ctx, createReq)
+	if !assert.Nil(t, err) {
+		return
+	}
+	vol := created.Volume
+	assert.Equal(t, int64(20*1024*1024), vol.CapacityBytes)
+	assert.Equal(t, "ext4", vol.Attributes["fstype"])
+	defer controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: vol.Id})
+
+	// CreateVolume is idempotent, unless the capacity does not match
+	again, err := controller.CreateVolume(ctx, createReq)
+	if assert.Nil(t, err) {
+		assert.Equal(t, vol.Id, again.Volume.Id)
+	}
+	createReq.CapacityRange.RequiredBytes = 40 * 1024 * 1024
+	_, err = controller.CreateVolume(ctx, createReq)
+	assert.Equal(t, codes.AlreadyExists, grpc.Code(err))
+
+	validated, err := controller.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId: vol.Id, VolumeCapabilities: []*csi.VolumeCapability{writer}})
+	if assert.Nil(t, err) {
+		assert.True(t, validated.Supported, validated.Message)
+	}
+	list, err := controller.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if assert.Nil(t, err) && assert.Len(t, list.Entries, 1) {
+		assert.Equal(t, vol.Id, list.Entries[0].Volume.Id)
+	}
+
+	// Volumes can only be attached to the node running the plugin
+	_, err = controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: vol.Id, NodeId: "node2", VolumeCapability: writer})
+	assert.Equal(t, codes.NotFound, grpc.Code(err))
+	published, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: vol.Id, NodeId: testNode, VolumeCapability: writer})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: vol.Id, NodeId: testNode})
+
+	staging := filepath.Join(root, "staging", "csivol")
+	target := filepath.Join(root, "pods", "pod1", "csivol")
+	_, err = node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{VolumeId: vol.Id,
+		PublishInfo: published.PublishInfo, StagingTargetPath: staging, VolumeCapability: writer})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer node.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: vol.Id, StagingTargetPath: staging})
+	for i := 0; i < 2; i++ {
+		_, err = node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{VolumeId: vol.Id,
+			StagingTargetPath: staging, TargetPath: target, VolumeCapability: writer})
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(target, "data"), []byte("data"), 0644))
+
+	// The volume stays staged while it is published
+	_, err = node.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: vol.Id, StagingTargetPath: staging})
+	assert.Equal(t, codes.FailedPrecondition, grpc.Code(err))
+
+	_, err = node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: vol.Id, TargetPath: target})
+	assert.Nil(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(staging, "data"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "data", string(data))
+	}
+	_, err = node.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: vol.Id, StagingTargetPath: staging})
+	assert.Nil(t, err)
+	_, err = controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: vol.Id, NodeId: testNode})
+	assert.Nil(t, err)
+
+	// DeleteVolume is idempotent
+	for i := 0; i < 2; i++ {
+		_, err = controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: vol.Id})
+		assert.Nil(t, err)
+	}
+}
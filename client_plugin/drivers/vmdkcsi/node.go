@@ -0,0 +1,242 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package vmdkcsi
+
+// CSI Node service - mounts attached volumes at the staging path and
+// bind mounts them into each pod which uses them.
+
+import (
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// isMounted returns true if a file system is mounted at path
+func isMounted(ctx context.Context, path string) (bool, error) {
+	mounts, err := fs.GetMountInfo(ctx, filepath.Dir(filepath.Clean(path)))
+	if err != nil {
+		return false, err
+	}
+	_, ok := mounts[filepath.Base(path)]
+	return ok, nil
+}
+
+// NodeStageVolume mounts the volume attached by ControllerPublishVolume at the staging path
+func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if req.GetStagingTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	if err := checkCapabilities([]*csi.VolumeCapability{req.GetVolumeCapability()}); err != nil {
+		return nil, err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	path := req.GetStagingTargetPath()
+	mounted, err := isMounted(ctx, path)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if mounted {
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	fstype := fsType(req.GetVolumeCapability())
+	if fstype == "" {
+		if meta, err := d.ops.Get(ctx, req.GetVolumeId()); err == nil {
+			fstype, _ = meta["fstype"].(string)
+		}
+	}
+	if fstype == "" {
+		fstype = fs.FstypeDefault
+	}
+	if err = fs.Mkdir(ctx, path); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	info := req.GetPublishInfo()
+	isReadOnly := isReadOnly(req.GetVolumeCapability())
+	if device, ok := info[deviceInfoKey]; ok {
+		err = fs.MountByDevicePath(ctx, path, fstype, device, isReadOnly, "")
+	} else {
+		if info[unitInfoKey] == "" || info[pciSlotInfoKey] == "" {
+			return nil, status.Error(codes.InvalidArgument, "Publish info missing in request, volume is not attached")
+		}
+		volDev := &fs.VolumeDevSpec{Unit: info[unitInfoKey], ControllerPciSlotNumber: info[pciSlotInfoKey]}
+		waitCtx, errWait := fs.DevAttachWaitPrep(ctx)
+		if errWait != nil {
+			fs.DevAttachWaitFallback()
+		} else if err = fs.DevAttachWait(ctx, waitCtx, volDev); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		err = fs.Mount(ctx, path, fstype, volDev, isReadOnly, "")
+	}
+	if err != nil {
+		requestid.Log(ctx).WithFields(log.Fields{"id": req.GetVolumeId(), "path": path,
+			"error": err}).Error("Failed to mount volume ")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	requestid.Log(ctx).WithFields(log.Fields{"id": req.GetVolumeId(), "path": path}).Info("Volume staged ")
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// NodeUnstageVolume unmounts the volume from the staging path, once it is not published anymore
+func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if req.GetStagingTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if count := d.refCounts.GetCount(req.GetVolumeId()); count > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "Volume %s is still published at %d target paths",
+			req.GetVolumeId(), count)
+	}
+	path := req.GetStagingTargetPath()
+	mounted, err := isMounted(ctx, path)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if mounted {
+		if err = fs.Unmount(ctx, path); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	requestid.Log(ctx).WithFields(log.Fields{"id": req.GetVolumeId(), "path": path}).Info("Volume unstaged ")
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// NodePublishVolume bind mounts the staged volume at the target path
+func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if req.GetStagingTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+	if req.GetTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	target := req.GetTargetPath()
+	if vol, ok := d.published[target]; ok {
+		if vol != req.GetVolumeId() {
+			return nil, status.Errorf(codes.AlreadyExists, "Volume %s is published at %s", vol, target)
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+	mounted, err := isMounted(ctx, req.GetStagingTargetPath())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !mounted {
+		return nil, status.Errorf(codes.FailedPrecondition, "Volume %s is not staged at %s",
+			req.GetVolumeId(), req.GetStagingTargetPath())
+	}
+
+	if err = fs.Mkdir(ctx, target); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	isReadOnly := req.GetReadonly() || isReadOnly(req.GetVolumeCapability())
+	if err = fs.BindMount(req.GetStagingTargetPath(), target, isReadOnly); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	d.published[target] = req.GetVolumeId()
+	count := d.refCounts.Incr(req.GetVolumeId())
+	requestid.Log(ctx).WithFields(log.Fields{"id": req.GetVolumeId(), "target": target,
+		"refcount": count}).Info("Volume published ")
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// NodeUnpublishVolume unmounts the volume from the target path
+func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if req.GetTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	target := req.GetTargetPath()
+	mounted, err := isMounted(ctx, target)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if mounted {
+		if err = fs.Unmount(ctx, target); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if _, ok := d.published[target]; ok {
+		delete(d.published, target)
+		if _, err = d.refCounts.Decr(ctx, req.GetVolumeId()); err != nil {
+			requestid.Log(ctx).WithFields(log.Fields{"id": req.GetVolumeId(),
+				"error": err}).Warning("Failed to decrease refcount ")
+		}
+	}
+	if err = os.Remove(target); err != nil && !os.IsNotExist(err) {
+		requestid.Log(ctx).WithFields(log.Fields{"target": target,
+			"error": err}).Warning("Failed to remove target path ")
+	}
+	requestid.Log(ctx).WithFields(log.Fields{"id": req.GetVolumeId(), "target": target}).Info("Volume unpublished ")
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// NodeGetId - see csi.NodeServer
+func (d *Driver) NodeGetId(ctx context.Context, req *csi.NodeGetIdRequest) (*csi.NodeGetIdResponse, error) {
+	return &csi.NodeGetIdResponse{NodeId: d.nodeID}, nil
+}
+
+// NodeGetCapabilities - see csi.NodeServer
+func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: []*csi.NodeServiceCapability{{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+				},
+			},
+		}},
+	}, nil
+}
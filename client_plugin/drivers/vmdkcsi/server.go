@@ -0,0 +1,88 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package vmdkcsi
+
+// gRPC server for the CSI services
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/metrics"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+const (
+	unixScheme = "unix://"
+	tcpScheme  = "tcp://"
+)
+
+// Listen listens on a CSI endpoint, either unix:///path/to/socket or tcp://host:port
+func Listen(endpoint string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(endpoint, unixScheme):
+		sock := strings.TrimPrefix(endpoint, unixScheme)
+		if err := fs.Mkdir(context.Background(), filepath.Dir(sock)); err != nil {
+			return nil, err
+		}
+		// Remove the socket left behind by a previous instance
+		if err := os.Remove(sock); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Failed to remove socket %s: %v", sock, err)
+		}
+		return net.Listen("unix", sock)
+	case strings.HasPrefix(endpoint, tcpScheme):
+		return net.Listen("tcp", strings.TrimPrefix(endpoint, tcpScheme))
+	}
+	return nil, fmt.Errorf("Invalid CSI endpoint %s, expected %s or %s", endpoint, unixScheme, tcpScheme)
+}
+
+// Serve serves the CSI services on listener until it is closed
+func (d *Driver) Serve(listener net.Listener) error {
+	server := grpc.NewServer(grpc.UnaryInterceptor(logRequest))
+	csi.RegisterIdentityServer(server, d)
+	csi.RegisterControllerServer(server, d)
+	csi.RegisterNodeServer(server, d)
+
+	log.WithFields(log.Fields{"address": listener.Addr().String()}).Info("Serving CSI requests ")
+	return server.Serve(listener)
+}
+
+// logRequest tags each request with a request ID, logs it and records its metrics
+func logRequest(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	ctx = requestid.NewContext(ctx, requestid.New())
+	method := path.Base(info.FullMethod)
+
+	requestid.Log(ctx).WithFields(log.Fields{"method": method, "request": req}).Debug("CSI request ")
+	resp, err := handler(ctx, req)
+	metrics.ObserveRequest("csi", method, start, err)
+	if err != nil {
+		requestid.Log(ctx).WithFields(log.Fields{"method": method, "error": err}).Error("CSI request failed ")
+	}
+	return resp, err
+}
@@ -0,0 +1,69 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package main
+
+// A Kubernetes FlexVolume driver for vSphere and Photon volumes - main.
+// Kubelet runs it once per call, e.g. "vsphere-flexvolume mount <path> <options>".
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/flexvolume"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/photon"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vmdk"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
+)
+
+func main() {
+	cfg, err := config.InitConfig(config.DefaultVMDKPluginConfigPath, config.DefaultFlexVolumeLogPath,
+		config.VSphereDriver, config.VSphereDriver)
+	if err != nil {
+		exit(fmt.Errorf("Failed to initialize config variables for FlexVolume driver: %v", err))
+	}
+
+	var driver drivers.VolumeDriver
+	switch cfg.Driver {
+	case config.PhotonDriver:
+		driver = photon.NewStatelessVolumeDriver(cfg, config.FlexVolumeMountRoot)
+	case config.VSphereDriver, config.VMDKDriver:
+		driver = vmdk.NewStatelessVolumeDriver(cfg, config.FlexVolumeMountRoot)
+	default:
+		exit(fmt.Errorf("Unknown driver %s", cfg.Driver))
+	}
+	if reflect.ValueOf(driver).IsNil() {
+		exit(fmt.Errorf("Error in driver initialization - %s", cfg.Driver))
+	}
+
+	nodeName, _ := os.Hostname()
+	result := flexvolume.NewDriver(driver, config.FlexVolumeMountRoot, nodeName).Run(flag.Args())
+	result.Print()
+	if result.Status == flexvolume.StatusFailure {
+		os.Exit(1)
+	}
+}
+
+// exit reports a failure to kubelet
+func exit(err error) {
+	log.WithFields(log.Fields{"error": err}).Error("FlexVolume driver failed ")
+	flexvolume.Result{Status: flexvolume.StatusFailure, Message: err.Error()}.Print()
+	os.Exit(1)
+}
@@ -0,0 +1,125 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+// Client for the admin server.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const clientTimeout = 10 * time.Minute // Extend and resync can take a while
+
+// Client sends requests to the admin server of a plugin
+type Client struct {
+	httpClient *http.Client
+}
+
+// NewClient returns a Client for the admin server listening on sockAddr
+func NewClient(sockAddr string) *Client {
+	return &Client{httpClient: &http.Client{
+		Timeout: clientTimeout,
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", sockAddr)
+			},
+		},
+	}}
+}
+
+// State returns the refcounting state of the plugin
+func (c *Client) State() (State, error) {
+	var state State
+	resp, err := c.httpClient.Get("http://admin" + StatePath)
+	if err != nil {
+		return state, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return state, decodeError(resp)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&state)
+	return state, err
+}
+
+// Resync discovers refcounts from Docker again
+func (c *Client) Resync() error {
+	return c.post(ResyncPath, nil)
+}
+
+// ForceUnmount unmounts and detaches a volume, dropping its refcount
+func (c *Client) ForceUnmount(name string) error {
+	return c.post(volumesPrefix+url.PathEscape(name)+"/"+unmountAction, nil)
+}
+
+// ForceDetach detaches a volume which is not mounted
+func (c *Client) ForceDetach(name string) error {
+	return c.post(volumesPrefix+url.PathEscape(name)+"/"+detachAction, nil)
+}
+
+// ExtendVolume grows a volume and its filesystem to size, e.g. "20gb"
+func (c *Client) ExtendVolume(name string, size string) error {
+	return c.post(volumesPrefix+url.PathEscape(name)+"/"+extendAction, ExtendRequest{Size: size})
+}
+
+// RevertSnapshot restores a volume from one of its snapshots
+func (c *Client) RevertSnapshot(name string, snapName string) error {
+	return c.post(volumesPrefix+url.PathEscape(name)+"/"+revertAction, SnapshotRequest{Snapshot: snapName})
+}
+
+// DeleteSnapshot deletes a snapshot of a volume
+func (c *Client) DeleteSnapshot(name string, snapName string) error {
+	return c.post(volumesPrefix+url.PathEscape(name)+"/"+deleteSnapshotAction, SnapshotRequest{Snapshot: snapName})
+}
+
+// FlushCache drops cached volume metadata
+func (c *Client) FlushCache() error {
+	return c.post(CacheFlushPath, nil)
+}
+
+// post sends body (if not nil) as JSON and returns the error from the reply, if any
+func (c *Client) post(path string, body interface{}) error {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+	}
+	resp, err := c.httpClient.Post("http://admin"+path, "application/json", &buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return decodeError(resp)
+	}
+	return nil
+}
+
+// decodeError returns the error in a failed reply
+func decodeError(resp *http.Response) error {
+	var reply Response
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil || reply.Err == "" {
+		return fmt.Errorf("Admin request failed: %s", resp.Status)
+	}
+	return errors.New(reply.Err)
+}
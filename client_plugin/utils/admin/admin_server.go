@@ -0,0 +1,275 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+// Admin server - serves administrative requests to a running plugin
+// over a Unix socket which is only accessible to root. Requests and
+// replies are JSON, errors are returned as {"Err": "..."}.
+//
+// Endpoints, each enabled if the driver implements the matching interface:
+//   GET  /state                                  - refcounts, mount IDs and init status
+//   POST /refcounts/resync                       - discover refcounts from Docker again
+//   POST /volumes/<name>/unmount                 - unmount and detach a volume, dropping its refcount
+//   POST /volumes/<name>/detach                  - detach a volume which is not mounted
+//   POST /volumes/<name>/extend {"Size": "20gb"} - grow a volume and its filesystem
+//   POST /volumes/<name>/revert {"Snapshot": "s1"} - restore a volume from a snapshot
+//   POST /volumes/<name>/deletesnapshot {"Snapshot": "s1"} - delete a snapshot of a volume
+//   POST /cache/flush                            - drop cached volume metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// StatePath is the URL path of the plugin state
+	StatePath = "/state"
+	// ResyncPath is the URL path to resync refcounts
+	ResyncPath = "/refcounts/resync"
+	// CacheFlushPath is the URL path to flush the volume metadata cache
+	CacheFlushPath = "/cache/flush"
+
+	volumesPrefix        = "/volumes/"
+	extendAction         = "extend"
+	unmountAction        = "unmount"
+	detachAction         = "detach"
+	revertAction         = "revert"
+	deleteSnapshotAction = "deletesnapshot"
+)
+
+// VolumeExtender is implemented by drivers which can grow volumes.
+type VolumeExtender interface {
+	ExtendVolume(name string, size string) error
+}
+
+// SnapshotManager is implemented by drivers supporting volume snapshots.
+type SnapshotManager interface {
+	RevertSnapshot(name string, snapName string) error
+	DeleteSnapshot(name string, snapName string) error
+}
+
+// StateReporter is implemented by drivers reporting their refcounting state.
+type StateReporter interface {
+	State() State
+}
+
+// Recoverer is implemented by drivers supporting manual recovery of refcounts
+// and mounts.
+type Recoverer interface {
+	Resync() error
+	ForceUnmount(name string) error
+	ForceDetach(name string) error
+}
+
+// CacheFlusher is implemented by drivers caching volume metadata.
+type CacheFlusher interface {
+	FlushCache()
+}
+
+// RefCount is the refcount of a volume
+type RefCount struct {
+	Count   uint
+	Mounted bool
+	Dev     string
+}
+
+// State is the refcounting state of the plugin
+type State struct {
+	Initialized   bool
+	RefCounts     map[string]RefCount
+	MountIDtoName map[string]string
+}
+
+// ExtendRequest is the body of an extend request
+type ExtendRequest struct {
+	Size string
+}
+
+// SnapshotRequest is the body of revert and deletesnapshot requests
+type SnapshotRequest struct {
+	Snapshot string
+}
+
+// Response is returned by all admin requests
+type Response struct {
+	Err string `json:",omitempty"`
+}
+
+// Server serves admin requests over a Unix socket
+type Server struct {
+	sockAddr string
+	mux      *http.ServeMux
+	listener net.Listener
+	extender VolumeExtender
+	snapshot SnapshotManager
+	reporter StateReporter
+	recover  Recoverer
+	flusher  CacheFlusher
+}
+
+// NewServer returns a new admin Server listening on sockAddr once started
+func NewServer(sockAddr string) *Server {
+	s := &Server{sockAddr: sockAddr, mux: http.NewServeMux()}
+	s.mux.HandleFunc(volumesPrefix, s.handleVolumes)
+	s.mux.HandleFunc(StatePath, s.handleState)
+	s.mux.HandleFunc(ResyncPath, s.handleResync)
+	s.mux.HandleFunc(CacheFlushPath, s.handleCacheFlush)
+	return s
+}
+
+// SetDriver enables the endpoints for the interfaces the driver implements
+func (s *Server) SetDriver(driver interface{}) {
+	s.extender, _ = driver.(VolumeExtender)
+	s.snapshot, _ = driver.(SnapshotManager)
+	s.reporter, _ = driver.(StateReporter)
+	s.recover, _ = driver.(Recoverer)
+	s.flusher, _ = driver.(CacheFlusher)
+}
+
+// Start starts serving requests in the background
+func (s *Server) Start() error {
+	if err := os.MkdirAll(filepath.Dir(s.sockAddr), 0755); err != nil {
+		return err
+	}
+	// A stale socket is left behind if the plugin was killed
+	os.Remove(s.sockAddr)
+	listener, err := net.Listen("unix", s.sockAddr)
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(s.sockAddr, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	s.listener = listener
+
+	log.WithFields(log.Fields{"address": s.sockAddr}).Info("Admin server listening on Unix socket ")
+	go func() {
+		err := http.Serve(listener, s.mux)
+		log.WithFields(log.Fields{"address": s.sockAddr, "error": err}).Info("Admin server stopped ")
+	}()
+	return nil
+}
+
+// Stop stops serving requests and removes the socket
+func (s *Server) Stop() {
+	if s.listener != nil {
+		s.listener.Close()
+		os.Remove(s.sockAddr)
+	}
+}
+
+// handleVolumes dispatches /volumes/<name>/<action> requests
+func (s *Server) handleVolumes(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, volumesPrefix), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Unknown admin request %s", r.URL.Path))
+		return
+	}
+	name, action := parts[0], parts[1]
+
+	switch {
+	case action == extendAction && r.Method == http.MethodPost && s.extender != nil:
+		var req ExtendRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Size == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid extend request, expected {\"Size\": \"<size>\"}"))
+			return
+		}
+		log.WithFields(log.Fields{"name": name, "size": req.Size}).Info("Admin request to extend volume ")
+		if err := s.extender.ExtendVolume(name, req.Size); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, Response{})
+	case (action == revertAction || action == deleteSnapshotAction) && r.Method == http.MethodPost && s.snapshot != nil:
+		var req SnapshotRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Snapshot == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid %s request, expected {\"Snapshot\": \"<snapshot>\"}", action))
+			return
+		}
+		log.WithFields(log.Fields{"name": name, "snapshot": req.Snapshot,
+			"action": action}).Info("Admin request for volume snapshot ")
+		if action == revertAction {
+			writeResult(w, s.snapshot.RevertSnapshot(name, req.Snapshot))
+		} else {
+			writeResult(w, s.snapshot.DeleteSnapshot(name, req.Snapshot))
+		}
+	case action == unmountAction && r.Method == http.MethodPost && s.recover != nil:
+		log.WithFields(log.Fields{"name": name}).Warning("Admin request to force unmount volume ")
+		writeResult(w, s.recover.ForceUnmount(name))
+	case action == detachAction && r.Method == http.MethodPost && s.recover != nil:
+		log.WithFields(log.Fields{"name": name}).Warning("Admin request to force detach volume ")
+		writeResult(w, s.recover.ForceDetach(name))
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("Unknown admin request %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// handleState returns the refcounting state
+func (s *Server) handleState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || s.reporter == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Unknown admin request %s %s", r.Method, r.URL.Path))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.reporter.State())
+}
+
+// handleResync discovers refcounts again
+func (s *Server) handleResync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || s.recover == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Unknown admin request %s %s", r.Method, r.URL.Path))
+		return
+	}
+	log.Warning("Admin request to resync refcounts ")
+	writeResult(w, s.recover.Resync())
+}
+
+// handleCacheFlush drops cached volume metadata
+func (s *Server) handleCacheFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || s.flusher == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Unknown admin request %s %s", r.Method, r.URL.Path))
+		return
+	}
+	log.Info("Admin request to flush volume cache ")
+	s.flusher.FlushCache()
+	writeJSON(w, http.StatusOK, Response{})
+}
+
+// writeResult writes an empty response on success or the error
+func writeResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, Response{})
+}
+
+func writeJSON(w http.ResponseWriter, status int, reply interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(reply)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	log.WithFields(log.Fields{"error": err}).Warning("Admin request failed ")
+	writeJSON(w, status, Response{Err: err.Error()})
+}
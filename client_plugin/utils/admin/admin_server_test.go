@@ -0,0 +1,218 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/admin"
+)
+
+// fakeDriver implements all the admin interfaces
+type fakeDriver struct {
+	sizes     map[string]string
+	snapshots map[string]string
+	refCounts map[string]admin.RefCount
+	resyncs   int
+	flushes   int
+}
+
+func (f *fakeDriver) ExtendVolume(name string, size string) error {
+	if name == "missing" {
+		return errors.New("Volume missing not found")
+	}
+	f.sizes[name] = size
+	return nil
+}
+
+func (f *fakeDriver) RevertSnapshot(name string, snapName string) error {
+	if f.snapshots[name] != snapName {
+		return errors.New("Snapshot " + snapName + " of volume " + name + " not found")
+	}
+	return nil
+}
+
+func (f *fakeDriver) DeleteSnapshot(name string, snapName string) error {
+	if err := f.RevertSnapshot(name, snapName); err != nil {
+		return err
+	}
+	delete(f.snapshots, name)
+	return nil
+}
+
+func (f *fakeDriver) State() admin.State {
+	return admin.State{
+		Initialized:   true,
+		RefCounts:     f.refCounts,
+		MountIDtoName: map[string]string{"id1": "vol1@ds1"},
+	}
+}
+
+func (f *fakeDriver) Resync() error {
+	f.resyncs++
+	return nil
+}
+
+func (f *fakeDriver) ForceUnmount(name string) error {
+	delete(f.refCounts, name)
+	return nil
+}
+
+func (f *fakeDriver) ForceDetach(name string) error {
+	if f.refCounts[name].Count != 0 {
+		return errors.New("Volume " + name + " is in use")
+	}
+	return nil
+}
+
+func (f *fakeDriver) FlushCache() {
+	f.flushes++
+}
+
+func startServer(t *testing.T, driver interface{}) (string, func()) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sockAddr := filepath.Join(dir, "admin.sock")
+	server := admin.NewServer(sockAddr)
+	server.SetDriver(driver)
+	if err = server.Start(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return sockAddr, func() {
+		server.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func adminClient(sockAddr string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", sockAddr)
+		},
+	}}
+}
+
+func post(t *testing.T, client *http.Client, path string, body string) (int, admin.Response) {
+	var reply admin.Response
+	resp, err := client.Post("http://admin"+path, "application/json", strings.NewReader(body))
+	if !assert.Nil(t, err) {
+		return 0, reply
+	}
+	defer resp.Body.Close()
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&reply))
+	return resp.StatusCode, reply
+}
+
+func TestExtend(t *testing.T) {
+	extender := &fakeDriver{sizes: make(map[string]string)}
+	sockAddr, stop := startServer(t, extender)
+	defer stop()
+	client := adminClient(sockAddr)
+
+	status, reply := post(t, client, "/volumes/vol1/extend", `{"Size": "20gb"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, reply.Err)
+	assert.Equal(t, "20gb", extender.sizes["vol1"])
+
+	status, reply = post(t, client, "/volumes/missing/extend", `{"Size": "20gb"}`)
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Contains(t, reply.Err, "not found")
+
+	status, _ = post(t, client, "/volumes/vol1/extend", `{}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = post(t, client, "/volumes/vol1/shrink", `{"Size": "1gb"}`)
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestSnapshots(t *testing.T) {
+	driver := &fakeDriver{snapshots: map[string]string{"vol1": "snap1"}}
+	sockAddr, stop := startServer(t, driver)
+	defer stop()
+	client := adminClient(sockAddr)
+
+	status, reply := post(t, client, "/volumes/vol1/revert", `{"Snapshot": "snap1"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, reply.Err)
+	status, reply = post(t, client, "/volumes/vol1/revert", `{"Snapshot": "snap2"}`)
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Contains(t, reply.Err, "not found")
+	status, _ = post(t, client, "/volumes/vol1/revert", `{}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	assert.Nil(t, admin.NewClient(sockAddr).DeleteSnapshot("vol1", "snap1"))
+	assert.Empty(t, driver.snapshots)
+	assert.NotNil(t, admin.NewClient(sockAddr).DeleteSnapshot("vol1", "snap1"))
+}
+
+func TestRecovery(t *testing.T) {
+	driver := &fakeDriver{
+		sizes: make(map[string]string),
+		refCounts: map[string]admin.RefCount{
+			"vol1@ds1": {Count: 2, Mounted: true, Dev: "/dev/sdb"},
+		},
+	}
+	sockAddr, stop := startServer(t, driver)
+	defer stop()
+	client := admin.NewClient(sockAddr)
+
+	state, err := client.State()
+	assert.Nil(t, err)
+	assert.True(t, state.Initialized)
+	assert.Equal(t, driver.refCounts, state.RefCounts)
+	assert.Equal(t, "vol1@ds1", state.MountIDtoName["id1"])
+
+	assert.Nil(t, client.Resync())
+	assert.Equal(t, 1, driver.resyncs)
+
+	err = client.ForceDetach("vol1@ds1")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "in use")
+	}
+	assert.Nil(t, client.ForceUnmount("vol1@ds1"))
+	assert.Nil(t, client.ForceDetach("vol1@ds1"))
+	assert.Empty(t, driver.refCounts)
+
+	assert.Nil(t, client.ExtendVolume("vol1@ds1", "10gb"))
+	assert.Equal(t, "10gb", driver.sizes["vol1@ds1"])
+
+	assert.Nil(t, client.FlushCache())
+	assert.Equal(t, 1, driver.flushes)
+}
+
+func TestUnsupported(t *testing.T) {
+	// A driver implementing none of the interfaces gets no endpoints
+	sockAddr, stop := startServer(t, struct{}{})
+	defer stop()
+	client := admin.NewClient(sockAddr)
+
+	_, err := client.State()
+	assert.NotNil(t, err)
+	assert.NotNil(t, client.Resync())
+	assert.NotNil(t, client.FlushCache())
+	assert.NotNil(t, client.ForceUnmount("vol1"))
+}
@@ -0,0 +1,81 @@
+// Copyright 2016-2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+// Storage classes, named sets of volume create options defined in the
+// configuration file. Classes are checked when the file is loaded, option
+// values are validated when volumes are created.
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ClassOpt is the volume create option selecting a storage class
+const ClassOpt = "class"
+
+// classOptions are the create options classes and host defaults may set
+var classOptions = []string{"size", "vsan-policy-name", "diskformat", "attach-as",
+	"access", "fstype", "mount-options", "mkfs-options", "encrypt"}
+
+// validateClasses checks the options of storage classes and host default
+// create options. Host defaults may select a class, classes cannot.
+func validateClasses(c Config) error {
+	for name, opts := range c.Classes {
+		if name == "" {
+			return fmt.Errorf("Storage class with no name")
+		}
+		if err := validateClassOptions(opts); err != nil {
+			return fmt.Errorf("Invalid storage class %s: %v", name, err)
+		}
+	}
+	defaults := make(map[string]string)
+	for k, v := range c.DefaultCreateOptions {
+		if k == ClassOpt {
+			if _, ok := c.Classes[v]; !ok {
+				return fmt.Errorf("Invalid default create options: unknown storage class %s", v)
+			}
+			continue
+		}
+		defaults[k] = v
+	}
+	if err := validateClassOptions(defaults); err != nil {
+		return fmt.Errorf("Invalid default create options: %v", err)
+	}
+	return nil
+}
+
+func validateClassOptions(opts map[string]string) error {
+	var invalid []string
+	for k := range opts {
+		if !isClassOption(k) {
+			invalid = append(invalid, k)
+		}
+	}
+	if len(invalid) != 0 {
+		sort.Strings(invalid)
+		return fmt.Errorf("options %v cannot be set, valid options are %v", invalid, classOptions)
+	}
+	return nil
+}
+
+func isClassOption(opt string) bool {
+	for _, o := range classOptions {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
@@ -42,6 +42,15 @@ const (
 	// DefaultPort is the default ESX service port.
 	DefaultPort = 1019
 
+	// DefaultVolumeCacheTTLSec is the default time to cache volume metadata
+	DefaultVolumeCacheTTLSec = 10
+
+	// DefaultShutdownTimeoutSec is the default time to wait for requests in progress on shutdown
+	DefaultShutdownTimeoutSec = 30
+
+	// DefaultRefCountReconcileSec is the default interval of refcount reconciliation with Docker
+	DefaultRefCountReconcileSec = 60
+
 	// Local constants
 	defaultMaxLogSizeMb  = 100
 	defaultMaxLogAgeDays = 28
@@ -56,11 +65,86 @@ type Config struct {
 	MaxLogSizeMb   int    `json:",omitempty"`
 	MaxLogAgeDays  int    `json:",omitempty"`
 	LogLevel       string `json:",omitempty"`
+	LogFormat      string `json:",omitempty"`
 	Target         string `json:",omitempty"`
 	Project        string `json:",omitempty"`
 	Host           string `json:",omitempty"`
+	AdminSock      string `json:",omitempty"`
+	// Transport to the ESX service: "vsocket" (default), "tcp" or "unix"
+	Transport string `json:",omitempty"`
+	// EsxAddress is host:port for the "tcp" transport, a socket path for "unix"
+	EsxAddress string `json:",omitempty"`
+	// CmdTimeoutsSec overrides the timeout of ESX commands by command name,
+	// "default" applies to all commands without their own timeout
+	CmdTimeoutsSec map[string]int `json:",omitempty"`
+	// VolumeCacheTTLSec is how long volume metadata from ESX is cached,
+	// DefaultVolumeCacheTTLSec if not set, a negative value disables the cache
+	VolumeCacheTTLSec int `json:",omitempty"`
+	// RefCountReconcileSec is how often refcounts are reconciled with Docker, besides
+	// on container events. DefaultRefCountReconcileSec if not set, a negative value disables it
+	RefCountReconcileSec int `json:",omitempty"`
+	// StateFile is where refcounts and mount IDs are saved, to be used right away
+	// after a plugin restart. DefaultVMDKPluginStateFile or DefaultVFilePluginStateFile if not set
+	StateFile string `json:",omitempty"`
+	// JournalDir is where the vsphere driver journals multi-step operations, to
+	// recover from crashes in the middle of them. DefaultJournalDir if not set
+	JournalDir string `json:",omitempty"`
+	// ShutdownTimeoutSec is how long to wait for requests in progress on SIGTERM
+	// or SIGINT, DefaultShutdownTimeoutSec if not set
+	ShutdownTimeoutSec int `json:",omitempty"`
+	// DetachIdleOnShutdown unmounts and detaches volumes no container uses on shutdown
+	DetachIdleOnShutdown bool `json:",omitempty"`
+
+	// ConfigFile is the file the configuration was loaded from, for reloads
+	ConfigFile string `json:"-"`
+	// MetricsAddr is the host:port to serve Prometheus metrics on, not served if empty
+	MetricsAddr string `json:",omitempty"`
+	// KeyProvider stores the keys of encrypted volumes: "file" or "http",
+	// encrypted volumes are not supported if not set
+	KeyProvider string `json:",omitempty"`
+	// KeyDir is the directory of the "file" key provider, DefaultKeyDir if not set
+	KeyDir string `json:",omitempty"`
+	// KeyServerURL is the base URL of the "http" key provider
+	KeyServerURL string `json:",omitempty"`
+	// Classes are named sets of volume create options, selected with -o class=<name>
+	Classes map[string]map[string]string `json:",omitempty"`
+	// DefaultCreateOptions are create options of volumes created on this host,
+	// when given neither explicitly nor by the class of the volume
+	DefaultCreateOptions map[string]string `json:",omitempty"`
+	// EtcdEndpoints are the client URLs of an external etcd cluster for the vFile
+	// KV store. If set, no embedded etcd is started and Swarm is not needed
+	EtcdEndpoints []string `json:",omitempty"`
+	// EtcdCACert, EtcdClientCert and EtcdClientKey are PEM files for TLS to etcd.
+	// The embedded etcd always uses TLS and authentication, with EtcdCACert or
+	// DefaultEtcdCACert, and the CA and client certificates shared by the swarm
+	// leader if the files are not there
+	EtcdCACert     string `json:",omitempty"`
+	EtcdClientCert string `json:",omitempty"`
+	EtcdClientKey  string `json:",omitempty"`
+	// EtcdCAKey is the PEM key of the CA of the embedded etcd, which managers
+	// issue themselves their certificates with. DefaultEtcdCAKey if not set.
+	// The swarm leader generates the CA if neither file exists
+	EtcdCAKey string `json:",omitempty"`
+	// EtcdUsername and EtcdPassword authenticate vFile to etcd
+	EtcdUsername string `json:",omitempty"`
+	EtcdPassword string `json:",omitempty"`
+	// FileServerPlacement is where vFile runs file servers, FileServersOnSwarm or
+	// FileServersOnHost. On hosts with EtcdEndpoints, on Swarm otherwise, if not set
+	FileServerPlacement string `json:",omitempty"`
+	// AdvertiseAddr is the address other hosts mount vFile volumes served by this
+	// host from. The address this host reaches etcd from, if not set
+	AdvertiseAddr string `json:",omitempty"`
+	// ClusterKey is the base64 AES-256 key sealing the Samba credentials of vFile
+	// volumes, the same on all nodes. Read from ClusterKeyFile if not set
+	ClusterKey string `json:",omitempty"`
+	// ClusterKeyFile holds the cluster key, e.g. a Docker secret. DefaultClusterKeyFile if not set
+	ClusterKeyFile string `json:",omitempty"`
 }
 
+// logLevelOverride is the log level given on the command line or in the
+// environment, which takes precedence over the configuration file
+var logLevelOverride string
+
 // LogInfo stores parameters for setting up logs
 type LogInfo struct {
 	LogLevel       *string
@@ -80,6 +164,12 @@ func Load(path string) (Config, error) {
 		return Config{}, err
 	}
 	setDefaults(&config)
+	if err := validateClasses(config); err != nil {
+		return Config{}, err
+	}
+	if err := validateVFile(config); err != nil {
+		return Config{}, err
+	}
 	return config, nil
 }
 
@@ -135,7 +225,11 @@ func LogInit(logInfo *LogInfo) bool {
 		panic(fmt.Sprintf("Failed to parse log level: %v", err))
 	}
 
-	log.SetFormatter(new(log_formatter.VmwareFormatter))
+	formatter, err := log_formatter.NewFormatter(c.LogFormat)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to set log format: %v", err))
+	}
+	log.SetFormatter(formatter)
 	log.SetLevel(level)
 
 	if usingConfigDefaults {
@@ -158,12 +252,14 @@ func InitConfig(defaultConfigPath string, defaultLogPath string, defaultDriver s
 	driverName := flag.String("driver", "", "Volume driver")
 
 	flag.Parse()
+	logLevelOverride = *logLevel
 
 	// Load the configuration if one was provided.
 	c, err := Load(*configFile)
 	if err != nil {
 		log.Warningf("Failed to load config file %s: %v", *configFile, err)
 	}
+	c.ConfigFile = *configFile
 
 	logInfo := &LogInfo{
 		LogLevel:       logLevel,
@@ -206,3 +302,30 @@ func InitConfig(defaultConfigPath string, defaultLogPath string, defaultDriver s
 	return c, nil
 
 }
+
+// Reload loads the configuration file of cfg again, and applies its log level
+// and format. Other settings are up to the caller to apply.
+func Reload(cfg Config) (Config, error) {
+	c, err := Load(cfg.ConfigFile)
+	if err != nil {
+		return cfg, err
+	}
+	c.ConfigFile = cfg.ConfigFile
+
+	levelName := c.LogLevel
+	if logLevelOverride != "" {
+		levelName = logLevelOverride
+	}
+	level, err := log.ParseLevel(levelName)
+	if err != nil {
+		return cfg, err
+	}
+	formatter, err := log_formatter.NewFormatter(c.LogFormat)
+	if err != nil {
+		return cfg, err
+	}
+	log.SetFormatter(formatter)
+	log.SetLevel(level)
+	log.WithFields(log.Fields{"config": c.ConfigFile, "log_level": levelName}).Info("Configuration reloaded ")
+	return c, nil
+}
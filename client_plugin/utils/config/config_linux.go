@@ -25,10 +25,36 @@ const (
 	DefaultVFilePluginConfigPath = "/etc/vfile.conf"
 	// DefaultVFilePluginLogPath is the default location of log (trace) file for vFile plugin
 	DefaultVFilePluginLogPath = "/var/log/vfile.log"
+	// DefaultCSIPluginLogPath is the default location of log (trace) file for the CSI plugin
+	DefaultCSIPluginLogPath = "/var/log/vsphere-csi.log"
+	// DefaultFlexVolumeLogPath is the default location of log (trace) file for the FlexVolume driver
+	DefaultFlexVolumeLogPath = "/var/log/vsphere-flexvolume.log"
+	// DefaultVMDKPluginAdminSock is the default location of the admin server socket
+	DefaultVMDKPluginAdminSock = "/var/run/docker-volume-vsphere/admin.sock"
+	// DefaultVFilePluginAdminSock is the default location of the admin server socket for vFile plugin
+	DefaultVFilePluginAdminSock = "/var/run/vfile/admin.sock"
+	// DefaultVMDKPluginStateFile is the default location of the refcount state file
+	DefaultVMDKPluginStateFile = "/var/run/docker-volume-vsphere/state.json"
+	// DefaultVFilePluginStateFile is the default location of the refcount state file for vFile plugin
+	DefaultVFilePluginStateFile = "/var/run/vfile/state.json"
+	// DefaultJournalDir is the default directory of the journal of volume operations
+	DefaultJournalDir = "/var/lib/docker-volume-vsphere/journal"
+	// DefaultKeyDir is the default directory of the "file" key provider
+	DefaultKeyDir = "/etc/docker-volume-vsphere/keys"
+	// DefaultClusterKeyFile is the default file of the vFile cluster key
+	DefaultClusterKeyFile = "/etc/vfile/cluster-key"
+	// DefaultEtcdCACert and DefaultEtcdCAKey are the default files of the CA
+	// of the embedded etcd of vFile
+	DefaultEtcdCACert = "/etc/vfile/etcd-ca.pem"
+	DefaultEtcdCAKey  = "/etc/vfile/etcd-ca-key.pem"
 
 	// MountRoot is the path where VMDK and photon volumes are mounted
 	MountRoot = "/mnt/vmdk"
 
+	// FlexVolumeMountRoot is the path where the FlexVolume driver mounts volumes,
+	// apart from the Docker plugin which unmounts volumes Docker does not use.
+	FlexVolumeMountRoot = "/mnt/vmdk-flexvolume"
+
 	// VFileMountRoot is the path where vFile volumes are mounted
 	VFileMountRoot = "/mnt/vfile"
 )
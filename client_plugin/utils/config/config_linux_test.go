@@ -19,6 +19,8 @@ package config_test
 import (
 	"github.com/stretchr/testify/assert"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
+	"io/ioutil"
+	"os"
 	"testing"
 )
 
@@ -29,3 +31,67 @@ func TestLoad(t *testing.T) {
 	assert.Equal(t, conf.MaxLogAgeDays, 28)
 	assert.Equal(t, conf.LogPath, "/var/log/docker-volume-vsphere.log")
 }
+
+func TestLoadClasses(t *testing.T) {
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	tests := []struct {
+		config string
+		valid  bool
+	}{
+		{`{"Classes": {"gold": {"size": "10gb", "vsan-policy-name": "gold"}},
+		   "DefaultCreateOptions": {"class": "gold", "fstype": "xfs"}}`, true},
+		{`{"Classes": {"gold": {"clone-from": "vol"}}}`, false},
+		{`{"Classes": {"gold": {"class": "silver"}}}`, false},
+		{`{"DefaultCreateOptions": {"class": "gold"}}`, false},
+		{`{"DefaultCreateOptions": {"sizes": "1gb"}}`, false},
+	}
+	for _, test := range tests {
+		assert.Nil(t, ioutil.WriteFile(f.Name(), []byte(test.config), 0600))
+		conf, err := config.Load(f.Name())
+		if test.valid {
+			assert.Nil(t, err, test.config)
+			assert.Equal(t, "10gb", conf.Classes["gold"]["size"])
+		} else {
+			assert.NotNil(t, err, test.config)
+		}
+	}
+}
+
+func TestLoadVFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	tests := []struct {
+		config    string
+		placement string // empty if invalid
+	}{
+		{`{}`, config.FileServersOnSwarm},
+		{`{"EtcdEndpoints": ["https://10.0.0.1:2379"], "EtcdCACert": "/etc/vfile/ca.pem",
+		   "EtcdClientCert": "/etc/vfile/cert.pem", "EtcdClientKey": "/etc/vfile/key.pem"}`, config.FileServersOnHost},
+		{`{"EtcdEndpoints": ["10.0.0.1:2379"], "FileServerPlacement": "swarm"}`, config.FileServersOnSwarm},
+		{`{"FileServerPlacement": "host"}`, config.FileServersOnHost},
+		{`{"FileServerPlacement": "node"}`, ""},
+		{`{"EtcdClientCert": "/etc/vfile/cert.pem"}`, ""},
+		{`{"EtcdUsername": "vfile"}`, ""},
+		{`{"EtcdCACert": "/etc/vfile/ca.pem", "EtcdCAKey": "/etc/vfile/ca-key.pem"}`, config.FileServersOnSwarm},
+		{`{"EtcdCAKey": "/etc/vfile/ca-key.pem"}`, config.FileServersOnSwarm},
+	}
+	for _, test := range tests {
+		assert.Nil(t, ioutil.WriteFile(f.Name(), []byte(test.config), 0600))
+		conf, err := config.Load(f.Name())
+		if test.placement != "" {
+			assert.Nil(t, err, test.config)
+			assert.Equal(t, test.placement, config.FileServerPlacement(conf), test.config)
+		} else {
+			assert.NotNil(t, err, test.config)
+		}
+	}
+}
@@ -25,6 +25,26 @@ var (
 	// DefaultVMDKPluginLogPath is the default location of the vmdk plugin log (trace) file.
 	DefaultVMDKPluginLogPath = filepath.Join(os.Getenv("LOCALAPPDATA"), "docker-volume-vsphere", "logs", "docker-volume-vsphere.log")
 
+	// DefaultVMDKPluginAdminSock is empty, the admin server is not supported on Windows.
+	DefaultVMDKPluginAdminSock = ""
+
+	// DefaultVMDKPluginStateFile is the default location of the refcount state file.
+	// It survives reboots, the saved boot ID tells when it is stale.
+	DefaultVMDKPluginStateFile = filepath.Join(os.Getenv("LOCALAPPDATA"), "docker-volume-vsphere", "state.json")
+
+	// DefaultJournalDir is the default directory of the journal of volume operations.
+	DefaultJournalDir = filepath.Join(os.Getenv("LOCALAPPDATA"), "docker-volume-vsphere", "journal")
+
+	// DefaultKeyDir is empty, encrypted volumes are not supported on Windows.
+	DefaultKeyDir = ""
+
+	// DefaultClusterKeyFile is empty, vFile is not supported on Windows.
+	DefaultClusterKeyFile = ""
+
+	// DefaultEtcdCACert and DefaultEtcdCAKey are empty, vFile is not supported on Windows.
+	DefaultEtcdCACert = ""
+	DefaultEtcdCAKey  = ""
+
 	// VMDK volumes are mounted here
 	MountRoot = filepath.Join(os.Getenv("LOCALAPPDATA"), "docker-volume-vsphere", "mounts")
 )
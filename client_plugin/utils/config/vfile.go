@@ -0,0 +1,56 @@
+// Copyright 2016-2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+// vFile settings: the etcd cluster of the KV store and where file servers run.
+
+import "fmt"
+
+const (
+	// FileServersOnSwarm runs the file servers of vFile volumes as Swarm services
+	FileServersOnSwarm = "swarm"
+	// FileServersOnHost runs the file servers of vFile volumes as containers,
+	// on the host mounting each volume first, or on the next host mounting
+	// it if that host cannot be reached
+	FileServersOnHost = "host"
+)
+
+// FileServerPlacement returns where vFile runs file servers with configuration c
+func FileServerPlacement(c Config) string {
+	if c.FileServerPlacement != "" {
+		return c.FileServerPlacement
+	}
+	if len(c.EtcdEndpoints) != 0 {
+		return FileServersOnHost
+	}
+	return FileServersOnSwarm
+}
+
+// validateVFile checks the vFile settings
+func validateVFile(c Config) error {
+	switch c.FileServerPlacement {
+	case "", FileServersOnSwarm, FileServersOnHost:
+	default:
+		return fmt.Errorf("Invalid FileServerPlacement %s, valid values are %s and %s",
+			c.FileServerPlacement, FileServersOnSwarm, FileServersOnHost)
+	}
+	if (c.EtcdClientCert == "") != (c.EtcdClientKey == "") {
+		return fmt.Errorf("EtcdClientCert and EtcdClientKey must be set together")
+	}
+	if (c.EtcdUsername == "") != (c.EtcdPassword == "") {
+		return fmt.Errorf("EtcdUsername and EtcdPassword must be set together")
+	}
+	return nil
+}
@@ -17,39 +17,63 @@
 package fs
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/metrics"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
 )
 
+// Results of waiting for an attached device
+const (
+	attachWaitFound   = "found"
+	attachWaitTimeout = "timeout"
+	attachWaitError   = "error"
+)
+
+var attachWaitDuration = metrics.NewHistogramVec("attach_wait_duration_seconds",
+	"Time spent waiting for attached volumes to show up in the guest.", nil, "result")
+
 // VolumeDevSpec - volume spec returned from the server on an attach
 type VolumeDevSpec struct {
 	Unit                    string
 	ControllerPciSlotNumber string
 }
 
+// Usage is the space and inode usage of a mounted file system
+type Usage struct {
+	BytesTotal     uint64
+	BytesUsed      uint64
+	BytesAvailable uint64 // available to unprivileged users
+	InodesTotal    uint64
+	InodesUsed     uint64
+	InodesFree     uint64
+}
+
 // Mkdir creates a directory at the specified path.
-func Mkdir(path string) error {
+func Mkdir(ctx context.Context, path string) error {
 	stat, err := os.Lstat(path)
 	if os.IsNotExist(err) {
-		log.WithField("path", path).Info("Directory doesn't exist, creating it ")
+		requestid.Log(ctx).WithField("path", path).Info("Directory doesn't exist, creating it ")
 		if err := os.MkdirAll(path, 0755); err != nil {
-			log.WithFields(log.Fields{"path": path,
+			requestid.Log(ctx).WithFields(log.Fields{"path": path,
 				"err": err}).Error("Failed to create directory ")
 			return err
 		}
 	} else if err != nil {
-		log.WithFields(log.Fields{"path": path,
+		requestid.Log(ctx).WithFields(log.Fields{"path": path,
 			"err": err}).Error("Failed to test directory existence ")
 		return err
 	}
 
 	if stat != nil && !stat.IsDir() {
 		msg := fmt.Sprintf("%v already exists and it's not a directory", path)
-		log.Error(msg)
-		return fmt.Errorf(msg)
+		requestid.Log(ctx).Error(msg)
+		return errors.New(msg)
 	}
 	return nil
 }
@@ -60,12 +84,12 @@ func Rmdir(path string) error {
 }
 
 // GetMountRootEntries returns the list of volumes under mountRoot
-func GetMountRootEntries(mountRoot string) ([]string, error) {
+func GetMountRootEntries(ctx context.Context, mountRoot string) ([]string, error) {
 	var vols []string
 	// Read entries in mountRoot for all volumes that are or were in use via the plugin
 	volumes, err := ioutil.ReadDir(mountRoot)
 	if err != nil {
-		log.Errorf("Unable to read entries from %s (%v)", mountRoot, err)
+		requestid.Log(ctx).Errorf("Unable to read entries from %s (%v)", mountRoot, err)
 		return vols, err
 	}
 
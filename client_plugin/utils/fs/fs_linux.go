@@ -17,6 +17,7 @@
 package fs
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -29,6 +30,7 @@ import (
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
 	"golang.org/x/exp/inotify"
 )
 
@@ -45,40 +47,59 @@ const (
 	devWaitTimeout   = 10 * time.Second         // give it plenty of time to sense the attached disk
 	bdevPath         = "/sys/block/"
 	deleteFile       = "/device/delete"
+	rescanFile       = "/device/rescan"
 	watchPath        = "/dev/disk/by-id"
 	diskWatchPath    = "/dev/disk/by-path"
 	linuxMountsFile  = "/proc/mounts" // Path of file containing linux mounts information
+	msLazytime       = 1 << 25        // MS_LAZYTIME, missing from syscall
 )
 
+// mountOptionFlags are the mount options passed to mount(2) as flags,
+// other options are passed to the file system as data.
+var mountOptionFlags = map[string]uintptr{
+	"noatime":     syscall.MS_NOATIME,
+	"nodiratime":  syscall.MS_NODIRATIME,
+	"relatime":    syscall.MS_RELATIME,
+	"strictatime": syscall.MS_STRICTATIME,
+	"lazytime":    msLazytime,
+	"nodev":       syscall.MS_NODEV,
+	"nosuid":      syscall.MS_NOSUID,
+	"noexec":      syscall.MS_NOEXEC,
+	"sync":        syscall.MS_SYNCHRONOUS,
+	"dirsync":     syscall.MS_DIRSYNC,
+}
+
 // BinSearchPath contains search paths for host binaries
 var BinSearchPath = []string{"/bin", "/sbin", "/usr/bin", "/usr/sbin"}
 
 // DevAttachWaitPrep creates a watcher that watches disk events.
-func DevAttachWaitPrep() (*inotify.Watcher, error) {
-	return devAttachWaitPrep(diskWatchPath)
+func DevAttachWaitPrep(ctx context.Context) (*inotify.Watcher, error) {
+	return devAttachWaitPrep(ctx, diskWatchPath)
 }
 
 // devAttachWaitPrep creates a watcher that watches devPath.
-func devAttachWaitPrep(devPath string) (*inotify.Watcher, error) {
+func devAttachWaitPrep(ctx context.Context, devPath string) (*inotify.Watcher, error) {
 	watcher, errWatcher := inotify.NewWatcher()
 	if errWatcher != nil {
-		log.WithFields(log.Fields{"err": errWatcher.Error()}).Error("Failed to create watcher ")
+		requestid.Log(ctx).WithFields(log.Fields{"err": errWatcher.Error()}).Error("Failed to create watcher ")
 		return nil, errors.New("Failed to create watcher")
 	}
 
 	err := watcher.Watch(devPath)
 	if err != nil {
-		log.WithFields(log.Fields{"path": devPath, "err": err.Error()}).Error("Failed to watch ")
+		requestid.Log(ctx).WithFields(log.Fields{"path": devPath, "err": err.Error()}).Error("Failed to watch ")
 		return nil, fmt.Errorf("Failed to watch path %s", devPath)
 	}
 	return watcher, nil
 }
 
 // DevAttachWait waits for attach operation to be completed
-func DevAttachWait(watcher *inotify.Watcher, volDev *VolumeDevSpec) error {
-	device, err := getDevicePath(volDev)
+func DevAttachWait(ctx context.Context, watcher *inotify.Watcher, volDev *VolumeDevSpec) error {
+	start := time.Now()
+	device, err := getDevicePath(ctx, volDev)
 	if err != nil {
-		log.WithFields(log.Fields{"volDev": *volDev, "err": err}).Error("Failed to get device path ")
+		requestid.Log(ctx).WithFields(log.Fields{"volDev": *volDev, "err": err}).Error("Failed to get device path ")
+		attachWaitDuration.ObserveSince(start, attachWaitError)
 		return err
 	}
 
@@ -87,43 +108,49 @@ func DevAttachWait(watcher *inotify.Watcher, volDev *VolumeDevSpec) error {
 	// If file already present, do not wait for attach
 	_, err = os.Stat(device)
 	if err == nil {
-		log.WithFields(
+		requestid.Log(ctx).WithFields(
 			log.Fields{"device": device},
 		).Info("Device file found. ")
+		attachWaitDuration.ObserveSince(start, attachWaitFound)
 		return nil
 	}
 
-	devAttachWait(watcher, device)
+	result := devAttachWait(ctx, watcher, device)
+	attachWaitDuration.ObserveSince(start, result)
 	return nil
 }
 
-// devAttachWait waits for attach operation to be completed
-func devAttachWait(watcher *inotify.Watcher, device string) {
+// devAttachWait waits for attach operation to be completed, returns how the wait ended
+func devAttachWait(ctx context.Context, watcher *inotify.Watcher, device string) string {
+	result := attachWaitFound
 loop:
 	for {
 		select {
 		case ev := <-watcher.Event:
-			log.Debug("event: ", ev)
+			requestid.Log(ctx).Debug("event: ", ev)
 			if ev.Name == device {
 				// Log when the device is discovered
-				log.WithFields(
+				requestid.Log(ctx).WithFields(
 					log.Fields{"device": device, "event": ev},
 				).Info("Scan complete ")
 				break loop
 			}
 		case err := <-watcher.Error:
-			log.WithFields(
+			requestid.Log(ctx).WithFields(
 				log.Fields{"device": device, "error": err},
 			).Error("Hit error during watch ")
+			result = attachWaitError
 			break loop
 		case <-time.After(devWaitTimeout):
-			log.WithFields(
+			requestid.Log(ctx).WithFields(
 				log.Fields{"timeout": devWaitTimeout, "device": device},
 			).Warning("Exceeded timeout while waiting for device attach to complete")
+			result = attachWaitTimeout
 			break loop
 		}
 	}
 	watcher.Close()
+	return result
 }
 
 // DevAttachWaitFallback performs basic fallback in case of watch failure.
@@ -132,31 +159,32 @@ func DevAttachWaitFallback() {
 }
 
 // Mkfs creates a filesystem at the specified volDev.
-func Mkfs(fstype string, label string, volDev *VolumeDevSpec) error {
-	device, err := getDevicePath(volDev)
+func Mkfs(ctx context.Context, fstype string, label string, volDev *VolumeDevSpec, options string) error {
+	device, err := getDevicePath(ctx, volDev)
 	if err != nil {
-		log.WithFields(log.Fields{"volDev": *volDev, "err": err}).Error("Failed to get device path ")
+		requestid.Log(ctx).WithFields(log.Fields{"volDev": *volDev, "err": err}).Error("Failed to get device path ")
 		return err
 	}
-	return MkfsByDevicePath(fstype, label, device)
+	return MkfsByDevicePath(ctx, fstype, label, device, options)
 }
 
 // MkfsByDevicePath creates a filesystem at the specified device.
-func MkfsByDevicePath(fstype string, label string, device string) error {
-	var err error
-	var out []byte
-
+// options are extra mkfs flags, see ValidateMkfsOptions.
+func MkfsByDevicePath(ctx context.Context, fstype string, label string, device string, options string) error {
 	// Identify mkfscmd for fstype
 	mkfscmd := mkfsLookup()[fstype]
 
 	// Workaround older versions of e2fsprogs, issue 629.
 	// If mkfscmd is of an ext* filesystem use -F flag
 	// to avoid having mkfs command to expect user confirmation.
+	var args []string
 	if strings.Split(mkfscmd, ".")[1][0:3] == "ext" {
-		out, err = exec.Command(mkfscmd, "-F", "-L", label, device).CombinedOutput()
-	} else {
-		out, err = exec.Command(mkfscmd, "-L", label, device).CombinedOutput()
+		args = append(args, "-F")
 	}
+	args = append(args, "-L", label)
+	args = append(args, strings.Fields(options)...)
+	args = append(args, device)
+	out, err := exec.Command(mkfscmd, args...).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("Failed to create filesystem on %s: %s. Output = %s",
 			device, err, out)
@@ -164,8 +192,83 @@ func MkfsByDevicePath(fstype string, label string, device string) error {
 	return nil
 }
 
+// GrowFs grows the filesystem at the specified (unmounted) volDev to the size of the disk.
+func GrowFs(ctx context.Context, fstype string, volDev *VolumeDevSpec) error {
+	device, err := getDevicePath(ctx, volDev)
+	if err != nil {
+		requestid.Log(ctx).WithFields(log.Fields{"volDev": *volDev, "err": err}).Error("Failed to get device path ")
+		return err
+	}
+	return GrowFsByDevicePath(ctx, fstype, device, "")
+}
+
+// GrowFsByDevicePath grows the filesystem on the device to the size of the device.
+// mountpoint is where the device is mounted, "" if it is not mounted.
+// ext* filesystems are grown online or offline with resize2fs, xfs only
+// grows online so it is mounted at a temporary mount point if needed.
+func GrowFsByDevicePath(ctx context.Context, fstype string, device string, mountpoint string) error {
+	var out []byte
+	var err error
+
+	requestid.Log(ctx).WithFields(log.Fields{"device": device, "fstype": fstype,
+		"mountpoint": mountpoint}).Info("Growing filesystem ")
+	switch {
+	case strings.HasPrefix(fstype, "ext"):
+		if mountpoint == "" {
+			// resize2fs insists on a freshly checked filesystem when offline,
+			// e2fsck exits with 1 when it fixed errors which is fine here.
+			out, err = exec.Command("e2fsck", "-f", "-p", device).CombinedOutput()
+			if exitErr, ok := err.(*exec.ExitError); ok &&
+				exitErr.Sys().(syscall.WaitStatus).ExitStatus() == 1 {
+				err = nil
+			}
+			if err != nil {
+				return fmt.Errorf("Failed to check filesystem on %s: %s. Output = %s",
+					device, err, out)
+			}
+		}
+		out, err = exec.Command("resize2fs", device).CombinedOutput()
+	case fstype == "xfs":
+		if mountpoint == "" {
+			tmpMountpoint, errTmp := ioutil.TempDir("", "growfs")
+			if errTmp != nil {
+				return errTmp
+			}
+			defer os.Remove(tmpMountpoint)
+			if errTmp = MountByDevicePath(ctx, tmpMountpoint, fstype, device, false, ""); errTmp != nil {
+				return errTmp
+			}
+			defer Unmount(ctx, tmpMountpoint)
+			mountpoint = tmpMountpoint
+		}
+		out, err = exec.Command("xfs_growfs", mountpoint).CombinedOutput()
+	default:
+		return fmt.Errorf("Growing %s filesystems is not supported", fstype)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to grow filesystem on %s: %s. Output = %s",
+			device, err, out)
+	}
+	return nil
+}
+
+// RescanDevice makes the kernel re-read the capacity of a SCSI disk after
+// it was extended. Devices without a rescan node (e.g. loop devices) are skipped.
+func RescanDevice(ctx context.Context, device string) error {
+	dev, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return err
+	}
+	rescan := bdevPath + filepath.Base(dev) + rescanFile
+	if _, err = os.Stat(rescan); os.IsNotExist(err) {
+		return nil
+	}
+	requestid.Log(ctx).Debugf("Rescanning device - device: %s, node: %s", device, rescan)
+	return ioutil.WriteFile(rescan, []byte("1"), 0644)
+}
+
 // VerifyFSSupport checks whether the fstype filesystem is supported.
-func VerifyFSSupport(fstype string) error {
+func VerifyFSSupport(ctx context.Context, fstype string) error {
 	supportedFs := mkfsLookup()
 	_, result := supportedFs[fstype]
 	if result == false {
@@ -197,37 +300,70 @@ func mkfsLookup() map[string]string {
 }
 
 // Mount the filesystem (`fs`) on the volDev at the given mountpoint.
-func Mount(mountpoint string, fstype string, volDev *VolumeDevSpec, isReadOnly bool) error {
-	device, err := getDevicePath(volDev)
+func Mount(ctx context.Context, mountpoint string, fstype string, volDev *VolumeDevSpec, isReadOnly bool, options string) error {
+	device, err := getDevicePath(ctx, volDev)
 	if err != nil {
-		log.WithFields(log.Fields{"volDev": *volDev, "err": err}).Error("Failed to get device path ")
+		requestid.Log(ctx).WithFields(log.Fields{"volDev": *volDev, "err": err}).Error("Failed to get device path ")
 		return err
 	}
-	return MountByDevicePath(mountpoint, fstype, device, isReadOnly)
+	return MountByDevicePath(ctx, mountpoint, fstype, device, isReadOnly, options)
 }
 
 // MountByDevicePath mounts the filesystem (`fs`) on the device at the given mount point.
-func MountByDevicePath(mountpoint string, fstype string, device string, isReadOnly bool) error {
-	log.WithFields(log.Fields{
+// options are comma separated mount options, see ValidateMountOptions.
+func MountByDevicePath(ctx context.Context, mountpoint string, fstype string, device string, isReadOnly bool, options string) error {
+	requestid.Log(ctx).WithFields(log.Fields{
 		"device":     device,
 		"fstype":     fstype,
 		"mountpoint": mountpoint,
+		"options":    options,
 	}).Debug("Calling syscall.Mount() ")
 
-	flags := 0
+	flags, data := parseMountOptions(options)
 	if isReadOnly {
-		flags = syscall.MS_RDONLY
+		flags |= syscall.MS_RDONLY
 	}
-	err := syscall.Mount(device, mountpoint, fstype, uintptr(flags), "")
+	err := syscall.Mount(device, mountpoint, fstype, flags, data)
 	if err != nil {
 		return fmt.Errorf("Failed to mount device %s at %s: %s", device, mountpoint, err)
 	}
 	return nil
 }
 
+// GetUsage returns the usage of the file system mounted at mountpoint
+func GetUsage(mountpoint string) (*Usage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(mountpoint, &st); err != nil {
+		return nil, err
+	}
+	bsize := uint64(st.Bsize)
+	return &Usage{
+		BytesTotal:     st.Blocks * bsize,
+		BytesUsed:      (st.Blocks - st.Bfree) * bsize,
+		BytesAvailable: st.Bavail * bsize,
+		InodesTotal:    st.Files,
+		InodesUsed:     st.Files - st.Ffree,
+		InodesFree:     st.Ffree,
+	}, nil
+}
+
+// parseMountOptions returns the mount(2) flags and file system data for options
+func parseMountOptions(options string) (uintptr, string) {
+	var flags uintptr
+	var data []string
+	for _, opt := range splitMountOptions(options) {
+		if flag, ok := mountOptionFlags[opt]; ok {
+			flags |= flag
+		} else {
+			data = append(data, opt)
+		}
+	}
+	return flags, strings.Join(data, ",")
+}
+
 // MountWithID - mount device with ID
-func MountWithID(mountpoint string, fstype string, id string, isReadOnly bool) error {
-	log.WithFields(log.Fields{
+func MountWithID(ctx context.Context, mountpoint string, fstype string, id string, isReadOnly bool) error {
+	requestid.Log(ctx).WithFields(log.Fields{
 		"device ID":  id,
 		"fstype":     fstype,
 		"mountpoint": mountpoint,
@@ -235,7 +371,7 @@ func MountWithID(mountpoint string, fstype string, id string, isReadOnly bool) e
 
 	// Scan so we may have the device before attempting a mount
 	// Loop over all hosts and scan each one
-	device, err := GetDevicePathByID(id)
+	device, err := GetDevicePathByID(ctx, id)
 	if err != nil {
 		return fmt.Errorf("Invalid device path %s for %s: %s",
 			device, mountpoint, err)
@@ -253,8 +389,26 @@ func MountWithID(mountpoint string, fstype string, id string, isReadOnly bool) e
 	return nil
 }
 
+// BindMount mounts the directory source at target as well.
+func BindMount(source string, target string, isReadOnly bool) error {
+	err := syscall.Mount(source, target, "", syscall.MS_BIND, "")
+	if err != nil {
+		return fmt.Errorf("Failed to bind mount %s at %s: %s", source, target, err)
+	}
+	if !isReadOnly {
+		return nil
+	}
+	// The read-only flag is ignored on the initial bind mount
+	err = syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+	if err != nil {
+		syscall.Unmount(target, 0)
+		return fmt.Errorf("Failed to remount %s read-only: %s", target, err)
+	}
+	return nil
+}
+
 // Unmount a device from the given mount point.
-func Unmount(mountPoint string) error {
+func Unmount(ctx context.Context, mountPoint string) error {
 	err := syscall.Unmount(mountPoint, 0)
 	if err != nil {
 		return fmt.Errorf("Unmount device at %s failed: %s",
@@ -268,7 +422,7 @@ func makeDevicePathWithID(id string) string {
 }
 
 // GetDevicePathByID - return full path for device with given ID
-func GetDevicePathByID(id string) (string, error) {
+func GetDevicePathByID(ctx context.Context, id string) (string, error) {
 	hosts, err := ioutil.ReadDir(scsiHostPath)
 	if err != nil {
 		return "", err
@@ -278,14 +432,14 @@ func GetDevicePathByID(id string) (string, error) {
 		//Scan so we may have the device before attempting a mount
 		scanHost := scsiHostPath + host.Name() + "/scan"
 		bytes := []byte("- - -")
-		log.WithFields(log.Fields{"disk id": id, "scan cmd": scanHost}).Info("Rescanning ... ")
+		requestid.Log(ctx).WithFields(log.Fields{"disk id": id, "scan cmd": scanHost}).Info("Rescanning ... ")
 		err = ioutil.WriteFile(scanHost, bytes, 0644)
 		if err != nil {
 			return "", err
 		}
 	}
 
-	watcher, errWatch := devAttachWaitPrep(watchPath)
+	watcher, errWatch := devAttachWaitPrep(ctx, watchPath)
 
 	device := makeDevicePathWithID(id)
 
@@ -294,7 +448,7 @@ func GetDevicePathByID(id string) (string, error) {
 	} else {
 		// Wait for the attach to complete, may timeout
 		// in which case we continue creating the file system.
-		devAttachWait(watcher, device)
+		devAttachWait(ctx, watcher, device)
 	}
 	_, err = os.Stat(device)
 	if err != nil {
@@ -304,7 +458,7 @@ func GetDevicePathByID(id string) (string, error) {
 }
 
 // DeleteDevicePathWithID - delete device with given ID
-func DeleteDevicePathWithID(id string) error {
+func DeleteDevicePathWithID(ctx context.Context, id string) error {
 	// Delete the device node
 	device := makeDevicePathWithID(id)
 	dev, err := os.Readlink(device)
@@ -316,7 +470,7 @@ func DeleteDevicePathWithID(id string) error {
 	node := bdevPath + links[len(links)-1] + deleteFile
 	bytes := []byte("1")
 
-	log.Debugf("Deleteing device node - id: %s, node: %s", id, node)
+	requestid.Log(ctx).Debugf("Deleteing device node - id: %s, node: %s", id, node)
 	err = ioutil.WriteFile(node, bytes, 0644)
 	if err != nil {
 		return err
@@ -324,8 +478,13 @@ func DeleteDevicePathWithID(id string) error {
 	return nil
 }
 
+// DevicePath returns the path of the device for volDev.
+func DevicePath(ctx context.Context, volDev *VolumeDevSpec) (string, error) {
+	return getDevicePath(ctx, volDev)
+}
+
 // getDevicePath returns the device path or error.
-func getDevicePath(volDev *VolumeDevSpec) (string, error) {
+func getDevicePath(ctx context.Context, volDev *VolumeDevSpec) (string, error) {
 	// Get the device node for the unit returned from the attach.
 	// Lookup each device that has a label and if that label matches
 	// the one for the given bus number.
@@ -335,7 +494,7 @@ func getDevicePath(volDev *VolumeDevSpec) (string, error) {
 
 	fh, err := os.Open(pciSlotAddr)
 	if err != nil {
-		log.WithFields(log.Fields{"Error": err}).Warn("Get device path failed for unit# %s @ PCI slot %s: ",
+		requestid.Log(ctx).WithFields(log.Fields{"Error": err}).Warnf("Get device path failed for unit# %s @ PCI slot %s ",
 			volDev.Unit, volDev.ControllerPciSlotNumber)
 		return "", fmt.Errorf("Device not found")
 	}
@@ -345,7 +504,7 @@ func getDevicePath(volDev *VolumeDevSpec) (string, error) {
 
 	fh.Close()
 	if err != nil && err != io.EOF {
-		log.WithFields(log.Fields{"Error": err}).Warn("Get device path failed for unit# %s @ PCI slot %s: ",
+		requestid.Log(ctx).WithFields(log.Fields{"Error": err}).Warnf("Get device path failed for unit# %s @ PCI slot %s ",
 			volDev.Unit, volDev.ControllerPciSlotNumber)
 		return "", fmt.Errorf("Device not found")
 	}
@@ -355,16 +514,16 @@ func getDevicePath(volDev *VolumeDevSpec) (string, error) {
 // GetMountInfo returns a map of mounted volumes and devices if available. It creates a map
 // of all volumes that are in use or may have been in use earlier and creates the map of
 // volume to device.
-func GetMountInfo(mountRoot string) (map[string]string, error) {
+func GetMountInfo(ctx context.Context, mountRoot string) (map[string]string, error) {
 	volumeMountMap := make(map[string]string) // map [volume mount path] -> device
 
 	// Read current mounted filesystems
 	data, err := ioutil.ReadFile(linuxMountsFile)
 	if err != nil {
-		log.Errorf("Can't get info from %s (%v)", linuxMountsFile, err)
+		requestid.Log(ctx).Errorf("Can't get info from %s (%v)", linuxMountsFile, err)
 		return volumeMountMap, err
 	}
-	log.WithFields(log.Fields{"data": string(data)}).Debug("Mounts read successfully: ")
+	requestid.Log(ctx).WithFields(log.Fields{"data": string(data)}).Debug("Mounts read successfully: ")
 
 	for _, line := range strings.Split(string(data), lf) {
 		field := strings.Fields(line)
@@ -376,9 +535,10 @@ func GetMountInfo(mountRoot string) (map[string]string, error) {
 			continue
 		}
 		vname := strings.Replace(filepath.Base(field[1]), "\\040", " ", -1)
-		volumeMountMap[vname] = field[0]
+		// Encrypted volumes are mounted from their LUKS mapping
+		volumeMountMap[vname] = mapperDevice(field[0])
 	}
 
-	log.WithFields(log.Fields{"map": volumeMountMap}).Debug("Successfully retrieved mounts: ")
+	requestid.Log(ctx).WithFields(log.Fields{"map": volumeMountMap}).Debug("Successfully retrieved mounts: ")
 	return volumeMountMap, nil
 }
@@ -15,6 +15,7 @@
 package fs
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -23,11 +24,31 @@ import (
 const funnyfs = "funnyfs"
 
 func TestVerifyFSSupport(t *testing.T) {
-	err := VerifyFSSupport(FstypeDefault)
+	err := VerifyFSSupport(context.Background(), FstypeDefault)
 	assert.Nil(t, err, "Fstype %s should be supported", FstypeDefault)
 }
 
 func TestVerifyFSSupportError(t *testing.T) {
-	err := VerifyFSSupport(funnyfs)
+	err := VerifyFSSupport(context.Background(), funnyfs)
 	assert.NotNil(t, err, "Fstype %s shouldn't be supported", funnyfs)
 }
+
+func TestValidateMountOptions(t *testing.T) {
+	for _, opts := range []string{"", "noatime", "noatime,discard,nobarrier", "data=writeback, commit=30"} {
+		assert.Nil(t, ValidateMountOptions("ext4", opts), "Mount options %s should be valid", opts)
+	}
+	assert.Nil(t, ValidateMountOptions("xfs", "noatime,largeio,allocsize=64m"))
+	for _, opts := range []string{"remount", "noatime,bind", "data=/etc/passwd", "largeio"} {
+		assert.NotNil(t, ValidateMountOptions("ext4", opts), "Mount options %s should be invalid", opts)
+	}
+	assert.NotNil(t, ValidateMountOptions(funnyfs, "discard"))
+}
+
+func TestValidateMkfsOptions(t *testing.T) {
+	assert.Nil(t, ValidateMkfsOptions("xfs", "-n ftype=1 -K"))
+	assert.Nil(t, ValidateMkfsOptions("ext4", "-E lazy_itable_init=0,lazy_journal_init=0 -m 0"))
+	for _, opts := range []string{"-L other", "-F", "-m", "-E", "-O ^has_journal;reboot", "-n ftype=1"} {
+		assert.NotNil(t, ValidateMkfsOptions("ext4", opts), "Mkfs options %s should be invalid", opts)
+	}
+	assert.NotNil(t, ValidateMkfsOptions(funnyfs, "-m 0"))
+}
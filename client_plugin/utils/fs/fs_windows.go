@@ -17,6 +17,7 @@
 package fs
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"path/filepath"
@@ -25,6 +26,7 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	ps "github.com/vmware/docker-volume-vsphere/client_plugin/utils/powershell"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
 )
 
 const (
@@ -122,9 +124,9 @@ const (
 )
 
 // VerifyFSSupport checks whether the fstype filesystem is supported.
-func VerifyFSSupport(fstype string) error {
+func VerifyFSSupport(ctx context.Context, fstype string) error {
 	if fstype != ntfs {
-		log.WithFields(log.Fields{"fstype": fstype}).Error("Unsupported fstype ")
+		requestid.Log(ctx).WithFields(log.Fields{"fstype": fstype}).Error("Unsupported fstype ")
 		return fmt.Errorf("Not found mkfs for %s\nSupported filesystems: %s",
 			fstype, ntfs)
 	}
@@ -132,7 +134,7 @@ func VerifyFSSupport(fstype string) error {
 }
 
 // DevAttachWaitPrep initializes and returns a new DiskWatcher.
-func DevAttachWaitPrep() (*DeviceWatcher, error) {
+func DevAttachWaitPrep(ctx context.Context) (*DeviceWatcher, error) {
 	watcher := NewDeviceWatcher()
 	watcher.Init()
 	return watcher, nil
@@ -140,32 +142,36 @@ func DevAttachWaitPrep() (*DeviceWatcher, error) {
 
 // DevAttachWait waits until the specified disk is attached, or returns
 // an error on watcher failure.
-func DevAttachWait(watcher *DeviceWatcher, volDev *VolumeDevSpec) error {
+func DevAttachWait(ctx context.Context, watcher *DeviceWatcher, volDev *VolumeDevSpec) error {
 	defer watcher.Terminate()
+	start := time.Now()
 	for {
-		log.WithFields(log.Fields{"volDev": *volDev}).Info("Waiting for a watcher event ")
+		requestid.Log(ctx).WithFields(log.Fields{"volDev": *volDev}).Info("Waiting for a watcher event ")
 		select {
 		case event := <-watcher.Event:
-			log.WithFields(log.Fields{"volDev": *volDev,
+			requestid.Log(ctx).WithFields(log.Fields{"volDev": *volDev,
 				"event": event}).Info("Watcher emitted an event ")
-			if diskNum, err := getDiskNum(volDev); err != nil {
-				log.WithFields(log.Fields{"volDev": *volDev,
+			if diskNum, err := getDiskNum(ctx, volDev); err != nil {
+				requestid.Log(ctx).WithFields(log.Fields{"volDev": *volDev,
 					"err": err}).Warn("Couldn't map volDev to diskNum, continuing.. ")
 			} else {
-				log.WithFields(log.Fields{"volDev": *volDev,
+				requestid.Log(ctx).WithFields(log.Fields{"volDev": *volDev,
 					"diskNum": diskNum}).Info("Successfully mapped volDev to diskNum ")
+				attachWaitDuration.ObserveSince(start, attachWaitFound)
 				return nil
 			}
-			log.WithFields(log.Fields{"volDev": *volDev}).Warn("Couldn't locate disk, waiting.. ")
+			requestid.Log(ctx).WithFields(log.Fields{"volDev": *volDev}).Warn("Couldn't locate disk, waiting.. ")
 
 		case err := <-watcher.Error:
-			log.WithFields(log.Fields{"volDev": *volDev,
+			requestid.Log(ctx).WithFields(log.Fields{"volDev": *volDev,
 				"err": err}).Error("Watcher returned an error ")
+			attachWaitDuration.ObserveSince(start, attachWaitError)
 			return err
 
 		case <-time.After(maxDiskAttachWaitSec):
 			msg := "Disk mapping timed out "
-			log.WithFields(log.Fields{"volDev": *volDev}).Error(msg)
+			requestid.Log(ctx).WithFields(log.Fields{"volDev": *volDev}).Error(msg)
+			attachWaitDuration.ObserveSince(start, attachWaitTimeout)
 			return errors.New(msg)
 		}
 	}
@@ -177,10 +183,14 @@ func DevAttachWaitFallback() {
 }
 
 // Mkfs creates a filesystem at the specified volDev.
-func Mkfs(fstype string, label string, volDev *VolumeDevSpec) error {
-	diskNum, err := getDiskNum(volDev)
+// Mkfs options are not supported.
+func Mkfs(ctx context.Context, fstype string, label string, volDev *VolumeDevSpec, options string) error {
+	if options != "" {
+		return errors.New("Mkfs options are not supported")
+	}
+	diskNum, err := getDiskNum(ctx, volDev)
 	if err != nil {
-		log.WithFields(log.Fields{"fstype": fstype, "label": label, "volDev": *volDev,
+		requestid.Log(ctx).WithFields(log.Fields{"fstype": fstype, "label": label, "volDev": *volDev,
 			"err": err}).Error("Failed to locate disk ")
 		return err
 	}
@@ -188,21 +198,25 @@ func Mkfs(fstype string, label string, volDev *VolumeDevSpec) error {
 	script := fmt.Sprintf(formatDiskScript, diskNum, diskNum, diskNum, fstype, label)
 	stdout, stderr, err := ps.Exec(script)
 	if err != nil {
-		log.WithFields(log.Fields{"fstype": fstype, "label": label, "volDev": *volDev, "diskNum": diskNum,
+		requestid.Log(ctx).WithFields(log.Fields{"fstype": fstype, "label": label, "volDev": *volDev, "diskNum": diskNum,
 			"err": err, "stdout": stdout, "stderr": stderr}).Error("Format disk script failed ")
 		return err
 	} else {
-		log.WithFields(log.Fields{"fstype": fstype, "label": label, "volDev": *volDev, "diskNum": diskNum,
+		requestid.Log(ctx).WithFields(log.Fields{"fstype": fstype, "label": label, "volDev": *volDev, "diskNum": diskNum,
 			"stdout": stdout}).Info("Format disk script executed successfully ")
 		return nil
 	}
 }
 
 // Mount mounts the filesystem on the volDev at the given mountpoint.
-func Mount(mountpoint string, fstype string, volDev *VolumeDevSpec, isReadOnly bool) error {
-	diskNum, err := getDiskNum(volDev)
+// Mount options are ignored.
+func Mount(ctx context.Context, mountpoint string, fstype string, volDev *VolumeDevSpec, isReadOnly bool, options string) error {
+	if options != "" {
+		requestid.Log(ctx).WithFields(log.Fields{"mountpoint": mountpoint, "options": options}).Warning("Ignoring mount options ")
+	}
+	diskNum, err := getDiskNum(ctx, volDev)
 	if err != nil {
-		log.WithFields(log.Fields{"mountpoint": mountpoint, "fstype": fstype,
+		requestid.Log(ctx).WithFields(log.Fields{"mountpoint": mountpoint, "fstype": fstype,
 			"volDev": *volDev, "isReadOnly": isReadOnly, "err": err}).Error("Failed to locate disk ")
 		return err
 	}
@@ -210,19 +224,19 @@ func Mount(mountpoint string, fstype string, volDev *VolumeDevSpec, isReadOnly b
 	script := fmt.Sprintf(mountDiskScript, diskNum, isReadOnly, diskNum, mountpoint)
 	stdout, stderr, err := ps.Exec(script)
 	if err != nil {
-		log.WithFields(log.Fields{"mountpoint": mountpoint, "fstype": fstype,
+		requestid.Log(ctx).WithFields(log.Fields{"mountpoint": mountpoint, "fstype": fstype,
 			"volDev": *volDev, "isReadOnly": isReadOnly, "diskNum": diskNum,
 			"err": err, "stdout": stdout, "stderr": stderr}).Error("Failed to mount disk ")
 		return err
 	}
 
-	log.WithFields(log.Fields{"mountpoint": mountpoint, "fstype": fstype, "volDev": *volDev,
+	requestid.Log(ctx).WithFields(log.Fields{"mountpoint": mountpoint, "fstype": fstype, "volDev": *volDev,
 		"isReadOnly": isReadOnly, "diskNum": diskNum, "stdout": stdout}).Info("Disk successfully mounted ")
 	return nil
 }
 
 // Unmount unmounts a disk from the given mount point.
-func Unmount(mountpoint string) error {
+func Unmount(ctx context.Context, mountpoint string) error {
 	// PowerShell returns access paths with a trailing slash.
 	if !strings.HasSuffix(mountpoint, `\`) {
 		mountpoint += `\`
@@ -231,40 +245,40 @@ func Unmount(mountpoint string) error {
 	script := fmt.Sprintf(unmountDiskScript, mountpoint, mountpoint)
 	stdout, stderr, err := ps.Exec(script)
 	if err != nil {
-		log.WithFields(log.Fields{"mountpoint": mountpoint, "err": err,
+		requestid.Log(ctx).WithFields(log.Fields{"mountpoint": mountpoint, "err": err,
 			"stdout": stdout, "stderr": stderr}).Error("Failed to unmount disk ")
 		return err
 	} else if tailSegment(stdout, lf, 2) == diskNotFound {
 		msg := fmt.Sprintf("Failed to unmount disk from '%s'", mountpoint)
-		log.WithField("stdout", stdout).Error(msg)
+		requestid.Log(ctx).WithField("stdout", stdout).Error(msg)
 		return errors.New(msg)
 	}
-	log.WithFields(log.Fields{"mountpoint": mountpoint,
+	requestid.Log(ctx).WithFields(log.Fields{"mountpoint": mountpoint,
 		"stdout": stdout}).Info("Disk unmounted ")
 	return nil
 }
 
 // getDiskNum returns the disk number corresponding to volDev, or an error on
 // failing to identify the disk.
-func getDiskNum(volDev *VolumeDevSpec) (string, error) {
+func getDiskNum(ctx context.Context, volDev *VolumeDevSpec) (string, error) {
 	script := fmt.Sprintf(scsiAddrToDiskNumScript, volDev.ControllerPciSlotNumber, volDev.Unit)
 	stdout, stderr, err := ps.Exec(script)
 	if err != nil {
-		log.WithFields(log.Fields{"volDev": *volDev, "err": err, "stdout": stdout,
+		requestid.Log(ctx).WithFields(log.Fields{"volDev": *volDev, "err": err, "stdout": stdout,
 			"stderr": stderr}).Error("Failed to execute the disk mapping script ")
 		return "", err
 	}
-	log.WithFields(log.Fields{"volDev": *volDev,
+	requestid.Log(ctx).WithFields(log.Fields{"volDev": *volDev,
 		"stdout": stdout}).Info("Disk mapping script executed ")
 
 	diskNum := strings.Replace(tailSegment(stdout, lf, 2), cr, "", -1)
 	if diskNum == diskNotFound {
 		msg := fmt.Sprintf("Could not identify disk for controller = %s, unit = %s",
 			volDev.ControllerPciSlotNumber, volDev.Unit)
-		log.Error(msg)
+		requestid.Log(ctx).Error(msg)
 		return "", errors.New(msg)
 	}
-	log.WithFields(log.Fields{"volDev": *volDev,
+	requestid.Log(ctx).WithFields(log.Fields{"volDev": *volDev,
 		"diskNum": diskNum}).Info("Successfully located disk ")
 	return diskNum, nil
 }
@@ -277,16 +291,16 @@ func tailSegment(out string, delim string, n int) string {
 }
 
 // GetMountInfo returns a map of mounted volumes and disk numbers.
-func GetMountInfo(mountRoot string) (map[string]string, error) {
+func GetMountInfo(ctx context.Context, mountRoot string) (map[string]string, error) {
 	volumeMountMap := make(map[string]string)
 
 	stdout, stderr, err := ps.Exec(mountListScript)
 	if err != nil {
-		log.WithFields(log.Fields{"err": err, "stdout": stdout,
+		requestid.Log(ctx).WithFields(log.Fields{"err": err, "stdout": stdout,
 			"stderr": stderr}).Error("Couldn't execute script to list mounts")
 		return volumeMountMap, err
 	}
-	log.WithFields(log.Fields{"stdout": stdout}).Info("List mounts script executed")
+	requestid.Log(ctx).WithFields(log.Fields{"stdout": stdout}).Info("List mounts script executed")
 
 	for _, line := range strings.Split(stdout, lf) {
 		fields := strings.SplitN(line, " ", 2)
@@ -302,33 +316,98 @@ func GetMountInfo(mountRoot string) (map[string]string, error) {
 		}
 	}
 
-	log.WithFields(log.Fields{"map": volumeMountMap}).Info("Successfully retrieved mounts")
+	requestid.Log(ctx).WithFields(log.Fields{"map": volumeMountMap}).Info("Successfully retrieved mounts")
 	return volumeMountMap, nil
 }
 
 // Functions needed by the photon driver, but not implemented for the Windows OS.
 
 // DeleteDevicePathWithID returns an error.
-func DeleteDevicePathWithID(id string) error {
+func DeleteDevicePathWithID(ctx context.Context, id string) error {
 	return errors.New("DeleteDevicePathWithID is not supported")
 }
 
 // GetDevicePathByID returns an error.
-func GetDevicePathByID(id string) (string, error) {
+func GetDevicePathByID(ctx context.Context, id string) (string, error) {
 	return "", errors.New("GetDevicePathByID is not supported")
 }
 
 // MkfsByDevicePath returns an error.
-func MkfsByDevicePath(fstype string, label string, device string) error {
+func MkfsByDevicePath(ctx context.Context, fstype string, label string, device string, options string) error {
 	return errors.New("MkfsByDevicePath is not supported")
 }
 
+// GrowFs returns an error.
+func GrowFs(ctx context.Context, fstype string, volDev *VolumeDevSpec) error {
+	return errors.New("GrowFs is not supported")
+}
+
+// GrowFsByDevicePath returns an error.
+func GrowFsByDevicePath(ctx context.Context, fstype string, device string, mountpoint string) error {
+	return errors.New("GrowFsByDevicePath is not supported")
+}
+
+// RescanDevice returns an error.
+func RescanDevice(ctx context.Context, device string) error {
+	return errors.New("RescanDevice is not supported")
+}
+
 // MountByDevicePath returns an error.
-func MountByDevicePath(mountpoint string, fstype string, device string, isReadOnly bool) error {
+func MountByDevicePath(ctx context.Context, mountpoint string, fstype string, device string, isReadOnly bool, options string) error {
 	return errors.New("MountByDevicePath is not supported")
 }
 
+// BindMount returns an error.
+func BindMount(source string, target string, isReadOnly bool) error {
+	return errors.New("BindMount is not supported")
+}
+
 // MountWithID returns an error.
-func MountWithID(mountpoint string, fstype string, id string, isReadOnly bool) error {
+func MountWithID(ctx context.Context, mountpoint string, fstype string, id string, isReadOnly bool) error {
 	return errors.New("MountWithID is not supported")
 }
+
+// GetUsage returns an error.
+func GetUsage(mountpoint string) (*Usage, error) {
+	return nil, errors.New("GetUsage is not supported")
+}
+
+// DevicePath returns an error.
+func DevicePath(ctx context.Context, volDev *VolumeDevSpec) (string, error) {
+	return "", errors.New("DevicePath is not supported")
+}
+
+// LuksMappingName returns the device mapper name used for the volume.
+func LuksMappingName(volName string) string {
+	return volName
+}
+
+// IsLuks returns false, encrypted volumes are not supported.
+func IsLuks(device string) (bool, error) {
+	return false, nil
+}
+
+// LuksFormat returns an error.
+func LuksFormat(ctx context.Context, device string, key []byte) error {
+	return errors.New("LuksFormat is not supported")
+}
+
+// LuksOpen returns an error.
+func LuksOpen(device string, name string, key []byte) (string, error) {
+	return "", errors.New("LuksOpen is not supported")
+}
+
+// LuksClose does nothing, as no LUKS device is ever opened.
+func LuksClose(name string) error {
+	return nil
+}
+
+// LuksResize returns an error.
+func LuksResize(name string, key []byte) error {
+	return errors.New("LuksResize is not supported")
+}
+
+// LuksBackingDevice returns an error.
+func LuksBackingDevice(mapped string) (string, error) {
+	return "", errors.New("LuksBackingDevice is not supported")
+}
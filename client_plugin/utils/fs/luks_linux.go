@@ -0,0 +1,142 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// LUKS (dm-crypt) support for encrypted volumes, using cryptsetup.
+// The key is passed to cryptsetup on stdin, it is never written to disk here.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
+)
+
+const (
+	// LuksMapperDir is where device mapper exposes opened LUKS devices
+	LuksMapperDir = "/dev/mapper"
+
+	luksMappingPrefix = "vdvs-"
+	dmDevicePrefix    = "/dev/dm-"
+	cryptsetupCmd     = "cryptsetup"
+)
+
+// luksMagic starts the header of LUKS (v1 and v2) devices
+var luksMagic = []byte{'L', 'U', 'K', 'S', 0xba, 0xbe}
+
+// LuksMappingName returns the device mapper name used for the volume
+func LuksMappingName(volName string) string {
+	return luksMappingPrefix + strings.Replace(volName, "/", "_", -1)
+}
+
+// IsLuks returns true if the device holds a LUKS header
+func IsLuks(device string) (bool, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header := make([]byte, len(luksMagic))
+	if _, err = io.ReadFull(f, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return bytes.Equal(header, luksMagic), nil
+}
+
+// LuksFormat initializes a LUKS header on the device, destroying its content
+func LuksFormat(ctx context.Context, device string, key []byte) error {
+	requestid.Log(ctx).WithFields(log.Fields{"device": device}).Info("Formatting LUKS device ")
+	return cryptsetup(key, "luksFormat", "--batch-mode", "--key-file=-", device)
+}
+
+// LuksOpen opens the LUKS device as mapping name, unless it is open already,
+// and returns the path of the decrypted device.
+func LuksOpen(device string, name string, key []byte) (string, error) {
+	mapped := filepath.Join(LuksMapperDir, name)
+	if _, err := os.Stat(mapped); err == nil {
+		return mapped, nil
+	}
+	err := cryptsetup(key, "luksOpen", "--key-file=-", device, name)
+	if err != nil {
+		return "", err
+	}
+	return mapped, nil
+}
+
+// LuksClose closes the mapping name, if it is open
+func LuksClose(name string) error {
+	if _, err := os.Stat(filepath.Join(LuksMapperDir, name)); os.IsNotExist(err) {
+		return nil
+	}
+	return cryptsetup(nil, "luksClose", name)
+}
+
+// LuksResize grows the open mapping name to the size of its device
+func LuksResize(name string, key []byte) error {
+	return cryptsetup(key, "resize", "--key-file=-", name)
+}
+
+// LuksBackingDevice returns the device under an open mapping, e.g. /dev/sdb
+// for /dev/mapper/vdvs-vol1@datastore1
+func LuksBackingDevice(mapped string) (string, error) {
+	dev, err := filepath.EvalSymlinks(mapped)
+	if err != nil {
+		return "", err
+	}
+	slaves, err := ioutil.ReadDir(bdevPath + filepath.Base(dev) + "/slaves")
+	if err != nil {
+		return "", err
+	}
+	if len(slaves) != 1 {
+		return "", fmt.Errorf("Expected one device under %s, found %d", mapped, len(slaves))
+	}
+	return "/dev/" + slaves[0].Name(), nil
+}
+
+// mapperDevice returns /dev/mapper/<name> for /dev/dm-N devices, as
+// mounts may show either of them. Other devices are returned as-is.
+func mapperDevice(device string) string {
+	if !strings.HasPrefix(device, dmDevicePrefix) {
+		return device
+	}
+	name, err := ioutil.ReadFile(bdevPath + filepath.Base(device) + "/dm/name")
+	if err != nil {
+		return device
+	}
+	return filepath.Join(LuksMapperDir, strings.TrimSpace(string(name)))
+}
+
+func cryptsetup(key []byte, args ...string) error {
+	cmd := exec.Command(cryptsetupCmd, args...)
+	if key != nil {
+		cmd.Stdin = bytes.NewReader(key)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to run %s %s: %s. Output = %s", cryptsetupCmd, args[0], err, out)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Mount and mkfs options of volumes, given at volume creation.
+//
+// Mount options are comma separated, as with mount -o ("noatime,discard").
+// Mkfs options are whitespace separated flags and values of the mkfs command
+// ("-n ftype=1"). Both are checked against an allow-list per file system type,
+// options controlling the label, forcing or the output are not allowed.
+
+package fs
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// MountOptionsOpt is the volume create option, and metadata key, of mount options
+	MountOptionsOpt = "mount-options"
+	// MkfsOptionsOpt is the volume create option, and metadata key, of mkfs options
+	MkfsOptionsOpt = "mkfs-options"
+)
+
+// commonMountOptions are the mount options accepted for all file systems.
+// Options ending with "=" take a value.
+var commonMountOptions = []string{"noatime", "nodiratime", "relatime", "strictatime",
+	"lazytime", "nodev", "nosuid", "noexec", "sync", "dirsync"}
+
+var extMountOptions = []string{"acl", "noacl", "user_xattr", "nouser_xattr", "errors=",
+	"barrier", "barrier=", "nobarrier", "data=", "commit=", "grpid", "nogrpid"}
+
+// fsMountOptions are the mount options accepted by file system type
+var fsMountOptions = map[string][]string{
+	"ext2": {"acl", "noacl", "user_xattr", "nouser_xattr", "errors=", "grpid", "nogrpid"},
+	"ext3": extMountOptions,
+	"ext4": append([]string{"discard", "nodiscard", "journal_checksum", "delalloc", "nodelalloc",
+		"auto_da_alloc", "noauto_da_alloc", "init_itable=", "noinit_itable", "stripe=",
+		"dioread_nolock", "dioread_lock"}, extMountOptions...),
+	"xfs": {"discard", "nodiscard", "barrier", "nobarrier", "inode32", "inode64", "largeio",
+		"nolargeio", "allocsize=", "logbufs=", "logbsize=", "swalloc", "wsync", "attr2",
+		"noattr2", "noquota", "uquota", "gquota", "pquota"},
+}
+
+// extMkfsOptions are the mke2fs flags accepted, with true for flags taking a value
+var extMkfsOptions = map[string]bool{"-b": true, "-E": true, "-g": true, "-G": true,
+	"-i": true, "-I": true, "-J": true, "-m": true, "-N": true, "-O": true, "-T": true}
+
+// fsMkfsOptions are the mkfs flags accepted by file system type
+var fsMkfsOptions = map[string]map[string]bool{
+	"ext2": extMkfsOptions,
+	"ext3": extMkfsOptions,
+	"ext4": extMkfsOptions,
+	"xfs": {"-b": true, "-d": true, "-i": true, "-l": true, "-m": true, "-n": true,
+		"-s": true, "-K": false},
+}
+
+// optionValueRe matches values of mount options and mkfs flags
+var optionValueRe = regexp.MustCompile(`^[A-Za-z0-9_.,:=+-]+$`)
+
+// splitMountOptions returns the mount options in options
+func splitMountOptions(options string) []string {
+	var opts []string
+	for _, opt := range strings.Split(options, ",") {
+		if opt = strings.TrimSpace(opt); opt != "" {
+			opts = append(opts, opt)
+		}
+	}
+	return opts
+}
+
+// ValidateMountOptions returns an error if options has a mount option
+// which is not allowed for fstype.
+func ValidateMountOptions(fstype string, options string) error {
+	for _, opt := range splitMountOptions(options) {
+		name := opt
+		if i := strings.Index(opt, "="); i >= 0 {
+			name = opt[:i+1]
+			if !optionValueRe.MatchString(opt[i+1:]) {
+				return fmt.Errorf("Invalid value in mount option %s", opt)
+			}
+		}
+		if !containsOption(commonMountOptions, name) && !containsOption(fsMountOptions[fstype], name) {
+			return fmt.Errorf("Mount option %s is not supported for %s. Valid options are: %v",
+				opt, fstype, append(append([]string{}, commonMountOptions...), fsMountOptions[fstype]...))
+		}
+	}
+	return nil
+}
+
+// ValidateMkfsOptions returns an error if options has a mkfs flag which
+// is not allowed for fstype, or a flag is missing its value.
+func ValidateMkfsOptions(fstype string, options string) error {
+	allowed := fsMkfsOptions[fstype]
+	args := strings.Fields(options)
+	for i := 0; i < len(args); i++ {
+		takesValue, ok := allowed[args[i]]
+		if !ok {
+			return fmt.Errorf("Mkfs option %s is not supported for %s", args[i], fstype)
+		}
+		if !takesValue {
+			continue
+		}
+		if i+1 == len(args) || !optionValueRe.MatchString(args[i+1]) {
+			return fmt.Errorf("Mkfs option %s requires a valid value", args[i])
+		}
+		i++
+	}
+	return nil
+}
+
+func containsOption(list []string, opt string) bool {
+	for _, o := range list {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyprovider
+
+// Keys stored in files in a local directory, readable by root only.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const keyFileSuffix = ".key"
+
+type fileProvider struct {
+	dir string
+}
+
+func newFileProvider(dir string) (*fileProvider, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("Key directory not configured")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Failed to create key directory %s: %v", dir, err)
+	}
+	return &fileProvider{dir: dir}, nil
+}
+
+func (p *fileProvider) path(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("Invalid volume name %q for a key file", name)
+	}
+	return filepath.Join(p.dir, name+keyFileSuffix), nil
+}
+
+// GetKey - see Provider
+func (p *fileProvider) GetKey(name string) ([]byte, error) {
+	path, err := p.path(name)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return key, err
+}
+
+// PutKey - see Provider. The key is written to a temporary file first,
+// so a crash never leaves a truncated key behind.
+func (p *fileProvider) PutKey(name string, key []byte) error {
+	path, err := p.path(name)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(p.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(key); err == nil {
+		err = tmp.Sync()
+	}
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write key file %s: %v", path, err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// DeleteKey - see Provider
+func (p *fileProvider) DeleteKey(name string) error {
+	path, err := p.path(name)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
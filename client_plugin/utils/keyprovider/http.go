@@ -0,0 +1,99 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyprovider
+
+// Keys stored on a key server: GET, PUT and DELETE of <url>/keys/<volume>,
+// with the key as the body. GET returns 404 for unknown volumes.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	keysPath         = "/keys/"
+	keyServerTimeout = 30 * time.Second
+	maxKeyBodyBytes  = 4096
+)
+
+type httpProvider struct {
+	baseURL string
+	client  *http.Client
+}
+
+func newHTTPProvider(baseURL string) (*httpProvider, error) {
+	if _, err := url.Parse(baseURL); err != nil || baseURL == "" {
+		return nil, fmt.Errorf("Invalid key server URL %q", baseURL)
+	}
+	return &httpProvider{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: keyServerTimeout},
+	}, nil
+}
+
+func (p *httpProvider) do(method string, name string, body []byte) ([]byte, int, error) {
+	req, err := http.NewRequest(method, p.baseURL+keysPath+url.PathEscape(name), bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Key server request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: maxKeyBodyBytes})
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	return data, resp.StatusCode, nil
+}
+
+// GetKey - see Provider
+func (p *httpProvider) GetKey(name string) ([]byte, error) {
+	key, status, err := p.do(http.MethodGet, name, nil)
+	switch {
+	case err != nil:
+		return nil, err
+	case status == http.StatusNotFound:
+		return nil, ErrNotFound
+	case status != http.StatusOK:
+		return nil, fmt.Errorf("Key server returned %d for volume %s", status, name)
+	}
+	return key, nil
+}
+
+// PutKey - see Provider
+func (p *httpProvider) PutKey(name string, key []byte) error {
+	_, status, err := p.do(http.MethodPut, name, key)
+	if err == nil && status/100 != 2 {
+		err = fmt.Errorf("Key server returned %d storing the key of volume %s", status, name)
+	}
+	return err
+}
+
+// DeleteKey - see Provider
+func (p *httpProvider) DeleteKey(name string) error {
+	_, status, err := p.do(http.MethodDelete, name, nil)
+	if err == nil && status/100 != 2 && status != http.StatusNotFound {
+		err = fmt.Errorf("Key server returned %d deleting the key of volume %s", status, name)
+	}
+	return err
+}
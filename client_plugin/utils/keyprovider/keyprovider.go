@@ -0,0 +1,74 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package keyprovider stores the keys of encrypted volumes, by volume name.
+//
+// Keys are kept either in files in a local directory, or on a key server
+// speaking a minimal HTTP protocol (GET, PUT and DELETE of <url>/keys/<volume>),
+// which stands in for KMIP key management servers.
+package keyprovider
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Key provider types, see New
+const (
+	FileProvider = "file"
+	HTTPProvider = "http"
+
+	keyBytes = 32
+)
+
+// ErrNotFound is returned by GetKey for volumes without a key
+var ErrNotFound = errors.New("Key not found")
+
+// Provider stores volume keys
+type Provider interface {
+	// GetKey returns the key of the volume, ErrNotFound if there is none
+	GetKey(name string) ([]byte, error)
+	// PutKey stores the key of the volume, replacing any previous one
+	PutKey(name string, key []byte) error
+	// DeleteKey removes the key of the volume, if any
+	DeleteKey(name string) error
+}
+
+// New returns the provider of type kind at location, the key directory for
+// FileProvider or the key server URL for HTTPProvider. It returns nil if
+// kind is empty, when no key provider is configured.
+func New(kind string, location string) (Provider, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case FileProvider:
+		return newFileProvider(location)
+	case HTTPProvider:
+		return newHTTPProvider(location)
+	}
+	return nil, fmt.Errorf("Unknown key provider %q, expected %s or %s", kind, FileProvider, HTTPProvider)
+}
+
+// NewKey returns a random key, hex encoded so it can be handled as a passphrase
+func NewKey() ([]byte, error) {
+	raw := make([]byte, keyBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("Failed to generate key: %v", err)
+	}
+	key := make([]byte, hex.EncodedLen(keyBytes))
+	hex.Encode(key, raw)
+	return key, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyprovider_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/keyprovider"
+)
+
+// keyServer is an in-memory key server
+type keyServer struct {
+	mtx  sync.Mutex
+	keys map[string][]byte
+}
+
+func (s *keyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	name := strings.TrimPrefix(r.URL.Path, "/keys/")
+	switch r.Method {
+	case http.MethodGet:
+		key, ok := s.keys[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(key)
+	case http.MethodPut:
+		key, _ := ioutil.ReadAll(r.Body)
+		s.keys[name] = key
+	case http.MethodDelete:
+		delete(s.keys, name)
+	}
+}
+
+// checkProvider runs a key through its lifecycle
+func checkProvider(t *testing.T, p keyprovider.Provider) {
+	_, err := p.GetKey("vol1@ds1")
+	assert.Equal(t, keyprovider.ErrNotFound, err)
+
+	key, err := keyprovider.NewKey()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Len(t, key, 64)
+	assert.Nil(t, p.PutKey("vol1@ds1", key))
+	got, err := p.GetKey("vol1@ds1")
+	assert.Nil(t, err)
+	assert.Equal(t, key, got)
+
+	// Keys are replaced, and deleting is idempotent
+	assert.Nil(t, p.PutKey("vol1@ds1", []byte("other")))
+	got, _ = p.GetKey("vol1@ds1")
+	assert.Equal(t, "other", string(got))
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, p.DeleteKey("vol1@ds1"))
+	}
+	_, err = p.GetKey("vol1@ds1")
+	assert.Equal(t, keyprovider.ErrNotFound, err)
+}
+
+func TestFileProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := keyprovider.New(keyprovider.FileProvider, dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	checkProvider(t, p)
+	assert.NotNil(t, p.PutKey("../vol1", []byte("key")), "Names must not escape the key directory")
+}
+
+func TestHTTPProvider(t *testing.T) {
+	server := httptest.NewServer(&keyServer{keys: make(map[string][]byte)})
+	defer server.Close()
+
+	p, err := keyprovider.New(keyprovider.HTTPProvider, server.URL+"/")
+	if !assert.Nil(t, err) {
+		return
+	}
+	checkProvider(t, p)
+}
+
+func TestNew(t *testing.T) {
+	p, err := keyprovider.New("", "")
+	assert.Nil(t, p)
+	assert.Nil(t, err)
+
+	_, err = keyprovider.New("kmip", "kmip.example.com")
+	assert.NotNil(t, err)
+}
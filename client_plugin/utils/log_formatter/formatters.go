@@ -0,0 +1,175 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// * This file contains the JSON and logfmt formatters, for log pipelines
+// * which parse the plugin logs. Both emit the time, level, message, caller
+// * and request ID followed by all other logrus fields.
+
+package log_formatter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
+)
+
+// Log formats, see NewFormatter
+const (
+	FormatVmware = "vmware"
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// Keys of the fields every formatter emits
+const (
+	timeKey   = "time"
+	levelKey  = "level"
+	msgKey    = "msg"
+	callerKey = "caller"
+)
+
+const maxCallerDepth = 25
+
+// NewFormatter returns the formatter for format, FormatVmware if empty
+func NewFormatter(format string) (log.Formatter, error) {
+	switch format {
+	case "", FormatVmware:
+		return new(VmwareFormatter), nil
+	case FormatJSON:
+		return new(JSONFormatter), nil
+	case FormatLogfmt:
+		return new(LogfmtFormatter), nil
+	}
+	return nil, fmt.Errorf("Unknown log format %q, expected %s, %s or %s",
+		format, FormatVmware, FormatJSON, FormatLogfmt)
+}
+
+// JSONFormatter writes one JSON object per line
+type JSONFormatter struct{}
+
+// Format log messages
+func (f *JSONFormatter) Format(entry *log.Entry) ([]byte, error) {
+	data := make(map[string]interface{}, len(entry.Data)+4)
+	for key, value := range entry.Data {
+		data[fieldKey(key)] = fieldValue(value)
+	}
+	data[timeKey] = entry.Time.Format(time.RFC3339Nano)
+	data[levelKey] = entry.Level.String()
+	data[msgKey] = strings.TrimSpace(entry.Message)
+	if caller := findCaller(); caller != "" {
+		data[callerKey] = caller
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal log fields to JSON: %v", err)
+	}
+	return append(b, '\n'), nil
+}
+
+// LogfmtFormatter writes key=value pairs as parsed by logfmt
+type LogfmtFormatter struct{}
+
+// Format log messages
+func (f *LogfmtFormatter) Format(entry *log.Entry) ([]byte, error) {
+	b := &bytes.Buffer{}
+	appendLogfmt(b, timeKey, entry.Time.Format(time.RFC3339Nano))
+	appendLogfmt(b, levelKey, entry.Level.String())
+	appendLogfmt(b, msgKey, strings.TrimSpace(entry.Message))
+	if caller := findCaller(); caller != "" {
+		appendLogfmt(b, callerKey, caller)
+	}
+	if id, ok := entry.Data[requestid.Key]; ok {
+		appendLogfmt(b, requestid.Key, id)
+	}
+
+	keys := make([]string, 0, len(entry.Data))
+	for key := range entry.Data {
+		if key != requestid.Key {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		appendLogfmt(b, fieldKey(key), fieldValue(entry.Data[key]))
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// fieldKey renames fields clashing with the ones every formatter emits
+func fieldKey(key string) string {
+	switch key {
+	case timeKey, levelKey, msgKey, callerKey:
+		return "fields." + key
+	}
+	return key
+}
+
+// fieldValue returns errors as their message, encoding/json drops them otherwise
+func fieldValue(value interface{}) interface{} {
+	if err, ok := value.(error); ok {
+		return err.Error()
+	}
+	return value
+}
+
+func appendLogfmt(b *bytes.Buffer, key string, value interface{}) {
+	if b.Len() > 0 {
+		b.WriteByte(' ')
+	}
+	b.WriteString(key)
+	b.WriteByte('=')
+	str, ok := value.(string)
+	if !ok {
+		str = fmt.Sprint(value)
+	}
+	if str == "" || strings.IndexFunc(str, logfmtNeedsQuote) >= 0 {
+		b.WriteString(strconv.Quote(str))
+	} else {
+		b.WriteString(str)
+	}
+}
+
+func logfmtNeedsQuote(ch rune) bool {
+	return ch <= ' ' || ch == '=' || ch == '"' || ch == '\\' || ch > '~'
+}
+
+// findCaller returns file:line of the code which logged the entry,
+// the first frame outside of logrus and this package.
+func findCaller() string {
+	pcs := make([]uintptr, maxCallerDepth)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if !strings.Contains(frame.Function, "github.com/Sirupsen/logrus.") &&
+			!strings.Contains(frame.Function, "/utils/log_formatter.") {
+			return fmt.Sprintf("%s/%s:%d", filepath.Base(filepath.Dir(frame.File)),
+				filepath.Base(frame.File), frame.Line)
+		}
+		if !more {
+			return ""
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log_formatter_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/log_formatter"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
+)
+
+// logWith logs a warning through a logger using the given format
+// and returns the output
+func logWith(ctx context.Context, t *testing.T, format string) string {
+	formatter, err := log_formatter.NewFormatter(format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	logger := log.New()
+	logger.Out = &out
+	logger.Formatter = formatter
+
+	entry := log.NewEntry(logger)
+	if id := requestid.FromContext(ctx); id != "" {
+		entry = entry.WithField(requestid.Key, id)
+	}
+	entry.WithFields(log.Fields{"name": "vol1@ds1", "error": errors.New("not found"),
+		"level": "clash"}).Warning("Failed to get volume ")
+	return out.String()
+}
+
+func TestJSONFormatter(t *testing.T) {
+	ctx := requestid.NewContext(context.Background(), "abc123")
+	out := logWith(ctx, t, log_formatter.FormatJSON)
+
+	var fields map[string]interface{}
+	if !assert.Nil(t, json.Unmarshal([]byte(out), &fields), out) {
+		return
+	}
+	assert.Equal(t, "warning", fields["level"])
+	assert.Equal(t, "Failed to get volume", fields["msg"])
+	assert.Equal(t, "abc123", fields[requestid.Key])
+	assert.Equal(t, "vol1@ds1", fields["name"])
+	assert.Equal(t, "not found", fields["error"])
+	assert.Equal(t, "clash", fields["fields.level"])
+	assert.NotEmpty(t, fields["time"])
+	assert.Contains(t, fields["caller"], "log_formatter/formatters_test.go:")
+}
+
+func TestLogfmtFormatter(t *testing.T) {
+	ctx := requestid.NewContext(context.Background(), "abc123")
+	out := logWith(ctx, t, log_formatter.FormatLogfmt)
+
+	assert.True(t, strings.HasPrefix(out, "time="), out)
+	assert.Contains(t, out, ` level=warning msg="Failed to get volume" caller=log_formatter/formatters_test.go:`)
+	assert.Contains(t, out, ` request_id=abc123 error="not found" fields.level=clash name=vol1@ds1`+"\n")
+}
+
+func TestNewFormatter(t *testing.T) {
+	formatter, err := log_formatter.NewFormatter("")
+	assert.Nil(t, err)
+	assert.IsType(t, &log_formatter.VmwareFormatter{}, formatter)
+
+	_, err = log_formatter.NewFormatter("xml")
+	assert.NotNil(t, err)
+
+	// Without a request ID in the context, no request_id field is logged
+	assert.NotContains(t, logWith(context.Background(), t, log_formatter.FormatVmware), requestid.Key)
+}
@@ -0,0 +1,123 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+// Counts and times the requests Docker (or a CSI container orchestrator)
+// sends to a volume driver.
+
+import (
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// Result label values
+const (
+	ResultSuccess = "success"
+	ResultError   = "error"
+)
+
+var (
+	pluginRequests = NewCounterVec("plugin_requests_total",
+		"Volume API requests (Docker or CSI) handled by the plugin.", "driver", "request", "result")
+	pluginRequestDuration = NewHistogramVec("plugin_request_duration_seconds",
+		"Duration of volume API requests (Docker or CSI).", nil, "driver", "request")
+)
+
+// Result returns the result label value for err
+func Result(err error) string {
+	if err != nil {
+		return ResultError
+	}
+	return ResultSuccess
+}
+
+// instrumentedDriver wraps a volume.Driver
+type instrumentedDriver struct {
+	driver volume.Driver
+	name   string
+}
+
+// InstrumentDriver returns a volume.Driver recording metrics for each request
+// before passing it to driver.
+func InstrumentDriver(name string, driver volume.Driver) volume.Driver {
+	return &instrumentedDriver{driver: driver, name: name}
+}
+
+// ObserveRequest records a request served by a plugin API other than volume.Driver
+func ObserveRequest(driver string, request string, start time.Time, err error) {
+	recordRequest(driver, request, start, Result(err))
+}
+
+func recordRequest(driver string, request string, start time.Time, result string) {
+	pluginRequests.Inc(driver, request, result)
+	pluginRequestDuration.ObserveSince(start, driver, request)
+}
+
+func (d *instrumentedDriver) observe(request string, start time.Time, resp volume.Response) volume.Response {
+	result := ResultSuccess
+	if resp.Err != "" {
+		result = ResultError
+	}
+	recordRequest(d.name, request, start, result)
+	return resp
+}
+
+// Create - see volume.Driver
+func (d *instrumentedDriver) Create(r volume.Request) volume.Response {
+	start := time.Now()
+	return d.observe("Create", start, d.driver.Create(r))
+}
+
+// List - see volume.Driver
+func (d *instrumentedDriver) List(r volume.Request) volume.Response {
+	start := time.Now()
+	return d.observe("List", start, d.driver.List(r))
+}
+
+// Get - see volume.Driver
+func (d *instrumentedDriver) Get(r volume.Request) volume.Response {
+	start := time.Now()
+	return d.observe("Get", start, d.driver.Get(r))
+}
+
+// Remove - see volume.Driver
+func (d *instrumentedDriver) Remove(r volume.Request) volume.Response {
+	start := time.Now()
+	return d.observe("Remove", start, d.driver.Remove(r))
+}
+
+// Path - see volume.Driver
+func (d *instrumentedDriver) Path(r volume.Request) volume.Response {
+	start := time.Now()
+	return d.observe("Path", start, d.driver.Path(r))
+}
+
+// Mount - see volume.Driver
+func (d *instrumentedDriver) Mount(r volume.MountRequest) volume.Response {
+	start := time.Now()
+	return d.observe("Mount", start, d.driver.Mount(r))
+}
+
+// Unmount - see volume.Driver
+func (d *instrumentedDriver) Unmount(r volume.UnmountRequest) volume.Response {
+	start := time.Now()
+	return d.observe("Unmount", start, d.driver.Unmount(r))
+}
+
+// Capabilities - see volume.Driver
+func (d *instrumentedDriver) Capabilities(r volume.Request) volume.Response {
+	return d.driver.Capabilities(r)
+}
@@ -0,0 +1,331 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+// Plugin metrics in the Prometheus text exposition format (version 0.0.4).
+//
+// Only counters, histograms and gauges computed at scrape time are needed
+// by the plugins, so they are implemented here rather than pulling the
+// Prometheus client library and its dependencies into vendor/.
+//
+// Metrics are registered in a process wide registry when created and are
+// served by Handler(). Creating a metric which already exists returns the
+// existing one, so metrics can be created by any package at init time.
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const namespace = "vdvs_"
+
+// DefBuckets are the default histogram buckets (in seconds), from quick
+// local calls to slow ESX disk operations.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// metric is anything the registry can write out
+type metric interface {
+	write(w io.Writer)
+}
+
+// registry holds all metrics by name
+type registry struct {
+	mtx     sync.Mutex
+	metrics map[string]metric
+}
+
+var defaultRegistry = &registry{metrics: make(map[string]metric)}
+
+// register adds m under name, unless there is a metric with that name already.
+// Returns the registered metric.
+func (r *registry) register(name string, m metric) metric {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if existing, ok := r.metrics[name]; ok {
+		return existing
+	}
+	r.metrics[name] = m
+	return m
+}
+
+// replace adds m under name, replacing any metric with that name
+func (r *registry) replace(name string, m metric) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.metrics[name] = m
+}
+
+// write writes all metrics sorted by name
+func (r *registry) write(w io.Writer) {
+	r.mtx.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]metric, 0, len(names))
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.mtx.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// desc is the name, help and label names of a metric
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func newDesc(name string, help string, labels []string) desc {
+	return desc{name: namespace + name, help: help, labels: labels}
+}
+
+func (d desc) writeHeader(w io.Writer, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.Replace(d.help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, metricType)
+}
+
+// key joins label values into a series key
+func (d desc) key(labelValues []string) string {
+	if len(labelValues) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d",
+			d.name, len(d.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// formatLabels returns {name="value",...} with extra appended, or "" if there are no labels
+func (d desc) formatLabels(labelValues []string, extra ...string) string {
+	pairs := make([]string, 0, len(d.labels)+len(extra)/2)
+	for i, label := range d.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", label, escape(labelValues[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra[i], escape(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return strings.Replace(value, `"`, `\"`, -1)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys returns the series keys in a stable order
+func sortedKeys(series map[string][]string) []string {
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CounterVec is a set of counters partitioned by label values
+type CounterVec struct {
+	desc
+	mtx         sync.Mutex
+	values      map[string]float64
+	labelValues map[string][]string
+}
+
+// NewCounterVec returns the counter with the given name (without the vdvs_
+// prefix), registering it if needed.
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:        newDesc(name, help, labels),
+		values:      make(map[string]float64),
+		labelValues: make(map[string][]string),
+	}
+	return defaultRegistry.register(c.name, c).(*CounterVec)
+}
+
+// Inc increments the counter for the label values by 1
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v (which must not be negative) to the counter for the label values
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if _, ok := c.labelValues[key]; !ok {
+		c.labelValues[key] = append([]string(nil), labelValues...)
+	}
+	c.values[key] += v
+}
+
+// Value returns the counter for the label values
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	key := c.key(labelValues)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.values[key]
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.writeHeader(w, "counter")
+	for _, key := range sortedKeys(c.labelValues) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.formatLabels(c.labelValues[key]), formatValue(c.values[key]))
+	}
+}
+
+// histogram is a single series of a HistogramVec
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec is a set of histograms partitioned by label values
+type HistogramVec struct {
+	desc
+	buckets     []float64
+	mtx         sync.Mutex
+	series      map[string]*histogram
+	labelValues map[string][]string
+}
+
+// NewHistogramVec returns the histogram with the given name (without the vdvs_
+// prefix), registering it if needed. Buckets are upper bounds in increasing order,
+// DefBuckets is used if nil.
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	h := &HistogramVec{
+		desc:        newDesc(name, help, labels),
+		buckets:     buckets,
+		series:      make(map[string]*histogram),
+		labelValues: make(map[string][]string),
+	}
+	return defaultRegistry.register(h.name, h).(*HistogramVec)
+}
+
+// Observe adds an observation for the label values
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+		h.labelValues[key] = append([]string(nil), labelValues...)
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// ObserveSince observes the time elapsed since start, in seconds
+func (h *HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// Count returns the number of observations for the label values
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	key := h.key(labelValues)
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if s, ok := h.series[key]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.writeHeader(w, "histogram")
+	for _, key := range sortedKeys(h.labelValues) {
+		s := h.series[key]
+		values := h.labelValues[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				h.formatLabels(values, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.formatLabels(values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.formatLabels(values), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.formatLabels(values), s.count)
+	}
+}
+
+// Sample is a gauge value with its label values
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// gaugeFunc is a gauge whose samples are computed at scrape time
+type gaugeFunc struct {
+	desc
+	collect func() []Sample
+}
+
+// NewGaugeFunc registers a gauge with the given name (without the vdvs_ prefix)
+// whose samples are returned by collect when scraped. collect must be safe
+// to call concurrently. An existing gauge with the same name is replaced.
+func NewGaugeFunc(name string, help string, labels []string, collect func() []Sample) {
+	g := &gaugeFunc{desc: newDesc(name, help, labels), collect: collect}
+	defaultRegistry.replace(g.name, g)
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	samples := g.collect()
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].LabelValues, "\xff") < strings.Join(samples[j].LabelValues, "\xff")
+	})
+	g.writeHeader(w, "gauge")
+	for _, sample := range samples {
+		g.key(sample.LabelValues) // checks the number of label values
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.formatLabels(sample.LabelValues), formatValue(sample.Value))
+	}
+}
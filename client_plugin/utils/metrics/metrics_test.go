@@ -0,0 +1,98 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/metrics"
+)
+
+// fakeDriver fails requests for volumes named "bad"
+type fakeDriver struct{}
+
+func response(name string) volume.Response {
+	if name == "bad" {
+		return volume.Response{Err: "bad volume"}
+	}
+	return volume.Response{}
+}
+
+func (fakeDriver) Create(r volume.Request) volume.Response         { return response(r.Name) }
+func (fakeDriver) List(r volume.Request) volume.Response           { return response(r.Name) }
+func (fakeDriver) Get(r volume.Request) volume.Response            { return response(r.Name) }
+func (fakeDriver) Remove(r volume.Request) volume.Response         { return response(r.Name) }
+func (fakeDriver) Path(r volume.Request) volume.Response           { return response(r.Name) }
+func (fakeDriver) Mount(r volume.MountRequest) volume.Response     { return response(r.Name) }
+func (fakeDriver) Unmount(r volume.UnmountRequest) volume.Response { return response(r.Name) }
+func (fakeDriver) Capabilities(r volume.Request) volume.Response   { return volume.Response{} }
+
+func scrape(t *testing.T, addr string) string {
+	resp, err := http.Get("http://" + addr + metrics.MetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, resp.Header.Get("Content-Type"), "version=0.0.4")
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	counter := metrics.NewCounterVec("test_total", "A test counter.", "op")
+	counter.Inc("a")
+	counter.Add(2, `quo"te`)
+	assert.Equal(t, counter, metrics.NewCounterVec("test_total", "Registered again.", "op"))
+	assert.Equal(t, 1.0, counter.Value("a"))
+
+	histogram := metrics.NewHistogramVec("test_seconds", "A test histogram.", []float64{1, 5})
+	histogram.Observe(0.5)
+	histogram.Observe(3)
+	histogram.Observe(10)
+
+	metrics.NewGaugeFunc("test_gauge", "A test gauge.", []string{"volume"}, func() []metrics.Sample {
+		return []metrics.Sample{{LabelValues: []string{"vol2"}, Value: 2}, {LabelValues: []string{"vol1"}, Value: 1}}
+	})
+
+	driver := metrics.InstrumentDriver("test", fakeDriver{})
+	driver.Mount(volume.MountRequest{Name: "good"})
+	driver.Mount(volume.MountRequest{Name: "bad"})
+	driver.Capabilities(volume.Request{})
+
+	addr, err := metrics.StartServer("127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	body := scrape(t, addr)
+
+	assert.Contains(t, body, "# HELP vdvs_test_total A test counter.\n# TYPE vdvs_test_total counter\n"+
+		"vdvs_test_total{op=\"a\"} 1\nvdvs_test_total{op=\"quo\\\"te\"} 2\n")
+	assert.Contains(t, body, "# TYPE vdvs_test_seconds histogram\n"+
+		"vdvs_test_seconds_bucket{le=\"1\"} 1\nvdvs_test_seconds_bucket{le=\"5\"} 2\n"+
+		"vdvs_test_seconds_bucket{le=\"+Inf\"} 3\nvdvs_test_seconds_sum 13.5\nvdvs_test_seconds_count 3\n")
+	assert.Contains(t, body, "# TYPE vdvs_test_gauge gauge\n"+
+		"vdvs_test_gauge{volume=\"vol1\"} 1\nvdvs_test_gauge{volume=\"vol2\"} 2\n")
+	assert.Contains(t, body, "vdvs_plugin_requests_total{driver=\"test\",request=\"Mount\",result=\"error\"} 1\n")
+	assert.Contains(t, body, "vdvs_plugin_requests_total{driver=\"test\",request=\"Mount\",result=\"success\"} 1\n")
+	assert.Contains(t, body, "vdvs_plugin_request_duration_seconds_count{driver=\"test\",request=\"Mount\"} 2\n")
+	assert.NotContains(t, body, "Capabilities")
+}
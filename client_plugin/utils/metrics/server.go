@@ -0,0 +1,54 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+// HTTP endpoint serving the metrics to Prometheus.
+
+import (
+	"net"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// MetricsPath is the URL path metrics are served on
+const MetricsPath = "/metrics"
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Handler returns an http.Handler writing out all metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		defaultRegistry.write(w)
+	})
+}
+
+// StartServer serves metrics on MetricsPath at addr (host:port) in the background.
+// Returns the address listened on, which differs from addr if the port is 0.
+func StartServer(addr string) (string, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, Handler())
+	go func() {
+		err := http.Serve(listener, mux)
+		log.WithFields(log.Fields{"address": addr, "error": err}).Warning("Metrics server stopped ")
+	}()
+	log.WithFields(log.Fields{"address": listener.Addr()}).Info("Serving metrics ")
+	return listener.Addr().String(), nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin_server
+
+// Tracks the requests in progress in a volume driver, so that shutdown can wait
+// for them. Once draining, requests changing volumes are refused.
+
+import (
+	"sync"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+const shuttingDownError = "Plugin is shutting down, retry once it restarts"
+
+// drainingDriver wraps a volume.Driver
+type drainingDriver struct {
+	driver   volume.Driver
+	mtx      sync.Mutex
+	draining bool
+	inFlight int
+	idle     chan struct{} // closed once draining with no request in progress
+}
+
+func newDrainingDriver(driver volume.Driver) *drainingDriver {
+	return &drainingDriver{driver: driver}
+}
+
+// enter counts a request in progress, returns false if draining
+func (d *drainingDriver) enter(refuse bool) bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.draining && refuse {
+		return false
+	}
+	d.inFlight++
+	return true
+}
+
+// leave ends a request counted by enter
+func (d *drainingDriver) leave() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.inFlight--
+	d.checkIdle()
+}
+
+// checkIdle closes d.idle once draining and no request is in progress.
+// Reads are still let in while draining, so it may get there more than once.
+// Caller holds the lock.
+func (d *drainingDriver) checkIdle() {
+	if !d.draining || d.inFlight != 0 {
+		return
+	}
+	select {
+	case <-d.idle:
+	default:
+		close(d.idle)
+	}
+}
+
+// drain refuses new requests changing volumes and waits for the requests in
+// progress, for up to timeout. Returns false if some are still in progress.
+func (d *drainingDriver) drain(timeout time.Duration) bool {
+	d.mtx.Lock()
+	if !d.draining {
+		d.draining = true
+		d.idle = make(chan struct{})
+		d.checkIdle()
+	}
+	idle := d.idle
+	d.mtx.Unlock()
+
+	select {
+	case <-idle:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Create - see volume.Driver
+func (d *drainingDriver) Create(r volume.Request) volume.Response {
+	if !d.enter(true) {
+		return volume.Response{Err: shuttingDownError}
+	}
+	defer d.leave()
+	return d.driver.Create(r)
+}
+
+// List - see volume.Driver
+func (d *drainingDriver) List(r volume.Request) volume.Response {
+	d.enter(false)
+	defer d.leave()
+	return d.driver.List(r)
+}
+
+// Get - see volume.Driver
+func (d *drainingDriver) Get(r volume.Request) volume.Response {
+	d.enter(false)
+	defer d.leave()
+	return d.driver.Get(r)
+}
+
+// Remove - see volume.Driver
+func (d *drainingDriver) Remove(r volume.Request) volume.Response {
+	if !d.enter(true) {
+		return volume.Response{Err: shuttingDownError}
+	}
+	defer d.leave()
+	return d.driver.Remove(r)
+}
+
+// Path - see volume.Driver
+func (d *drainingDriver) Path(r volume.Request) volume.Response {
+	d.enter(false)
+	defer d.leave()
+	return d.driver.Path(r)
+}
+
+// Mount - see volume.Driver
+func (d *drainingDriver) Mount(r volume.MountRequest) volume.Response {
+	if !d.enter(true) {
+		return volume.Response{Err: shuttingDownError}
+	}
+	defer d.leave()
+	return d.driver.Mount(r)
+}
+
+// Unmount - see volume.Driver
+func (d *drainingDriver) Unmount(r volume.UnmountRequest) volume.Response {
+	if !d.enter(true) {
+		return volume.Response{Err: shuttingDownError}
+	}
+	defer d.leave()
+	return d.driver.Unmount(r)
+}
+
+// Capabilities - see volume.Driver
+func (d *drainingDriver) Capabilities(r volume.Request) volume.Response {
+	return d.driver.Capabilities(r)
+}
@@ -0,0 +1,63 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin_server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingDriver holds Mount until released
+type blockingDriver struct {
+	volume.Driver
+	mounting chan struct{}
+	release  chan struct{}
+}
+
+func (d *blockingDriver) Mount(r volume.MountRequest) volume.Response {
+	close(d.mounting)
+	<-d.release
+	return volume.Response{Mountpoint: "/mnt/" + r.Name}
+}
+
+func (d *blockingDriver) Get(r volume.Request) volume.Response {
+	return volume.Response{}
+}
+
+func TestDrain(t *testing.T) {
+	backend := &blockingDriver{mounting: make(chan struct{}), release: make(chan struct{})}
+	d := newDrainingDriver(backend)
+
+	mounted := make(chan volume.Response)
+	go func() { mounted <- d.Mount(volume.MountRequest{Name: "vol"}) }()
+	<-backend.mounting
+
+	// The mount in progress holds up the drain
+	assert.False(t, d.drain(10*time.Millisecond))
+	assert.Equal(t, shuttingDownError, d.Create(volume.Request{Name: "vol2"}).Err)
+	assert.Equal(t, shuttingDownError, d.Unmount(volume.UnmountRequest{Name: "vol"}).Err)
+	assert.Empty(t, d.Get(volume.Request{Name: "vol"}).Err, "Reads are still served")
+
+	close(backend.release)
+	assert.Equal(t, "/mnt/vol", (<-mounted).Mountpoint)
+	assert.True(t, d.drain(time.Second))
+
+	// Reads served once drained leave it drained
+	assert.Empty(t, d.Get(volume.Request{Name: "vol"}).Err)
+	assert.True(t, d.drain(time.Second))
+}
@@ -14,37 +14,111 @@
 
 package plugin_server
 
+// Plugin server, with graceful shutdown and configuration reload.
+//
+// On SIGINT or SIGTERM the server stops accepting connections, waits for the
+// requests in progress for up to ShutdownTimeoutSec, and has the driver save
+// its state (optionally unmounting idle volumes) before exiting.
+// On SIGHUP the config file is reloaded: log level and format apply to all
+// drivers, other settings to drivers implementing Reloader.
+
 import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/codecov"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
 )
 
 // PluginServer responds to HTTP requests from Docker.
 type PluginServer interface {
 	// Init initializes the server.
 	Init()
+	// Stop stops accepting requests.
+	Stop()
 	// Destroy destroys the server.
 	Destroy()
 }
 
-// StartServer starts a plugin server based on runtime OS
-func StartServer(driverName string, driver *volume.Driver) {
-	server := NewPluginServer(driverName, driver)
+// Stopper is implemented by drivers with state to save on shutdown
+type Stopper interface {
+	// Shutdown saves the driver state, unmounting volumes not used
+	// by any container if detachIdle is set
+	Shutdown(detachIdle bool)
+}
+
+// Reloader is implemented by drivers applying a reloaded configuration
+type Reloader interface {
+	Reload(cfg config.Config)
+}
+
+// StartServer starts a plugin server based on runtime OS, serving driver.
+// backend is the driver implementation behind any wrappers of driver, it is
+// notified on shutdown and configuration reload.
+func StartServer(cfg config.Config, driver *volume.Driver, backend volume.Driver) {
+	draining := newDrainingDriver(*driver)
+	var served volume.Driver = draining
+	server := NewPluginServer(cfg.Driver, &served)
+	stopping := make(chan struct{})
 
 	sigChannel := make(chan os.Signal, 1)
-	signal.Notify(sigChannel, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
-		sig := <-sigChannel
-		log.WithFields(log.Fields{"signal": sig}).Warning("Received signal ")
-		coverage.Capture()
-		server.Destroy()
-		os.Exit(0)
+		for sig := range sigChannel {
+			log.WithFields(log.Fields{"signal": sig}).Warning("Received signal ")
+			if sig == syscall.SIGHUP {
+				cfg = reload(cfg, backend)
+				continue
+			}
+			close(stopping)
+			shutdown(cfg, server, draining, backend)
+			os.Exit(0)
+		}
 	}()
 
 	server.Init()
+	select {
+	case <-stopping:
+		// Stopped by a signal, wait for the shutdown to complete
+		select {}
+	default:
+	}
+}
+
+// shutdown stops the server once requests in progress are done
+func shutdown(cfg config.Config, server PluginServer, draining *drainingDriver, backend volume.Driver) {
+	server.Stop()
+	timeout := cfg.ShutdownTimeoutSec
+	if timeout <= 0 {
+		timeout = config.DefaultShutdownTimeoutSec
+	}
+	if !draining.drain(time.Duration(timeout) * time.Second) {
+		log.WithFields(log.Fields{"timeout sec": timeout}).Warning("Requests still in progress, shutting down anyway ")
+	}
+	if s, ok := backend.(Stopper); ok {
+		s.Shutdown(cfg.DetachIdleOnShutdown)
+	}
+	coverage.Capture()
+	server.Destroy()
+	log.Info("Plugin stopped")
+}
+
+// reload reloads the config file, returns the configuration now in effect
+func reload(cfg config.Config, backend volume.Driver) config.Config {
+	newCfg, err := config.Reload(cfg)
+	if err != nil {
+		log.WithFields(log.Fields{"file": cfg.ConfigFile, "error": err}).Warning("Failed to reload config, keeping the current one ")
+		return cfg
+	}
+	if r, ok := backend.(Reloader); ok {
+		r.Reload(newCfg)
+	}
+	// Settings given on the command line are not in the file, keep them
+	cfg.ShutdownTimeoutSec = newCfg.ShutdownTimeoutSec
+	cfg.DetachIdleOnShutdown = newCfg.DetachIdleOnShutdown
+	return cfg
 }
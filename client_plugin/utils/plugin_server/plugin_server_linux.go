@@ -18,10 +18,12 @@ package plugin_server
 // relies on the docker/go-plugins-helpers/volume API.
 
 import (
+	"net"
 	"os"
 	"path/filepath"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-connections/sockets"
 	"github.com/docker/go-plugins-helpers/volume"
 )
 
@@ -33,6 +35,7 @@ type SockPluginServer struct {
 	PluginServer
 	sockAddr string         // Server's unix sock address
 	driver   *volume.Driver // The driver implementation
+	listener net.Listener   // The unix sock listener
 }
 
 // An equivalent function is not exported from the SDK.
@@ -55,14 +58,32 @@ func NewPluginServer(driverName string, driver *volume.Driver) *SockPluginServer
 func (s *SockPluginServer) Init() {
 	handler := volume.NewHandler(*s.driver)
 
+	// The listener is created here rather than by the SDK, to close it on Stop
+	var err error
+	if err = os.MkdirAll(pluginSockDir, 0755); err == nil {
+		s.listener, err = sockets.NewUnixSocket(s.sockAddr, "root")
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"address": s.sockAddr, "err": err}).Error("Failed to listen on Unix socket ")
+		return
+	}
+
 	log.WithFields(log.Fields{
 		"address": s.sockAddr,
-	}).Info("Going into ServeUnix - Listening on Unix socket ")
+	}).Info("Going into Serve - Listening on Unix socket ")
+
+	log.Info(handler.Serve(s.listener))
+}
 
-	log.Info(handler.ServeUnix("root", s.sockAddr))
+// Stop closes the Docker plugin sock, no new requests are accepted.
+func (s *SockPluginServer) Stop() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
 }
 
 // Destroy removes the Docker plugin sock.
 func (s *SockPluginServer) Destroy() {
+	s.Stop()
 	os.Remove(s.sockAddr)
 }
@@ -95,9 +95,16 @@ func (s *NpipePluginServer) Init() {
 	log.Info(handler.Serve(s.listener))
 }
 
+// Stop shuts down the npipe listener, no new requests are accepted.
+func (s *NpipePluginServer) Stop() {
+	if s.listener != nil {
+		log.WithFields(log.Fields{"npipe": npipeAddr}).Info("Closing npipe listener ")
+		s.listener.Close()
+	}
+}
+
 // Destroy shuts down the npipe listener.
 func (s *NpipePluginServer) Destroy() {
-	log.WithFields(log.Fields{"npipe": npipeAddr}).Info("Closing npipe listener ")
-	s.listener.Close()
+	s.Stop()
 	ps.Exit()
 }
@@ -17,11 +17,12 @@ package plugin_utils
 // This file holds utility/helper methods required in plugin module
 
 import (
+	"context"
 	"strings"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
 )
 
 const (
@@ -41,8 +42,8 @@ type VolumeInfo struct {
 }
 
 // AlreadyMounted - check if volume is already mounted on the mountRoot
-func AlreadyMounted(name string, mountRoot string) bool {
-	volumeMap, err := fs.GetMountInfo(mountRoot)
+func AlreadyMounted(ctx context.Context, name string, mountRoot string) bool {
+	volumeMap, err := fs.GetMountInfo(ctx, mountRoot)
 
 	if err != nil {
 		return false
@@ -67,7 +68,7 @@ func IsFullVolName(volName string) bool {
 // GetVolumeInfo - return VolumeInfo with a qualified volume name.
 // Optionally returns datastore and volume metadata if retrieved from ESX.
 // If Volume Metadata is nil then caller can use getVolume()
-func GetVolumeInfo(name string, datastoreName string, d drivers.VolumeDriver) (*VolumeInfo, error) {
+func GetVolumeInfo(ctx context.Context, name string, datastoreName string, d drivers.VolumeDriver) (*VolumeInfo, error) {
 	// if fullname already, return
 	if IsFullVolName(name) {
 		return &VolumeInfo{name, "", nil}, nil
@@ -81,7 +82,7 @@ func GetVolumeInfo(name string, datastoreName string, d drivers.VolumeDriver) (*
 	// Do a get trip to esx and construct full name
 	volumeMeta, err := d.GetVolume(name)
 	if err != nil {
-		log.Errorf("Unable to get volume metadata %s (err: %v)", name, err)
+		requestid.Log(ctx).Errorf("Unable to get volume metadata %s (err: %v)", name, err)
 		return nil, err
 	}
 	datastoreName = volumeMeta[datastoreKey].(string)
@@ -0,0 +1,296 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package refcount
+
+//
+// Continuous refcount reconciliation.
+//
+// Refcounts are discovered from Docker on plugin start only. If Docker misses
+// an Unmount (container killed while Docker is down, daemon crash), the volume
+// stays mounted and attached until the plugin restarts. The reconciler compares
+// refcounts, the container mounts known to Docker and the mounts under the
+// mount root periodically and on container die/destroy/start events, and
+// repairs the differences.
+//
+// Docker lists a container as running only once its volumes are mounted, so
+// refcounts and Docker differ for a moment whenever a container starts or
+// stops. A difference is repaired only if it is unchanged after reconcileGrace.
+//
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/events"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/metrics"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
+	"golang.org/x/net/context"
+)
+
+const (
+	// Time a difference must persist before it is repaired
+	reconcileGrace = 30 * time.Second
+	// Delay before talking to Docker again after a failure
+	dockerRetryDelay = 10 * time.Second
+
+	// Corrections made by the reconciler, as metric labels
+	correctRefcount = "refcount"
+	correctUnmount  = "unmount"
+	correctMount    = "mount"
+	correctDetach   = "detach"
+)
+
+// Container events which change volume usage
+var containerEvents = []string{"start", "die", "destroy"}
+
+var corrections = metrics.NewCounterVec("refcount_corrections_total",
+	"Refcount and mount corrections made by the refcount reconciler.", "action")
+
+// mismatch is a difference between the plugin and Docker for a volume
+type mismatch struct {
+	count       uint // refcount
+	dockerCount uint // containers using the volume, per Docker
+	mounted     bool // mounted under the mount root
+	firstSeen   time.Time
+}
+
+// StartReconciler reconciles refcounts with Docker in the background, every
+// intervalSec seconds and on container events. A zero interval uses
+// config.DefaultRefCountReconcileSec, a negative one disables reconciliation.
+// Init must have been called.
+func (r *RefCountsMap) StartReconciler(intervalSec int) {
+	if intervalSec == 0 {
+		intervalSec = config.DefaultRefCountReconcileSec
+	}
+	if intervalSec < 0 || r.driver == nil {
+		return
+	}
+	c, err := client.NewClient(DockerHostAddr, ApiVersion, nil, defaultHeaders)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Warning("Failed to create Docker client, refcounts are not reconciled ")
+		return
+	}
+	trigger := make(chan struct{}, 1)
+	go r.watchEvents(c, trigger)
+	go r.reconcileLoop(c, time.Duration(intervalSec)*time.Second, trigger)
+	log.WithFields(log.Fields{"interval": intervalSec}).Info("Refcount reconciler started ")
+}
+
+// reconcileLoop runs reconciliation passes until the process exits
+func (r *RefCountsMap) reconcileLoop(c *client.Client, interval time.Duration, trigger <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var recheck <-chan time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case <-trigger:
+		case <-recheck:
+		}
+		ctx := requestid.Background()
+		pending, err := r.reconcile(ctx, c)
+		if err != nil {
+			requestid.Log(ctx).WithFields(log.Fields{"error": err}).Warning("Refcount reconciliation failed ")
+		}
+		// Come back once pending differences are due, rather than on the next tick
+		recheck = nil
+		if pending {
+			recheck = time.After(reconcileGrace)
+		}
+	}
+}
+
+// watchEvents triggers a reconciliation pass on container events
+func (r *RefCountsMap) watchEvents(c *client.Client, trigger chan<- struct{}) {
+	args := filters.NewArgs()
+	args.Add("type", events.ContainerEventType)
+	for _, action := range containerEvents {
+		args.Add("event", action)
+	}
+	for {
+		err := readEvents(c, args, trigger)
+		log.WithFields(log.Fields{"error": err}).Warning("Lost Docker events, subscribing again ")
+		time.Sleep(dockerRetryDelay)
+	}
+}
+
+// readEvents reads container events until the stream fails
+func readEvents(c *client.Client, args filters.Args, trigger chan<- struct{}) error {
+	body, err := c.Events(context.Background(), types.EventsOptions{Filters: args})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	decoder := json.NewDecoder(body)
+	for {
+		var msg events.Message
+		if err = decoder.Decode(&msg); err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{"container": msg.Actor.ID, "action": msg.Action}).Debug("Container event ")
+		// A pass is pending already if the channel is full
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// reconcile runs one reconciliation pass. Returns true if differences are
+// waiting for the grace period to pass.
+func (r *RefCountsMap) reconcile(ctx context.Context, c *client.Client) (bool, error) {
+	if !r.IsInitialized() {
+		// Discovery is in progress, and repairs the same things
+		return false, nil
+	}
+	r.mtx.RLock()
+	generation := r.generation
+	r.mtx.RUnlock()
+
+	dockerCounts, err := dockerRefCounts(ctx, c, r.driver)
+	if err != nil {
+		return false, err
+	}
+
+	// Mount and unmount wait for repairs to complete
+	r.StateMtx.Lock()
+	defer r.StateMtx.Unlock()
+	if !r.IsInitialized() {
+		return false, nil
+	}
+	mounts, err := fs.GetMountInfo(ctx, mountRoot)
+	if err != nil {
+		return false, err
+	}
+
+	r.mtx.Lock()
+	if r.generation != generation {
+		// Refcounts changed while Docker was queried, check again later
+		r.mtx.Unlock()
+		return true, nil
+	}
+	due := r.findMismatches(dockerCounts, mounts, time.Now())
+	pending := len(r.mismatches) != 0
+	r.mtx.Unlock()
+
+	for vol, m := range due {
+		r.correct(ctx, vol, m)
+	}
+	if len(due) != 0 {
+		r.SaveState()
+	}
+	return pending, nil
+}
+
+// findMismatches records differences between refcounts, Docker and mounts,
+// and returns those which persisted for reconcileGrace. Caller holds mtx.
+func (r *RefCountsMap) findMismatches(dockerCounts map[string]uint, mounts map[string]string, now time.Time) map[string]mismatch {
+	vols := make(map[string]bool)
+	for vol := range r.refMap {
+		vols[vol] = true
+	}
+	for vol := range dockerCounts {
+		vols[vol] = true
+	}
+	for vol := range mounts {
+		vols[vol] = true
+	}
+	for vol := range r.mismatches {
+		vols[vol] = true
+	}
+
+	due := make(map[string]mismatch)
+	for vol := range vols {
+		m := mismatch{dockerCount: dockerCounts[vol], firstSeen: now}
+		if rc := r.refMap[vol]; rc != nil {
+			m.count = rc.count
+		}
+		_, m.mounted = mounts[vol]
+		if m.count == m.dockerCount && m.mounted == (m.count > 0) {
+			delete(r.mismatches, vol)
+			continue
+		}
+
+		prev, ok := r.mismatches[vol]
+		if ok && prev.count == m.count && prev.dockerCount == m.dockerCount && prev.mounted == m.mounted {
+			m.firstSeen = prev.firstSeen
+		}
+		if now.Sub(m.firstSeen) < reconcileGrace {
+			r.mismatches[vol] = m
+			continue
+		}
+		delete(r.mismatches, vol)
+		due[vol] = m
+	}
+	return due
+}
+
+// correct sets the refcount of the volume to what Docker sees, and mounts,
+// unmounts or detaches the volume to match. Caller holds StateMtx.
+func (r *RefCountsMap) correct(ctx context.Context, vol string, m mismatch) {
+	f := log.Fields{
+		"name":          vol,
+		"refcnt":        m.count,
+		"docker refcnt": m.dockerCount,
+		"mounted":       m.mounted,
+		"since":         m.firstSeen,
+	}
+	requestid.Log(ctx).WithFields(f).Warning("Refcount out of sync with Docker, correcting ")
+
+	r.mtx.Lock()
+	if m.dockerCount == 0 {
+		delete(r.refMap, vol)
+		r.forgetMountIDs(vol)
+	} else {
+		rc := r.refMap[vol]
+		if rc == nil {
+			rc = newRefCount()
+			r.refMap[vol] = rc
+		}
+		rc.count = m.dockerCount
+		rc.mounted = true
+	}
+	r.generation++
+	r.mtx.Unlock()
+	if m.count != m.dockerCount {
+		corrections.Inc(correctRefcount)
+	}
+
+	var err error
+	switch {
+	case m.dockerCount == 0 && m.mounted:
+		// Leaked mount, e.g. Docker missed the Unmount
+		corrections.Inc(correctUnmount)
+		err = r.driver.UnmountVolume(vol)
+	case m.dockerCount == 0 && m.count > 0:
+		// Unmounted out of band, the volume may still be attached
+		corrections.Inc(correctDetach)
+		err = r.driver.DetachVolume(vol)
+		fs.Rmdir(strings.Join([]string{mountRoot, vol}, "/"))
+	case m.dockerCount > 0 && !m.mounted:
+		corrections.Inc(correctMount)
+		err = recoveryMount(ctx, r.driver, vol)
+	}
+	if err != nil {
+		requestid.Log(ctx).WithFields(f).WithField("error", err).Warning("Correction failed - manual recovery may be needed ")
+	}
+}
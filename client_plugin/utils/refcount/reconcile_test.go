@@ -0,0 +1,103 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package refcount
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// recordingDriver records the recovery calls made by the reconciler
+type recordingDriver struct {
+	calls []string
+}
+
+func (d *recordingDriver) MountVolume(name string, fstype string, id string, isReadOnly bool, skipAttach bool, mountOptions string) (string, error) {
+	d.calls = append(d.calls, "mount "+name)
+	return "", nil
+}
+
+func (d *recordingDriver) UnmountVolume(name string) error {
+	d.calls = append(d.calls, "unmount "+name)
+	return nil
+}
+
+func (d *recordingDriver) GetVolume(name string) (map[string]interface{}, error) {
+	return map[string]interface{}{"fstype": "ext4"}, nil
+}
+
+func (d *recordingDriver) DetachVolume(name string) error {
+	d.calls = append(d.calls, "detach "+name)
+	return nil
+}
+
+func TestReconcileCorrections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mountRoot = dir
+
+	d := &recordingDriver{}
+	r := NewRefCountsMap()
+	r.driver = d
+	r.mismatches = make(map[string]mismatch)
+	for _, vol := range []string{"ok@ds", "leaked@ds", "lost@ds", "unmounted@ds", "missed@ds"} {
+		r.Incr(vol)
+	}
+	r.Incr("missed@ds")
+
+	docker := map[string]uint{"ok@ds": 1, "lost@ds": 1, "missed@ds": 1, "starting@ds": 1}
+	mounts := map[string]string{"ok@ds": "/dev/sdb", "leaked@ds": "/dev/sdc", "missed@ds": "/dev/sdd",
+		"stale@ds": "/dev/sde"}
+
+	// Nothing is corrected within the grace period
+	now := time.Now()
+	r.mtx.Lock()
+	due := r.findMismatches(docker, mounts, now)
+	r.mtx.Unlock()
+	assert.Empty(t, due)
+	assert.Len(t, r.mismatches, 6)
+
+	// A volume back in sync is forgotten, a changed difference starts over
+	delete(docker, "starting@ds")
+	docker["missed@ds"] = 3
+	r.mtx.Lock()
+	due = r.findMismatches(docker, mounts, now.Add(reconcileGrace))
+	r.mtx.Unlock()
+	var names []string
+	for vol, m := range due {
+		names = append(names, vol)
+		r.correct(context.Background(), vol, m)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"leaked@ds", "lost@ds", "stale@ds", "unmounted@ds"}, names)
+	assert.Len(t, r.mismatches, 1)
+	sort.Strings(d.calls)
+	assert.Equal(t, []string{"detach unmounted@ds", "mount lost@ds", "unmount leaked@ds", "unmount stale@ds"}, d.calls)
+
+	assert.Equal(t, uint(1), r.GetCount("ok@ds"))
+	assert.Equal(t, uint(1), r.GetCount("lost@ds"))
+	assert.Equal(t, uint(2), r.GetCount("missed@ds"))
+	assert.Equal(t, uint(0), r.GetCount("leaked@ds"))
+	assert.Equal(t, uint(0), r.GetCount("unmounted@ds"))
+}
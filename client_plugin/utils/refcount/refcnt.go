@@ -39,7 +39,9 @@
 //   and actual mounts are in sync.
 //
 // The process is initiated on plugin start,and ONLY if Docker is already
-// running and thus answering client.Info() request.
+// running and thus answering client.Info() request. Afterwards, the same
+// comparison keeps running in the background (see reconcile.go) to correct
+// mounts leaked while the plugin is running.
 //
 // After refcount discovery, results are compared to fs.GetMountInfo() content.
 //
@@ -48,6 +50,10 @@
 // on Windows, and  will unmount stuff there at will - this place SHOULD NOT be
 // used for manual mounts.
 //
+// Encrypted volumes are mounted from their /dev/mapper/vdvs-<volume_name> LUKS
+// mapping, which fs.GetMountInfo() reports instead of /dev/dm-N. The driver closes
+// the mapping on unmount and detach, so recovery needs no special handling for them.
+//
 // If a volume IS mounted, but should not be (refcount = 0)
 //   - we assume there was a restart of VM or even ESX, and
 //     the mount is stale (since Docker does not need it)
@@ -63,6 +69,9 @@
 // mountspoint of view the volume is not used, but the VMDK is still attached
 // to the VM) - we leave it to manual recovery.
 //
+// If a state file is set, refcounts saved by the previous plugin run are used
+// right away instead, and validated against Docker in the background (see state.go).
+//
 // The RefCountsMap is safe to be used by multiple goroutines and has a single
 // RWMutex to serialize operations on the map and refCounts.
 // The serialization of operations per volume is assured by the volume/store
@@ -83,7 +92,9 @@ import (
 	"github.com/docker/engine-api/types/filters"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/metrics"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/plugin_utils"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
 	"golang.org/x/net/context"
 )
 
@@ -109,6 +120,10 @@ type refCount struct {
 	// Volume is mounted from this device. Used on recovery only , for info
 	// purposes. Value is empty during normal operation
 	dev string
+
+	// Time the first reference was counted, i.e. the volume was mounted,
+	// or the time it was found mounted on recovery
+	since time.Time
 }
 
 // RefCountsMap struct
@@ -119,6 +134,29 @@ type RefCountsMap struct {
 	refcntInitSuccess bool        // save refcounting success
 	isDirty           bool        // flag to check reconciling has been interrupted
 	StateMtx          *sync.Mutex // (Exported) Synchronizes refcounting between mount/unmount and refcounting thread
+
+	// Saved by Init for Resync and recovery requests
+	driver   drivers.VolumeDriver
+	mountDir string
+	name     string
+
+	// Bumped on every refcount change, so the reconciler can tell
+	// if refcounts changed while it was querying Docker
+	generation uint64
+	// Differences found by the reconciler, waiting for the grace period
+	mismatches map[string]mismatch
+
+	// Refcounts and mountIDs are saved to stateFile, if set
+	stateFile string
+	mountIDs  map[string]string
+}
+
+// RefCountInfo is the refcount of a volume as reported by Dump
+type RefCountInfo struct {
+	Count   uint
+	Mounted bool
+	Dev     string
+	Since   time.Time
 }
 
 var (
@@ -141,8 +179,9 @@ func init() {
 // NewRefCountsMap - creates a new RefCountsMap
 func NewRefCountsMap() *RefCountsMap {
 	return &RefCountsMap{
-		refMap: make(map[string]*refCount),
-		mtx:    &sync.RWMutex{},
+		refMap:     make(map[string]*refCount),
+		mtx:        &sync.RWMutex{},
+		mismatches: make(map[string]mismatch),
 
 		StateMtx:          &sync.Mutex{},
 		isDirty:           false,
@@ -154,6 +193,7 @@ func NewRefCountsMap() *RefCountsMap {
 func newRefCount() *refCount {
 	return &refCount{
 		count: 0,
+		since: time.Now(),
 	}
 }
 
@@ -172,16 +212,151 @@ func (r *RefCountsMap) MarkDirty() {
 // tries to calculate refCounts for dvs volumes. If failed, triggers a timer
 // based reattempt to schedule scan after a delay
 func (r *RefCountsMap) Init(d drivers.VolumeDriver, mountDir string, name string) {
-	err := r.calculate(d, mountDir, name)
+	r.driver = d
+	r.mountDir = mountDir
+	r.name = name
+	r.registerMetrics()
+	ctx := requestid.Background()
+	if r.loadState(ctx) {
+		// Serve requests with the saved refcounts right away, and check them against Docker
+		mountRoot = mountDir
+		driverName = name
+		r.refcntInitSuccess = true
+		go r.validateState()
+		return
+	}
+	err := r.calculate(ctx, d, mountDir, name)
 	// If refcounting wasn't successful, schedule one again
 	if err != nil {
-		log.Infof("Refcounting failed: (%v).", err)
+		requestid.Log(ctx).Infof("Refcounting failed: (%v).", err)
 		go func() {
 			r.retryCalculate(d, mountDir, name)
 		}()
 	}
 }
 
+// Resync drops all refcounts and discovers them again from Docker, same as
+// on plugin start. Until refcounting completes, unmounts are delayed and
+// removes are refused. If it fails, it is retried in the background.
+func (r *RefCountsMap) Resync() error {
+	if r.driver == nil {
+		return fmt.Errorf("Refcounts are not initialized")
+	}
+	r.StateMtx.Lock()
+	r.refcntInitSuccess = false
+	r.mtx.Lock()
+	r.refMap = make(map[string]*refCount)
+	r.mtx.Unlock()
+	r.StateMtx.Unlock()
+
+	ctx := requestid.Background()
+	requestid.Log(ctx).Info("Resyncing refcounts")
+	err := r.calculate(ctx, r.driver, r.mountDir, r.name)
+	if err != nil {
+		requestid.Log(ctx).Infof("Refcounting failed: (%v).", err)
+		go func() {
+			r.retryCalculate(r.driver, r.mountDir, r.name)
+		}()
+	}
+	return err
+}
+
+// ForceUnmount unmounts and detaches the volume whatever its refcount,
+// and drops the refcount. Caller holds StateMtx.
+func (r *RefCountsMap) ForceUnmount(vol string) error {
+	if r.driver == nil {
+		return fmt.Errorf("Refcounts are not initialized")
+	}
+	r.mtx.Lock()
+	delete(r.refMap, vol)
+	r.mtx.Unlock()
+	return r.driver.UnmountVolume(vol)
+}
+
+// ForceDetach detaches the volume, which should not be mounted. Caller holds StateMtx.
+func (r *RefCountsMap) ForceDetach(vol string) error {
+	if r.driver == nil {
+		return fmt.Errorf("Refcounts are not initialized")
+	}
+	if r.GetCount(vol) != 0 {
+		return fmt.Errorf("Volume %s is in use (refcount=%d), unmount it instead", vol, r.GetCount(vol))
+	}
+	return r.driver.DetachVolume(vol)
+}
+
+// Shutdown saves the refcounts for the next plugin start. If detachIdle is
+// set, volumes mounted under the mount root which no container uses are
+// unmounted and detached first.
+func (r *RefCountsMap) Shutdown(detachIdle bool) {
+	r.StateMtx.Lock()
+	defer r.StateMtx.Unlock()
+	if detachIdle && r.IsInitialized() && r.driver != nil {
+		ctx := requestid.Background()
+		mounts, err := fs.GetMountInfo(ctx, mountRoot)
+		if err != nil {
+			requestid.Log(ctx).WithFields(log.Fields{"error": err}).Warning("Failed to get mounts, idle volumes are left attached ")
+		}
+		for vol := range mounts {
+			if r.GetCount(vol) != 0 {
+				continue
+			}
+			requestid.Log(ctx).WithFields(log.Fields{"name": vol}).Info("Detaching idle volume ")
+			if err = r.driver.UnmountVolume(vol); err != nil {
+				requestid.Log(ctx).WithFields(log.Fields{"name": vol, "error": err}).Warning("Failed to detach idle volume ")
+			}
+		}
+	}
+	r.SaveState()
+}
+
+// Dump returns a copy of the refcounts, by volume
+func (r *RefCountsMap) Dump() map[string]RefCountInfo {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	result := make(map[string]RefCountInfo, len(r.refMap))
+	for name, cnt := range r.refMap {
+		if cnt != nil {
+			result[name] = RefCountInfo{Count: cnt.count, Mounted: cnt.mounted, Dev: cnt.dev, Since: cnt.since}
+		}
+	}
+	return result
+}
+
+// Get returns the refcount of the volume, false if it is not referred
+func (r *RefCountsMap) Get(vol string) (RefCountInfo, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	cnt := r.refMap[vol]
+	if cnt == nil {
+		return RefCountInfo{}, false
+	}
+	return RefCountInfo{Count: cnt.count, Mounted: cnt.mounted, Dev: cnt.dev, Since: cnt.since}, true
+}
+
+// registerMetrics exports the refcounts as gauges
+func (r *RefCountsMap) registerMetrics() {
+	metrics.NewGaugeFunc("volume_refcount", "Containers using a volume, as counted by the plugin.",
+		[]string{"volume"}, func() []metrics.Sample {
+			r.mtx.RLock()
+			defer r.mtx.RUnlock()
+			samples := make([]metrics.Sample, 0, len(r.refMap))
+			for name, cnt := range r.refMap {
+				if cnt != nil {
+					samples = append(samples, metrics.Sample{LabelValues: []string{name}, Value: float64(cnt.count)})
+				}
+			}
+			return samples
+		})
+	metrics.NewGaugeFunc("refcount_initialized", "1 once refcounts have been discovered from Docker.",
+		nil, func() []metrics.Sample {
+			value := 0.0
+			if r.IsInitialized() {
+				value = 1
+			}
+			return []metrics.Sample{{Value: value}}
+		})
+}
+
 // create a timer to calculate refcount after a delay. If failed, retry again
 // until retry attempt limit reached
 func (r *RefCountsMap) retryCalculate(d drivers.VolumeDriver, mountDir string, name string) {
@@ -189,13 +364,14 @@ func (r *RefCountsMap) retryCalculate(d drivers.VolumeDriver, mountDir string, n
 	delay := refCountDelayStartSec
 	for attemptLeft > 0 {
 		// generate a random delay everytime
-		log.Infof("Scheduling again after %d seconds", delay)
+		ctx := requestid.Background()
+		requestid.Log(ctx).Infof("Scheduling again after %d seconds", delay)
 		timer := time.NewTimer(time.Duration(delay) * time.Second)
 
 		<-timer.C
-		err := r.calculate(d, mountDir, driverName)
+		err := r.calculate(ctx, d, mountDir, driverName)
 		if err != nil {
-			log.Infof("Refcounting failed: (%v). Attempts left: %d ", err, attemptLeft)
+			requestid.Log(ctx).Infof("Refcounting failed: (%v). Attempts left: %d ", err, attemptLeft)
 			attemptLeft--
 			// exponential backoff
 			delay += delay
@@ -209,46 +385,46 @@ func (r *RefCountsMap) retryCalculate(d drivers.VolumeDriver, mountDir string, n
 }
 
 // calculate Refcounts. Discover volume usage refcounts from Docker.
-func (r *RefCountsMap) calculate(d drivers.VolumeDriver, mountDir string, name string) error {
+func (r *RefCountsMap) calculate(ctx context.Context, d drivers.VolumeDriver, mountDir string, name string) error {
 	c, err := client.NewClient(DockerHostAddr, ApiVersion, nil, defaultHeaders)
 	if err != nil {
-		log.Panicf("Failed to create client for Docker at %s.( %v)",
+		requestid.Log(ctx).Panicf("Failed to create client for Docker at %s.( %v)",
 			DockerHostAddr, err)
 	}
 	mountRoot = mountDir
 	driverName = name
 
-	log.Infof("Getting volume data from %s", DockerHostAddr)
+	requestid.Log(ctx).Infof("Getting volume data from %s", DockerHostAddr)
 
-	ctx, cancel := context.WithTimeout(context.Background(), dockerConnTimeoutSec*time.Second)
+	infoCtx, cancel := context.WithTimeout(ctx, dockerConnTimeoutSec*time.Second)
 	defer cancel()
-	info, err := c.Info(ctx)
+	info, err := c.Info(infoCtx)
 	if err != nil {
-		log.Infof("Can't connect to %s due to (%v), skipping discovery", DockerHostAddr, err)
+		requestid.Log(ctx).Infof("Can't connect to %s due to (%v), skipping discovery", DockerHostAddr, err)
 		return err
 	}
-	log.Debugf("Docker info: version=%s, root=%s, OS=%s",
+	requestid.Log(ctx).Debugf("Docker info: version=%s, root=%s, OS=%s",
 		info.ServerVersion, info.DockerRootDir, info.OperatingSystem)
 
 	// connects (and polls if needed) and then calls discovery
-	err = r.discoverAndSync(c, d)
+	err = r.discoverAndSync(ctx, c, d)
 	if err != nil {
-		log.Errorf("Failed to discover mount refcounts(%v)", err)
+		requestid.Log(ctx).Errorf("Failed to discover mount refcounts(%v)", err)
 		return err
 	}
 
 	// RLocks the RefCountsMap
 	r.mtx.RLock()
 	defer r.mtx.RUnlock()
-	log.Infof("Discovered %d volumes that may be in use.", len(r.refMap))
+	requestid.Log(ctx).Infof("Discovered %d volumes that may be in use.", len(r.refMap))
 	for name, cnt := range r.refMap {
 		if cnt != nil {
-			log.Infof("Volume name=%s count=%d mounted=%t device='%s'",
+			requestid.Log(ctx).Infof("Volume name=%s count=%d mounted=%t device='%s'",
 				name, cnt.count, cnt.mounted, cnt.dev)
 		}
 	}
 
-	log.Infof("Refcounting successfully completed")
+	requestid.Log(ctx).Infof("Refcounting successfully completed")
 	return nil
 }
 
@@ -278,13 +454,14 @@ func (r *RefCountsMap) Incr(vol string) uint {
 		r.refMap[vol] = rc
 	}
 	rc.count++
+	r.generation++
 	return rc.count
 }
 
 // Decr recfcount for the volume vol and returns the new count
 // returns -1  for error (and resets count to 0)
 // also deletes the node from the map if refcount drops to 0
-func (r *RefCountsMap) Decr(vol string) (uint, error) {
+func (r *RefCountsMap) Decr(ctx context.Context, vol string) (uint, error) {
 	// Locks the RefCountsMap
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
@@ -293,20 +470,21 @@ func (r *RefCountsMap) Decr(vol string) (uint, error) {
 	if rc == nil {
 		return 0, fmt.Errorf("Decr: Missing refcount. name=%s", vol)
 	}
+	r.generation++
 
 	if rc.count == 0 {
 		// we should NEVER get here. Even if Docker sends Unmount before Mount,
 		// it should be caught in previous check. So delete the entry (in case
 		// someone upstairs does 'recover', and panic.
 		delete(r.refMap, vol)
-		log.Warning("Decr: refcnt already 0 (rc.count=0), name=%s", vol)
+		requestid.Log(ctx).Warningf("Decr: refcnt already 0 (rc.count=0), name=%s", vol)
 		return 0, nil
 	}
 
 	rc.count--
 
 	if rc.count < 0 {
-		log.Warningf("Decr: Internal error, refcnt is negative. Trying to recover, deleting the counter - name=%s refcnt=%d", vol, rc.count)
+		requestid.Log(ctx).Warningf("Decr: Internal error, refcnt is negative. Trying to recover, deleting the counter - name=%s refcnt=%d", vol, rc.count)
 	}
 	// Deletes the refcount only if there are no references
 	if rc.count <= 0 {
@@ -342,89 +520,102 @@ func (r *RefCountsMap) checkDirty() bool {
 }
 
 // enumerates volumes and  builds RefCountsMap, then sync with mount info
-func (r *RefCountsMap) discoverAndSync(c *client.Client, d drivers.VolumeDriver) error {
+func (r *RefCountsMap) discoverAndSync(ctx context.Context, c *client.Client, d drivers.VolumeDriver) error {
 	// we assume to  have empty refcounts. Let's enforce
 
 	r.StateMtx.Lock()
 	r.isDirty = false
 	r.StateMtx.Unlock()
 
+	counts, err := dockerRefCounts(ctx, c, d)
+	if err != nil {
+		return err
+	}
+	if r.checkDirty() {
+		return fmt.Errorf("refcounting wasn't clean.")
+	}
+	for vol, count := range counts {
+		for i := uint(0); i < count; i++ {
+			r.Incr(vol)
+		}
+	}
+
+	// lock and check if the background refcount was dirtied.
+	// get mounts, remove unncessary mounts and set refcntInitSuccess
+	// under same lock to avoid races with parallel mount/unmount
+	r.StateMtx.Lock()
+	defer r.StateMtx.Unlock()
+	if r.isDirty == true {
+		// refcounting was dirtied by parallel mount/unmount.
+		return fmt.Errorf("refcounting wasn't clean.")
+	}
+
+	// Check that refcounts and actual mount info from Linux match
+	// If they don't, unmount unneeded stuff, or yell if something is
+	// not mounted but should be (it's error. we should not get there)
+	r.updateRefMap(ctx)
+	r.syncMountsWithRefCounters(ctx, d)
+	// mark reconciling success so that further unmounts can instantly be processed
+	r.refcntInitSuccess = true
+	r.SaveState()
+	return nil
+}
+
+// dockerRefCounts returns the number of running, paused or restarting
+// containers using each volume of the plugin, as Docker sees it
+func dockerRefCounts(ctx context.Context, c *client.Client, d drivers.VolumeDriver) (map[string]uint, error) {
 	filters := filters.NewArgs()
 	filters.Add("status", "running")
 	filters.Add("status", "paused")
 	filters.Add("status", "restarting")
 
-	ctx, cancel := context.WithTimeout(context.Background(), dockerConnTimeoutSec*time.Second)
+	listCtx, cancel := context.WithTimeout(ctx, dockerConnTimeoutSec*time.Second)
 	defer cancel()
-	containers, err := c.ContainerList(ctx, types.ContainerListOptions{
+	containers, err := c.ContainerList(listCtx, types.ContainerListOptions{
 		All:    true,
 		Filter: filters,
 	})
 	if err != nil {
-		log.Errorf("ContainerList failed (err: %v)", err)
-		return err
+		requestid.Log(ctx).Errorf("ContainerList failed (err: %v)", err)
+		return nil, err
 	}
 
 	// use same datastore for all volumes with short names
 	datastoreName := ""
+	counts := make(map[string]uint)
 
-	log.Infof("Found %d running or paused containers", len(containers))
+	requestid.Log(ctx).Debugf("Found %d running or paused containers", len(containers))
 	for _, ct := range containers {
-
-		if r.checkDirty() {
-			return fmt.Errorf("refcounting wasn't clean.")
-		}
-
-		ctx_inspect, cancel_inspect := context.WithTimeout(context.Background(), dockerConnTimeoutSec*time.Second)
-		defer cancel_inspect()
+		ctx_inspect, cancel_inspect := context.WithTimeout(ctx, dockerConnTimeoutSec*time.Second)
 		containerJSONInfo, err := c.ContainerInspect(ctx_inspect, ct.ID)
+		cancel_inspect()
 		if err != nil {
-			log.Errorf("ContainerInspect failed for %s (err: %v)", ct.Names, err)
-			// We intentionally don't cleanup refMap because whatever refCounts(if any) we were able to
-			// populate are valid.
-			return err
+			requestid.Log(ctx).Errorf("ContainerInspect failed for %s (err: %v)", ct.Names, err)
+			return nil, err
 		}
-		log.Debugf("  Mounts for %v", ct.Names)
+		requestid.Log(ctx).Debugf("  Mounts for %v", ct.Names)
 		for _, mount := range containerJSONInfo.Mounts {
 			// check if the mount location belongs to vmdk plugin
 			if isVMDKMount(mount.Source) != true {
 				continue
 			}
 
-			volumeInfo, err := plugin_utils.GetVolumeInfo(mount.Name, datastoreName, d)
+			volumeInfo, err := plugin_utils.GetVolumeInfo(ctx, mount.Name, datastoreName, d)
 			if err != nil {
-				log.Errorf("Unable to get volume info for volume %s. err:%v", mount.Name, err)
-				return err
+				requestid.Log(ctx).Errorf("Unable to get volume info for volume %s. err:%v", mount.Name, err)
+				return nil, err
 			}
 			datastoreName = volumeInfo.DatastoreName
-			r.Incr(volumeInfo.VolumeName)
-			log.Debugf("name=%v (driver=%s source=%s) (%v)",
+			counts[volumeInfo.VolumeName]++
+			requestid.Log(ctx).Debugf("name=%v (driver=%s source=%s) (%v)",
 				mount.Name, mount.Driver, mount.Source, mount)
 		}
 	}
-
-	// lock and check if the background refcount was dirtied.
-	// get mounts, remove unncessary mounts and set refcntInitSuccess
-	// under same lock to avoid races with parallel mount/unmount
-	r.StateMtx.Lock()
-	defer r.StateMtx.Unlock()
-	if r.isDirty == true {
-		// refcounting was dirtied by parallel mount/unmount.
-		return fmt.Errorf("refcounting wasn't clean.")
-	}
-
-	// Check that refcounts and actual mount info from Linux match
-	// If they don't, unmount unneeded stuff, or yell if something is
-	// not mounted but should be (it's error. we should not get there)
-	r.updateRefMap()
-	r.syncMountsWithRefCounters(d)
-	// mark reconciling success so that further unmounts can instantly be processed
-	r.refcntInitSuccess = true
-	return nil
+	return counts, nil
 }
 
 // syncronize mount info with refcounts - and unmounts if needed
-func (r *RefCountsMap) syncMountsWithRefCounters(d drivers.VolumeDriver) {
+func (r *RefCountsMap) syncMountsWithRefCounters(ctx context.Context, d drivers.VolumeDriver) {
 	// Lock the RefCountsMap
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
@@ -437,14 +628,14 @@ func (r *RefCountsMap) syncMountsWithRefCounters(d drivers.VolumeDriver) {
 			"dev":     cnt.dev,
 		}
 
-		log.WithFields(f).Debug("Refcnt record: ")
+		requestid.Log(ctx).WithFields(f).Debug("Refcnt record: ")
 		if cnt.mounted == true {
 			if cnt.count == 0 {
 				// Volume mounted but not used - UNMOUNT and DETACH !
-				log.WithFields(f).Info("Initiating recovery unmount. ")
+				requestid.Log(ctx).WithFields(f).Info("Initiating recovery unmount. ")
 				err := d.UnmountVolume(vol)
 				if err != nil {
-					log.Warning("Failed to unmount - manual recovery may be needed")
+					requestid.Log(ctx).Warning("Failed to unmount - manual recovery may be needed")
 				}
 			}
 		} else {
@@ -454,7 +645,7 @@ func (r *RefCountsMap) syncMountsWithRefCounters(d drivers.VolumeDriver) {
 				// removed.
 				err := d.DetachVolume(vol)
 				if err != nil {
-					log.Warning("Failed to detach volume %s - volume may be attached and manual recovery may be needed ", vol)
+					requestid.Log(ctx).Warningf("Failed to detach volume %s - volume may be attached and manual recovery may be needed ", vol)
 				}
 				fs.Rmdir(strings.Join([]string{mountRoot, vol}, "/"))
 				delete(r.refMap, vol)
@@ -463,45 +654,53 @@ func (r *RefCountsMap) syncMountsWithRefCounters(d drivers.VolumeDriver) {
 				// It could happen when Docker runs a container with a volume
 				// but not using files on the volumes, and the volume is (manually?)
 				// unmounted. Unlikely but possible. Mount !
-				log.WithFields(f).Warning("Initiating recovery mount. ")
-				status, err := d.GetVolume(vol)
-				if err != nil {
-					log.Warning("Failed to mount - manual recovery may be needed")
-				} else {
-					//Ensure the refcount map has this disk ID
-					id := ""
-					exists := false
-					if driverName == photonDriver {
-						if id, exists = status["ID"].(string); !exists {
-							log.Warning("Failed to disk ID for photon disk cannot mount in use disk")
-						}
-					}
-
-					isReadOnly := false
-					if access, exists := status["access"]; exists {
-						if access == "read-only" {
-							isReadOnly = true
-						}
-					}
-					// It could be possible that volume (device) is just namespace mounted for the container and not
-					// under plugin rootfs. We trigger a mount, and if the device is already attached, vmdkops service on esx host
-					// returns proper device ids and we just mount it under plugin rootfs
-					_, err = d.MountVolume(vol, status["fstype"].(string), id, isReadOnly, false)
-					if err != nil {
-						log.Warning("Failed to mount - manual recovery may be needed")
-					}
-				}
+				requestid.Log(ctx).WithFields(f).Warning("Initiating recovery mount. ")
+				recoveryMount(ctx, d, vol)
 			}
 		}
 	}
 }
 
+// recoveryMount mounts a volume which Docker uses but is not mounted
+func recoveryMount(ctx context.Context, d drivers.VolumeDriver, vol string) error {
+	status, err := d.GetVolume(vol)
+	if err != nil {
+		requestid.Log(ctx).Warning("Failed to mount - manual recovery may be needed")
+		return err
+	}
+	//Ensure the refcount map has this disk ID
+	id := ""
+	exists := false
+	if driverName == photonDriver {
+		if id, exists = status["ID"].(string); !exists {
+			requestid.Log(ctx).Warning("Failed to disk ID for photon disk cannot mount in use disk")
+		}
+	}
+
+	isReadOnly := false
+	if access, exists := status["access"]; exists {
+		if access == "read-only" {
+			isReadOnly = true
+		}
+	}
+	// It could be possible that volume (device) is just namespace mounted for the container and not
+	// under plugin rootfs. We trigger a mount, and if the device is already attached, vmdkops service on esx host
+	// returns proper device ids and we just mount it under plugin rootfs
+	fstype, _ := status["fstype"].(string)
+	mountOptions, _ := status[fs.MountOptionsOpt].(string)
+	_, err = d.MountVolume(vol, fstype, id, isReadOnly, false, mountOptions)
+	if err != nil {
+		requestid.Log(ctx).Warning("Failed to mount - manual recovery may be needed")
+	}
+	return err
+}
+
 // updates refcount map with mounted volumes using mount info
-func (r *RefCountsMap) updateRefMap() error {
+func (r *RefCountsMap) updateRefMap(ctx context.Context) error {
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
 
-	volumeMap, err := fs.GetMountInfo(mountRoot)
+	volumeMap, err := fs.GetMountInfo(ctx, mountRoot)
 
 	if err != nil {
 		return err
@@ -515,13 +714,13 @@ func (r *RefCountsMap) updateRefMap() error {
 		refInfo.mounted = true
 		refInfo.dev = dev
 		r.refMap[volName] = refInfo
-		log.Debugf("Volume '%s' was found mounted, ref=(%#v)", volName, refInfo)
+		requestid.Log(ctx).Debugf("Volume '%s' was found mounted, ref=(%#v)", volName, refInfo)
 	}
 
 	// Add volumes found under mountRoot, reset refMap entry
 	// for those that are present under mountRoot but aren't
 	// mounted.
-	volumes, err := fs.GetMountRootEntries(mountRoot)
+	volumes, err := fs.GetMountRootEntries(ctx, mountRoot)
 	if err != nil {
 		return err
 	}
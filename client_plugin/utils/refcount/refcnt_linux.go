@@ -16,5 +16,22 @@
 
 package refcount
 
+import (
+	"io/ioutil"
+	"strings"
+)
+
 // DockerHostAddr is the docker engine sock path on Linux.
 const DockerHostAddr = "unix:///var/run/docker.sock"
+
+// bootIDFile changes on every boot
+const bootIDFile = "/proc/sys/kernel/random/boot_id"
+
+// getBootID returns an ID of the current boot, empty if it is unknown
+func getBootID() string {
+	data, err := ioutil.ReadFile(bootIDFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -16,5 +16,25 @@
 
 package refcount
 
+import (
+	"syscall"
+	"time"
+)
+
 // DockerHostAddr is the docker engine npipe address on Windows.
 const DockerHostAddr = "npipe:////./pipe/docker_engine"
+
+var procGetTickCount64 = syscall.NewLazyDLL("kernel32.dll").NewProc("GetTickCount64")
+
+// getBootID returns an ID of the current boot, empty if it is unknown.
+// Windows has no boot ID, the boot time is used instead. It is computed from
+// the uptime and rounded to the minute, so it may differ by a minute between
+// calls in the same boot: the state file is then discarded, which is safe.
+func getBootID() string {
+	if err := procGetTickCount64.Find(); err != nil {
+		return ""
+	}
+	ms, _, _ := procGetTickCount64.Call()
+	boot := time.Now().Add(-time.Duration(ms) * time.Millisecond)
+	return boot.UTC().Truncate(time.Minute).Format(time.RFC3339)
+}
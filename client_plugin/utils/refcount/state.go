@@ -0,0 +1,173 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package refcount
+
+//
+// Refcount state file.
+//
+// Refcounts and the mount IDs of the driver are saved to a state file on every
+// change, and loaded on plugin start. With a saved state the plugin serves
+// Unmount and Remove right away after a restart, instead of waiting for the
+// discovery from Docker. The loaded state is then validated against Docker by
+// reconciliation passes (see reconcile.go), which correct whatever changed
+// while the plugin was down.
+//
+// The state file is only used in the boot it was saved in: after a reboot
+// nothing is mounted anymore, even if the file survived (e.g. in LOCALAPPDATA
+// on Windows), so the boot ID is saved along with the refcounts.
+//
+// The file is replaced atomically. If it is missing or cannot be read,
+// refcounts are discovered from Docker as usual.
+//
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/requestid"
+	"golang.org/x/net/context"
+)
+
+// savedRefCount is the refcount of a volume in the state file
+type savedRefCount struct {
+	Count uint
+	Since time.Time
+}
+
+// savedState is the content of the state file
+type savedState struct {
+	BootID    string
+	RefCounts map[string]savedRefCount
+	MountIDs  map[string]string
+}
+
+// SetStateFile makes refcounts and the mount IDs in mountIDs persist in path,
+// nothing is persisted if path is empty. Mount IDs of volumes found unused are
+// dropped from mountIDs. Must be called before Init, mountIDs is only to be
+// changed under StateMtx.
+func (r *RefCountsMap) SetStateFile(path string, mountIDs map[string]string) {
+	r.stateFile = path
+	r.mountIDs = mountIDs
+}
+
+// loadState loads refcounts and mount IDs from the state file.
+// Returns false if there is no usable state file.
+func (r *RefCountsMap) loadState(ctx context.Context) bool {
+	if r.stateFile == "" {
+		return false
+	}
+	data, err := ioutil.ReadFile(r.stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			requestid.Log(ctx).WithFields(log.Fields{"file": r.stateFile, "error": err}).Warning("Failed to read state file ")
+		}
+		return false
+	}
+	var state savedState
+	if err = json.Unmarshal(data, &state); err != nil {
+		requestid.Log(ctx).WithFields(log.Fields{"file": r.stateFile, "error": err}).Warning("Failed to parse state file ")
+		return false
+	}
+	if bootID := getBootID(); bootID == "" || state.BootID != bootID {
+		requestid.Log(ctx).WithFields(log.Fields{"file": r.stateFile}).Info("State file is from a previous boot, ignoring it ")
+		return false
+	}
+
+	r.mtx.Lock()
+	for name, saved := range state.RefCounts {
+		r.refMap[name] = &refCount{count: saved.Count, since: saved.Since}
+	}
+	r.mtx.Unlock()
+	for id, name := range state.MountIDs {
+		r.mountIDs[id] = name
+	}
+	requestid.Log(ctx).WithFields(log.Fields{"file": r.stateFile, "volumes": len(state.RefCounts),
+		"mount IDs": len(state.MountIDs)}).Info("Loaded refcounts from state file ")
+	return true
+}
+
+// SaveState writes refcounts and mount IDs to the state file, if there is one.
+// Nothing is saved until refcounts are initialized. Caller holds StateMtx.
+func (r *RefCountsMap) SaveState() {
+	if r.stateFile == "" || !r.refcntInitSuccess {
+		return
+	}
+	state := savedState{BootID: getBootID(), RefCounts: make(map[string]savedRefCount), MountIDs: r.mountIDs}
+	r.mtx.RLock()
+	for name, cnt := range r.refMap {
+		if cnt != nil && cnt.count > 0 {
+			state.RefCounts[name] = savedRefCount{Count: cnt.count, Since: cnt.since}
+		}
+	}
+	r.mtx.RUnlock()
+
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = writeFileAtomic(r.stateFile, data)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"file": r.stateFile, "error": err}).Warning("Failed to save state file ")
+	}
+}
+
+// forgetMountIDs drops the mount IDs of the volume. Caller holds StateMtx.
+func (r *RefCountsMap) forgetMountIDs(vol string) {
+	for id, name := range r.mountIDs {
+		if name == vol {
+			delete(r.mountIDs, id)
+		}
+	}
+}
+
+// validateState checks the refcounts loaded from the state file against
+// Docker and the mounts, and corrects them, until they agree
+func (r *RefCountsMap) validateState() {
+	c, err := client.NewClient(DockerHostAddr, ApiVersion, nil, defaultHeaders)
+	if err != nil {
+		log.Panicf("Failed to create client for Docker at %s.( %v)",
+			DockerHostAddr, err)
+	}
+	for {
+		ctx := requestid.Background()
+		pending, err := r.reconcile(ctx, c)
+		switch {
+		case err != nil:
+			requestid.Log(ctx).WithFields(log.Fields{"error": err}).Warning("Failed to validate saved refcounts, retrying ")
+			time.Sleep(dockerRetryDelay)
+		case pending:
+			time.Sleep(reconcileGrace)
+		default:
+			requestid.Log(ctx).Info("Saved refcounts validated against Docker")
+			return
+		}
+	}
+}
+
+// writeFileAtomic replaces the file with data, readers see either the old or the new content
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,91 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package refcount
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "run", "state.json")
+
+	r := NewRefCountsMap()
+	mountIDs := make(map[string]string)
+	r.SetStateFile(path, mountIDs)
+	assert.False(t, r.loadState(context.Background()), "No state file yet")
+
+	// Nothing is saved before refcounts are initialized
+	r.Incr("vol1@ds")
+	r.SaveState()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	r.refcntInitSuccess = true
+	r.Incr("vol1@ds")
+	r.Incr("vol2@ds")
+	mountIDs["id1"] = "vol1@ds"
+	mountIDs["id2"] = "vol1@ds"
+	mountIDs["id3"] = "vol2@ds"
+	r.SaveState()
+
+	loaded := NewRefCountsMap()
+	loadedIDs := make(map[string]string)
+	loaded.SetStateFile(path, loadedIDs)
+	if !assert.True(t, loaded.loadState(context.Background())) {
+		return
+	}
+	assert.Equal(t, uint(2), loaded.GetCount("vol1@ds"))
+	assert.Equal(t, uint(1), loaded.GetCount("vol2@ds"))
+	assert.Equal(t, mountIDs, loadedIDs)
+	info, _ := r.Get("vol1@ds")
+	loadedInfo, _ := loaded.Get("vol1@ds")
+	assert.True(t, info.Since.Equal(loadedInfo.Since))
+
+	loaded.forgetMountIDs("vol1@ds")
+	assert.Equal(t, map[string]string{"id3": "vol2@ds"}, loadedIDs)
+
+	// A state file saved before a reboot falls back to discovery
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	var state savedState
+	assert.Nil(t, json.Unmarshal(data, &state))
+	assert.Equal(t, getBootID(), state.BootID)
+	state.BootID = "previous-boot"
+	data, _ = json.Marshal(state)
+	assert.Nil(t, ioutil.WriteFile(path, data, 0600))
+	rebooted := NewRefCountsMap()
+	rebooted.SetStateFile(path, make(map[string]string))
+	assert.False(t, rebooted.loadState(context.Background()))
+	assert.Equal(t, uint(0), rebooted.GetCount("vol1@ds"))
+
+	// A broken state file falls back to discovery
+	assert.Nil(t, ioutil.WriteFile(path, []byte("{"), 0600))
+	assert.False(t, NewRefCountsMap().loadState(context.Background()))
+	broken := NewRefCountsMap()
+	broken.SetStateFile(path, make(map[string]string))
+	assert.False(t, broken.loadState(context.Background()))
+}
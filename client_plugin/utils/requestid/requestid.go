@@ -0,0 +1,72 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requestid
+
+// Correlation IDs for requests served by the plugin. An ID is generated when
+// a request from Docker (or the admin server) enters a driver and carried in
+// the context passed down to VmdkOps, so all logs for a request can be found
+// by its ID.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Key is the log field holding the request ID
+const Key = "request_id"
+
+type contextKey struct{}
+
+var fallbackCounter uint64
+
+// New returns a new random request ID
+func New() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// Unique enough for correlating logs
+		return fmt.Sprintf("%x-%x", time.Now().UnixNano(), atomic.AddUint64(&fallbackCounter, 1))
+	}
+	return hex.EncodeToString(b)
+}
+
+// NewContext returns a copy of ctx carrying the request ID id
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID in ctx, or "" if there is none
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Background returns a background context with a new request ID
+func Background() context.Context {
+	return NewContext(context.Background(), New())
+}
+
+// Log returns a log entry with the request ID in ctx as a field, if any
+func Log(ctx context.Context) *log.Entry {
+	if id := FromContext(ctx); id != "" {
+		return log.WithField(Key, id)
+	}
+	return log.NewEntry(log.StandardLogger())
+}
@@ -0,0 +1,116 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// vdvs-admin - command line client for the admin server of the plugins.
+//
+// Usage: vdvs-admin [-sock <admin socket>] <command> [args]
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/admin"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
+)
+
+const usage = `Usage: vdvs-admin [-sock <admin socket>] <command> [args]
+
+Commands:
+  state                  Show refcounts, mount IDs and refcounting init status
+  resync                 Discover refcounts from Docker again
+  unmount <volume>       Unmount and detach a volume, even if it is in use
+  detach <volume>        Detach a volume which is not in use
+  extend <volume> <size> Grow a volume and its filesystem, e.g. extend vol1@datastore1 20gb
+  revert <volume> <snapshot>
+                         Restore a detached volume from one of its snapshots
+  delete-snapshot <volume> <snapshot>
+                         Delete a snapshot of a volume
+  flush-cache            Drop cached volume metadata
+
+Volume names are full names (volume@datastore) as shown by "state".
+
+Options:
+`
+
+// command runs an admin request with the given arguments
+type command struct {
+	args int
+	run  func(c *admin.Client, args []string) error
+}
+
+var commands = map[string]command{
+	"state": {0, func(c *admin.Client, args []string) error {
+		state, err := c.State()
+		if err != nil {
+			return err
+		}
+		out, err := json.MarshalIndent(state, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}},
+	"resync": {0, func(c *admin.Client, args []string) error {
+		return c.Resync()
+	}},
+	"unmount": {1, func(c *admin.Client, args []string) error {
+		return c.ForceUnmount(args[0])
+	}},
+	"detach": {1, func(c *admin.Client, args []string) error {
+		return c.ForceDetach(args[0])
+	}},
+	"extend": {2, func(c *admin.Client, args []string) error {
+		return c.ExtendVolume(args[0], args[1])
+	}},
+	"revert": {2, func(c *admin.Client, args []string) error {
+		return c.RevertSnapshot(args[0], args[1])
+	}},
+	"delete-snapshot": {2, func(c *admin.Client, args []string) error {
+		return c.DeleteSnapshot(args[0], args[1])
+	}},
+	"flush-cache": {0, func(c *admin.Client, args []string) error {
+		return c.FlushCache()
+	}},
+}
+
+func main() {
+	sockAddr := flag.String("sock", config.DefaultVMDKPluginAdminSock,
+		"Admin socket of the plugin, "+config.DefaultVFilePluginAdminSock+" for vFile")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok || len(args)-1 != cmd.args {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(admin.NewClient(*sockAddr), args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", args[0], err)
+		os.Exit(1)
+	}
+}
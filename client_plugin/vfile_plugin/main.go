@@ -23,7 +23,9 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vfile"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/admin"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/metrics"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/plugin_server"
 )
 
@@ -39,6 +41,10 @@ func main() {
 		os.Exit(1)
 	}
 
+	if cfg.StateFile == "" {
+		cfg.StateFile = config.DefaultVFilePluginStateFile
+	}
+
 	if cfg.Driver == config.VFileDriver {
 		driver = vfile.NewVolumeDriver(cfg, config.VFileMountRoot)
 	} else {
@@ -51,5 +57,25 @@ func main() {
 		os.Exit(1)
 	}
 
-	plugin_server.StartServer(cfg.Driver, &driver)
+	adminSock := cfg.AdminSock
+	if adminSock == "" {
+		adminSock = config.DefaultVFilePluginAdminSock
+	}
+	if adminSock != "" {
+		server := admin.NewServer(adminSock)
+		server.SetDriver(driver)
+		if err := server.Start(); err != nil {
+			log.WithFields(log.Fields{"address": adminSock, "error": err}).Warning("Failed to start admin server, continuing however.. ")
+		}
+	}
+
+	if cfg.MetricsAddr != "" {
+		if _, err := metrics.StartServer(cfg.MetricsAddr); err != nil {
+			log.WithFields(log.Fields{"address": cfg.MetricsAddr, "error": err}).Warning("Failed to start metrics server, continuing however.. ")
+		}
+	}
+	backend := driver
+	driver = metrics.InstrumentDriver(cfg.Driver, driver)
+
+	plugin_server.StartServer(cfg, &driver, backend)
 }
@@ -24,7 +24,9 @@ import (
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/photon"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vmdk"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/admin"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/metrics"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/plugin_server"
 )
 
@@ -45,6 +47,10 @@ func startPluginServer() {
 		os.Exit(1)
 	}
 
+	if cfg.StateFile == "" {
+		cfg.StateFile = config.DefaultVMDKPluginStateFile
+	}
+
 	switch {
 	case cfg.Driver == config.PhotonDriver:
 		driver = photon.NewVolumeDriver(cfg, config.MountRoot)
@@ -64,5 +70,36 @@ func startPluginServer() {
 		os.Exit(1)
 	}
 
-	plugin_server.StartServer(cfg.Driver, &driver)
+	startAdminServer(cfg, driver)
+	startMetricsServer(cfg)
+	backend := driver
+	driver = metrics.InstrumentDriver(cfg.Driver, driver)
+
+	plugin_server.StartServer(cfg, &driver, backend)
+}
+
+// startMetricsServer serves Prometheus metrics, if there is an address configured for it.
+func startMetricsServer(cfg config.Config) {
+	if cfg.MetricsAddr == "" {
+		return
+	}
+	if _, err := metrics.StartServer(cfg.MetricsAddr); err != nil {
+		log.WithFields(log.Fields{"address": cfg.MetricsAddr, "error": err}).Warning("Failed to start metrics server, continuing however.. ")
+	}
+}
+
+// startAdminServer starts the admin server, if there is a socket configured for it.
+func startAdminServer(cfg config.Config, driver volume.Driver) {
+	sockAddr := cfg.AdminSock
+	if sockAddr == "" {
+		sockAddr = config.DefaultVMDKPluginAdminSock
+	}
+	if sockAddr == "" {
+		return
+	}
+	server := admin.NewServer(sockAddr)
+	server.SetDriver(driver)
+	if err := server.Start(); err != nil {
+		log.WithFields(log.Fields{"address": sockAddr, "error": err}).Warning("Failed to start admin server, continuing however.. ")
+	}
 }
@@ -34,6 +34,10 @@ CMD_REMOVE = 'remove'
 CMD_ATTACH = 'attach'
 CMD_DETACH = 'detach'
 CMD_GET    = 'get'
+CMD_SNAPSHOT        = 'snapshot'
+CMD_DELETE_SNAPSHOT = 'deletesnapshot'
+CMD_REVERT_SNAPSHOT = 'revertsnapshot'
+CMD_EXTEND          = 'extend'
 
 SIZE = 'size'
 
@@ -329,6 +333,26 @@ def check_privileges_for_command(cmd, opts, tenant_uuid, datastore_url, privileg
             result = error_code_to_message[ErrorCode.PRIVILEGE_NO_DELETE_PRIVILEGE]
             return result
 
+    # Snapshots are disks of their own, taking and reverting them needs the same
+    # privilege as creating volumes, and removing them the same as removing volumes.
+    if cmd in [CMD_SNAPSHOT, CMD_REVERT_SNAPSHOT]:
+        if not has_privilege(privileges, auth_data_const.COL_ALLOW_CREATE):
+            result = error_code_to_message[ErrorCode.PRIVILEGE_NO_CREATE_PRIVILEGE]
+            return result
+
+    if cmd == CMD_EXTEND:
+        if not has_privilege(privileges, auth_data_const.COL_ALLOW_CREATE):
+            result = error_code_to_message[ErrorCode.PRIVILEGE_NO_CREATE_PRIVILEGE]
+            return result
+        if not check_max_volume_size(convert.convert_to_MB(get_vol_size(opts)), privileges):
+            result = error_code_to_message[ErrorCode.PRIVILEGE_MAX_VOL_EXCEED]
+            return result
+
+    if cmd == CMD_DELETE_SNAPSHOT:
+        if not has_privilege(privileges, auth_data_const.COL_ALLOW_CREATE):
+            result = error_code_to_message[ErrorCode.PRIVILEGE_NO_DELETE_PRIVILEGE]
+            return result
+
 def err_msg_no_table(table_name):
     error_msg = "table " + table_name + " does not exist"
     logging.error(error_msg)
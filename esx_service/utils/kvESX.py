@@ -52,6 +52,7 @@ DVOL_KEY = "docker-volume-vsphere"
 # Volume attributes
 VOL_SIZE = 'size'
 VOL_ALLOC = 'allocated'
+VOL_CAPACITY_KB = 'capacityKb'  # exact size, VOL_SIZE is rounded down for display
 
 # Results in a buffered, locked, filter-less open,
 # all vmdks are opened with these flags
@@ -343,7 +344,8 @@ def get_info(volpath):
         logging.warning("Failed to get size of disk %s - %x", volpath, res)
         return None
 
-    return {VOL_SIZE: convert(sinfo.size), VOL_ALLOC: convert(sinfo.allocated)}
+    return {VOL_SIZE: convert(sinfo.size), VOL_ALLOC: convert(sinfo.allocated),
+            VOL_CAPACITY_KB: sinfo.size // KB}
 
 
 def get_uint(val):
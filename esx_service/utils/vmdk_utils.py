@@ -54,6 +54,11 @@ SPECIAL_FILES_REGEXP = r"\A.*-(delta|ctk|digest|flat)\.vmdk$"
 # glob expression to match end of 'delta' (aka snapshots) file names.
 SNAP_SUFFIX_GLOB = "-[0-9][0-9][0-9][0-9][0-9][0-9].vmdk"
 
+# Volume snapshots are full copies kept next to the volume as <volume>@<snapshot>.vmdk.
+# '@' separates volume and datastore in full volume names, so it is never part of
+# a volume name and the copies can't be mistaken for volumes.
+VOL_SNAPSHOT_SEPARATOR = "@"
+
 # regexp for finding datastore path "[datastore] path/to/file.vmdk" from full vmdk path
 DATASTORE_PATH_REGEXP = r"^/vmfs/volumes/([^/]+)/(.*\.vmdk)$"
 
@@ -216,6 +221,26 @@ def get_vmdk_path(path, vol_name):
     return latest
 
 
+def get_vol_snapshot_path(vmdk_path, vol_name, snap_name):
+    """
+    Returns full path to the VMDK holding snapshot <snap_name> of volume <vol_name>,
+    which is kept in the same folder as the volume VMDK <vmdk_path>.
+    """
+    return os.path.join(os.path.dirname(vmdk_path),
+                        "{0}{1}{2}.vmdk".format(vol_name, VOL_SNAPSHOT_SEPARATOR, snap_name))
+
+
+def list_vol_snapshot_paths(vmdk_path, vol_name):
+    """
+    Returns full paths to all snapshot VMDKs of volume <vol_name>, including
+    the ones not recorded in the volume metadata (e.g. left over by a crash).
+    """
+    path = os.path.dirname(vmdk_path)
+    prefix = vol_name + VOL_SNAPSHOT_SEPARATOR
+    return [os.path.join(path, f) for f in os.listdir(path)
+            if f.startswith(prefix) and vmdk_is_a_descriptor(path, f)]
+
+
 def get_datastore_path(vmdk_path):
     """Returns a string datastore path "[datastore] path/to/file.vmdk"
     from a full vmdk path.
@@ -250,7 +275,8 @@ def list_vmdks(path, volname="", show_snapshots=False):
     path -  where the VMDKs are looked for
     volname - if passed, only files related to this VMDKs will be returned. Useful when
             doing volume snapshot inspect
-    show_snapshots - if set to True, all VMDKs (including delta files) will be returned
+    show_snapshots - if set to True, all VMDKs (including delta files and volume
+            snapshots) will be returned
     """
 
     # dockvols may not exists on a datastore - this is normal.
@@ -263,7 +289,7 @@ def list_vmdks(path, volname="", show_snapshots=False):
 
     if not show_snapshots:
         expr = re.compile(SNAP_VMDK_REGEXP)
-        vmdks = [f for f in vmdks if not expr.match(f)]
+        vmdks = [f for f in vmdks if not expr.match(f) and VOL_SNAPSHOT_SEPARATOR not in f]
     logging.debug("vmdks %s", vmdks)
     return vmdks
 
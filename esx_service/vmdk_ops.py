@@ -28,6 +28,11 @@ Commands ("cmd" in request):
 		"get"    - get info about an individual volume (vmdk)
 		"attach" - attach a VMDK to the requesting VM
 		"detach" - detach a VMDK from the requesting VM (assuming it's unmounted)
+		"snapshot"       - copy a (detached) VMDK to a named snapshot
+		"listsnapshots"  - enumerate snapshots of a VMDK
+		"deletesnapshot" - remove a snapshot of a VMDK
+		"revertsnapshot" - restore a (detached) VMDK from a snapshot
+		"extend"         - grow a VMDK, attached or not
 
 '''
 
@@ -297,9 +302,21 @@ def cloneVMDK(vm_name, vmdk_path, opts={}, vm_uuid=None, datastore_url=None, vm_
     if not os.path.isfile(src_vmdk_path):
         return err("Could not find volume for cloning %s" % opts[kv.CLONE_FROM])
 
+    # Clone a snapshot of the source rather than its disk, which may have
+    # changed since the snapshot was taken
+    src_disk_path = src_vmdk_path
+    snap_name = opts.get(kv.CLONE_SNAPSHOT)
+    if snap_name:
+        error_info, _, _, i = get_snapshot(src_vmdk_path, src_volume, {kv.SNAPSHOT_NAME: snap_name})
+        if error_info:
+            return error_info
+        if i < 0:
+            return err("Snapshot {0} of volume {1} not found".format(snap_name, src_volume))
+        src_disk_path = vmdk_utils.get_vol_snapshot_path(src_vmdk_path, src_volume, snap_name)
+
     # Form datastore path from vmdk_path
     dest_vol = vmdk_utils.get_datastore_path(vmdk_path)
-    source_vol = vmdk_utils.get_datastore_path(src_vmdk_path)
+    source_vol = vmdk_utils.get_datastore_path(src_disk_path)
     lockname = "{}.{}.{}".format(src_datastore, tenant_name, src_volume)
     with lockManager.get_lock(lockname):
         # Verify if the source volume is in use.
@@ -363,11 +380,17 @@ def cloneVMDK(vm_name, vmdk_path, opts={}, vm_uuid=None, datastore_url=None, vm_
     vol_meta[kv.CREATED_BY] = vm_name
     vol_meta[kv.CREATED] = time.asctime(time.gmtime())
     vol_meta[kv.VOL_OPTS][kv.CLONE_FROM] = src_volume
+    if snap_name:
+        vol_meta[kv.VOL_OPTS][kv.CLONE_SNAPSHOT] = snap_name
     vol_meta[kv.VOL_OPTS][kv.DISK_ALLOCATION_FORMAT] = opts[kv.DISK_ALLOCATION_FORMAT]
     if kv.ACCESS in opts:
         vol_meta[kv.VOL_OPTS][kv.ACCESS] = opts[kv.ACCESS]
     if kv.ATTACH_AS in opts:
         vol_meta[kv.VOL_OPTS][kv.ATTACH_AS] = opts[kv.ATTACH_AS]
+    if kv.MOUNT_OPTIONS in opts:
+        vol_meta[kv.VOL_OPTS][kv.MOUNT_OPTIONS] = opts[kv.MOUNT_OPTIONS]
+    if kv.CLASS in opts:
+        vol_meta[kv.VOL_OPTS][kv.CLASS] = opts[kv.CLASS]
 
     if not kv.setAll(vmdk_path, vol_meta):
         msg = "Failed to create metadata kv store for {0}".format(vmdk_path)
@@ -390,12 +413,16 @@ def validate_opts(opts, vmdk_path):
      * size - The size of the disk to create
      * vsan-policy-name - The name of an existing policy to use
      * diskformat - The allocation format of allocated disk
+     * clone-snapshot - The snapshot of the clone-from volume to clone
     """
     valid_opts = [kv.SIZE, kv.VSAN_POLICY_NAME, kv.DISK_ALLOCATION_FORMAT,
-                  kv.ATTACH_AS, kv.ACCESS, kv.FILESYSTEM_TYPE, kv.CLONE_FROM]
+                  kv.ATTACH_AS, kv.ACCESS, kv.FILESYSTEM_TYPE, kv.CLONE_FROM,
+                  kv.MOUNT_OPTIONS, kv.MKFS_OPTIONS, kv.CLASS, kv.CLONE_SNAPSHOT]
     defaults = [kv.DEFAULT_DISK_SIZE, kv.DEFAULT_VSAN_POLICY,\
                 kv.DEFAULT_ALLOCATION_FORMAT, kv.DEFAULT_ATTACH_AS,\
-                kv.DEFAULT_ACCESS, kv.DEFAULT_FILESYSTEM_TYPE, kv.DEFAULT_CLONE_FROM]
+                kv.DEFAULT_ACCESS, kv.DEFAULT_FILESYSTEM_TYPE, kv.DEFAULT_CLONE_FROM,\
+                kv.DEFAULT_MOUNT_OPTIONS, kv.DEFAULT_MKFS_OPTIONS, kv.DEFAULT_CLASS,\
+                kv.DEFAULT_CLONE_SNAPSHOT]
     invalid = frozenset(opts.keys()).difference(valid_opts)
     if len(invalid) != 0:
         msg = 'Invalid options: {0} \n'.format(list(invalid)) \
@@ -405,6 +432,8 @@ def validate_opts(opts, vmdk_path):
 
     # For validation of clone (in)compatible options
     clone = True if kv.CLONE_FROM in opts else False
+    if kv.CLONE_SNAPSHOT in opts and not clone:
+        raise ValidationError("Cannot define clone-snapshot without clone-from")
 
     if kv.SIZE in opts:
         validate_size(opts[kv.SIZE], clone)
@@ -418,6 +447,8 @@ def validate_opts(opts, vmdk_path):
         validate_access(opts[kv.ACCESS])
     if kv.FILESYSTEM_TYPE in opts:
         validate_fstype(opts[kv.FILESYSTEM_TYPE], clone)
+    if kv.MKFS_OPTIONS in opts:
+        validate_mkfs_options(clone)
 
 
 def validate_size(size, clone=False):
@@ -510,6 +541,13 @@ def validate_fstype(fstype, clone=False):
     if clone:
         raise ValidationError("Cannot define the filesystem type for a clone")
 
+def validate_mkfs_options(clone=False):
+    """
+    Ensure that we don't accept mkfs options for a clone
+    """
+    if clone:
+        raise ValidationError("Cannot define mkfs options for a clone")
+
 # Returns the UUID if the vmdk_path is for a VSAN backed.
 def get_vsan_uuid(vmdk_path):
     f = open(vmdk_path)
@@ -568,6 +606,17 @@ def vol_info(vol_meta, vol_size_info, datastore):
           vinfo[kv.CLONE_FROM] = vol_meta[kv.VOL_OPTS][kv.CLONE_FROM]
        else:
           vinfo[kv.CLONE_FROM] = kv.DEFAULT_CLONE_FROM
+       if kv.CLONE_SNAPSHOT in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.CLONE_SNAPSHOT] = vol_meta[kv.VOL_OPTS][kv.CLONE_SNAPSHOT]
+       if kv.MOUNT_OPTIONS in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.MOUNT_OPTIONS] = vol_meta[kv.VOL_OPTS][kv.MOUNT_OPTIONS]
+       if kv.MKFS_OPTIONS in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.MKFS_OPTIONS] = vol_meta[kv.VOL_OPTS][kv.MKFS_OPTIONS]
+       if kv.CLASS in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.CLASS] = vol_meta[kv.VOL_OPTS][kv.CLASS]
+
+    if vol_meta.get(kv.SNAPSHOTS):
+        vinfo[kv.SNAPSHOTS] = vol_meta[kv.SNAPSHOTS]
 
     return vinfo
 
@@ -626,6 +675,15 @@ def removeVMDK(vmdk_path, vol_name=None, vm_name=None, tenant_uuid=None, datasto
                       vmdk_path, vol_name, attached_vm_name, kv_uuid)
         return err("Failed to remove volume {0}, in use by VM = {1}.".format(vol_name, attached_vm_name))
 
+    # Snapshots go away with the volume
+    if vol_name is None:
+        vol_name = vmdk_utils.get_volname_from_vmdk_path(vmdk_path)
+    for snap_path in vmdk_utils.list_vol_snapshot_paths(vmdk_path, vol_name):
+        clean_err = cleanVMDK(snap_path)
+        if clean_err:
+            logging.warning("Failed to clean snapshot %s file: %s", snap_path, clean_err)
+            return clean_err
+
     # Cleaning .vmdk file
     clean_err = cleanVMDK(vmdk_path, vol_name)
 
@@ -663,6 +721,272 @@ def getVMDK(vmdk_path, vol_name, datastore):
 
     return result
 
+def copyVMDK(src_path, dest_path, disk_format=kv.DEFAULT_ALLOCATION_FORMAT):
+    """Copies the disk src_path (with its metadata) to dest_path. Returns None or err(msg)"""
+    logging.debug("copyVMDK: %s to %s", src_path, dest_path)
+    vdisk_spec = vim.VirtualDiskManager.VirtualDiskSpec()
+    vdisk_spec.adapterType = VMDK_ADAPTER_TYPE
+    vdisk_spec.diskType = kv.VALID_ALLOCATION_FORMATS.get(disk_format, disk_format)
+
+    si = get_si()
+    task = si.content.virtualDiskManager.CopyVirtualDisk(
+        sourceName=vmdk_utils.get_datastore_path(src_path),
+        destName=vmdk_utils.get_datastore_path(dest_path),
+        destSpec=vdisk_spec)
+    try:
+        wait_for_tasks(si, [task])
+    except vim.fault.VimFault as ex:
+        return err("Failed to copy {0}: {1}".format(src_path, ex.msg))
+    return None
+
+
+def moveVMDK(src_path, dest_path):
+    """Renames the disk src_path (with its metadata) to dest_path. Returns None or err(msg)"""
+    logging.debug("moveVMDK: %s to %s", src_path, dest_path)
+    si = get_si()
+    task = si.content.virtualDiskManager.MoveVirtualDisk(
+        sourceName=vmdk_utils.get_datastore_path(src_path),
+        destName=vmdk_utils.get_datastore_path(dest_path),
+        force=False)
+    try:
+        wait_for_tasks(si, [task])
+    except vim.fault.VimFault as ex:
+        return err("Failed to move {0}: {1}".format(src_path, ex.msg))
+    return None
+
+
+def validate_snapshot_name(snap_name):
+    """
+    Snapshot names become part of the snapshot VMDK file name, so the volume name
+    rules apply. '@' is not allowed as it separates volume and snapshot names.
+    """
+    if not snap_name or len(snap_name) > MAX_VOL_NAME_LEN:
+        raise ValidationError("Snapshot name '{0}' is invalid (max len is {1})".format(snap_name, MAX_VOL_NAME_LEN))
+    if re.match(vmdk_utils.SNAP_NAME_REGEXP, snap_name):
+        raise ValidationError("Snapshot names ending with '-NNNNNN' (where N is a digit) are not supported")
+    for c in ILLEGAL_CHARACTERS | {vmdk_utils.VOL_SNAPSHOT_SEPARATOR}:
+        if c in snap_name:
+            raise ValidationError("Snapshot name contains illegal characters: {0}".format(c))
+
+
+def get_snapshot(vmdk_path, vol_name, opts):
+    """
+    Validates the snapshot request for volume vol_name.
+    Returns (error, volume metadata, snapshot name, index of the snapshot in
+    the volume metadata or -1 if there is no such snapshot)
+    """
+    snap_name = opts.get(kv.SNAPSHOT_NAME) if opts else None
+    try:
+        validate_snapshot_name(snap_name)
+    except ValidationError as ex:
+        return err(ex.msg), None, snap_name, -1
+
+    if not os.path.isfile(vmdk_path):
+        return err("Volume {0} not found (file: {1})".format(vol_name, vmdk_path)), None, snap_name, -1
+
+    vol_meta = kv.getAll(vmdk_path)
+    if not vol_meta:
+        return err("Failed to get metadata for volume {0}".format(vol_name)), None, snap_name, -1
+
+    snapshots = vol_meta.setdefault(kv.SNAPSHOTS, [])
+    for i, snap in enumerate(snapshots):
+        if snap[u'Name'] == snap_name:
+            return None, vol_meta, snap_name, i
+    return None, vol_meta, snap_name, -1
+
+
+def snapshotVMDK(vmdk_path, vol_name, opts):
+    """
+    Takes a point-in-time copy of a volume. The volume must be detached, as the
+    disk of a running VM is locked. Returns None or err(msg)
+    """
+    logging.info("*** snapshotVMDK: %s opts=%s", vmdk_path, opts)
+    error_info, vol_meta, snap_name, i = get_snapshot(vmdk_path, vol_name, opts)
+    if error_info:
+        return error_info
+    if i >= 0:
+        return err("Snapshot {0} of volume {1} already exists".format(snap_name, vol_name))
+
+    attached, uuid, attach_as, attached_vm_name = getStatusAttached(vmdk_path)
+    if attached:
+        log_attached_volume(vmdk_path, uuid, attached_vm_name)
+        return err("Failed to snapshot volume {0}, in use by VM = {1}.".format(vol_name, attached_vm_name))
+
+    snap_path = vmdk_utils.get_vol_snapshot_path(vmdk_path, vol_name, snap_name)
+    disk_format = vol_meta.get(kv.VOL_OPTS, {}).get(kv.DISK_ALLOCATION_FORMAT, kv.DEFAULT_ALLOCATION_FORMAT)
+    copy_err = copyVMDK(vmdk_path, snap_path, disk_format)
+    if copy_err:
+        return copy_err
+
+    vol_meta[kv.SNAPSHOTS].append({u'Name': snap_name,
+                                   u'Created': time.asctime(time.gmtime()),
+                                   u'Size': kv.get_vol_info(vmdk_path)[SIZE]})
+    if not kv.setAll(vmdk_path, vol_meta):
+        msg = "Failed to save volume metadata for {0}.".format(vmdk_path)
+        logging.warning("snapshotVMDK: " + msg)
+        cleanVMDK(snap_path)
+        return err(msg)
+
+    logging.info("Snapshot %s of volume %s created", snap_name, vol_name)
+    return None
+
+
+def listSnapshotsVMDK(vmdk_path, vol_name):
+    """Returns the list of snapshots of a volume, oldest first, or err(msg)"""
+    if not os.path.isfile(vmdk_path):
+        return err("Volume {0} not found (file: {1})".format(vol_name, vmdk_path))
+    vol_meta = kv.getAll(vmdk_path)
+    if not vol_meta:
+        return err("Failed to get metadata for volume {0}".format(vol_name))
+    return vol_meta.get(kv.SNAPSHOTS, [])
+
+
+def deleteSnapshotVMDK(vmdk_path, vol_name, opts):
+    """Removes a snapshot of a volume. Returns None or err(msg)"""
+    logging.info("*** deleteSnapshotVMDK: %s opts=%s", vmdk_path, opts)
+    error_info, vol_meta, snap_name, i = get_snapshot(vmdk_path, vol_name, opts)
+    if error_info:
+        return error_info
+    if i < 0:
+        return err("Snapshot {0} of volume {1} not found".format(snap_name, vol_name))
+
+    clean_err = cleanVMDK(vmdk_utils.get_vol_snapshot_path(vmdk_path, vol_name, snap_name))
+    if clean_err:
+        return clean_err
+
+    del vol_meta[kv.SNAPSHOTS][i]
+    if not kv.setAll(vmdk_path, vol_meta):
+        msg = "Failed to save volume metadata for {0}.".format(vmdk_path)
+        logging.warning("deleteSnapshotVMDK: " + msg)
+        return err(msg)
+
+    logging.info("Snapshot %s of volume %s removed", snap_name, vol_name)
+    return None
+
+
+def revertSnapshotVMDK(vmdk_path, vol_name, opts):
+    """
+    Restores the content of a detached volume from a snapshot. The volume keeps
+    its current metadata (and snapshots), only the disk is replaced.
+    Returns None or err(msg)
+    """
+    logging.info("*** revertSnapshotVMDK: %s opts=%s", vmdk_path, opts)
+    error_info, vol_meta, snap_name, i = get_snapshot(vmdk_path, vol_name, opts)
+    if error_info:
+        return error_info
+    if i < 0:
+        return err("Snapshot {0} of volume {1} not found".format(snap_name, vol_name))
+
+    attached, uuid, attach_as, attached_vm_name = getStatusAttached(vmdk_path)
+    if attached:
+        log_attached_volume(vmdk_path, uuid, attached_vm_name)
+        return err("Failed to revert volume {0}, in use by VM = {1}.".format(vol_name, attached_vm_name))
+
+    # Copy the snapshot aside first, then swap it with the volume disk, so that
+    # the volume is never lost if one of the steps fails. Names with two
+    # separators can't clash with snapshots.
+    snap_path = vmdk_utils.get_vol_snapshot_path(vmdk_path, vol_name, snap_name)
+    new_path = vmdk_utils.get_vol_snapshot_path(vmdk_path, vol_name, vmdk_utils.VOL_SNAPSHOT_SEPARATOR + "new")
+    old_path = vmdk_utils.get_vol_snapshot_path(vmdk_path, vol_name, vmdk_utils.VOL_SNAPSHOT_SEPARATOR + "old")
+    disk_format = vol_meta.get(kv.VOL_OPTS, {}).get(kv.DISK_ALLOCATION_FORMAT, kv.DEFAULT_ALLOCATION_FORMAT)
+    copy_err = copyVMDK(snap_path, new_path, disk_format)
+    if copy_err:
+        return copy_err
+
+    move_err = moveVMDK(vmdk_path, old_path)
+    if move_err:
+        cleanVMDK(new_path)
+        return move_err
+
+    move_err = moveVMDK(new_path, vmdk_path)
+    if move_err:
+        if moveVMDK(old_path, vmdk_path):
+            logging.error("revertSnapshotVMDK: failed to restore %s from %s", vmdk_path, old_path)
+        cleanVMDK(new_path)
+        return move_err
+    cleanVMDK(old_path)
+
+    # The disk came with the metadata saved at snapshot time, put the current one back
+    snap_size = vol_meta[kv.SNAPSHOTS][i][u'Size']
+    if kv.VOL_OPTS in vol_meta and kv.SIZE in vol_meta[kv.VOL_OPTS]:
+        vol_meta[kv.VOL_OPTS][kv.SIZE] = snap_size.lower()
+    if not kv.setAll(vmdk_path, vol_meta):
+        msg = "Failed to save volume metadata for {0}.".format(vmdk_path)
+        logging.warning("revertSnapshotVMDK: " + msg)
+        return err(msg)
+
+    logging.info("Volume %s reverted to snapshot %s", vol_name, snap_name)
+    return None
+
+
+def extendVMDK(vmdk_path, vol_name, opts, tenant_uuid=None, datastore_url=None):
+    """
+    Grows a volume to opts["size"]. Detached disks are extended directly, attached
+    ones through the VM they are attached to, as the VM holds a lock on the disk.
+    Returns None or err(msg)
+    """
+    logging.info("*** extendVMDK: %s opts=%s", vmdk_path, opts)
+    if not opts or list(opts.keys()) != [kv.SIZE]:
+        return err("Invalid options for extend: {0}. Only '{1}' is supported".format(opts, kv.SIZE))
+    try:
+        validate_size(opts[kv.SIZE])
+    except ValidationError as ex:
+        return err(ex.msg)
+
+    if not os.path.isfile(vmdk_path):
+        return err("Volume {0} not found (file: {1})".format(vol_name, vmdk_path))
+    vol_meta = kv.getAll(vmdk_path)
+    vol_size_info = kv.get_vol_info(vmdk_path)
+    if not vol_meta or not vol_size_info:
+        return err("Failed to get metadata for volume {0}".format(vol_name))
+
+    new_kb = convert.convert_to_KB(opts[kv.SIZE])
+    if new_kb < vol_size_info[kv.CAPACITY_KB]:
+        return err("Cannot shrink volume {0} from {1} to {2}".format(vol_name, vol_size_info[SIZE], opts[kv.SIZE]))
+
+    si = get_si()
+    attached, uuid, attach_as, attached_vm_name = getStatusAttached(vmdk_path)
+    if attached:
+        # Prior to #1526, uuid in KV is bios uuid, so fall back to it
+        vm = findVmByUuidChoice(uuid, uuid) if uuid else None
+        device = findDeviceByPath(vmdk_path, vm) if vm else None
+        if not device:
+            return err("Failed to extend volume {0}, cannot find it on VM = {1}.".format(vol_name, attached_vm_name))
+        device.capacityInKB = new_kb
+        disk_spec = vim.vm.device.VirtualDeviceSpec()
+        disk_spec.operation = vim.vm.device.VirtualDeviceSpec.Operation.edit
+        disk_spec.device = device
+        spec = vim.vm.ConfigSpec()
+        spec.deviceChange = [disk_spec]
+        task = vm.ReconfigVM_Task(spec=spec)
+    else:
+        disk_format = vol_meta.get(kv.VOL_OPTS, {}).get(kv.DISK_ALLOCATION_FORMAT, kv.DEFAULT_ALLOCATION_FORMAT)
+        task = si.content.virtualDiskManager.ExtendVirtualDisk(
+            name=vmdk_utils.get_datastore_path(vmdk_path),
+            newCapacityKb=new_kb,
+            eagerZero=(disk_format == 'eagerzeroedthick'))
+    try:
+        wait_for_tasks(si, [task])
+    except vim.fault.VimFault as ex:
+        return err("Failed to extend volume {0}: {1}".format(vol_name, ex.msg))
+
+    vol_meta.setdefault(kv.VOL_OPTS, {})[kv.SIZE] = opts[kv.SIZE]
+    if not kv.setAll(vmdk_path, vol_meta):
+        logging.warning("extendVMDK: Failed to save volume metadata for %s", vmdk_path)
+
+    # keep the size used for quotas up to date
+    if tenant_uuid:
+        error_info = auth.remove_volume_from_volumes_table(tenant_uuid, datastore_url, vol_name)
+        if not error_info:
+            error_info = auth.add_volume_to_volumes_table(tenant_uuid, datastore_url, vol_name,
+                                                          convert.convert_to_MB(opts[kv.SIZE]))
+        if error_info:
+            logging.warning("extendVMDK: Failed to update volume size of %s: %s", vol_name, error_info)
+
+    logging.info("Volume %s extended to %s", vol_name, opts[kv.SIZE])
+    return None
+
+
 def listVMDK(tenant):
     """
     Returns a list of volume names (note: may be an empty list).
@@ -1111,6 +1435,20 @@ def executeRequest(vm_uuid, vm_name, config_path, cmd, full_vol_name, opts, vc_u
                                   vm_name=vm_name,
                                   tenant_uuid=tenant_uuid,
                                   datastore_url=datastore_url)
+        elif cmd == "snapshot":
+            response = snapshotVMDK(vmdk_path=vmdk_path, vol_name=vol_name, opts=opts)
+        elif cmd == "listsnapshots":
+            response = listSnapshotsVMDK(vmdk_path=vmdk_path, vol_name=vol_name)
+        elif cmd == "deletesnapshot":
+            response = deleteSnapshotVMDK(vmdk_path=vmdk_path, vol_name=vol_name, opts=opts)
+        elif cmd == "revertsnapshot":
+            response = revertSnapshotVMDK(vmdk_path=vmdk_path, vol_name=vol_name, opts=opts)
+        elif cmd == "extend":
+            response = extendVMDK(vmdk_path=vmdk_path,
+                                  vol_name=vol_name,
+                                  opts=opts,
+                                  tenant_uuid=tenant_uuid,
+                                  datastore_url=datastore_url)
 
         # For attach/detach reconfigure tasks, hold a per vm lock.
         elif cmd == "attach":
@@ -349,6 +349,136 @@ class VmdkCreateCloneRemoveTestCase(unittest.TestCase):
         err = vmdk_ops.removeVMDK(self.name3)
         self.assertEqual(err, None, err)
 
+class VmdkSnapshotTestCase(unittest.TestCase):
+    """Unit test for VMDK snapshot ops"""
+
+    vm_name = test_utils.generate_test_vm_name()
+    volName = "vol_SnapshotTest"
+
+    def setUp(self):
+        self.name = vmdk_utils.get_vmdk_path(path, self.volName)
+        err = vmdk_ops.createVMDK(vm_name=self.vm_name,
+                                  vmdk_path=self.name,
+                                  vol_name=self.volName)
+        self.assertEqual(err, None, err)
+
+    def tearDown(self):
+        vmdk_ops.removeVMDK(self.name)
+
+    def snapshot_opts(self, snap_name):
+        return {volume_kv.SNAPSHOT_NAME: snap_name}
+
+    def snapshot_path(self, snap_name):
+        return vmdk_utils.get_vol_snapshot_path(self.name, self.volName, snap_name)
+
+    def test_snapshot_name(self):
+        for snap_name in ["", "a/b", "a@b", "snap-000001", "x" * (vmdk_ops.MAX_VOL_NAME_LEN + 1)]:
+            err = vmdk_ops.snapshotVMDK(self.name, self.volName, self.snapshot_opts(snap_name))
+            self.assertNotEqual(err, None, "Snapshot name '{0}' should be rejected".format(snap_name))
+
+    def testSnapshotRevertDelete(self):
+        err = vmdk_ops.snapshotVMDK(self.name, self.volName, self.snapshot_opts("snap1"))
+        self.assertEqual(err, None, err)
+        self.assertTrue(os.path.isfile(self.snapshot_path("snap1")))
+        err = vmdk_ops.snapshotVMDK(self.name, self.volName, self.snapshot_opts("snap1"))
+        self.assertNotEqual(err, None, "Duplicate snapshot should fail")
+
+        # snapshots are listed with the volume, but not as volumes
+        snapshots = vmdk_ops.listSnapshotsVMDK(self.name, self.volName)
+        self.assertEqual([s[u'Name'] for s in snapshots], ["snap1"])
+        self.assertEqual(snapshots[0][u'Size'], "100MB")
+        info = vmdk_ops.getVMDK(self.name, self.volName, None)
+        self.assertEqual(info[volume_kv.SNAPSHOTS], snapshots)
+        self.assertNotIn(os.path.basename(self.snapshot_path("snap1")), vmdk_utils.list_vmdks(path))
+
+        # revert is refused while the volume is in use
+        volume_kv.set_kv(self.name, volume_kv.STATUS, volume_kv.ATTACHED)
+        volume_kv.set_kv(self.name, volume_kv.ATTACHED_VM_NAME, self.vm_name)
+        err = vmdk_ops.revertSnapshotVMDK(self.name, self.volName, self.snapshot_opts("snap1"))
+        self.assertNotEqual(err, None, "Revert of an attached volume should fail")
+        err = vmdk_ops.snapshotVMDK(self.name, self.volName, self.snapshot_opts("snap2"))
+        self.assertNotEqual(err, None, "Snapshot of an attached volume should fail")
+        vmdk_ops.setStatusDetached(self.name)
+
+        err = vmdk_ops.revertSnapshotVMDK(self.name, self.volName, self.snapshot_opts("snap1"))
+        self.assertEqual(err, None, err)
+        self.assertEqual(vmdk_ops.listSnapshotsVMDK(self.name, self.volName), snapshots)
+        self.assertEqual(vmdk_utils.list_vol_snapshot_paths(self.name, self.volName),
+                         [self.snapshot_path("snap1")])
+        err = vmdk_ops.revertSnapshotVMDK(self.name, self.volName, self.snapshot_opts("nosuchsnap"))
+        self.assertNotEqual(err, None, err)
+
+        err = vmdk_ops.deleteSnapshotVMDK(self.name, self.volName, self.snapshot_opts("snap1"))
+        self.assertEqual(err, None, err)
+        self.assertFalse(os.path.isfile(self.snapshot_path("snap1")))
+        self.assertEqual(vmdk_ops.listSnapshotsVMDK(self.name, self.volName), [])
+        err = vmdk_ops.deleteSnapshotVMDK(self.name, self.volName, self.snapshot_opts("snap1"))
+        self.assertNotEqual(err, None, err)
+
+    def testRemoveWithSnapshots(self):
+        err = vmdk_ops.snapshotVMDK(self.name, self.volName, self.snapshot_opts("snap1"))
+        self.assertEqual(err, None, err)
+        err = vmdk_ops.removeVMDK(self.name)
+        self.assertEqual(err, None, err)
+        self.assertFalse(os.path.isfile(self.snapshot_path("snap1")),
+                         "Snapshot is still present after volume delete")
+
+class VmdkExtendTestCase(unittest.TestCase):
+    """Unit test for VMDK extend op"""
+
+    vm_name = test_utils.generate_test_vm_name()
+    volName = "vol_ExtendTest"
+    vm = None
+
+    def setUp(self):
+        self.name = vmdk_utils.get_vmdk_path(path, self.volName)
+        err = vmdk_ops.createVMDK(vm_name=self.vm_name,
+                                  vmdk_path=self.name,
+                                  vol_name=self.volName)
+        self.assertEqual(err, None, err)
+
+    def tearDown(self):
+        if self.vm:
+            test_utils.remove_vm(vmdk_ops.get_si(), self.vm)
+            self.vm = None
+        vmdk_ops.removeVMDK(self.name)
+
+    def extend(self, size):
+        return vmdk_ops.extendVMDK(self.name, self.volName, {volume_kv.SIZE: size})
+
+    def testExtendDetached(self):
+        self.assertNotEqual(self.extend("big"), None, "Invalid size should fail")
+        self.assertNotEqual(self.extend("10mb"), None, "Shrinking a volume should fail")
+        err = vmdk_ops.extendVMDK(self.name, self.volName, {volume_kv.SIZE: "200mb", volume_kv.ACCESS: "read-only"})
+        self.assertNotEqual(err, None, "Options other than size should fail")
+
+        err = self.extend("200mb")
+        self.assertEqual(err, None, err)
+        self.assertEqual(volume_kv.get_vol_info(self.name)[volume_kv.SIZE], "200MB")
+        self.assertEqual(volume_kv.getAll(self.name)[volume_kv.VOL_OPTS][volume_kv.SIZE], "200mb")
+        # extending to the current size is a no-op
+        err = self.extend("200mb")
+        self.assertEqual(err, None, err)
+
+    def testExtendAttached(self):
+        si = vmdk_ops.get_si()
+        datastore = vmdk_utils.get_datastore_from_vmdk_path(self.name)
+        error, self.vm = test_utils.create_vm(si=si,
+                                              vm_name=self.vm_name,
+                                              datastore_name=datastore)
+        self.assertFalse(error, error)
+        ret = vmdk_ops.disk_attach(vmdk_path=self.name, vm=self.vm)
+        self.assertFalse("Error" in ret, ret)
+
+        err = self.extend("300mb")
+        self.assertEqual(err, None, err)
+        device = vmdk_ops.findDeviceByPath(self.name, self.vm)
+        self.assertEqual(device.capacityInKB, 300 * 1024)
+
+        ret = vmdk_ops.disk_detach(vmdk_path=self.name, vm=self.vm)
+        self.assertEqual(ret, None, ret)
+        self.assertEqual(volume_kv.get_vol_info(self.name)[volume_kv.SIZE], "300MB")
+
 class ValidationTestCase(unittest.TestCase):
     """ Test validation of -o options on create """
 
@@ -390,7 +520,8 @@ class ValidationTestCase(unittest.TestCase):
     def test_failure(self):
         bad = [{volume_kv.SIZE: '2'}, {volume_kv.VSAN_POLICY_NAME: 'bad-policy'},
         {volume_kv.DISK_ALLOCATION_FORMAT: 'thiN'}, {volume_kv.SIZE: 'mb'}, {'bad-option': '4'}, {'bad-option': 'what',
-                                                             volume_kv.SIZE: '4mb'}]
+                                                             volume_kv.SIZE: '4mb'},
+        {volume_kv.CLONE_SNAPSHOT: 'snap1'}]
         for opts in bad:
             with self.assertRaises(vmdk_ops.ValidationError):
                 vmdk_ops.validate_opts(opts, self.path)
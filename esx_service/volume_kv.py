@@ -91,6 +91,28 @@ DEFAULT_FILESYSTEM_TYPE = 'ext4'
 # Clone references
 CLONE_FROM = 'clone-from' # clone volume parent
 DEFAULT_CLONE_FROM = 'None'
+CLONE_SNAPSHOT = 'clone-snapshot' # snapshot of the parent to clone, rather than its disk
+DEFAULT_CLONE_SNAPSHOT = ''
+
+# Mount and mkfs options
+# These options are validated and handled in the volume-plugin at the docker host,
+# and tracked in volume metadata.
+MOUNT_OPTIONS = 'mount-options'
+DEFAULT_MOUNT_OPTIONS = ''
+MKFS_OPTIONS = 'mkfs-options'
+DEFAULT_MKFS_OPTIONS = ''
+
+# Storage class
+# Classes are defined and applied in the volume-plugin at the docker host,
+# the class a volume was created with is tracked in volume metadata.
+CLASS = 'class'
+DEFAULT_CLASS = ''
+
+# Volume snapshots
+# The snapshot name is passed as an option of the snapshot commands. The snapshots
+# of a volume are tracked in its metadata as a list of {Name, Created, Size}, oldest first.
+SNAPSHOT_NAME = 'snapshot-name'
+SNAPSHOTS = 'snapshots'
 
 # Create a kv store object for this volume identified by vol_path
 # Create the side car or open if it exists.
@@ -174,5 +196,8 @@ def remove(vol_path, key):
 
     return kvESX.save(vol_path, vol_meta)
 
+# Key of the exact volume size in get_vol_info() results
+CAPACITY_KB = kvESX.VOL_CAPACITY_KB
+
 def get_vol_info(vol_path):
    return kvESX.get_info(vol_path)
@@ -60,9 +60,18 @@ function deployvmtest {
 }
 
 function deployvm {
+    # vFile nodes share the key sealing the credentials of volumes
+    if [ "$PLUGIN_NAME" == "vfile" ]
+    then
+        CLUSTER_KEY=`head -c 32 /dev/urandom | base64`
+    fi
     for ip in $IP_LIST
     do
         TARGET=root@$ip
+        if [ -n "$CLUSTER_KEY" ]
+        then
+            $SSH $TARGET "$MKDIR_P /etc/vfile && (umask 077; echo $CLUSTER_KEY > /etc/vfile/cluster-key)"
+        fi
         installManagedPlugin
         deployVMPost
     done